@@ -0,0 +1,257 @@
+// Package api has type definitions for the Telegram Bot API
+//
+// See https://core.telegram.org/bots/api for the full reference. Only
+// the parts of the API used by rclone are described here.
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Response is the envelope every Bot API method returns
+type Response struct {
+	OK          bool                `json:"ok"`
+	ErrorCode   int                 `json:"error_code,omitempty"`
+	Description string              `json:"description,omitempty"`
+	Parameters  *ResponseParameters `json:"parameters,omitempty"`
+	Result      json.RawMessage     `json:"result,omitempty"`
+}
+
+// ResponseParameters describes why a request failed and how it may
+// be retried
+type ResponseParameters struct {
+	MigrateToChatID int64 `json:"migrate_to_chat_id,omitempty"` // the group was upgraded to this supergroup
+	RetryAfter      int   `json:"retry_after,omitempty"`        // seconds to wait before repeating the request
+}
+
+// Error describes a failed Bot API call
+//
+// It is made from the response envelope when ok is false.
+type Error struct {
+	Method      string              // the method which was called
+	StatusCode  int                 // HTTP status code of the response
+	ErrorCode   int                 // error_code from the envelope
+	Description string              // description from the envelope
+	Parameters  *ResponseParameters // parameters from the envelope, if any
+}
+
+// Error satisfies the error interface
+func (e *Error) Error() string {
+	return fmt.Sprintf("telegram %s failed: %d %s", e.Method, e.ErrorCode, e.Description)
+}
+
+// RetryAfter returns how long Telegram asked us to wait before
+// retrying or 0 if it didn't say
+func (e *Error) RetryAfter() time.Duration {
+	if e.Parameters == nil {
+		return 0
+	}
+	return time.Duration(e.Parameters.RetryAfter) * time.Second
+}
+
+// User describes a Telegram user or bot
+type User struct {
+	ID        int64  `json:"id"`
+	IsBot     bool   `json:"is_bot"`
+	FirstName string `json:"first_name"`
+	Username  string `json:"username,omitempty"`
+}
+
+// Chat describes a chat as embedded in a Message
+type Chat struct {
+	ID        int64  `json:"id"`
+	Type      string `json:"type"`
+	Title     string `json:"title,omitempty"`
+	Username  string `json:"username,omitempty"`
+	FirstName string `json:"first_name,omitempty"`
+}
+
+// Document describes a general file attached to a Message
+type Document struct {
+	FileID       string `json:"file_id"`
+	FileUniqueID string `json:"file_unique_id"`
+	FileName     string `json:"file_name,omitempty"`
+	MimeType     string `json:"mime_type,omitempty"`
+	FileSize     int64  `json:"file_size,omitempty"`
+}
+
+// PhotoSize describes one size of a photo attached to a Message
+type PhotoSize struct {
+	FileID       string `json:"file_id"`
+	FileUniqueID string `json:"file_unique_id"`
+	Width        int    `json:"width"`
+	Height       int    `json:"height"`
+	FileSize     int64  `json:"file_size,omitempty"`
+}
+
+// Video describes a video file attached to a Message
+type Video struct {
+	FileID       string `json:"file_id"`
+	FileUniqueID string `json:"file_unique_id"`
+	Width        int    `json:"width"`
+	Height       int    `json:"height"`
+	Duration     int    `json:"duration"`
+	FileName     string `json:"file_name,omitempty"`
+	MimeType     string `json:"mime_type,omitempty"`
+	FileSize     int64  `json:"file_size,omitempty"`
+}
+
+// Audio describes an audio file attached to a Message
+type Audio struct {
+	FileID       string `json:"file_id"`
+	FileUniqueID string `json:"file_unique_id"`
+	Duration     int    `json:"duration"`
+	FileName     string `json:"file_name,omitempty"`
+	MimeType     string `json:"mime_type,omitempty"`
+	FileSize     int64  `json:"file_size,omitempty"`
+}
+
+// Message describes a message in a chat
+type Message struct {
+	MessageID       int64       `json:"message_id"`
+	MessageThreadID int64       `json:"message_thread_id,omitempty"` // forum topic the message is in, if any
+	From            *User       `json:"from,omitempty"`              // sender, empty for messages sent to channels
+	SenderChat      *Chat       `json:"sender_chat,omitempty"`       // chat the message was sent on behalf of, if any
+	Date            int64       `json:"date"`
+	EditDate        int64       `json:"edit_date,omitempty"` // when the message was last edited, if it was
+	Chat            Chat        `json:"chat"`
+	Caption         string      `json:"caption,omitempty"`
+	Document        *Document   `json:"document,omitempty"`
+	Photo           []PhotoSize `json:"photo,omitempty"` // available sizes of the photo, smallest first
+	Video           *Video      `json:"video,omitempty"`
+	Audio           *Audio      `json:"audio,omitempty"`
+}
+
+// Time returns the date of the message as a time.Time
+func (m *Message) Time() time.Time {
+	return time.Unix(m.Date, 0)
+}
+
+// Changed returns when the message was last edited, or posted if it
+// wasn't edited, as a time.Time
+func (m *Message) Changed() time.Time {
+	if m.EditDate != 0 {
+		return time.Unix(m.EditDate, 0)
+	}
+	return m.Time()
+}
+
+// File returns the file attached to the message described as a
+// Document, or nil if there isn't one
+//
+// Photos are described by their largest size. They don't keep their
+// file names and are always JPEG images.
+func (m *Message) File() *Document {
+	switch {
+	case m.Document != nil:
+		return m.Document
+	case m.Video != nil:
+		return &Document{
+			FileID:       m.Video.FileID,
+			FileUniqueID: m.Video.FileUniqueID,
+			FileName:     m.Video.FileName,
+			MimeType:     m.Video.MimeType,
+			FileSize:     m.Video.FileSize,
+		}
+	case m.Audio != nil:
+		return &Document{
+			FileID:       m.Audio.FileID,
+			FileUniqueID: m.Audio.FileUniqueID,
+			FileName:     m.Audio.FileName,
+			MimeType:     m.Audio.MimeType,
+			FileSize:     m.Audio.FileSize,
+		}
+	case len(m.Photo) > 0:
+		largest := m.Photo[len(m.Photo)-1]
+		for _, size := range m.Photo {
+			if size.FileSize > largest.FileSize {
+				largest = size
+			}
+		}
+		return &Document{
+			FileID:       largest.FileID,
+			FileUniqueID: largest.FileUniqueID,
+			MimeType:     "image/jpeg",
+			FileSize:     largest.FileSize,
+		}
+	}
+	return nil
+}
+
+// ChatFullInfo describes a chat as returned by getChat
+type ChatFullInfo struct {
+	ID            int64    `json:"id"`
+	Type          string   `json:"type"`
+	Title         string   `json:"title,omitempty"`
+	Username      string   `json:"username,omitempty"`
+	IsForum       bool     `json:"is_forum,omitempty"`       // set if the supergroup has topics enabled
+	Description   string   `json:"description,omitempty"`    // description of the group or channel
+	PinnedMessage *Message `json:"pinned_message,omitempty"` // the most recently pinned message
+}
+
+// ChatMember describes a member of a chat as returned by
+// getChatMember
+//
+// Status is one of creator, administrator, member, restricted, left
+// or kicked. The permissions are only given for administrators.
+type ChatMember struct {
+	Status            string `json:"status"`
+	User              User   `json:"user"`
+	CanDeleteMessages bool   `json:"can_delete_messages,omitempty"`
+	CanPinMessages    bool   `json:"can_pin_messages,omitempty"`
+}
+
+// ForumTopic describes a topic in a forum supergroup as returned by
+// createForumTopic
+type ForumTopic struct {
+	MessageThreadID int64  `json:"message_thread_id"`
+	Name            string `json:"name"`
+	IconColor       int    `json:"icon_color"`
+}
+
+// Update describes an incoming update as returned by getUpdates
+//
+// At most one of the optional message fields is present.
+type Update struct {
+	UpdateID          int64              `json:"update_id"`
+	Message           *Message           `json:"message,omitempty"`
+	EditedMessage     *Message           `json:"edited_message,omitempty"`
+	ChannelPost       *Message           `json:"channel_post,omitempty"`
+	EditedChannelPost *Message           `json:"edited_channel_post,omitempty"`
+	MyChatMember      *ChatMemberUpdated `json:"my_chat_member,omitempty"`
+}
+
+// ChatMemberUpdated describes a change to the membership of a chat,
+// such as the bot being added to it
+type ChatMemberUpdated struct {
+	Chat Chat  `json:"chat"`
+	Date int64 `json:"date"`
+}
+
+// GetMessage returns the message carried by the update, if any
+//
+// Edited messages are returned with their new contents.
+func (u *Update) GetMessage() *Message {
+	switch {
+	case u.Message != nil:
+		return u.Message
+	case u.EditedMessage != nil:
+		return u.EditedMessage
+	case u.ChannelPost != nil:
+		return u.ChannelPost
+	}
+	return u.EditedChannelPost
+}
+
+// File describes a file ready to be downloaded as returned by getFile
+//
+// The file can be downloaded via /file/bot<token>/<file_path>. The
+// link is guaranteed to be valid for at least one hour.
+type File struct {
+	FileID       string `json:"file_id"`
+	FileUniqueID string `json:"file_unique_id"`
+	FileSize     int64  `json:"file_size,omitempty"`
+	FilePath     string `json:"file_path,omitempty"`
+}
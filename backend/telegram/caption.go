@@ -0,0 +1,117 @@
+package telegram
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"time"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/hash"
+)
+
+// maxCaptionLength is the most characters, counted in UTF-16 code
+// units, Telegram allows in the caption of a message
+const maxCaptionLength = 1024
+
+// documentCaption describes the file a document belongs to
+//
+// It is written as JSON in the caption of the message carrying the
+// document so each message describes itself and the manifest can be
+// rebuilt from the chat if it is lost.
+type documentCaption struct {
+	Path      string    `json:"path"`                // path of the file relative to the chat root
+	Size      int64     `json:"size"`                // size of the whole file, -1 if not known
+	ModTime   time.Time `json:"modtime"`             // modification time of the source
+	MD5       string    `json:"md5,omitempty"`       // hex MD5 of the whole file, if known
+	Part      int       `json:"part,omitempty"`      // number of the part, if the file is chunked
+	Parts     int       `json:"parts,omitempty"`     // number of parts, only given on the last part of files of unknown size
+	Truncated bool      `json:"truncated,omitempty"` // set if the start of Path was dropped to fit
+}
+
+// newCaption returns the caption for the documents of src uploaded
+// to remote, or nil if captions aren't being written
+func (f *Fs) newCaption(ctx context.Context, src fs.ObjectInfo, remote string) *documentCaption {
+	if !f.opt.WriteCaptions {
+		return nil
+	}
+	// Only use the MD5 if the source has one
+	md5, _ := src.Hash(ctx, hash.MD5)
+	return &documentCaption{
+		Path:    remote,
+		Size:    src.Size(),
+		ModTime: src.ModTime(ctx),
+		MD5:     md5,
+	}
+}
+
+// part returns the caption for part n
+func (c *documentCaption) part(n int) *documentCaption {
+	if c == nil {
+		return nil
+	}
+	partCaption := *c
+	partCaption.Part = n
+	return &partCaption
+}
+
+// lastPart returns the caption for part n which is the last part
+//
+// If the size of the file isn't known the number of parts is recorded
+// so a rebuild can tell whether any are missing from the end.
+func (c *documentCaption) lastPart(n int) *documentCaption {
+	partCaption := c.part(n)
+	if partCaption != nil && partCaption.Size < 0 {
+		partCaption.Parts = n
+	}
+	return partCaption
+}
+
+// encode returns c as JSON short enough to be a caption
+//
+// If it is too long the start of the path is dropped, keeping the
+// file name, and Truncated is set. The manifest always has the full
+// path.
+func (c documentCaption) encode() string {
+	for {
+		var buf bytes.Buffer
+		encoder := json.NewEncoder(&buf)
+		encoder.SetEscapeHTML(false)
+		_ = encoder.Encode(&c) // can't fail
+		caption := string(bytes.TrimSuffix(buf.Bytes(), []byte("\n")))
+		excess := utf16Length(caption) - maxCaptionLength
+		if excess <= 0 {
+			return caption
+		}
+		// Escaped characters take up to 6, so this never drops
+		// more than needed
+		for range max(excess/6, 1) {
+			_, size := utf8.DecodeRuneInString(c.Path)
+			c.Path = c.Path[size:]
+		}
+		c.Truncated = true
+	}
+}
+
+// decodeCaption parses the caption of a message carrying a document
+//
+// It returns nil if the caption doesn't describe a file, for example
+// if it was written by someone else.
+func decodeCaption(s string) *documentCaption {
+	var c documentCaption
+	if json.Unmarshal([]byte(s), &c) != nil || c.Path == "" {
+		return nil
+	}
+	return &c
+}
+
+// utf16Length returns the length of s in UTF-16 code units, which is
+// how Telegram measures text
+func utf16Length(s string) (n int) {
+	for _, r := range s {
+		n += utf16.RuneLen(r)
+	}
+	return n
+}
@@ -0,0 +1,275 @@
+package telegram
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/rclone/rclone/backend/telegram/api"
+	"github.com/rclone/rclone/fs"
+)
+
+// changeSnapshot records the files and directories inside the root
+// in the manifest so the changes between two can be found
+type changeSnapshot struct {
+	files map[string]fileState // state of each file by path in the manifest
+	dirs  map[string]struct{}  // explicit and implied directories by path in the manifest
+}
+
+// fileState is what a listing shows of a file
+type fileState struct {
+	id      int64 // id of the message carrying the document
+	size    int64
+	modTime int64 // in Unix nanoseconds
+	md5     string
+}
+
+// ChangeNotify calls notifyFunc with the files and directories which
+// changed in the manifest every time the poll interval passes
+//
+// The manifest is checked for changes saved by other rclone
+// processes, and with import_documents documents posted to the chat
+// by other accounts are added to it first.
+func (f *Fs) ChangeNotify(ctx context.Context, notifyFunc func(string, fs.EntryType), pollIntervalChan <-chan time.Duration) {
+	go func() {
+		// Take the snapshot early so all changes from now on are
+		// noticed
+		last, err := f.currentSnapshot(ctx)
+		if err != nil {
+			fs.Errorf(f, "Could not read file list to notify changes: %s", err)
+		}
+
+		var ticker *time.Ticker
+		var tickerC <-chan time.Time
+		for {
+			select {
+			case pollInterval, ok := <-pollIntervalChan:
+				if !ok {
+					if ticker != nil {
+						ticker.Stop()
+					}
+					return
+				}
+				if ticker != nil {
+					ticker.Stop()
+					ticker, tickerC = nil, nil
+				}
+				if pollInterval != 0 {
+					ticker = time.NewTicker(pollInterval)
+					tickerC = ticker.C
+				}
+			case <-tickerC:
+				fs.Debugf(f, "Checking for changes on remote")
+				last, err = f.changeNotifyRunner(ctx, notifyFunc, last)
+				if err != nil {
+					fs.Infof(f, "Change notify listener failure: %s", err)
+				}
+			}
+		}
+	}()
+}
+
+// changeNotifyRunner brings the manifest up to date and calls
+// notifyFunc with what changed since last, returning the new snapshot
+//
+// If last is nil nothing is notified as there is nothing to compare
+// with.
+func (f *Fs) changeNotifyRunner(ctx context.Context, notifyFunc func(string, fs.EntryType), last *changeSnapshot) (*changeSnapshot, error) {
+	var documents []*api.Message
+	if f.opt.ImportDocuments {
+		var err error
+		documents, err = f.chatDocuments(ctx)
+		if err != nil {
+			return last, fmt.Errorf("failed to read documents in chat: %w", err)
+		}
+	}
+	f.listMu.Lock()
+	current, toDelete, err := f.pollFileListLocked(ctx, documents)
+	f.listMu.Unlock()
+	f.deleteOldDocuments(ctx, toDelete)
+	if err != nil {
+		return last, err
+	}
+	if last != nil {
+		current.changes(last, func(p string, entryType fs.EntryType) {
+			notifyFunc(f.relPath(p), entryType)
+		})
+	}
+	return current, nil
+}
+
+// currentSnapshot returns the snapshot of the cached manifest
+func (f *Fs) currentSnapshot(ctx context.Context) (snapshot *changeSnapshot, err error) {
+	err = f.readFileList(ctx, func(m *manifest) error {
+		snapshot = f.snapshot(m)
+		return nil
+	})
+	return snapshot, err
+}
+
+// pollFileListLocked reads the manifest again if it was saved since it
+// was read and imports any of documents which are new, returning the
+// snapshot of the result
+//
+// The documents returned should be deleted with deleteOldDocuments
+// once listMu is released.
+//
+// Call with listMu held.
+func (f *Fs) pollFileListLocked(ctx context.Context, documents []*api.Message) (snapshot *changeSnapshot, toDelete []*manifestEntry, err error) {
+	err = f.refreshFileListLocked(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	m, err := f.getFileList(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	refs := manifestReferences(m)
+	var imports []*api.Message
+	for _, message := range documents {
+		if _, found := refs.messageIDs[message.MessageID]; found || message.MessageID <= m.Imported || isFileList(message) {
+			continue
+		}
+		imports = append(imports, message)
+	}
+	if len(imports) > 0 {
+		toDelete, err = f.changeFileListLocked(ctx, func(m *manifest) ([]*manifestEntry, error) {
+			f.importDocuments(m, imports)
+			return nil, nil
+		})
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to import documents: %w", err)
+		}
+	}
+	return f.snapshot(m), toDelete, nil
+}
+
+// refreshFileListLocked forgets the cached manifest if a different one
+// is pinned in the chat, which is cheaper to check than reading it
+//
+// Unsaved changes are kept as the changes in the chat are merged in
+// when they are saved.
+//
+// Call with listMu held.
+func (f *Fs) refreshFileListLocked(ctx context.Context) error {
+	if f.fileList == nil || f.dirty {
+		return nil
+	}
+	message, err := f.findFileList(ctx)
+	if err == fs.ErrorObjectNotFound {
+		if f.fileList.messageID != 0 {
+			f.forgetFileListLocked()
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if message.MessageID != f.fileList.messageID || message.Document.FileUniqueID != f.fileList.documentID {
+		fs.Debugf(f, "File list changed in the chat - reading it again")
+		f.forgetFileListLocked()
+	}
+	return nil
+}
+
+// importDocuments adds the files carried by messages, which were
+// posted to the chat by other accounts, to m
+func (f *Fs) importDocuments(m *manifest, messages []*api.Message) {
+	for _, message := range messages {
+		m.Imported = max(m.Imported, message.MessageID)
+		caption := decodeCaption(message.Caption)
+		if caption != nil && caption.Part > 0 {
+			fs.Debugf(f, "Not importing part %d of chunked file %q in message %d", caption.Part, caption.Path, message.MessageID)
+			continue
+		}
+		if caption == nil && message.File().FileName == "" {
+			fs.Debugf(f, "Not importing photo in message %d as it has no name", message.MessageID)
+			continue
+		}
+		if caption != nil && caption.Truncated {
+			fs.Logf(f, "Not importing document in message %d as its path was too long to fit in the caption", message.MessageID)
+			continue
+		}
+		entry := f.documentEntry(message, caption)
+		if caption == nil && entry.TopicID != 0 {
+			// Put it in the directory of the topic it was posted in
+			for _, t := range m.Topics {
+				if t.ThreadID == entry.TopicID {
+					entry.Path = path.Join(t.Name, entry.Path)
+				}
+			}
+		}
+		if m.find(entry.Path) != nil || m.isDir(entry.Path) {
+			fs.Logf(entry.Path, "Not importing document in message %d as the name is already in use", message.MessageID)
+			continue
+		}
+		m.add(entry)
+		fs.Infof(entry.Path, "Imported document posted to the chat in message %d", message.MessageID)
+	}
+}
+
+// snapshot returns the snapshot of the files and directories inside
+// the root in m
+//
+// Call with listMu held.
+func (f *Fs) snapshot(m *manifest) *changeSnapshot {
+	s := &changeSnapshot{
+		files: map[string]fileState{},
+		dirs:  map[string]struct{}{},
+	}
+	root := f.absPath("")
+	inside := func(p string) bool {
+		return root == "" || strings.HasPrefix(p, root+"/")
+	}
+	addDirs := func(dir string) {
+		for ; inside(dir) && dir != ""; dir = parentDir(dir) {
+			s.dirs[dir] = struct{}{}
+		}
+	}
+	for _, entry := range m.Entries {
+		if !inside(entry.Path) {
+			continue
+		}
+		s.files[entry.Path] = fileState{
+			id:      entry.id(),
+			size:    entry.Size,
+			modTime: entry.ModTime.UnixNano(),
+			md5:     entry.MD5,
+		}
+		addDirs(parentDir(entry.Path))
+	}
+	for _, dir := range m.Dirs {
+		addDirs(dir)
+	}
+	return s
+}
+
+// changes calls notify with the paths which are different in s from
+// old
+//
+// Directories which were made or removed are notified as well as the
+// files in them so their parents are listed again.
+func (s *changeSnapshot) changes(old *changeSnapshot, notify func(p string, entryType fs.EntryType)) {
+	for p, state := range s.files {
+		if oldState, ok := old.files[p]; !ok || oldState != state {
+			notify(p, fs.EntryObject)
+		}
+	}
+	for p := range old.files {
+		if _, ok := s.files[p]; !ok {
+			notify(p, fs.EntryObject)
+		}
+	}
+	for dir := range s.dirs {
+		if _, ok := old.dirs[dir]; !ok {
+			notify(dir, fs.EntryDirectory)
+		}
+	}
+	for dir := range old.dirs {
+		if _, ok := s.dirs[dir]; !ok {
+			notify(dir, fs.EntryDirectory)
+		}
+	}
+}
@@ -0,0 +1,498 @@
+package telegram
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"strings"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/fserrors"
+	"github.com/rclone/rclone/fs/hash"
+)
+
+// multiFs is the root of a remote spread over several chats
+//
+// Each chat is a top level directory. Everything inside it is handled
+// by the Fs for the chat, which shares the root of the multiFs so the
+// paths of its objects start with the name of the chat.
+type multiFs struct {
+	name     string         // name of this remote
+	opt      Options        // parsed options
+	features *fs.Features   // optional features
+	chats    map[string]*Fs // the Fs for each chat by name
+	names    []string       // names of the chats in order
+}
+
+// parseChats parses the chats option into chat IDs by name, returning
+// the names in order
+func parseChats(chats string) (ids map[string]string, names []string, err error) {
+	ids = map[string]string{}
+	for _, item := range strings.Split(chats, ",") {
+		name, id, ok := strings.Cut(strings.TrimSpace(item), "=")
+		name, id = strings.TrimSpace(name), strings.TrimSpace(id)
+		if !ok || name == "" || id == "" {
+			return nil, nil, fmt.Errorf("invalid chats entry %q: must be name=chat_id", item)
+		}
+		if strings.Contains(name, "/") {
+			return nil, nil, fmt.Errorf("invalid chats entry %q: name can't contain /", item)
+		}
+		if _, found := ids[name]; found {
+			return nil, nil, fmt.Errorf("invalid chats: %q is used more than once", name)
+		}
+		ids[name] = id
+		names = append(names, name)
+	}
+	return ids, names, nil
+}
+
+// newMultiFs makes the remote for the chats option
+//
+// If root is inside one of the chats the Fs for that chat is returned
+// instead.
+func newMultiFs(ctx context.Context, name, root string, opt *Options) (fs.Fs, error) {
+	ids, names, err := parseChats(opt.Chats)
+	if err != nil {
+		return nil, err
+	}
+	root = strings.Trim(root, "/")
+	f := &multiFs{
+		name:  name,
+		opt:   *opt,
+		chats: map[string]*Fs{},
+		names: names,
+	}
+	chatName, _, _ := strings.Cut(root, "/")
+	if root != "" {
+		if _, ok := ids[chatName]; !ok {
+			return nil, f.noChat(chatName)
+		}
+		// Only the chat the root is in is used
+		names = []string{chatName}
+	}
+	var first *Fs
+	for _, name := range names {
+		chatOpt := *opt
+		chatOpt.ChatID = ids[name]
+		chatOpt.Chats = ""
+		chat := newFs(ctx, f.name, root, &chatOpt)
+		chat.chat = name
+		// Share the connection and the pacer as the rate limits
+		// are for the bot rather than the chat
+		if first == nil {
+			first = chat
+		} else {
+			chat.srv = first.srv
+			chat.pacer = first.pacer
+		}
+		err = chat.check(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("chat %q: %w", name, err)
+		}
+		f.chats[name] = chat
+	}
+	if root != "" {
+		return f.chats[chatName].checkRoot(ctx)
+	}
+	f.features = (&fs.Features{
+		CanHaveEmptyDirectories: true,
+		ReadMimeType:            true,
+		WriteMimeType:           true,
+		ReadMetadata:            true,
+		WriteMetadata:           true,
+		UserMetadata:            true,
+		ServerSideAcrossConfigs: true,
+	}).Fill(ctx, f)
+	return f, nil
+}
+
+// noChat returns the error for a path in a chat which isn't configured
+func (f *multiFs) noChat(name string) error {
+	return fserrors.NoRetryError(fmt.Errorf("no chat called %q - the chats are %s", name, strings.Join(f.names, ", ")))
+}
+
+// chatFor returns the Fs for the chat holding remote, or nil if it
+// isn't inside a configured chat
+func (f *multiFs) chatFor(remote string) *Fs {
+	name, _, found := strings.Cut(remote, "/")
+	if !found {
+		return nil
+	}
+	return f.chats[name]
+}
+
+// ------------------------------------------------------------
+
+// Name of the remote (as passed into NewFs)
+func (f *multiFs) Name() string {
+	return f.name
+}
+
+// Root of the remote (as passed into NewFs)
+func (f *multiFs) Root() string {
+	return ""
+}
+
+// String converts this Fs to a string
+func (f *multiFs) String() string {
+	return fmt.Sprintf("telegram chats %s", strings.Join(f.names, ", "))
+}
+
+// Features returns the optional features of this Fs
+func (f *multiFs) Features() *fs.Features {
+	return f.features
+}
+
+// Precision of the ModTimes in this Fs
+func (f *multiFs) Precision() time.Duration {
+	return f.chats[f.names[0]].Precision()
+}
+
+// Hashes returns the supported hash sets.
+func (f *multiFs) Hashes() hash.Set {
+	return hash.Set(hash.MD5)
+}
+
+// List the objects and directories in dir into entries
+//
+// The root lists a directory for each chat.
+func (f *multiFs) List(ctx context.Context, dir string) (entries fs.DirEntries, err error) {
+	if dir == "" {
+		for _, name := range f.names {
+			entries = append(entries, fs.NewDir(name, time.Time{}))
+		}
+		return entries, nil
+	}
+	chat, ok := f.chats[dir]
+	if !ok {
+		chat = f.chatFor(dir)
+	}
+	if chat == nil {
+		return nil, fs.ErrorDirNotFound
+	}
+	return chat.List(ctx, dir)
+}
+
+// ListR lists the objects and directories of the Fs starting
+// from dir recursively into out.
+func (f *multiFs) ListR(ctx context.Context, dir string, callback fs.ListRCallback) error {
+	if dir != "" {
+		chat, ok := f.chats[dir]
+		if !ok {
+			chat = f.chatFor(dir)
+		}
+		if chat == nil {
+			return fs.ErrorDirNotFound
+		}
+		return chat.ListR(ctx, dir, callback)
+	}
+	for _, name := range f.names {
+		err := callback(fs.DirEntries{fs.NewDir(name, time.Time{})})
+		if err != nil {
+			return err
+		}
+		err = f.chats[name].ListR(ctx, name, callback)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NewObject finds the Object at remote.  If it can't be found
+// it returns the error fs.ErrorObjectNotFound.
+func (f *multiFs) NewObject(ctx context.Context, remote string) (fs.Object, error) {
+	chat := f.chatFor(remote)
+	if chat == nil {
+		return nil, fs.ErrorObjectNotFound
+	}
+	return chat.NewObject(ctx, remote)
+}
+
+// putChat returns the Fs for the chat to upload src to
+func (f *multiFs) putChat(src fs.ObjectInfo) (*Fs, error) {
+	remote := src.Remote()
+	chat := f.chatFor(remote)
+	if chat != nil {
+		return chat, nil
+	}
+	name, _, found := strings.Cut(remote, "/")
+	if !found {
+		return nil, fserrors.NoRetryError(fmt.Errorf("can't upload %q to the root - files must go in one of the chats %s", remote, strings.Join(f.names, ", ")))
+	}
+	return nil, f.noChat(name)
+}
+
+// Put the object into the chat its path starts with
+func (f *multiFs) Put(ctx context.Context, in io.Reader, src fs.ObjectInfo, options ...fs.OpenOption) (fs.Object, error) {
+	chat, err := f.putChat(src)
+	if err != nil {
+		return nil, err
+	}
+	return chat.Put(ctx, in, src, options...)
+}
+
+// PutStream uploads to the remote path with the modTime given of indeterminate size
+func (f *multiFs) PutStream(ctx context.Context, in io.Reader, src fs.ObjectInfo, options ...fs.OpenOption) (fs.Object, error) {
+	chat, err := f.putChat(src)
+	if err != nil {
+		return nil, err
+	}
+	return chat.PutStream(ctx, in, src, options...)
+}
+
+// Mkdir makes the directory (container, bucket)
+//
+// The root and the directories for the chats always exist.
+func (f *multiFs) Mkdir(ctx context.Context, dir string) error {
+	if dir == "" {
+		return nil
+	}
+	name, _, _ := strings.Cut(dir, "/")
+	chat, ok := f.chats[name]
+	if !ok {
+		return f.noChat(name)
+	}
+	return chat.Mkdir(ctx, dir)
+}
+
+// Rmdir removes the directory (container, bucket) if empty
+//
+// The directories for the chats can't be removed so this only checks
+// they are empty.
+func (f *multiFs) Rmdir(ctx context.Context, dir string) error {
+	if dir == "" {
+		return fs.ErrorDirectoryNotEmpty
+	}
+	chat, ok := f.chats[dir]
+	if !ok {
+		chat = f.chatFor(dir)
+	}
+	if chat == nil {
+		return fs.ErrorDirNotFound
+	}
+	return chat.Rmdir(ctx, dir)
+}
+
+// Purge deletes all the files in the directory
+//
+// Purging the root purges every chat.
+func (f *multiFs) Purge(ctx context.Context, dir string) error {
+	if dir == "" {
+		for _, name := range f.names {
+			err := f.chats[name].Purge(ctx, name)
+			if err != nil {
+				return fmt.Errorf("chat %q: %w", name, err)
+			}
+		}
+		return nil
+	}
+	chat, ok := f.chats[dir]
+	if !ok {
+		chat = f.chatFor(dir)
+	}
+	if chat == nil {
+		return fs.ErrorDirNotFound
+	}
+	return chat.Purge(ctx, dir)
+}
+
+// Move src to this remote using server-side move operations.
+//
+// Files can only be moved within a chat. Otherwise it returns
+// fs.ErrorCantMove so they are copied instead.
+func (f *multiFs) Move(ctx context.Context, src fs.Object, remote string) (fs.Object, error) {
+	chat := f.chatFor(remote)
+	if chat == nil {
+		return nil, fs.ErrorCantMove
+	}
+	return chat.Move(ctx, src, remote)
+}
+
+// Copy src to this remote using server-side copy operations.
+//
+// Files can be copied between chats using the same bot. Otherwise it
+// returns fs.ErrorCantCopy so they are downloaded and uploaded instead.
+func (f *multiFs) Copy(ctx context.Context, src fs.Object, remote string) (fs.Object, error) {
+	chat := f.chatFor(remote)
+	if chat == nil {
+		return nil, fs.ErrorCantCopy
+	}
+	return chat.Copy(ctx, src, remote)
+}
+
+// DirMove moves src, srcRemote to this remote at dstRemote
+// using server-side move operations.
+//
+// Directories can only be moved within a chat and the directories
+// for the chats can't be moved at all.
+func (f *multiFs) DirMove(ctx context.Context, src fs.Fs, srcRemote, dstRemote string) error {
+	if multi, ok := src.(*multiFs); ok {
+		chat := multi.chatFor(srcRemote)
+		if chat == nil {
+			return fs.ErrorCantDirMove
+		}
+		src = chat
+	}
+	chat := f.chatFor(dstRemote)
+	if chat == nil {
+		return fs.ErrorCantDirMove
+	}
+	return chat.DirMove(ctx, src, srcRemote, dstRemote)
+}
+
+// About gets quota information totalled over all the chats
+func (f *multiFs) About(ctx context.Context) (*fs.Usage, error) {
+	var used, objects int64
+	for _, name := range f.names {
+		usage, err := f.chats[name].About(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("chat %q: %w", name, err)
+		}
+		used += *usage.Used
+		objects += *usage.Objects
+	}
+	return &fs.Usage{
+		Used:    fs.NewUsageValue(used),
+		Objects: fs.NewUsageValue(objects),
+	}, nil
+}
+
+// PublicLink generates a public link to the remote path (usually readable by anyone)
+func (f *multiFs) PublicLink(ctx context.Context, remote string, expire fs.Duration, unlink bool) (string, error) {
+	chat := f.chatFor(remote)
+	if chat == nil {
+		return "", fs.ErrorObjectNotFound
+	}
+	return chat.PublicLink(ctx, remote, expire, unlink)
+}
+
+// UserInfo returns info about the bot and each of the chats, whose
+// details are prefixed by the name of the chat
+func (f *multiFs) UserInfo(ctx context.Context) (map[string]string, error) {
+	info := map[string]string{}
+	for _, name := range f.names {
+		chatInfo, err := f.chats[name].UserInfo(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("chat %q: %w", name, err)
+		}
+		for key, value := range chatInfo {
+			if key != "Bot" && key != "BotID" {
+				key = name + "." + key
+			}
+			info[key] = value
+		}
+	}
+	return info, nil
+}
+
+// DirCacheFlush forgets the cached manifests of all the chats
+func (f *multiFs) DirCacheFlush() {
+	for _, chat := range f.chats {
+		chat.DirCacheFlush()
+	}
+}
+
+// Shutdown the backend, saving any unsaved changes to the manifests
+func (f *multiFs) Shutdown(ctx context.Context) error {
+	var errs []error
+	for _, name := range f.names {
+		if err := f.chats[name].Shutdown(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("chat %q: %w", name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// ChangeNotify calls notifyFunc with the changes in every chat
+func (f *multiFs) ChangeNotify(ctx context.Context, notifyFunc func(string, fs.EntryType), pollIntervalChan <-chan time.Duration) {
+	chans := make([]chan time.Duration, len(f.names))
+	for i, name := range f.names {
+		chans[i] = make(chan time.Duration)
+		f.chats[name].ChangeNotify(ctx, notifyFunc, chans[i])
+	}
+	go func() {
+		for pollInterval := range pollIntervalChan {
+			for _, c := range chans {
+				c <- pollInterval
+			}
+		}
+		for _, c := range chans {
+			close(c)
+		}
+	}()
+}
+
+// pathChat returns the Fs for the chat holding remote, which may be
+// the directory of the chat itself
+func (f *multiFs) pathChat(remote string) (*Fs, error) {
+	name, _, _ := strings.Cut(remote, "/")
+	chat := f.chats[name]
+	if chat == nil {
+		return nil, f.noChat(name)
+	}
+	return chat, nil
+}
+
+// Command runs the command on every chat, returning the output for
+// each by name
+//
+// Commands given paths are run on the chat holding them instead. The
+// links get-link finds in each chat are returned together.
+func (f *multiFs) Command(ctx context.Context, name string, arg []string, opt map[string]string) (any, error) {
+	switch {
+	case name == "get-link" && len(arg) > 0:
+		links := map[string][]string{}
+		for _, remote := range arg {
+			chat, err := f.pathChat(remote)
+			if err != nil {
+				return nil, err
+			}
+			chatLinks, err := chat.Command(ctx, name, []string{remote}, opt)
+			if err != nil {
+				return nil, err
+			}
+			maps.Copy(links, chatLinks.(map[string][]string))
+		}
+		return links, nil
+	case (name == "du" || name == "download-url") && len(arg) > 0:
+		chat, err := f.pathChat(arg[0])
+		if err != nil {
+			return nil, err
+		}
+		return chat.Command(ctx, name, arg, opt)
+	}
+	out := map[string]any{}
+	for _, chatName := range f.names {
+		chatOut, err := f.chats[chatName].Command(ctx, name, arg, opt)
+		if err == fs.ErrorCommandNotFound {
+			return nil, err
+		}
+		if err != nil {
+			return nil, fmt.Errorf("chat %q: %w", chatName, err)
+		}
+		out[chatName] = chatOut
+	}
+	return out, nil
+}
+
+// Check the interfaces are satisfied
+var (
+	_ fs.Fs              = &multiFs{}
+	_ fs.Shutdowner      = &multiFs{}
+	_ fs.Mover           = &multiFs{}
+	_ fs.Copier          = &multiFs{}
+	_ fs.DirMover        = &multiFs{}
+	_ fs.Purger          = &multiFs{}
+	_ fs.Abouter         = &multiFs{}
+	_ fs.PutStreamer     = &multiFs{}
+	_ fs.Commander       = &multiFs{}
+	_ fs.ListRer         = &multiFs{}
+	_ fs.DirCacheFlusher = &multiFs{}
+	_ fs.PublicLinker    = &multiFs{}
+	_ fs.UserInfoer      = &multiFs{}
+	_ fs.ChangeNotifier  = &multiFs{}
+)
@@ -0,0 +1,154 @@
+package telegram
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/accounting"
+)
+
+// brokenEntry describes a manifest entry whose document Telegram no
+// longer has
+type brokenEntry struct {
+	Path      string `json:"path"`
+	MessageID int64  `json:"message_id"`
+	Part      int    `json:"part,omitempty"` // number of the part which is missing, from 1, if chunked
+	Error     string `json:"error"`
+}
+
+// checkResult is the output of the check-index command
+type checkResult struct {
+	Files        int            `json:"files"`             // number of files checked
+	Documents    int            `json:"documents"`         // number of documents checked
+	Broken       []brokenEntry  `json:"broken"`            // entries whose documents are missing
+	Removed      int            `json:"removed,omitempty"` // number of broken entries removed with fix
+	Unreferenced []unreferenced `json:"unreferenced"`      // documents posted by others the manifest doesn't refer to
+}
+
+// checkIndex checks that the document of every file in the manifest of
+// the whole chat can still be downloaded, removing the entries of
+// those which can't if fix is set
+//
+// The Bot API has no way of reading a message by id so each document
+// is checked by resolving its file_id, one call at a time through the
+// pacer. Telegram keeps the file_ids of deleted messages working for a
+// while so a file whose message was deleted only shows up once they
+// stop.
+func (f *Fs) checkIndex(ctx context.Context, fix bool) (*checkResult, error) {
+	err := f.forgetFileList(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		entries []*manifestEntry
+		refs    *references
+	)
+	err = f.readFileList(ctx, func(m *manifest) error {
+		entries = append(entries, m.Entries...)
+		refs = manifestReferences(m)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	result := &checkResult{
+		Broken: []brokenEntry{},
+	}
+	var (
+		broken []*manifestEntry
+		stats  = accounting.Stats(ctx)
+		queued int64
+	)
+	for _, entry := range entries {
+		queued += entry.Size
+	}
+	for i, entry := range entries {
+		stats.SetCheckQueue(len(entries)-i, queued)
+		queued -= entry.Size
+		result.Files++
+		tr := stats.NewCheckingTransfer(f.newObject(entry), "checking document")
+		problem, err := f.checkEntry(ctx, entry, result)
+		tr.Done(ctx, err)
+		if err != nil {
+			return nil, err
+		}
+		if problem != nil {
+			result.Broken = append(result.Broken, *problem)
+			broken = append(broken, entry)
+		}
+	}
+	stats.SetCheckQueue(0, 0)
+	result.Unreferenced, err = f.unreferencedDocuments(ctx, refs)
+	if err != nil {
+		return nil, err
+	}
+	fs.Infof(f, "Checked %d documents of %d files: %d broken, %d documents posted by others which the manifest doesn't refer to", result.Documents, result.Files, len(result.Broken), len(result.Unreferenced))
+	if len(broken) == 0 {
+		return result, nil
+	}
+	if fix {
+		broken = slices.DeleteFunc(broken, func(entry *manifestEntry) bool {
+			return skipChange(ctx, entry.Path, "remove broken entry")
+		})
+		if len(broken) == 0 {
+			return result, nil
+		}
+		err = f.changeFileList(ctx, func(m *manifest) ([]*manifestEntry, error) {
+			var removed []*manifestEntry
+			for _, entry := range broken {
+				// The entry may have changed since it was checked
+				if m.remove(entry.Path, entry.id()) {
+					removed = append(removed, entry)
+				}
+			}
+			result.Removed = len(removed)
+			return removed, nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to remove broken entries: %w", err)
+		}
+		fs.Infof(f, "Removed %d broken entries", result.Removed)
+		return result, nil
+	}
+	// rclone doesn't show the output of commands which fail so the
+	// problems are logged too
+	for _, problem := range result.Broken {
+		fs.Errorf(f, "Broken entry for %q (message %d): %s", problem.Path, problem.MessageID, problem.Error)
+	}
+	return result, fmt.Errorf("found %d broken entries - use -o fix=true to remove them", len(result.Broken))
+}
+
+// checkEntry checks the documents of entry can be resolved, counting
+// them in result, and describes the first which can't
+func (f *Fs) checkEntry(ctx context.Context, entry *manifestEntry, result *checkResult) (*brokenEntry, error) {
+	if entry.isEmpty() {
+		return nil, nil
+	}
+	check := func(fileID string, messageID int64, part int) (*brokenEntry, error) {
+		result.Documents++
+		if fileID == "" {
+			return &brokenEntry{Path: decodePath(entry.Path), MessageID: messageID, Part: part, Error: "no document recorded - forward its message into the chat and run the rebuild command"}, nil
+		}
+		_, err := f.getFile(ctx, fileID)
+		if errors.Is(err, fs.ErrorObjectNotFound) {
+			return &brokenEntry{Path: decodePath(entry.Path), MessageID: messageID, Part: part, Error: "document not found"}, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to check %q: %w", decodePath(entry.Path), err)
+		}
+		return nil, nil
+	}
+	if len(entry.Chunks) == 0 {
+		return check(entry.FileID, entry.MessageID, 0)
+	}
+	for i, chunk := range entry.Chunks {
+		problem, err := check(chunk.FileID, chunk.MessageID, i+1)
+		if problem != nil || err != nil {
+			return problem, err
+		}
+	}
+	return nil, nil
+}
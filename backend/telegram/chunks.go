@@ -0,0 +1,315 @@
+package telegram
+
+import (
+	"bufio"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	gohash "hash"
+	"io"
+	"slices"
+	"sync"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/lib/multipart"
+	"github.com/rclone/rclone/lib/pacer"
+	"golang.org/x/sync/errgroup"
+)
+
+// chunkName returns the name of the document carrying part n of remote
+//
+// Parts are numbered from 1.
+func chunkName(remote string, n int) string {
+	return fmt.Sprintf("%s.part%04d", remote, n)
+}
+
+// uploadChunks uploads in as a series of documents of at most
+// chunk_size bytes each
+//
+// Up to upload_concurrency parts are sent at once. Each is read into
+// memory first so the next can be read while it is sent and so it can
+// be sent again if Telegram asks for it to be retried.
+//
+// If the size is known each part is recorded in the manifest as it is
+// sent. If the upload fails these are kept so that uploading the same
+// file again carries on from where it stopped, otherwise any parts
+// already sent are deleted.
+func (f *Fs) uploadChunks(ctx context.Context, in io.Reader, src fs.ObjectInfo, threadID int64) (_ *manifestEntry, err error) {
+	remote := f.absPath(src.Remote())
+	entry := &manifestEntry{
+		Path:    remote,
+		ModTime: src.ModTime(ctx),
+		TopicID: threadID,
+	}
+	var (
+		chunkSize   = int64(f.opt.ChunkSize)
+		size        = src.Size()
+		resumable   = size >= 0
+		concurrency = max(f.opt.UploadConcurrency, 1)
+		tokens      = pacer.NewTokenDispenser(concurrency)
+		g, gCtx     = errgroup.WithContext(ctx)
+		mu          sync.Mutex // protects entry.Chunks while parts are sent
+		br          = bufio.NewReader(in)
+		resume      []*manifestChunk
+		caption     = f.newCaption(ctx, src, remote)
+		// parts which were sent are recorded, or deleted, even if
+		// the upload is cancelled
+		finishCtx, cancel = finishContext(ctx)
+	)
+	defer cancel()
+	if resumable {
+		resume, err = f.pendingParts(ctx, remote, size)
+		if err != nil {
+			return nil, err
+		}
+	}
+	defer func() {
+		if err == nil || resumable {
+			return
+		}
+		sent := slices.DeleteFunc(entry.Chunks, func(chunk *manifestChunk) bool { return chunk == nil })
+		if delErr := f.deleteDocuments(finishCtx, 0, sent); delErr != nil {
+			fs.Debugf(f, "Failed to delete parts of %q after failed upload: %v", remote, delErr)
+		}
+	}()
+	// sendPart sends part n, which is the last part if last is set, and
+	// records it in its place in entry.Chunks
+	// and in the pending upload
+	sendPart := func(n int, last bool, part io.Reader, partSize int64, partHash gohash.Hash) error {
+		partCaption := caption.part(n)
+		if last {
+			partCaption = caption.lastPart(n)
+		}
+		chunk, err := f.sendChunk(gCtx, remote, threadID, partCaption, n, part, partSize)
+		if err != nil {
+			return err
+		}
+		chunk.MD5 = hex.EncodeToString(partHash.Sum(nil))
+		if resumable {
+			err = f.addPendingPart(finishCtx, remote, size, n, chunk)
+			if err != nil {
+				if delErr := f.deleteDocuments(finishCtx, 0, []*manifestChunk{chunk}); delErr != nil {
+					fs.Debugf(f, "Failed to delete part %d of %q after failing to record it: %v", n, remote, delErr)
+				}
+				return err
+			}
+		}
+		mu.Lock()
+		entry.Chunks[n-1] = chunk
+		mu.Unlock()
+		return nil
+	}
+	for n := 1; ; n++ {
+		// Stop when the input runs out, sending no parts at all for
+		// an empty file
+		_, err = br.Peek(1)
+		if err == io.EOF {
+			err = nil
+			break
+		}
+		if err != nil {
+			err = fmt.Errorf("failed to read part %d: %w", n, err)
+			break
+		}
+		tokens.Get()
+		// Fail fast - there is no point sending more parts if one
+		// failed, which Wait returns, or the upload was cancelled
+		if gCtx.Err() != nil {
+			tokens.Put()
+			err = ctx.Err()
+			break
+		}
+		mu.Lock()
+		entry.Chunks = append(entry.Chunks, nil)
+		mu.Unlock()
+		partHash := md5.New()
+		var sent *manifestChunk // part sent by an earlier attempt, if any
+		if n <= len(resume) {
+			sent = resume[n-1]
+		}
+		rw := multipart.NewRW()
+		var partSize int64
+		partSize, err = io.CopyN(io.MultiWriter(rw, partHash), br, chunkSize)
+		if err != nil && err != io.EOF {
+			_ = rw.Close()
+			tokens.Put()
+			err = fmt.Errorf("failed to read part %d: %w", n, err)
+			break
+		}
+		// The part is the last if the input ran out while reading it
+		// or there is nothing after it
+		last := err == io.EOF
+		if !last {
+			_, peekErr := br.Peek(1)
+			last = peekErr == io.EOF
+		}
+		err = nil
+		entry.Size += partSize
+		if sent != nil {
+			if sent.Size == partSize && sent.MD5 == hex.EncodeToString(partHash.Sum(nil)) {
+				fs.Debugf(f, "Reusing part %d of %q sent by an earlier upload", n, remote)
+				entry.Chunks[n-1] = sent
+				_ = rw.Close()
+				tokens.Put()
+				continue
+			}
+			if n == 1 {
+				// The earlier upload was of different content so
+				// none of its parts can be used
+				fs.Debugf(f, "Not resuming upload of %q as it has changed", remote)
+				resume = nil
+			}
+		}
+		g.Go(func() error {
+			defer func() {
+				_ = rw.Close()
+				tokens.Put()
+			}()
+			return sendPart(n, last, rw, partSize, partHash)
+		})
+	}
+	if waitErr := g.Wait(); err == nil {
+		err = waitErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// pendingParts returns the parts sent by an earlier upload of size
+// bytes to remote which didn't finish
+//
+// A pending upload of a different size is abandoned and its parts
+// deleted.
+func (f *Fs) pendingParts(ctx context.Context, remote string, size int64) (parts []*manifestChunk, err error) {
+	var stale bool
+	err = f.readFileList(ctx, func(m *manifest) error {
+		p := m.findPending(remote)
+		if p == nil {
+			return nil
+		}
+		if p.Size != size {
+			stale = true
+			return nil
+		}
+		parts = slices.Clone(p.Chunks)
+		return nil
+	})
+	if err != nil || !stale {
+		return parts, err
+	}
+	fs.Debugf(f, "Abandoning earlier upload of %q as its size has changed", remote)
+	return nil, f.changeFileList(ctx, func(m *manifest) ([]*manifestEntry, error) {
+		return m.finishPending(&manifestEntry{Path: remote}), nil
+	})
+}
+
+// addPendingPart records that part n of the upload of size bytes to
+// remote was sent as chunk
+func (f *Fs) addPendingPart(ctx context.Context, remote string, size int64, n int, chunk *manifestChunk) error {
+	return f.changeFileList(ctx, func(m *manifest) ([]*manifestEntry, error) {
+		unused := m.addPendingPart(remote, size, n, chunk)
+		if len(unused) == 0 {
+			return nil, nil
+		}
+		return []*manifestEntry{{Path: remote, Chunks: unused}}, nil
+	})
+}
+
+// sendChunk sends part n of remote to the forum topic threadID, if
+// not 0, with caption, if not nil, describing it
+func (f *Fs) sendChunk(ctx context.Context, remote string, threadID int64, caption *documentCaption, n int, part io.Reader, partSize int64) (*manifestChunk, error) {
+	message, err := f.sendDocument(ctx, chunkName(remote, n), threadID, caption, "", part, partSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to upload part %d: %w", n, err)
+	}
+	if message.Document == nil {
+		return nil, fmt.Errorf("telegram upload of part %d failed: no document in reply", n)
+	}
+	return &manifestChunk{
+		Size:      partSize,
+		FileID:    message.Document.FileID,
+		MessageID: message.MessageID,
+	}, nil
+}
+
+// chunkedReader reads the parts of a chunked object in turn
+type chunkedReader struct {
+	ctx    context.Context
+	f      *Fs
+	chunks []*manifestChunk // parts still to be opened
+	offset int64            // offset into the first part still to be opened
+	limit  int64            // bytes still to be opened, -1 for all
+	in     io.ReadCloser    // the part being read, or nil
+}
+
+// openChunks opens a chunked object for reading
+//
+// Only the parts overlapping the requested range are downloaded, and
+// only the bytes of them in the range, so the ranges opened by a
+// multi-thread copy are read independently.
+func (o *Object) openChunks(ctx context.Context, options ...fs.OpenOption) (io.ReadCloser, error) {
+	offset, limit := decodeOpenOptions(o, options, o.size)
+	chunks := o.chunks
+	for len(chunks) > 0 && offset >= chunks[0].Size {
+		offset -= chunks[0].Size
+		chunks = chunks[1:]
+	}
+	return &chunkedReader{
+		ctx:    ctx,
+		f:      o.fs,
+		chunks: chunks,
+		offset: offset,
+		limit:  limit,
+	}, nil
+}
+
+// Read bytes from the parts, opening the next one as needed
+func (r *chunkedReader) Read(p []byte) (n int, err error) {
+	for {
+		if r.in == nil {
+			if len(r.chunks) == 0 || r.limit == 0 {
+				return 0, io.EOF
+			}
+			chunk := r.chunks[0]
+			length := chunk.Size - r.offset
+			if r.limit >= 0 {
+				length = min(length, r.limit)
+				r.limit -= length
+			}
+			var options []fs.OpenOption
+			if r.offset > 0 || length < chunk.Size {
+				options = append(options, &fs.RangeOption{Start: r.offset, End: r.offset + length - 1})
+			}
+			r.in, err = r.f.openDocument(r.ctx, chunk.FileID, chunk.Size, options...)
+			if err != nil {
+				return 0, err
+			}
+			r.chunks = r.chunks[1:]
+			r.offset = 0
+		}
+		n, err = r.in.Read(p)
+		if err == io.EOF {
+			err = r.in.Close()
+			r.in = nil
+			if n > 0 || err != nil {
+				return n, err
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+// Close the part being read, if any
+func (r *chunkedReader) Close() error {
+	r.chunks = nil
+	if r.in == nil {
+		return nil
+	}
+	err := r.in.Close()
+	r.in = nil
+	return err
+}
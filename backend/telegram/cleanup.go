@@ -0,0 +1,242 @@
+package telegram
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/rclone/rclone/backend/telegram/api"
+	"github.com/rclone/rclone/fs"
+)
+
+// errUndeletable is returned when Telegram refuses to delete a
+// message, which it does for messages more than 48 hours old in chats
+// where the bot isn't an admin allowed to delete messages
+var errUndeletable = errors.New("telegram won't let the bot delete it")
+
+// orphan describes a document rclone failed to delete when the
+// manifest stopped referring to it
+type orphan struct {
+	Path      string `json:"path"`
+	Size      int64  `json:"size"`
+	MessageID int64  `json:"message_id"`
+	Parts     int    `json:"parts,omitempty"`
+}
+
+// unreferenced describes a document posted by another account which
+// the manifest doesn't refer to
+type unreferenced struct {
+	MessageID int64     `json:"message_id"`
+	FileName  string    `json:"file_name"`
+	Size      int64     `json:"size"`
+	Posted    time.Time `json:"posted"`
+	PostedBy  string    `json:"posted_by,omitempty"`
+}
+
+// cleanupResult is the output of the cleanup command
+type cleanupResult struct {
+	Orphans      []orphan       `json:"orphans"`               // documents rclone failed to delete
+	Deleted      int            `json:"deleted"`               // number of orphans deleted
+	DeletedBytes int64          `json:"deleted_bytes"`         // size of the orphans deleted
+	Undeletable  []orphan       `json:"undeletable,omitempty"` // orphans Telegram refused to delete
+	Unreferenced []unreferenced `json:"unreferenced"`          // documents posted by others the manifest doesn't refer to
+}
+
+// newOrphan describes the orphan entry
+//
+// The size of the parts of unfinished uploads isn't recorded in their
+// entry so it is added up from the parts.
+func newOrphan(entry *manifestEntry) orphan {
+	o := orphan{
+		Path:      entry.Path,
+		Size:      entry.Size,
+		MessageID: entry.id(),
+		Parts:     len(entry.Chunks),
+	}
+	if o.Size == 0 {
+		for _, chunk := range entry.Chunks {
+			o.Size += chunk.Size
+		}
+	}
+	return o
+}
+
+// postedBy describes who posted message
+func postedBy(message *api.Message) string {
+	switch {
+	case message.SenderChat != nil:
+		return chatName(message.SenderChat)
+	case message.From == nil:
+		return ""
+	case message.From.Username != "":
+		return "@" + message.From.Username
+	}
+	return message.From.FirstName
+}
+
+// references records the documents a manifest refers to
+type references struct {
+	messageIDs map[int64]struct{}
+	fileIDs    map[string]struct{} // of legacy entries with no message recorded
+	fileListID int64               // id of the message carrying the manifest
+}
+
+// manifestReferences returns the documents m refers to
+func manifestReferences(m *manifest) *references {
+	refs := &references{
+		messageIDs: map[int64]struct{}{},
+		fileIDs:    map[string]struct{}{},
+		fileListID: m.messageID,
+	}
+	for _, entry := range m.Entries {
+		refs.add(entry.MessageID, entry.FileID)
+		for _, chunk := range entry.Chunks {
+			refs.add(chunk.MessageID, chunk.FileID)
+		}
+	}
+	for _, p := range m.Pending {
+		for _, chunk := range p.Chunks {
+			if chunk != nil {
+				refs.add(chunk.MessageID, chunk.FileID)
+			}
+		}
+	}
+	return refs
+}
+
+// add records a reference to a document
+func (refs *references) add(messageID int64, fileID string) {
+	if messageID != 0 {
+		refs.messageIDs[messageID] = struct{}{}
+	} else if fileID != "" {
+		refs.fileIDs[fileID] = struct{}{}
+	}
+}
+
+// unreferencedDocuments lists the documents in the recent updates
+// which refs doesn't include
+//
+// Telegram doesn't send bots the messages they post themselves so
+// these were all posted by other accounts.
+func (f *Fs) unreferencedDocuments(ctx context.Context, refs *references) ([]unreferenced, error) {
+	documents, err := f.chatDocuments(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read documents in chat: %w", err)
+	}
+	found := []unreferenced{}
+	for _, message := range documents {
+		if message.MessageID == refs.fileListID {
+			continue
+		}
+		if _, ok := refs.messageIDs[message.MessageID]; ok {
+			continue
+		}
+		doc := message.File()
+		if _, ok := refs.fileIDs[doc.FileID]; ok {
+			continue
+		}
+		found = append(found, unreferenced{
+			MessageID: message.MessageID,
+			FileName:  doc.FileName,
+			Size:      doc.FileSize,
+			Posted:    message.Time(),
+			PostedBy:  postedBy(message),
+		})
+	}
+	return found, nil
+}
+
+// cleanupOrphans lists the documents left in the chat which the
+// manifest doesn't refer to, deleting the bot's own if unsafe is set
+//
+// Telegram doesn't send bots the messages they post themselves so the
+// bot's documents which rclone failed to delete are found from the
+// record of them kept in the manifest. Documents posted by other
+// accounts are found in the recent updates. Deleting those could
+// destroy other people's files so they are only ever listed.
+func (f *Fs) cleanupOrphans(ctx context.Context, unsafe bool) (*cleanupResult, error) {
+	// Read the manifest afresh, saving any changes of ours first, so
+	// documents just added by others aren't taken for orphans
+	err := f.forgetFileList(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		orphans []*manifestEntry
+		refs    *references
+	)
+	err = f.readFileList(ctx, func(m *manifest) error {
+		orphans = append(orphans, m.Orphans...)
+		refs = manifestReferences(m)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	result := &cleanupResult{
+		Orphans: []orphan{},
+	}
+	result.Unreferenced, err = f.unreferencedDocuments(ctx, refs)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range orphans {
+		result.Orphans = append(result.Orphans, newOrphan(entry))
+	}
+	if unsafe {
+		err = f.deleteOrphans(ctx, orphans, result)
+		if err != nil {
+			return nil, err
+		}
+		fs.Infof(f, "Deleted %d orphaned documents (%v), %d couldn't be deleted", result.Deleted, fs.SizeSuffix(result.DeletedBytes), len(result.Undeletable))
+	} else {
+		fs.Infof(f, "Found %d orphaned documents - use -o unsafe=true to delete them", len(result.Orphans))
+	}
+	fs.Infof(f, "Found %d documents posted by others which the manifest doesn't refer to", len(result.Unreferenced))
+	return result, nil
+}
+
+// deleteOrphans deletes the documents of orphans, recording the
+// outcome in result, and removes the record of the ones deleted from
+// the manifest
+//
+// Those Telegram refuses to delete stay recorded so they are reported
+// until they are deleted by hand.
+func (f *Fs) deleteOrphans(ctx context.Context, orphans []*manifestEntry, result *cleanupResult) error {
+	var (
+		deleted []int64
+		err     error
+	)
+	for _, entry := range orphans {
+		if skipChange(ctx, entry.Path, "delete orphaned document") {
+			continue
+		}
+		err = f.deleteDocuments(ctx, entry.MessageID, entry.Chunks)
+		if errors.Is(err, errUndeletable) {
+			fs.Logf(f, "Can't delete orphaned document for %q - delete message %d by hand: %v", entry.Path, entry.id(), err)
+			result.Undeletable = append(result.Undeletable, newOrphan(entry))
+			err = nil
+			continue
+		}
+		if err != nil {
+			err = fmt.Errorf("failed to delete orphaned document for %q: %w", entry.Path, err)
+			break
+		}
+		deleted = append(deleted, entry.id())
+		result.Deleted++
+		result.DeletedBytes += newOrphan(entry).Size
+	}
+	if len(deleted) > 0 {
+		saveErr := f.changeFileList(ctx, func(m *manifest) ([]*manifestEntry, error) {
+			for _, messageID := range deleted {
+				m.removeOrphan(messageID)
+			}
+			return nil, nil
+		})
+		if saveErr != nil && err == nil {
+			err = fmt.Errorf("failed to remove deleted orphans from the file list: %w", saveErr)
+		}
+	}
+	return err
+}
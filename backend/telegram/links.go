@@ -0,0 +1,148 @@
+package telegram
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/rclone/rclone/backend/telegram/api"
+	"github.com/rclone/rclone/fs"
+)
+
+// messageLink returns the t.me link to the message with the id given
+// in chat
+//
+// Public chats are linked to by username. Private supergroups and
+// channels have ids of -100 followed by the id used in links. Messages
+// in other private chats can't be linked to.
+func messageLink(chat *api.ChatFullInfo, messageID int64) (string, error) {
+	if chat.Username != "" {
+		return fmt.Sprintf("https://t.me/%s/%d", chat.Username, messageID), nil
+	}
+	internalID, ok := strings.CutPrefix(strconv.FormatInt(chat.ID, 10), "-100")
+	if !ok {
+		return "", fmt.Errorf("messages in %s chats can't be linked to", chat.Type)
+	}
+	return fmt.Sprintf("https://t.me/c/%s/%d", internalID, messageID), nil
+}
+
+// entryMessages returns the ids of the messages carrying the documents
+// of entry, one for each part if it is chunked
+//
+// It returns an error if entry has no documents.
+func entryMessages(entry *manifestEntry) ([]int64, error) {
+	switch {
+	case entry.isEmpty():
+		return nil, errors.New("empty files aren't posted to the chat")
+	case len(entry.Chunks) > 0:
+		ids := make([]int64, len(entry.Chunks))
+		for i, chunk := range entry.Chunks {
+			ids[i] = chunk.MessageID
+		}
+		return ids, nil
+	case entry.MessageID == 0:
+		return nil, errors.New("message not known")
+	}
+	return []int64{entry.MessageID}, nil
+}
+
+// getLinks returns the t.me links to the messages carrying the files
+// at remotes by path, with a link for each part of chunked files
+//
+// Directories are only allowed if recursive is set, in which case
+// all the files inside them are linked to, skipping those which
+// can't be.
+func (f *Fs) getLinks(ctx context.Context, remotes []string, recursive bool) (map[string][]string, error) {
+	if len(remotes) == 0 {
+		return nil, errors.New("need at least one path to link to")
+	}
+	messages := map[string][]int64{}
+	err := f.readFileList(ctx, func(m *manifest) error {
+		for _, remote := range remotes {
+			absPath := f.absPath(remote)
+			if entry := m.find(absPath); entry != nil {
+				ids, err := entryMessages(entry)
+				if err != nil {
+					return fmt.Errorf("can't link to %q: %w", remote, err)
+				}
+				messages[remote] = ids
+				continue
+			}
+			if !m.isDir(absPath) {
+				return fmt.Errorf("can't link to %q: %w", remote, fs.ErrorObjectNotFound)
+			}
+			if !recursive {
+				return fmt.Errorf("can't link to %q: it is a directory - use -o recursive=true to link to the files in it", remote)
+			}
+			entries, _, _ := m.listR(absPath)
+			for _, entry := range entries {
+				ids, err := entryMessages(entry)
+				if err != nil {
+					fs.Logf(f, "Not linking to %q: %v", f.relPath(entry.Path), err)
+					continue
+				}
+				messages[f.relPath(entry.Path)] = ids
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	chat, err := f.getChat(ctx)
+	if err != nil {
+		return nil, err
+	}
+	links := make(map[string][]string, len(messages))
+	for remote, ids := range messages {
+		for _, id := range ids {
+			link, err := messageLink(chat, id)
+			if err != nil {
+				return nil, fmt.Errorf("can't link to %q: %w", remote, err)
+			}
+			links[remote] = append(links[remote], link)
+		}
+	}
+	if chat.Username == "" && len(links) > 0 {
+		fs.Logf(f, "Chat is private so only its members can open the links")
+	}
+	return links, nil
+}
+
+// downloadURL returns the URL to download the file at remote straight
+// from the Bot API, or only its path under the file endpoint if
+// redact is set
+//
+// The URL contains the bot token and Telegram only promises it works
+// for an hour. Files stored in several parts have no single URL.
+func (f *Fs) downloadURL(ctx context.Context, remote string, redact bool) (string, error) {
+	obj, err := f.NewObject(ctx, remote)
+	if err != nil {
+		return "", err
+	}
+	o := obj.(*Object)
+	switch {
+	case o.isEmpty():
+		return "", fmt.Errorf("no URL for %q: empty files aren't posted to the chat", remote)
+	case len(o.chunks) > 0:
+		return "", fmt.Errorf("no URL for %q: it is stored as %d separate parts so there is no single URL - use rclone cat instead", remote, len(o.chunks))
+	case o.fileID == "":
+		return "", fmt.Errorf("no URL for %q: no document recorded", remote)
+	}
+	file, err := f.getFile(ctx, o.fileID)
+	if err != nil {
+		return "", err
+	}
+	filePath := file.FilePath
+	if path.IsAbs(filePath) {
+		filePath = f.serverFilePath(filePath)
+	}
+	if redact {
+		return filePath, nil
+	}
+	fs.Logf(f, "The URL contains the bot token so anyone with it can control the bot - don't share it. It works for about an hour.")
+	return f.fileURL(filePath), nil
+}
@@ -0,0 +1,903 @@
+package telegram
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+)
+
+// manifestVersion is the version of the manifest format written
+//
+// Version 0 is the original format which was a bare JSON array of
+// file names. It is still read and is upgraded on the next write.
+const manifestVersion = 1
+
+// manifest is the index of the files stored in the chat
+//
+// It is stored as JSON in the filelist.json document.
+//
+// Sequence is increased every time the manifest is saved so writers
+// can tell whether someone else saved it since they read it.
+type manifest struct {
+	Version  int              `json:"version"`
+	Sequence int64            `json:"sequence,omitempty"`
+	Entries  []*manifestEntry `json:"entries"`
+	Dirs     []string         `json:"dirs,omitempty"`     // directories made explicitly so they exist when empty
+	Pending  []*pendingUpload `json:"pending,omitempty"`  // chunked uploads which haven't finished
+	Topics   []*forumTopic    `json:"topics,omitempty"`   // forum topics made for top level directories
+	Orphans  []*manifestEntry `json:"orphans,omitempty"`  // documents which couldn't be deleted when they stopped being used
+	Imported int64            `json:"imported,omitempty"` // id of the newest message imported with import_documents
+
+	messageID      int64            // id of the message this manifest was read from, 0 if new
+	documentID     string           // file_unique_id of the document it was read from or last saved as, "" if new
+	size           int64            // size of the document it was read from or last saved as, 0 if new
+	savedTime      time.Time        // when it was last saved, zero if new
+	removed        []*manifestEntry // entries removed since the manifest was read
+	addedDirs      []string         // directories made since the manifest was read
+	removedDirs    []string         // directories removed since the manifest was read
+	removedPending []*pendingUpload // pending uploads removed since the manifest was read
+	addedTopics    []*forumTopic    // topics made since the manifest was read
+	removedTopics  []*forumTopic    // topics removed since the manifest was read
+	addedOrphans   []*manifestEntry // orphans recorded since the manifest was read
+	removedOrphans []*manifestEntry // orphans removed since the manifest was read
+	duplicates     []*manifestEntry // older entries for the same path dropped when the manifest was read
+
+	// Indexes so looking up a file or directory doesn't scan the
+	// whole manifest. They are built when first needed and kept up to
+	// date by the methods which change Entries, Dirs and Pending.
+	byPath        map[string][]*manifestEntry // entries for each path in the order they were added
+	position      map[*manifestEntry]int      // index of each entry in Entries
+	inside        map[string]int              // number of entries and explicit directories anywhere inside each directory
+	pendingByPath map[string]*pendingUpload   // pending upload for each path
+}
+
+// manifestEntry describes a file stored in the chat
+type manifestEntry struct {
+	Path      string      `json:"path"`                 // path of the file relative to the chat root
+	Size      int64       `json:"size"`                 // size in bytes
+	ModTime   time.Time   `json:"modtime"`              // modification time of the source
+	MD5       string      `json:"md5,omitempty"`        // hex MD5 of the content, if known
+	FileID    string      `json:"file_id,omitempty"`    // Telegram file_id of the document
+	MessageID int64       `json:"message_id,omitempty"` // id of the message carrying the document
+	Sequence  int64       `json:"sequence,omitempty"`   // sequence of the manifest which added the entry
+	TopicID   int64       `json:"topic_id,omitempty"`   // message_thread_id of the forum topic holding the documents, if any
+	MimeType  string      `json:"mime_type,omitempty"`  // MIME type of the content, if known
+	SentAs    string      `json:"sent_as,omitempty"`    // photo, video or audio if sent as media with send_as_media
+	Metadata  fs.Metadata `json:"metadata,omitempty"`   // rclone metadata of the file other than mtime and content-type, if any
+
+	Chunks []*manifestChunk `json:"chunks,omitempty"` // parts of the file if it was uploaded in chunks
+}
+
+// manifestChunk describes one part of a file uploaded in chunks
+type manifestChunk struct {
+	Size      int64  `json:"size"`          // size of this part in bytes
+	FileID    string `json:"file_id"`       // Telegram file_id of the document
+	MessageID int64  `json:"message_id"`    // id of the message carrying the document
+	MD5       string `json:"md5,omitempty"` // hex MD5 of this part, if known
+}
+
+// pendingUpload records the parts sent so far of a chunked upload
+// which hasn't finished so it can carry on from where it stopped
+//
+// There is at most one for each path. It is identified by the size of
+// the file and the MD5 of its first part.
+type pendingUpload struct {
+	Path     string           `json:"path"`               // path of the file being uploaded
+	Size     int64            `json:"size"`               // size of the file in bytes
+	Updated  time.Time        `json:"updated"`            // when a part was last sent
+	Chunks   []*manifestChunk `json:"chunks"`             // parts by number, nil if not sent yet
+	Sequence int64            `json:"sequence,omitempty"` // sequence of the manifest which last changed it
+}
+
+// forumTopic records the forum topic the documents uploaded to a top
+// level directory are posted in when use_topics is set
+type forumTopic struct {
+	Name     string `json:"name"`      // name of the top level directory
+	ThreadID int64  `json:"thread_id"` // message_thread_id of the topic
+}
+
+// id returns the id of the message identifying the entry
+//
+// For chunked files this is the message carrying the first part.
+func (entry *manifestEntry) id() int64 {
+	if len(entry.Chunks) > 0 {
+		return entry.Chunks[0].MessageID
+	}
+	return entry.MessageID
+}
+
+// documents returns the number of documents carrying entry
+func (entry *manifestEntry) documents() int {
+	switch {
+	case len(entry.Chunks) > 0:
+		return len(entry.Chunks)
+	case entry.FileID != "":
+		return 1
+	}
+	return 0
+}
+
+// isEmpty returns true if entry is a file of 0 bytes
+//
+// Telegram won't accept empty documents so these are only recorded in
+// the manifest. Unlike legacy entries, which only have a path, they
+// have an MD5.
+func (entry *manifestEntry) isEmpty() bool {
+	return entry.FileID == "" && len(entry.Chunks) == 0 && entry.MD5 != ""
+}
+
+// decodeManifest parses data which may be in any supported format
+func decodeManifest(data []byte) (*manifest, error) {
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] == '[' {
+		var names []string
+		err := json.Unmarshal(data, &names)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode legacy manifest: %w", err)
+		}
+		m := &manifest{Version: 0}
+		for _, name := range names {
+			m.Entries = append(m.Entries, &manifestEntry{Path: name})
+		}
+		return m, nil
+	}
+	m := new(manifest)
+	err := json.Unmarshal(data, m)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode manifest: %w", err)
+	}
+	if m.Version > manifestVersion {
+		return nil, fmt.Errorf("manifest version %d is newer than supported version %d - upgrade rclone", m.Version, manifestVersion)
+	}
+	err = m.check()
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode manifest: %w", err)
+	}
+	return m, nil
+}
+
+// check returns an error if m has nulls where records should be
+//
+// Anyone in the chat can post a manifest so these are rejected rather
+// than crash rclone when used. Only the parts of pending uploads not
+// sent yet are null.
+func (m *manifest) check() error {
+	for _, entry := range slices.Concat(m.Entries, m.Orphans) {
+		if entry == nil {
+			return errors.New("null entry")
+		}
+		if slices.Contains(entry.Chunks, nil) {
+			return fmt.Errorf("null part in entry for %q", entry.Path)
+		}
+	}
+	if slices.Contains(m.Pending, nil) {
+		return errors.New("null pending upload")
+	}
+	if slices.Contains(m.Topics, nil) {
+		return errors.New("null topic")
+	}
+	return nil
+}
+
+// encode returns the manifest as JSON in the current format with the
+// next sequence, ready to be saved
+func (m *manifest) encode() ([]byte, error) {
+	out := *m
+	out.Version = manifestVersion
+	out.Sequence++
+	return json.Marshal(&out)
+}
+
+// saved records that the output of encode was saved
+func (m *manifest) saved() {
+	m.Version = manifestVersion
+	m.Sequence++
+	m.removed = nil
+	m.addedDirs = nil
+	m.removedDirs = nil
+	m.removedPending = nil
+	m.addedTopics = nil
+	m.removedTopics = nil
+	m.addedOrphans = nil
+	m.removedOrphans = nil
+}
+
+// changed returns true if entry was added since the manifest was read
+func (m *manifest) changed(entry *manifestEntry) bool {
+	return entry.Sequence > m.Sequence
+}
+
+// add adds entry to the manifest
+func (m *manifest) add(entry *manifestEntry) {
+	entry.Sequence = m.Sequence + 1
+	m.Entries = append(m.Entries, entry)
+	m.indexEntry(entry, len(m.Entries)-1)
+}
+
+// buildIndex builds the indexes of the entries and directories if
+// they haven't been built
+func (m *manifest) buildIndex() {
+	if m.byPath != nil {
+		return
+	}
+	m.byPath = make(map[string][]*manifestEntry, len(m.Entries))
+	m.position = make(map[*manifestEntry]int, len(m.Entries))
+	m.inside = make(map[string]int)
+	for i, entry := range m.Entries {
+		m.byPath[entry.Path] = append(m.byPath[entry.Path], entry)
+		m.position[entry] = i
+		m.countInside(entry.Path, 1)
+	}
+	for _, dir := range m.Dirs {
+		m.countInside(dir, 1)
+	}
+}
+
+// resetIndex drops the indexes so they are built again when next
+// needed, for use after Entries or Dirs are replaced
+func (m *manifest) resetIndex() {
+	m.byPath = nil
+	m.position = nil
+	m.inside = nil
+}
+
+// countInside adds delta to the count of things inside each of the
+// directories holding the file or directory p
+func (m *manifest) countInside(p string, delta int) {
+	for i := len(p) - 1; i > 0; i-- {
+		if p[i] != '/' {
+			continue
+		}
+		dir := p[:i]
+		if m.inside[dir] += delta; m.inside[dir] <= 0 {
+			delete(m.inside, dir)
+		}
+	}
+}
+
+// entriesFor returns the entries for path, building the indexes if
+// needed
+func (m *manifest) entriesFor(path string) []*manifestEntry {
+	m.buildIndex()
+	return m.byPath[path]
+}
+
+// indexEntry adds entry, which was just put at index i of Entries, to
+// the indexes if they have been built
+func (m *manifest) indexEntry(entry *manifestEntry, i int) {
+	if m.byPath == nil {
+		return
+	}
+	m.byPath[entry.Path] = append(m.byPath[entry.Path], entry)
+	m.position[entry] = i
+	m.countInside(entry.Path, 1)
+}
+
+// unindexEntry removes entry, which was just removed from Entries,
+// from the indexes if they have been built
+func (m *manifest) unindexEntry(entry *manifestEntry) {
+	if m.byPath == nil {
+		return
+	}
+	entries := slices.DeleteFunc(m.byPath[entry.Path], func(e *manifestEntry) bool { return e == entry })
+	if len(entries) == 0 {
+		delete(m.byPath, entry.Path)
+	} else {
+		m.byPath[entry.Path] = entries
+	}
+	delete(m.position, entry)
+	m.countInside(entry.Path, -1)
+}
+
+// find returns the entry for path or nil if not found
+func (m *manifest) find(path string) *manifestEntry {
+	if entries := m.entriesFor(path); len(entries) > 0 {
+		return entries[0]
+	}
+	return nil
+}
+
+// isDir returns true if dir was made explicitly or holds any entries
+func (m *manifest) isDir(dir string) bool {
+	if dir == "" || slices.Contains(m.Dirs, dir) {
+		return true
+	}
+	return !m.isEmptyDir(dir)
+}
+
+// isEmptyDir returns true if there is nothing inside dir
+func (m *manifest) isEmptyDir(dir string) bool {
+	if dir == "" {
+		return len(m.Entries) == 0 && len(m.Dirs) == 0
+	}
+	m.buildIndex()
+	return m.inside[dir] == 0
+}
+
+// listDir returns the entries directly inside dir and the paths of
+// the directories directly inside it
+//
+// Directories are made explicitly or implied by the paths of the
+// entries inside them. It returns found false if dir doesn't exist.
+func (m *manifest) listDir(dir string) (entries []*manifestEntry, dirs []string, found bool) {
+	prefix := ""
+	if dir != "" {
+		prefix = dir + "/"
+	}
+	seen := map[string]struct{}{}
+	addDir := func(leaf string) {
+		subDir, _, _ := strings.Cut(leaf, "/")
+		if _, ok := seen[subDir]; !ok {
+			seen[subDir] = struct{}{}
+			dirs = append(dirs, prefix+subDir)
+		}
+	}
+	for _, entry := range m.Entries {
+		leaf, ok := strings.CutPrefix(entry.Path, prefix)
+		if !ok {
+			continue
+		}
+		if strings.Contains(leaf, "/") {
+			addDir(leaf)
+		} else {
+			entries = append(entries, entry)
+		}
+	}
+	for _, subDir := range m.Dirs {
+		if leaf, ok := strings.CutPrefix(subDir, prefix); ok && leaf != "" {
+			addDir(leaf)
+		}
+	}
+	found = dir == "" || len(entries) > 0 || len(dirs) > 0 || slices.Contains(m.Dirs, dir)
+	return entries, dirs, found
+}
+
+// listR returns all the entries inside dir and the paths of all the
+// directories inside it, recursively
+//
+// Directories are listed before anything inside them. It returns
+// found false if dir doesn't exist.
+func (m *manifest) listR(dir string) (entries []*manifestEntry, dirs []string, found bool) {
+	prefix := ""
+	if dir != "" {
+		prefix = dir + "/"
+	}
+	seen := map[string]struct{}{}
+	// addDirs adds the directory holding leaf and all its parents
+	// inside dir
+	addDirs := func(leaf string) {
+		for i, c := range leaf {
+			if c != '/' {
+				continue
+			}
+			subDir := prefix + leaf[:i]
+			if _, ok := seen[subDir]; !ok {
+				seen[subDir] = struct{}{}
+				dirs = append(dirs, subDir)
+			}
+		}
+	}
+	for _, entry := range m.Entries {
+		if leaf, ok := strings.CutPrefix(entry.Path, prefix); ok {
+			addDirs(leaf)
+			entries = append(entries, entry)
+		}
+	}
+	for _, subDir := range m.Dirs {
+		if leaf, ok := strings.CutPrefix(subDir, prefix); ok && leaf != "" {
+			addDirs(leaf + "/")
+		}
+	}
+	found = dir == "" || len(entries) > 0 || len(dirs) > 0 || slices.Contains(m.Dirs, dir)
+	return entries, dirs, found
+}
+
+// parentDir returns the directory holding p, which is "" at the top
+func parentDir(p string) string {
+	i := strings.LastIndexByte(p, '/')
+	if i < 0 {
+		return ""
+	}
+	return p[:i]
+}
+
+// addDir records that dir was made
+func (m *manifest) addDir(dir string) {
+	if !slices.Contains(m.Dirs, dir) {
+		m.Dirs = append(m.Dirs, dir)
+		m.addedDirs = append(m.addedDirs, dir)
+		if m.inside != nil {
+			m.countInside(dir, 1)
+		}
+	}
+}
+
+// keepParent records the directory holding p as made if it would
+// otherwise vanish now nothing is left in it
+func (m *manifest) keepParent(p string) {
+	dir := parentDir(p)
+	if !m.isDir(dir) {
+		m.addDir(dir)
+	}
+}
+
+// removeDir removes the record that dir was made
+//
+// It returns false if dir wasn't made explicitly.
+func (m *manifest) removeDir(dir string) bool {
+	i := slices.Index(m.Dirs, dir)
+	if i < 0 {
+		return false
+	}
+	m.Dirs = slices.Delete(m.Dirs, i, i+1)
+	m.removedDirs = append(m.removedDirs, dir)
+	if m.inside != nil {
+		m.countInside(dir, -1)
+	}
+	return true
+}
+
+// moveDir moves everything inside srcDir, and srcDir itself if it
+// was made explicitly, to dstDir
+//
+// The entries are re-added under their new paths so the move merges
+// like any other change.
+func (m *manifest) moveDir(srcDir, dstDir string) {
+	srcPrefix, dstPrefix := srcDir+"/", dstDir+"/"
+	if srcDir == "" {
+		srcPrefix = ""
+	}
+	if dstDir == "" {
+		dstPrefix = ""
+	}
+	var moved []*manifestEntry
+	for _, entry := range slices.Clone(m.Entries) {
+		leaf, ok := strings.CutPrefix(entry.Path, srcPrefix)
+		if !ok {
+			continue
+		}
+		newEntry := *entry
+		newEntry.Path = dstPrefix + leaf
+		m.remove(entry.Path, entry.id())
+		moved = append(moved, &newEntry)
+	}
+	for _, entry := range moved {
+		m.add(entry)
+	}
+	for _, dir := range slices.Clone(m.Dirs) {
+		if dir == srcDir {
+			m.removeDir(dir)
+			m.addDir(dstDir)
+		} else if leaf, ok := strings.CutPrefix(dir, srcPrefix); ok {
+			m.removeDir(dir)
+			m.addDir(dstPrefix + leaf)
+		}
+	}
+}
+
+// purge removes everything inside dir, and dir itself if it was made
+// explicitly, returning the entries removed
+func (m *manifest) purge(dir string) (removed []*manifestEntry) {
+	prefix := dir + "/"
+	if dir == "" {
+		prefix = ""
+	}
+	for _, entry := range slices.Clone(m.Entries) {
+		if strings.HasPrefix(entry.Path, prefix) {
+			m.remove(entry.Path, entry.id())
+			removed = append(removed, entry)
+		}
+	}
+	for _, subDir := range slices.Clone(m.Dirs) {
+		if subDir == dir || strings.HasPrefix(subDir, prefix) {
+			m.removeDir(subDir)
+		}
+	}
+	return removed
+}
+
+// index returns the index of the entry for path carried by messageID
+//
+// If messageID is 0 the first entry for path is used. It returns -1
+// if no entry was found.
+func (m *manifest) index(path string, messageID int64) int {
+	for _, entry := range m.entriesFor(path) {
+		if messageID == 0 || entry.id() == messageID {
+			return m.position[entry]
+		}
+	}
+	return -1
+}
+
+// remove removes the entry for path carried by messageID
+//
+// The last entry is moved into its place so the rest don't have to be
+// moved up. It returns false if no entry was found.
+func (m *manifest) remove(path string, messageID int64) bool {
+	i := m.index(path, messageID)
+	if i < 0 {
+		return false
+	}
+	entry := m.Entries[i]
+	m.removed = append(m.removed, entry)
+	last := len(m.Entries) - 1
+	m.Entries[i] = m.Entries[last]
+	m.Entries[last] = nil
+	m.Entries = m.Entries[:last]
+	m.unindexEntry(entry)
+	if i < last {
+		m.position[m.Entries[i]] = i
+	}
+	return true
+}
+
+// put adds entry replacing any entries for the same path, which it
+// returns
+func (m *manifest) put(entry *manifestEntry) (replaced []*manifestEntry) {
+	for {
+		old := m.find(entry.Path)
+		if old == nil {
+			break
+		}
+		m.remove(old.Path, old.id())
+		replaced = append(replaced, old)
+	}
+	m.add(entry)
+	return replaced
+}
+
+// dedupe removes all but the newest entry for each path, returning
+// the entries removed
+//
+// Older versions of rclone added an entry every time a file was
+// uploaded so a manifest may hold more than one entry for a path. The
+// newest is the one with the largest sequence, then the latest
+// modification time, then the one added last.
+func (m *manifest) dedupe() (discarded []*manifestEntry) {
+	newest := make(map[string]*manifestEntry, len(m.Entries))
+	for _, entry := range m.Entries {
+		old, ok := newest[entry.Path]
+		if !ok || entry.Sequence > old.Sequence || (entry.Sequence == old.Sequence && !entry.ModTime.Before(old.ModTime)) {
+			newest[entry.Path] = entry
+		}
+	}
+	if len(newest) == len(m.Entries) {
+		return nil
+	}
+	m.Entries = slices.DeleteFunc(m.Entries, func(entry *manifestEntry) bool {
+		if newest[entry.Path] == entry {
+			return false
+		}
+		fs.Logf(entry.Path, "Discarding duplicate entry in file list (modified %v) - keeping the newest (modified %v)", entry.ModTime, newest[entry.Path].ModTime)
+		discarded = append(discarded, entry)
+		return true
+	})
+	m.removed = append(m.removed, discarded...)
+	m.resetIndex()
+	return discarded
+}
+
+// replace replaces the entry for path carried by messageID with
+// newEntry, adding newEntry if it wasn't found
+func (m *manifest) replace(path string, messageID int64, newEntry *manifestEntry) {
+	i := m.index(path, messageID)
+	if i < 0 {
+		m.add(newEntry)
+		return
+	}
+	newEntry.Sequence = m.Sequence + 1
+	m.removed = append(m.removed, m.Entries[i])
+	m.unindexEntry(m.Entries[i])
+	m.Entries[i] = newEntry
+	m.indexEntry(newEntry, i)
+}
+
+// findPending returns the pending upload for path or nil if not found
+func (m *manifest) findPending(path string) *pendingUpload {
+	if m.pendingByPath == nil {
+		m.pendingByPath = make(map[string]*pendingUpload, len(m.Pending))
+		for _, p := range m.Pending {
+			if _, ok := m.pendingByPath[p.Path]; !ok {
+				m.pendingByPath[p.Path] = p
+			}
+		}
+	}
+	return m.pendingByPath[path]
+}
+
+// addPendingPart records that part n of the upload of size bytes to
+// path was sent as chunk
+//
+// A pending upload of a different size to path is replaced. It returns
+// any parts which are no longer referenced.
+func (m *manifest) addPendingPart(path string, size int64, n int, chunk *manifestChunk) (unused []*manifestChunk) {
+	p := m.findPending(path)
+	if p != nil && p.Size != size {
+		unused = m.removePending(path).Chunks
+		p = nil
+	}
+	if p == nil {
+		p = &pendingUpload{Path: path, Size: size}
+		m.Pending = append(m.Pending, p)
+		if m.pendingByPath != nil {
+			m.pendingByPath[path] = p
+		}
+	}
+	for len(p.Chunks) < n {
+		p.Chunks = append(p.Chunks, nil)
+	}
+	if old := p.Chunks[n-1]; old != nil {
+		unused = append(unused, old)
+	}
+	p.Chunks[n-1] = chunk
+	p.Updated = time.Now()
+	p.Sequence = m.Sequence + 1
+	return slices.DeleteFunc(unused, func(chunk *manifestChunk) bool { return chunk == nil })
+}
+
+// removePending removes the pending upload for path, returning it, or
+// nil if there wasn't one
+func (m *manifest) removePending(path string) *pendingUpload {
+	p := m.findPending(path)
+	if p == nil {
+		return nil
+	}
+	i := slices.Index(m.Pending, p)
+	m.Pending = slices.Delete(m.Pending, i, i+1)
+	m.removedPending = append(m.removedPending, p)
+	delete(m.pendingByPath, path)
+	return p
+}
+
+// finishPending removes the pending upload for the path of entry,
+// which has finished, returning the parts it doesn't use
+func (m *manifest) finishPending(entry *manifestEntry) (unused []*manifestEntry) {
+	p := m.removePending(entry.Path)
+	if p == nil {
+		return nil
+	}
+	chunks := slices.DeleteFunc(slices.Clone(p.Chunks), func(chunk *manifestChunk) bool {
+		return chunk == nil || slices.ContainsFunc(entry.Chunks, func(used *manifestChunk) bool {
+			return used.MessageID == chunk.MessageID
+		})
+	})
+	if len(chunks) == 0 {
+		return nil
+	}
+	return []*manifestEntry{{Path: p.Path, Chunks: chunks}}
+}
+
+// merge applies the changes made to m since it was read to newer, a
+// copy of the manifest saved by someone else since, and makes m the
+// result
+//
+// Entries are keyed by path. Where both sides added an entry for the
+// same path the one with the larger sequence is kept, or the newest if
+// they are the same. It returns the entries which were overridden,
+// whose documents are no longer referenced.
+//
+// If conflictSuffix isn't empty and the entries added by both sides
+// have different contents, ours is kept as well with conflictSuffix
+// added to its path. These are returned as conflicts.
+func (m *manifest) merge(newer *manifest, conflictSuffix string) (overridden, conflicts []*manifestEntry) {
+	base := m.Sequence
+	entries := slices.Clone(newer.Entries)
+	for _, removed := range m.removed {
+		entries = slices.DeleteFunc(entries, func(entry *manifestEntry) bool {
+			return entry.Path == removed.Path && entry.id() == removed.id()
+		})
+	}
+	// Anything else we have which we didn't add is either in newer
+	// already or was removed by the other writer
+	for _, ours := range m.Entries {
+		if !m.changed(ours) {
+			continue
+		}
+		i := slices.IndexFunc(entries, func(entry *manifestEntry) bool {
+			return entry.Path == ours.Path && entry.Sequence > base
+		})
+		switch {
+		case i < 0:
+			entries = append(entries, ours)
+		case entries[i].id() != 0 && entries[i].id() == ours.id():
+			// Both imported the same document
+			continue
+		case conflictSuffix != "" && !sameContent(entries[i], ours):
+			p := conflictPath(entries, ours.Path+conflictSuffix)
+			fs.Logf(ours.Path, "Keeping our change as %q as someone else saved a different one (modified %v)", p, entries[i].ModTime)
+			ours.Path = p
+			entries = append(entries, ours)
+			conflicts = append(conflicts, ours)
+		case entries[i].Sequence > ours.Sequence || (entries[i].Sequence == ours.Sequence && entries[i].ModTime.After(ours.ModTime)):
+			fs.Logf(ours.Path, "Discarding our change as someone else saved a newer one (modified %v)", entries[i].ModTime)
+			overridden = append(overridden, ours)
+			continue
+		default:
+			fs.Logf(ours.Path, "Overriding a change saved by someone else (modified %v)", entries[i].ModTime)
+			overridden = append(overridden, entries[i])
+			entries[i] = ours
+		}
+		// Our additions are saved in the sequence after newer's
+		ours.Sequence = newer.Sequence + 1
+	}
+	dirs := slices.Clone(newer.Dirs)
+	for _, dir := range m.addedDirs {
+		if !slices.Contains(dirs, dir) {
+			dirs = append(dirs, dir)
+		}
+	}
+	dirs = slices.DeleteFunc(dirs, func(dir string) bool {
+		return slices.Contains(m.removedDirs, dir)
+	})
+	// Pending uploads are only changed by the rclone doing the
+	// upload so ours replace theirs
+	pending := slices.DeleteFunc(slices.Clone(newer.Pending), func(p *pendingUpload) bool {
+		return slices.ContainsFunc(m.removedPending, func(removed *pendingUpload) bool {
+			return removed.Path == p.Path && p.Sequence <= base
+		})
+	})
+	for _, ours := range m.Pending {
+		if ours.Sequence <= base {
+			continue
+		}
+		pending = slices.DeleteFunc(pending, func(p *pendingUpload) bool { return p.Path == ours.Path })
+		pending = append(pending, ours)
+		ours.Sequence = newer.Sequence + 1
+	}
+	topics := slices.DeleteFunc(slices.Clone(newer.Topics), func(t *forumTopic) bool {
+		return slices.ContainsFunc(m.removedTopics, func(removed *forumTopic) bool {
+			return *removed == *t
+		})
+	})
+	for _, ours := range m.addedTopics {
+		if !slices.ContainsFunc(topics, func(t *forumTopic) bool { return t.Name == ours.Name }) {
+			topics = append(topics, ours)
+		}
+	}
+	orphans := slices.DeleteFunc(slices.Clone(newer.Orphans), func(o *manifestEntry) bool {
+		return slices.ContainsFunc(m.removedOrphans, func(removed *manifestEntry) bool {
+			return removed.id() == o.id()
+		})
+	})
+	for _, ours := range m.addedOrphans {
+		if !slices.ContainsFunc(orphans, func(o *manifestEntry) bool { return o.id() == ours.id() }) {
+			orphans = append(orphans, ours)
+		}
+	}
+	m.Entries = entries
+	m.Dirs = dirs
+	m.Pending = pending
+	m.Topics = topics
+	m.Orphans = orphans
+	m.Imported = max(m.Imported, newer.Imported)
+	m.resetIndex()
+	m.pendingByPath = nil
+	m.Sequence = newer.Sequence
+	m.messageID = newer.messageID
+	m.documentID = newer.documentID
+	m.removed = nil
+	m.addedDirs = nil
+	m.removedDirs = nil
+	m.removedPending = nil
+	m.addedTopics = nil
+	m.removedTopics = nil
+	m.addedOrphans = nil
+	m.removedOrphans = nil
+	return overridden, conflicts
+}
+
+// sameContent returns true if a and b hold the same data
+func sameContent(a, b *manifestEntry) bool {
+	if a.MD5 != "" && b.MD5 != "" {
+		return a.Size == b.Size && a.MD5 == b.MD5
+	}
+	return isCopyOf(a, b)
+}
+
+// conflictPath returns p, or p with a number added if entries already
+// has a file there
+func conflictPath(entries []*manifestEntry, p string) string {
+	used := func(p string) bool {
+		return slices.ContainsFunc(entries, func(entry *manifestEntry) bool { return entry.Path == p })
+	}
+	newPath := p
+	for i := 2; used(newPath); i++ {
+		newPath = fmt.Sprintf("%s-%d", p, i)
+	}
+	return newPath
+}
+
+// addOrphan records that the documents of entry couldn't be deleted
+func (m *manifest) addOrphan(entry *manifestEntry) {
+	if slices.ContainsFunc(m.Orphans, func(o *manifestEntry) bool { return o.id() == entry.id() }) {
+		return
+	}
+	m.Orphans = append(m.Orphans, entry)
+	m.addedOrphans = append(m.addedOrphans, entry)
+}
+
+// removeOrphan removes the record of the orphan whose first message
+// is messageID, returning false if there wasn't one
+func (m *manifest) removeOrphan(messageID int64) bool {
+	i := slices.IndexFunc(m.Orphans, func(o *manifestEntry) bool { return o.id() == messageID })
+	if i < 0 {
+		return false
+	}
+	m.removedOrphans = append(m.removedOrphans, m.Orphans[i])
+	m.Orphans = slices.Delete(m.Orphans, i, i+1)
+	return true
+}
+
+// findTopic returns the forum topic for the top level directory name
+// or nil if there isn't one
+func (m *manifest) findTopic(name string) *forumTopic {
+	for _, t := range m.Topics {
+		if t.Name == name {
+			return t
+		}
+	}
+	return nil
+}
+
+// addTopic records that the forum topic t was made
+func (m *manifest) addTopic(t *forumTopic) {
+	m.Topics = append(m.Topics, t)
+	m.addedTopics = append(m.addedTopics, t)
+}
+
+// removeTopic removes the record of the forum topic for name,
+// returning it or nil if there wasn't one
+func (m *manifest) removeTopic(name string) *forumTopic {
+	i := slices.IndexFunc(m.Topics, func(t *forumTopic) bool { return t.Name == name })
+	if i < 0 {
+		return nil
+	}
+	t := m.Topics[i]
+	m.Topics = slices.Delete(m.Topics, i, i+1)
+	m.removedTopics = append(m.removedTopics, t)
+	return t
+}
+
+// topicInUse returns true if any file, or unfinished upload, has
+// documents in the forum topic t
+//
+// Deleting a topic deletes all the messages in it so it mustn't be
+// deleted while this is true. Unfinished uploads don't record their
+// topic so any inside the directory t was made for count.
+func (m *manifest) topicInUse(t *forumTopic) bool {
+	for _, entry := range m.Entries {
+		if entry.TopicID == t.ThreadID {
+			return true
+		}
+	}
+	prefix := t.Name + "/"
+	for _, p := range m.Pending {
+		if strings.HasPrefix(p.Path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// unusedTopics removes the forum topics for the top level directories
+// which no longer exist, unless files still have documents in them,
+// and returns them
+//
+// If dir isn't "" only its topic is considered.
+func (m *manifest) unusedTopics(dir string) (unused []*forumTopic) {
+	for _, t := range m.Topics {
+		if (dir == "" || t.Name == dir) && !m.isDir(t.Name) && !m.topicInUse(t) {
+			unused = append(unused, t)
+		}
+	}
+	for _, t := range unused {
+		m.removeTopic(t.Name)
+	}
+	return unused
+}
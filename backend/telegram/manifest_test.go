@@ -0,0 +1,680 @@
+package telegram
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	updateGolden = flag.Bool("updategolden", false, "update golden files for regression test")
+)
+
+// checkGolden checks got against the golden file, or re-writes the
+// file if -updategolden is set
+func checkGolden(t *testing.T, fileName string, got []byte) {
+	if *updateGolden {
+		t.Logf("Updating golden file %q", fileName)
+		err := os.WriteFile(fileName, got, 0666)
+		require.NoError(t, err)
+	} else {
+		want, err := os.ReadFile(fileName)
+		require.NoError(t, err)
+		assert.Equal(t, string(want), string(got), fileName)
+	}
+}
+
+// goldenManifest returns a manifest using every part of the format
+func goldenManifest() *manifest {
+	modTime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	return &manifest{
+		Version:  manifestVersion,
+		Sequence: 41,
+		Entries: []*manifestEntry{{
+			Path:      "dir/a.txt",
+			Size:      3,
+			ModTime:   modTime,
+			MD5:       "9e107d9d372bb6826bd81d3542a419d6",
+			FileID:    "BQACAgQAAx",
+			MessageID: 17,
+			Sequence:  40,
+			MimeType:  "text/plain",
+			Metadata:  fs.Metadata{"owner": "alice"},
+		}, {
+			Path:    "big.bin",
+			Size:    2,
+			ModTime: modTime,
+			TopicID: 5,
+			Chunks: []*manifestChunk{
+				{Size: 1, FileID: "BQACAgQAAy", MessageID: 18, MD5: "0cc175b9c0f1b6a831c399e269772661"},
+				{Size: 1, FileID: "BQACAgQAAz", MessageID: 19},
+			},
+		}, {
+			Path:    "photo.jpg",
+			Size:    4,
+			ModTime: modTime,
+			FileID:  "AgACAgQAAx",
+			SentAs:  sendAsPhoto,
+		}, {
+			Path:    "empty.txt",
+			ModTime: modTime,
+			MD5:     "d41d8cd98f00b204e9800998ecf8427e",
+		}},
+		Dirs: []string{"dir", "empty"},
+		Pending: []*pendingUpload{{
+			Path:     "part.bin",
+			Size:     2,
+			Updated:  modTime,
+			Chunks:   []*manifestChunk{{Size: 1, FileID: "BQACAgQAAw", MessageID: 20}, nil},
+			Sequence: 39,
+		}},
+		Topics:  []*forumTopic{{Name: "dir", ThreadID: 5}},
+		Orphans: []*manifestEntry{{Path: "gone.txt", Size: 1, ModTime: modTime, FileID: "BQACAgQAAv", MessageID: 21}},
+	}
+}
+
+// TestManifestGolden checks the format of the manifest doesn't change
+// by accident and that manifests saved by every version are still read
+//
+// The manifests in testdata are saved by earlier versions and must
+// never change. Those in testdata/golden are what this version saves
+// and are updated with -updategolden when the format is changed on
+// purpose. Add a copy of the new golden/manifest.json as
+// manifest-vN.json when manifestVersion is increased.
+func TestManifestGolden(t *testing.T) {
+	data, err := goldenManifest().encode()
+	require.NoError(t, err)
+	checkGolden(t, "testdata/golden/manifest.json", data)
+
+	t.Run("V0", func(t *testing.T) {
+		data, err := os.ReadFile("testdata/manifest-v0.json")
+		require.NoError(t, err)
+		m, err := decodeManifest(data)
+		require.NoError(t, err)
+		assert.Equal(t, &manifest{Entries: []*manifestEntry{
+			{Path: "a.txt"}, {Path: "dir/b.txt"}, {Path: "dir/sub/c.txt"},
+		}}, m)
+		data, err = m.encode()
+		require.NoError(t, err)
+		checkGolden(t, "testdata/golden/manifest-v0-upgraded.json", data)
+	})
+
+	t.Run("V1", func(t *testing.T) {
+		data, err := os.ReadFile("testdata/manifest-v1.json")
+		require.NoError(t, err)
+		m, err := decodeManifest(data)
+		require.NoError(t, err)
+		want := goldenManifest()
+		want.Version = 1
+		want.Sequence++
+		assert.Equal(t, want, m)
+		m.Sequence--
+		data, err = m.encode()
+		require.NoError(t, err)
+		checkGolden(t, "testdata/golden/manifest.json", data)
+	})
+}
+
+func TestDecodeManifest(t *testing.T) {
+	modTime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	t.Run("Legacy", func(t *testing.T) {
+		m, err := decodeManifest([]byte(` ["a.txt", "b.txt"]`))
+		require.NoError(t, err)
+		assert.Equal(t, 0, m.Version)
+		require.Len(t, m.Entries, 2)
+		assert.Equal(t, &manifestEntry{Path: "a.txt"}, m.Entries[0])
+		assert.Equal(t, &manifestEntry{Path: "b.txt"}, m.Entries[1])
+	})
+
+	t.Run("Current", func(t *testing.T) {
+		in := &manifest{Entries: []*manifestEntry{{
+			Path:      "dir/a.txt",
+			Size:      42,
+			ModTime:   modTime,
+			MD5:       "9e107d9d372bb6826bd81d3542a419d6",
+			FileID:    "BQACAgQAAx",
+			MessageID: 17,
+		}}}
+		data, err := in.encode()
+		require.NoError(t, err)
+		m, err := decodeManifest(data)
+		require.NoError(t, err)
+		assert.Equal(t, manifestVersion, m.Version)
+		assert.Equal(t, in.Entries, m.Entries)
+	})
+
+	t.Run("TooNew", func(t *testing.T) {
+		_, err := decodeManifest([]byte(`{"version":999,"entries":[]}`))
+		assert.ErrorContains(t, err, "newer than supported")
+	})
+
+	t.Run("Corrupt", func(t *testing.T) {
+		_, err := decodeManifest([]byte(`{"version":`))
+		assert.Error(t, err)
+		_, err = decodeManifest([]byte(`["a.txt",`))
+		assert.Error(t, err)
+	})
+}
+
+// FuzzDecodeManifest checks that hostile manifests, which anyone in
+// the chat can post, are either rejected or usable
+//
+// Run with go test -fuzz FuzzDecodeManifest
+func FuzzDecodeManifest(f *testing.F) {
+	current, err := (&manifest{
+		Entries: []*manifestEntry{
+			{Path: "dir/a.txt", Size: 3, MD5: "9e107d9d372bb6826bd81d3542a419d6", FileID: "BQACAgQAAx", MessageID: 17},
+			{Path: "big.bin", Size: 2, Chunks: []*manifestChunk{{Size: 1, FileID: "x", MessageID: 18}, {Size: 1, FileID: "y", MessageID: 19}}},
+			{Path: "empty.txt", MD5: "d41d8cd98f00b204e9800998ecf8427e"},
+		},
+		Dirs:    []string{"dir", "other"},
+		Pending: []*pendingUpload{{Path: "part.bin", Size: 2, Chunks: []*manifestChunk{{Size: 1, FileID: "z", MessageID: 20}, nil}}},
+		Topics:  []*forumTopic{{Name: "dir", ThreadID: 5}},
+		Orphans: []*manifestEntry{{Path: "gone.txt", Size: 1, MessageID: 21}},
+	}).encode()
+	require.NoError(f, err)
+	f.Add(current)
+	f.Add(current[:len(current)/2])
+	f.Add([]byte(`["a.txt", "b.txt", "a.txt"]`))
+	f.Add([]byte(`["a.txt",`))
+	f.Add([]byte(`{"version":999,"entries":[]}`))
+	f.Add([]byte(`{"version":1,"entries":[null],"pending":[null],"topics":[null],"orphans":[null]}`))
+	f.Add([]byte(`{"version":1,"entries":[{"path":"a","chunks":[null]}],"orphans":[{"chunks":[null]}]}`))
+	f.Add([]byte(`{"version":1,"entries":[{"path":""},{"path":"/"},{"path":"a//b/"}],"dirs":["","a/"]}`))
+	f.Add([]byte(strings.Repeat("[", 100000) + strings.Repeat("]", 100000)))
+	f.Add([]byte(`{"version":1,"entries":[{"path":"` + strings.Repeat("x", 2<<20) + `"}]}`))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		m, err := decodeManifest(data)
+		if err != nil {
+			assert.Nil(t, m)
+			return
+		}
+		// Everything done with a manifest read from the chat
+		m.dedupe()
+		_, _, _ = m.listR("")
+		for _, entry := range m.Entries {
+			_ = m.find(entry.Path)
+			_ = m.isDir(parentDir(entry.Path))
+			_ = entry.id()
+			_ = entry.documents()
+		}
+		_ = manifestReferences(m)
+		for _, entry := range m.Orphans {
+			_ = newOrphan(entry)
+		}
+		data, err = m.encode()
+		require.NoError(t, err)
+		again, err := decodeManifest(data)
+		require.NoError(t, err)
+		assert.Equal(t, len(m.Entries), len(again.Entries))
+	})
+}
+
+func TestManifestMerge(t *testing.T) {
+	modTime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	entry := func(path string, messageID, sequence int64, age time.Duration) *manifestEntry {
+		return &manifestEntry{Path: path, MessageID: messageID, Sequence: sequence, ModTime: modTime.Add(-age)}
+	}
+	paths := func(m *manifest) (paths []string) {
+		for _, entry := range m.Entries {
+			paths = append(paths, fmt.Sprintf("%s:%d", entry.Path, entry.MessageID))
+		}
+		return paths
+	}
+
+	// Both writers start from the same manifest
+	ours := &manifest{Sequence: 3, Entries: []*manifestEntry{
+		entry("keep", 1, 1, 0),
+		entry("theirs-removed", 2, 2, 0),
+		entry("ours-removed", 3, 3, 0),
+	}}
+	newer := &manifest{Sequence: 5, messageID: 99, Entries: []*manifestEntry{
+		entry("keep", 1, 1, 0),
+		entry("ours-removed", 3, 3, 0),
+		entry("theirs-added", 10, 4, 0),
+		entry("both-older", 11, 4, 0),
+		entry("both-newer", 12, 4, time.Hour),
+		entry("both-later", 13, 5, 0),
+	}}
+	require.True(t, ours.remove("ours-removed", 3))
+	ours.add(entry("ours-added", 20, 0, 0))
+	ours.add(entry("both-older", 21, 0, time.Hour))
+	ours.add(entry("both-newer", 22, 0, 0))
+	ours.add(entry("both-later", 23, 0, 0))
+
+	overridden, _ := ours.merge(newer, "")
+	assert.Equal(t, []string{
+		"keep:1",
+		"theirs-added:10",
+		"both-older:11",
+		"both-newer:22",
+		"both-later:13",
+		"ours-added:20",
+	}, paths(ours))
+	assert.Equal(t, []string{"both-older:21", "both-newer:12", "both-later:23"}, paths(&manifest{Entries: overridden}))
+	assert.Equal(t, int64(5), ours.Sequence)
+	assert.Equal(t, int64(99), ours.messageID)
+	assert.Equal(t, int64(6), ours.find("ours-added").Sequence)
+	assert.Equal(t, int64(1), ours.find("keep").Sequence)
+
+	// The next save is after the newer one
+	data, err := ours.encode()
+	require.NoError(t, err)
+	ours.saved()
+	decoded, err := decodeManifest(data)
+	require.NoError(t, err)
+	assert.Equal(t, int64(6), decoded.Sequence)
+}
+
+func TestManifestMergeConflicts(t *testing.T) {
+	entry := func(path string, messageID int64, md5 string) *manifestEntry {
+		return &manifestEntry{Path: path, MessageID: messageID, Size: 3, MD5: md5, Sequence: 4}
+	}
+	ours := &manifest{Sequence: 3}
+	newer := &manifest{Sequence: 4, Entries: []*manifestEntry{
+		entry("differ", 10, "aaa"),
+		entry("same", 11, "bbb"),
+		entry("differ.conflict", 12, "ccc"),
+	}}
+	ours.add(entry("differ", 20, "ddd"))
+	ours.add(entry("same", 21, "bbb"))
+
+	overridden, conflicts := ours.merge(newer, ".conflict")
+	// Theirs keeps the name and ours is kept beside it
+	assert.Equal(t, int64(10), ours.find("differ").MessageID)
+	require.Len(t, conflicts, 1)
+	assert.Equal(t, "differ.conflict-2", conflicts[0].Path)
+	assert.Equal(t, int64(20), ours.find("differ.conflict-2").MessageID)
+	assert.Equal(t, int64(5), conflicts[0].Sequence)
+	// Identical changes aren't conflicts
+	require.Len(t, overridden, 1)
+	assert.Equal(t, "same", overridden[0].Path)
+	assert.Len(t, ours.Entries, 4)
+}
+
+func TestManifestListDir(t *testing.T) {
+	m := &manifest{
+		Entries: []*manifestEntry{
+			{Path: "a.txt"},
+			{Path: "dir/b.txt"},
+			{Path: "dir/sub/c.txt"},
+			{Path: "dir/sub/d.txt"},
+		},
+		Dirs: []string{"empty", "dir/made/deep"},
+	}
+	names := func(entries []*manifestEntry) (names []string) {
+		for _, entry := range entries {
+			names = append(names, entry.Path)
+		}
+		return names
+	}
+	for _, test := range []struct {
+		dir         string
+		wantEntries []string
+		wantDirs    []string
+		wantFound   bool
+	}{
+		{"", []string{"a.txt"}, []string{"dir", "empty"}, true},
+		{"dir", []string{"dir/b.txt"}, []string{"dir/sub", "dir/made"}, true},
+		{"dir/sub", []string{"dir/sub/c.txt", "dir/sub/d.txt"}, nil, true},
+		{"dir/made", nil, []string{"dir/made/deep"}, true},
+		{"dir/made/deep", nil, nil, true},
+		{"empty", nil, nil, true},
+		{"missing", nil, nil, false},
+		{"di", nil, nil, false},
+	} {
+		entries, dirs, found := m.listDir(test.dir)
+		assert.Equal(t, test.wantEntries, names(entries), test.dir)
+		assert.Equal(t, test.wantDirs, dirs, test.dir)
+		assert.Equal(t, test.wantFound, found, test.dir)
+	}
+	assert.True(t, m.isDir("dir/made"))
+	assert.False(t, m.isEmptyDir("dir/made"))
+	assert.True(t, m.isEmptyDir("empty"))
+	assert.False(t, m.isEmptyDir(""))
+	assert.True(t, (&manifest{}).isEmptyDir(""))
+}
+
+func TestManifestDedupe(t *testing.T) {
+	modTime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	m := &manifest{Sequence: 4, Entries: []*manifestEntry{
+		{Path: "a.txt", MessageID: 1, Sequence: 1, ModTime: modTime},
+		{Path: "b.txt", MessageID: 2, Sequence: 2, ModTime: modTime},
+		{Path: "a.txt", MessageID: 3, Sequence: 3, ModTime: modTime.Add(-time.Hour)},
+		{Path: "c.txt", MessageID: 4, Sequence: 4, ModTime: modTime},
+		{Path: "c.txt", MessageID: 5, Sequence: 4, ModTime: modTime.Add(-time.Hour)},
+		{Path: "legacy.txt"},
+		{Path: "legacy.txt"},
+	}}
+	legacy := m.Entries[6]
+	discarded := m.dedupe()
+	var got []string
+	for _, entry := range m.Entries {
+		got = append(got, fmt.Sprintf("%s:%d", entry.Path, entry.MessageID))
+	}
+	assert.Equal(t, []string{"b.txt:2", "a.txt:3", "c.txt:4", "legacy.txt:0"}, got)
+	assert.Same(t, legacy, m.find("legacy.txt"))
+	require.Len(t, discarded, 3)
+	assert.Equal(t, discarded, m.removed)
+
+	assert.Nil(t, m.dedupe())
+}
+
+func TestManifestIndex(t *testing.T) {
+	m := &manifest{Sequence: 1, Entries: []*manifestEntry{
+		{Path: "a.txt", MessageID: 1},
+		{Path: "b.txt", MessageID: 2},
+		{Path: "a.txt", MessageID: 3},
+	}}
+	// check the indexes agree with a scan of the entries
+	check := func() {
+		t.Helper()
+		for _, path := range []string{"a.txt", "b.txt", "c.txt", "d.txt", "dir/c.txt"} {
+			found := m.find(path)
+			if !slices.ContainsFunc(m.Entries, func(entry *manifestEntry) bool { return entry.Path == path }) {
+				assert.Nil(t, found, path)
+				assert.Equal(t, -1, m.index(path, 0), path)
+				continue
+			}
+			require.NotNil(t, found, path)
+			assert.Equal(t, path, found.Path)
+			assert.Same(t, found, m.Entries[m.index(path, 0)], path)
+		}
+		for _, dir := range []string{"dir", "other"} {
+			empty := !slices.ContainsFunc(m.Entries, func(entry *manifestEntry) bool { return strings.HasPrefix(entry.Path, dir+"/") }) &&
+				!slices.ContainsFunc(m.Dirs, func(subDir string) bool { return strings.HasPrefix(subDir, dir+"/") })
+			assert.Equal(t, empty, m.isEmptyDir(dir), dir)
+		}
+	}
+
+	// Built from the entries the first time it is used
+	check()
+	assert.Equal(t, 2, m.index("a.txt", 3))
+	assert.Equal(t, -1, m.index("a.txt", 2))
+
+	// and kept up to date as they change
+	m.add(&manifestEntry{Path: "c.txt", MessageID: 4})
+	check()
+	assert.True(t, m.remove("a.txt", 1))
+	check()
+	assert.Equal(t, int64(3), m.find("a.txt").MessageID)
+	m.replace("b.txt", 2, &manifestEntry{Path: "b.txt", MessageID: 5})
+	check()
+	assert.Equal(t, int64(5), m.find("b.txt").MessageID)
+	replaced := m.put(&manifestEntry{Path: "a.txt", MessageID: 6})
+	require.Len(t, replaced, 1)
+	assert.Equal(t, int64(3), replaced[0].MessageID)
+	check()
+	m.moveDir("", "dir")
+	check()
+	assert.Nil(t, m.find("c.txt"))
+	assert.Equal(t, int64(4), m.find("dir/c.txt").MessageID)
+	assert.True(t, m.isDir("dir"))
+	m.addDir("other/sub")
+	check()
+	assert.True(t, m.isDir("other"))
+	require.True(t, m.removeDir("other/sub"))
+	check()
+	assert.False(t, m.isDir("other"))
+	m.merge(&manifest{Sequence: 9, Entries: []*manifestEntry{{Path: "d.txt", MessageID: 7, Sequence: 9}}}, "")
+	check()
+	assert.Equal(t, int64(7), m.find("d.txt").MessageID)
+
+	// Pending uploads too
+	assert.Nil(t, m.findPending("big.bin"))
+	m.addPendingPart("big.bin", 10, 1, &manifestChunk{MessageID: 8})
+	require.NotNil(t, m.findPending("big.bin"))
+	unused := m.addPendingPart("big.bin", 20, 1, &manifestChunk{MessageID: 9})
+	assert.Len(t, unused, 1)
+	assert.Equal(t, int64(20), m.findPending("big.bin").Size)
+	require.NotNil(t, m.removePending("big.bin"))
+	assert.Nil(t, m.findPending("big.bin"))
+	assert.Empty(t, m.Pending)
+}
+
+func TestManifestListR(t *testing.T) {
+	m := &manifest{
+		Entries: []*manifestEntry{
+			{Path: "a.txt"},
+			{Path: "dir/b.txt"},
+			{Path: "dir/sub/c.txt"},
+		},
+		Dirs: []string{"empty", "dir/made/deep"},
+	}
+	names := func(entries []*manifestEntry) (names []string) {
+		for _, entry := range entries {
+			names = append(names, entry.Path)
+		}
+		return names
+	}
+	for _, test := range []struct {
+		dir         string
+		wantEntries []string
+		wantDirs    []string
+		wantFound   bool
+	}{
+		{"", []string{"a.txt", "dir/b.txt", "dir/sub/c.txt"}, []string{"dir", "dir/sub", "empty", "dir/made", "dir/made/deep"}, true},
+		{"dir", []string{"dir/b.txt", "dir/sub/c.txt"}, []string{"dir/sub", "dir/made", "dir/made/deep"}, true},
+		{"dir/made", nil, []string{"dir/made/deep"}, true},
+		{"empty", nil, nil, true},
+		{"missing", nil, nil, false},
+	} {
+		entries, dirs, found := m.listR(test.dir)
+		assert.Equal(t, test.wantEntries, names(entries), test.dir)
+		assert.Equal(t, test.wantDirs, dirs, test.dir)
+		assert.Equal(t, test.wantFound, found, test.dir)
+	}
+}
+
+func TestManifestPending(t *testing.T) {
+	chunk := func(messageID int64) *manifestChunk {
+		return &manifestChunk{Size: 4, MessageID: messageID}
+	}
+	m := &manifest{Sequence: 2}
+	assert.Empty(t, m.addPendingPart("a.txt", 10, 2, chunk(2)))
+	assert.Empty(t, m.addPendingPart("a.txt", 10, 1, chunk(1)))
+	p := m.findPending("a.txt")
+	require.NotNil(t, p)
+	assert.Equal(t, []*manifestChunk{chunk(1), chunk(2)}, p.Chunks)
+	assert.Equal(t, int64(3), p.Sequence)
+
+	// Sending a part again replaces it
+	assert.Equal(t, []*manifestChunk{chunk(1)}, m.addPendingPart("a.txt", 10, 1, chunk(3)))
+	// and a different size replaces the whole upload
+	assert.Equal(t, []*manifestChunk{chunk(3), chunk(2)}, m.addPendingPart("a.txt", 12, 3, chunk(4)))
+	assert.Equal(t, []*manifestChunk{nil, nil, chunk(4)}, m.findPending("a.txt").Chunks)
+	m.addPendingPart("a.txt", 12, 1, chunk(5))
+
+	// Finishing returns the parts which aren't used
+	entry := &manifestEntry{Path: "a.txt", Chunks: []*manifestChunk{chunk(5), chunk(6), chunk(7)}}
+	assert.Equal(t, []*manifestEntry{{Path: "a.txt", Chunks: []*manifestChunk{chunk(4)}}}, m.finishPending(entry))
+	assert.Nil(t, m.findPending("a.txt"))
+	m.addPendingPart("b.txt", 12, 1, chunk(8))
+	entry = &manifestEntry{Path: "b.txt", Chunks: []*manifestChunk{chunk(8), chunk(9)}}
+	assert.Empty(t, m.finishPending(entry))
+	assert.Empty(t, m.finishPending(entry))
+}
+
+func TestManifestMergePending(t *testing.T) {
+	pending := func(path string, sequence int64) *pendingUpload {
+		return &pendingUpload{Path: path, Size: 10, Sequence: sequence}
+	}
+	ours := &manifest{Sequence: 3, Pending: []*pendingUpload{
+		pending("keep", 1),
+		pending("ours-removed", 2),
+		pending("ours-changed", 3),
+	}}
+	newer := &manifest{Sequence: 5, Pending: []*pendingUpload{
+		pending("keep", 1),
+		pending("ours-removed", 2),
+		pending("ours-changed", 3),
+		pending("theirs-added", 4),
+	}}
+	require.NotNil(t, ours.removePending("ours-removed"))
+	ours.addPendingPart("ours-changed", 10, 1, &manifestChunk{MessageID: 1})
+	ours.addPendingPart("ours-added", 10, 1, &manifestChunk{MessageID: 2})
+
+	ours.merge(newer, "")
+	var got []string
+	for _, p := range ours.Pending {
+		got = append(got, fmt.Sprintf("%s:%d", p.Path, p.Sequence))
+	}
+	assert.Equal(t, []string{"keep:1", "theirs-added:4", "ours-changed:6", "ours-added:6"}, got)
+	assert.Empty(t, ours.removedPending)
+}
+
+func TestManifestTopics(t *testing.T) {
+	photos := &forumTopic{Name: "photos", ThreadID: 10}
+	m := &manifest{
+		Entries: []*manifestEntry{{Path: "elsewhere.jpg", MessageID: 11, TopicID: 10}},
+		Dirs:    []string{"docs"},
+		Topics:  []*forumTopic{photos, {Name: "docs", ThreadID: 20}, {Name: "empty", ThreadID: 30}, {Name: "pending", ThreadID: 40}},
+		Pending: []*pendingUpload{{Path: "pending/big.bin", Size: 10}},
+	}
+	assert.Equal(t, photos, m.findTopic("photos"))
+	assert.Nil(t, m.findTopic("missing"))
+
+	// Topics are only unused if their directory is gone and no
+	// documents are in them
+	assert.Empty(t, m.unusedTopics("docs"))
+	assert.Equal(t, []*forumTopic{{Name: "empty", ThreadID: 30}}, m.unusedTopics(""))
+	assert.Nil(t, m.findTopic("empty"))
+	assert.NotNil(t, m.findTopic("photos"), "topic holding documents removed")
+	assert.NotNil(t, m.findTopic("pending"), "topic holding unfinished upload removed")
+}
+
+func TestManifestMergeTopics(t *testing.T) {
+	topic := func(name string, threadID int64) *forumTopic {
+		return &forumTopic{Name: name, ThreadID: threadID}
+	}
+	ours := &manifest{Sequence: 3, Topics: []*forumTopic{topic("keep", 1), topic("ours-removed", 2)}}
+	newer := &manifest{Sequence: 5, Topics: []*forumTopic{topic("keep", 1), topic("ours-removed", 2), topic("theirs-added", 3), topic("both-added", 4)}}
+	require.NotNil(t, ours.removeTopic("ours-removed"))
+	ours.addTopic(topic("ours-added", 5))
+	ours.addTopic(topic("both-added", 6))
+
+	ours.merge(newer, "")
+	// Where both made a topic for the same directory theirs wins
+	assert.Equal(t, []*forumTopic{topic("keep", 1), topic("theirs-added", 3), topic("both-added", 4), topic("ours-added", 5)}, ours.Topics)
+	assert.Empty(t, ours.addedTopics)
+	assert.Empty(t, ours.removedTopics)
+}
+
+func TestManifestMergeOrphans(t *testing.T) {
+	orphan := func(messageID int64) *manifestEntry {
+		return &manifestEntry{Path: "file.txt", MessageID: messageID}
+	}
+	ours := &manifest{Sequence: 3, Orphans: []*manifestEntry{orphan(1), orphan(2)}}
+	newer := &manifest{Sequence: 5, Orphans: []*manifestEntry{orphan(1), orphan(2), orphan(3), orphan(4)}}
+	require.True(t, ours.removeOrphan(2))
+	assert.False(t, ours.removeOrphan(2))
+	ours.addOrphan(orphan(4))
+	ours.addOrphan(orphan(5))
+	ours.addOrphan(orphan(5))
+
+	ours.merge(newer, "")
+	assert.Equal(t, []*manifestEntry{orphan(1), orphan(3), orphan(4), orphan(5)}, ours.Orphans)
+	assert.Empty(t, ours.addedOrphans)
+	assert.Empty(t, ours.removedOrphans)
+}
+
+func TestManifestMergeImported(t *testing.T) {
+	// Both imported the same document, and they imported more
+	ours := &manifest{Sequence: 3, Imported: 10}
+	newer := &manifest{Sequence: 5, Imported: 12, Entries: []*manifestEntry{
+		{Path: "report.pdf", MessageID: 10, Sequence: 5},
+	}}
+	ours.add(&manifestEntry{Path: "report.pdf", MessageID: 10})
+
+	overridden, _ := ours.merge(newer, "")
+	assert.Empty(t, overridden)
+	require.Len(t, ours.Entries, 1)
+	assert.Equal(t, int64(10), ours.Entries[0].MessageID)
+	assert.Equal(t, int64(12), ours.Imported)
+}
+
+func BenchmarkManifestIndex(b *testing.B) {
+	for _, n := range []int{1000, 10000, 100000} {
+		b.Run(fmt.Sprintf("Entries%d", n), func(b *testing.B) {
+			m := &manifest{}
+			for i := range n {
+				m.add(&manifestEntry{Path: fmt.Sprintf("dir%d/file%d.txt", i%100, i), MessageID: int64(i + 1)})
+			}
+			b.ResetTimer()
+			for i := range b.N {
+				j := i % n
+				dir := fmt.Sprintf("dir%d", j%100)
+				path := fmt.Sprintf("%s/file%d.txt", dir, j)
+				entry := m.find(path)
+				if entry == nil || !m.isDir(dir) || m.isEmptyDir(dir) || m.isDir("missing") {
+					b.Fatal("index is wrong")
+				}
+				if !m.remove(path, entry.MessageID) {
+					b.Fatal("remove failed")
+				}
+				m.add(entry)
+			}
+		})
+	}
+}
+
+func BenchmarkManifestEncode(b *testing.B) {
+	for _, n := range []int{10000, 100000} {
+		m := benchmarkManifest(n)
+		data, err := m.encode()
+		require.NoError(b, err)
+		b.Run(fmt.Sprintf("Entries%d", n), func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(data)))
+			for range b.N {
+				_, err := m.encode()
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkManifestDecode(b *testing.B) {
+	for _, n := range []int{10000, 100000} {
+		data, err := benchmarkManifest(n).encode()
+		require.NoError(b, err)
+		b.Run(fmt.Sprintf("Entries%d", n), func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(data)))
+			for range b.N {
+				_, err := decodeManifest(data)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// benchmarkManifest makes a manifest of n files like those uploaded
+func benchmarkManifest(n int) *manifest {
+	modTime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	m := &manifest{}
+	for i := range n {
+		m.add(&manifestEntry{
+			Path:      fmt.Sprintf("dir%d/file%d.txt", i%100, i),
+			Size:      int64(i),
+			ModTime:   modTime.Add(time.Duration(i) * time.Second),
+			MD5:       "9e107d9d372bb6826bd81d3542a419d6",
+			FileID:    fmt.Sprintf("BQACAgQAAxkDAAI%08d", i),
+			MessageID: int64(i + 1),
+		})
+	}
+	return m
+}
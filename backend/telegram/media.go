@@ -0,0 +1,76 @@
+package telegram
+
+import (
+	"strings"
+
+	"github.com/rclone/rclone/backend/telegram/api"
+)
+
+// Values of send_as_media
+const (
+	sendMediaNone       = "document-only" // send everything as documents
+	sendMediaVideoAudio = "video-audio"   // send videos and audio as media as they aren't changed
+	sendMediaAll        = "all"           // send images as photos too, which are recompressed
+)
+
+// How a file was sent, as recorded in the manifest
+const (
+	sendAsDocument = ""      // with sendDocument
+	sendAsPhoto    = "photo" // with sendPhoto, which recompresses the image
+	sendAsVideo    = "video" // with sendVideo
+	sendAsAudio    = "audio" // with sendAudio
+)
+
+// maxPhotoSize is the largest image sendPhoto accepts
+const maxPhotoSize = 10 * 1000 * 1000
+
+// mediaTypes are the MIME types Telegram clients can show inline and
+// how to send each one
+var mediaTypes = map[string]string{
+	"image/jpeg":  sendAsPhoto,
+	"image/png":   sendAsPhoto,
+	"image/webp":  sendAsPhoto,
+	"video/mp4":   sendAsVideo,
+	"audio/mpeg":  sendAsAudio,
+	"audio/mp4":   sendAsAudio,
+	"audio/x-m4a": sendAsAudio,
+}
+
+// sendMethod returns the Bot API method which sends files as kind and
+// the name of the parameter carrying the file
+func sendMethod(kind string) (method, field string) {
+	if kind == sendAsDocument {
+		return "sendDocument", "document"
+	}
+	return "send" + strings.ToUpper(kind[:1]) + kind[1:], kind
+}
+
+// sendAs returns how to send a file of size bytes with the MIME type
+// given according to send_as_media
+//
+// Anything which isn't media, or is too big to send as a photo, is
+// sent as a document.
+func (f *Fs) sendAs(mimeType string, size int64) string {
+	mimeType, _, _ = strings.Cut(mimeType, ";")
+	kind := mediaTypes[strings.TrimSpace(mimeType)]
+	switch {
+	case f.opt.SendAsMedia == sendMediaNone:
+		return sendAsDocument
+	case kind == sendAsPhoto && (f.opt.SendAsMedia != sendMediaAll || size > maxPhotoSize):
+		return sendAsDocument
+	}
+	return kind
+}
+
+// messageSentAs returns how the file attached to message was sent
+func messageSentAs(message *api.Message) string {
+	switch {
+	case len(message.Photo) > 0:
+		return sendAsPhoto
+	case message.Video != nil:
+		return sendAsVideo
+	case message.Audio != nil:
+		return sendAsAudio
+	}
+	return sendAsDocument
+}
@@ -0,0 +1,97 @@
+package telegram
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+)
+
+// metadataHelp is the help for the metadata the backend supports
+const metadataHelp = `Metadata is kept in the manifest alongside each file, so any keys
+can be stored. The modification time is the time recorded for the file
+and the content-type is the MIME type of its document rather than
+separate keys.`
+
+// systemMetadataInfo describes the system metadata keys
+var systemMetadataInfo = map[string]fs.MetadataHelp{
+	"mtime": {
+		Help:    "Time of last modification, read from rclone metadata",
+		Type:    "RFC 3339",
+		Example: "2006-01-02T15:04:05.999999999Z07:00",
+	},
+	"btime": {
+		Help:    "Time of file birth (creation), read from rclone metadata",
+		Type:    "RFC 3339",
+		Example: "2006-01-02T15:04:05.999999999Z07:00",
+	},
+	"content-type": {
+		Help:    "MIME type, also known as media type",
+		Type:    "string",
+		Example: "text/plain",
+	},
+}
+
+// readMetadata reads the metadata to store for src
+//
+// It returns nil if there is none, which is the case unless
+// --metadata is in use.
+func (f *Fs) readMetadata(ctx context.Context, src fs.ObjectInfo, options []fs.OpenOption) (fs.Metadata, error) {
+	meta, err := fs.GetMetadataOptions(ctx, f, src, options)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read metadata: %w", err)
+	}
+	for _, key := range []string{"mtime", "btime"} {
+		if value, ok := meta[key]; ok {
+			if _, err := time.Parse(time.RFC3339Nano, value); err != nil {
+				return nil, fmt.Errorf("failed to parse metadata %s: %w", key, err)
+			}
+		}
+	}
+	if len(meta) == 0 {
+		return nil, nil
+	}
+	return meta, nil
+}
+
+// setMetadata records the metadata read by readMetadata in the entry
+//
+// The mtime becomes the modification time of the entry, the
+// content-type its MIME type, and the other keys are kept in its
+// metadata, which is left out of the manifest if there aren't any.
+func (entry *manifestEntry) setMetadata(meta fs.Metadata) {
+	if meta == nil {
+		return
+	}
+	if value, ok := meta["mtime"]; ok {
+		entry.ModTime, _ = time.Parse(time.RFC3339Nano, value)
+	}
+	if value := meta["content-type"]; value != "" {
+		entry.MimeType = value
+	}
+	entry.Metadata = nil
+	for key, value := range meta {
+		if key == "mtime" || key == "content-type" {
+			continue
+		}
+		if entry.Metadata == nil {
+			entry.Metadata = make(fs.Metadata, len(meta))
+		}
+		entry.Metadata[key] = value
+	}
+}
+
+// Metadata returns metadata for an object
+//
+// It should return nil if there is no Metadata
+func (o *Object) Metadata(ctx context.Context) (fs.Metadata, error) {
+	metadata := make(fs.Metadata, len(o.metadata)+2)
+	maps.Copy(metadata, o.metadata)
+	metadata["mtime"] = o.modTime.Format(time.RFC3339Nano)
+	if o.mimeType != "" {
+		metadata["content-type"] = o.mimeType
+	}
+	return metadata, nil
+}
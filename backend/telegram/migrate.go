@@ -0,0 +1,188 @@
+package telegram
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/accounting"
+)
+
+// migrateFailure describes a file which couldn't be copied to the
+// target chat
+type migrateFailure struct {
+	Path  string `json:"path"`
+	Error string `json:"error"`
+}
+
+// migrateResult is the output of the migrate command
+type migrateResult struct {
+	Copied      int              `json:"copied"`            // number of files copied
+	CopiedBytes int64            `json:"copied_bytes"`      // size of the files copied
+	Skipped     int              `json:"skipped"`           // number of files already in the target chat
+	Failed      []migrateFailure `json:"failed"`            // files which couldn't be copied
+	Deleted     *purgeResult     `json:"deleted,omitempty"` // what was deleted from this chat with delete-source
+}
+
+// targetChat returns an Fs for the chat chatID using the same bot,
+// connection and pacer as f
+func (f *Fs) targetChat(ctx context.Context, chatID string) (*Fs, error) {
+	if chatID == "" {
+		return nil, errors.New("need the chat to migrate to - use -o target-chat=ID")
+	}
+	if chatID == f.opt.ChatID {
+		return nil, errors.New("can't migrate a chat to itself")
+	}
+	opt := f.opt
+	opt.ChatID = chatID
+	target := newFs(ctx, f.name, "", &opt)
+	target.srv = f.srv
+	target.pacer = f.pacer
+	err := target.check(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("target chat %s: %w", chatID, err)
+	}
+	return target, nil
+}
+
+// migrate copies every file in the manifest of the chat to the chat
+// targetChatID, deleting everything from this chat afterwards if
+// deleteSource is set and all the files were copied
+//
+// The documents are sent again by file_id, which works in any chat the
+// bot is in, so nothing is downloaded or uploaded. Each file copied is
+// added to the manifest of the target chat so if the migration stops
+// part way running it again skips the files already copied.
+func (f *Fs) migrate(ctx context.Context, targetChatID string, deleteSource bool) (result *migrateResult, err error) {
+	target, err := f.targetChat(ctx, targetChatID)
+	if err != nil {
+		return nil, err
+	}
+	// Save whatever was copied if the flush timer hasn't yet
+	defer func() {
+		if flushErr := target.flushFileList(ctx); flushErr != nil && err == nil {
+			result, err = nil, fmt.Errorf("failed to save the manifest of the target chat: %w", flushErr)
+		}
+	}()
+	err = f.forgetFileList(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		entries []*manifestEntry
+		dirs    []string
+	)
+	err = f.readFileList(ctx, func(m *manifest) error {
+		entries = append(entries, m.Entries...)
+		dirs = append(dirs, m.Dirs...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	result = &migrateResult{
+		Failed: []migrateFailure{},
+	}
+	var (
+		stats  = accounting.Stats(ctx)
+		queued int64
+	)
+	for _, entry := range entries {
+		queued += entry.Size
+	}
+	defer stats.SetTransferQueue(0, 0)
+	for i, entry := range entries {
+		stats.SetTransferQueue(len(entries)-i, queued)
+		queued -= entry.Size
+		var copied bool
+		err = target.readFileList(ctx, func(m *manifest) error {
+			copied = isCopyOf(m.find(entry.Path), entry)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		if copied {
+			result.Skipped++
+			continue
+		}
+		if skipChange(ctx, decodePath(entry.Path), "migrate") {
+			continue
+		}
+		err := f.migrateEntry(ctx, target, entry)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if err != nil {
+			fs.Errorf(f, "Failed to migrate %q: %v", decodePath(entry.Path), err)
+			result.Failed = append(result.Failed, migrateFailure{Path: decodePath(entry.Path), Error: err.Error()})
+			continue
+		}
+		result.Copied++
+		result.CopiedBytes += entry.Size
+	}
+	if len(dirs) > 0 && !skipChange(ctx, target, "migrate directories") {
+		err = target.changeFileList(ctx, func(m *manifest) ([]*manifestEntry, error) {
+			for _, dir := range dirs {
+				m.addDir(dir)
+			}
+			return nil, nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to migrate directories: %w", err)
+		}
+	}
+	fs.Infof(f, "Copied %d files (%v) to chat %s, %d were there already, %d failed", result.Copied, fs.SizeSuffix(result.CopiedBytes), targetChatID, result.Skipped, len(result.Failed))
+	if !deleteSource {
+		return result, nil
+	}
+	if len(result.Failed) > 0 {
+		return result, fmt.Errorf("not deleting the source as %d files failed to migrate", len(result.Failed))
+	}
+	err = target.flushFileList(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("not deleting the source as the manifest of the target chat couldn't be saved: %w", err)
+	}
+	result.Deleted, err = f.purgeChat(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// migrateEntry copies the file described by entry to the chat target,
+// accounting it as a server-side copy
+func (f *Fs) migrateEntry(ctx context.Context, target *Fs, entry *manifestEntry) (err error) {
+	tr := accounting.Stats(ctx).NewTransferRemoteSize(decodePath(entry.Path), entry.Size, f, target)
+	defer func() {
+		tr.Done(ctx, err)
+	}()
+	in := tr.Account(ctx, nil)
+	defer fs.CheckClose(in, &err)
+	in.ServerSideTransferStart()
+	newEntry, err := target.resendDocuments(ctx, f.newObject(entry), entry.Path)
+	if err != nil {
+		return err
+	}
+	err = target.changeFileList(ctx, func(m *manifest) ([]*manifestEntry, error) {
+		return m.put(newEntry), nil
+	})
+	if err != nil {
+		if delErr := target.deleteDocuments(ctx, newEntry.MessageID, newEntry.Chunks); delErr != nil {
+			fs.Debugf(target, "Failed to delete copied document after failed migration: %v", delErr)
+		}
+		return err
+	}
+	in.ServerSideCopyEnd(entry.Size)
+	return nil
+}
+
+// isCopyOf returns true if other, which may be nil, holds the same
+// contents as entry
+func isCopyOf(other, entry *manifestEntry) bool {
+	if other == nil || other.Size != entry.Size || !other.ModTime.Equal(entry.ModTime) {
+		return false
+	}
+	return other.MD5 == "" || entry.MD5 == "" || other.MD5 == entry.MD5
+}
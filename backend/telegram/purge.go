@@ -0,0 +1,107 @@
+package telegram
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/accounting"
+)
+
+// purgeResult is the output of the purge-chat command
+type purgeResult struct {
+	Files        int            `json:"files"`                 // number of files in the manifest
+	Deleted      int            `json:"deleted"`               // number of documents deleted
+	DeletedBytes int64          `json:"deleted_bytes"`         // size of the documents deleted
+	Undeletable  []orphan       `json:"undeletable,omitempty"` // documents Telegram refused to delete
+	Unreferenced []unreferenced `json:"unreferenced"`          // documents posted by others which are left alone
+}
+
+// purgeChat deletes every document rclone posted to the chat, the
+// forum topics it made and the manifest, leaving the chat itself
+//
+// The documents are found from the manifest, including the orphans
+// and the parts of unfinished uploads, as Telegram doesn't send bots
+// the messages they post themselves. Deleting a message which is
+// already gone counts as deleting it so this can be run again if it
+// stops part way.
+func (f *Fs) purgeChat(ctx context.Context) (*purgeResult, error) {
+	err := f.forgetFileList(ctx)
+	if err != nil {
+		return nil, err
+	}
+	f.listMu.Lock()
+	defer f.listMu.Unlock()
+	m, err := f.getFileList(ctx)
+	if err != nil {
+		return nil, err
+	}
+	result := &purgeResult{
+		Files: len(m.Entries),
+	}
+	result.Unreferenced, err = f.unreferencedDocuments(ctx, manifestReferences(m))
+	if err != nil {
+		return nil, err
+	}
+	documents := slices.Concat(m.Entries, m.Orphans)
+	for _, p := range m.Pending {
+		entry := &manifestEntry{Path: p.Path}
+		for _, chunk := range p.Chunks {
+			if chunk != nil {
+				entry.Chunks = append(entry.Chunks, chunk)
+			}
+		}
+		documents = append(documents, entry)
+	}
+	if skipChange(ctx, f, fmt.Sprintf("delete %d documents, %d forum topics and the manifest", len(documents), len(m.Topics))) {
+		return result, nil
+	}
+	for _, entry := range documents {
+		if entry.MessageID == 0 && len(entry.Chunks) == 0 {
+			// Empty files and legacy entries have no message
+			continue
+		}
+		// This stops at --max-delete like deleting files does
+		err = accounting.Stats(ctx).DeleteFile(ctx, newOrphan(entry).Size)
+		if err != nil {
+			return nil, fmt.Errorf("stopped before deleting the document for %q: %w", entry.Path, err)
+		}
+		err = f.deleteDocuments(ctx, entry.MessageID, entry.Chunks)
+		if errors.Is(err, errUndeletable) {
+			fs.Logf(f, "Can't delete document for %q - delete message %d by hand: %v", entry.Path, entry.id(), err)
+			result.Undeletable = append(result.Undeletable, newOrphan(entry))
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to delete document for %q - run purge-chat again to carry on: %w", entry.Path, err)
+		}
+		result.Deleted++
+		result.DeletedBytes += newOrphan(entry).Size
+	}
+	for _, t := range m.Topics {
+		f.deleteTopic(ctx, t)
+	}
+	if m.messageID != 0 {
+		err = f.deleteMessage(ctx, m.messageID)
+		if errors.Is(err, errUndeletable) {
+			// Unpinned it won't be found so the chat starts afresh
+			fs.Logf(f, "Can't delete the manifest - delete message %d by hand: %v", m.messageID, err)
+			result.Undeletable = append(result.Undeletable, orphan{Path: fileListName, Size: m.size, MessageID: m.messageID})
+			err = f.call(ctx, "unpinChatMessage", url.Values{
+				"chat_id":    {f.opt.ChatID},
+				"message_id": {strconv.FormatInt(m.messageID, 10)},
+			}, nil)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to delete the manifest: %w", err)
+		}
+	}
+	f.forgetFileListLocked()
+	f.fileListID = 0
+	fs.Infof(f, "Deleted %d documents (%v), %d couldn't be deleted, %d posted by others left alone", result.Deleted, fs.SizeSuffix(result.DeletedBytes), len(result.Undeletable), len(result.Unreferenced))
+	return result, nil
+}
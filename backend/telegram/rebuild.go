@@ -0,0 +1,240 @@
+package telegram
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/rclone/rclone/backend/telegram/api"
+	"github.com/rclone/rclone/fs"
+)
+
+// rebuildStats counts what rebuildFileList found in the chat
+type rebuildStats struct {
+	Recovered  int // files in the new manifest
+	NoMetadata int // documents without a caption, restored by name
+	Incomplete int // chunked files missing parts, not restored
+	Superseded int // files replaced by a newer one at the same path
+}
+
+// rebuildCandidate is a file found in the chat
+type rebuildCandidate struct {
+	entry  *manifestEntry
+	newest int64 // id of the newest message carrying it
+}
+
+// rebuild makes a new manifest from the documents in the chat and
+// saves it unless dryRun is set, in which case it is returned
+func (f *Fs) rebuild(ctx context.Context, dryRun bool) (any, error) {
+	f.listMu.Lock()
+	defer f.listMu.Unlock()
+	m, stats, err := f.rebuildFileList(ctx)
+	if err != nil {
+		return nil, err
+	}
+	summary := fmt.Sprintf("Recovered %d files. %d documents had no metadata so were restored by name. Skipped %d incomplete chunked files and %d older files at the same path.",
+		stats.Recovered, stats.NoMetadata, stats.Incomplete, stats.Superseded)
+	fs.Infof(f, "%s", summary)
+	if dryRun || skipChange(ctx, fileListName, "rebuild") {
+		return m, nil
+	}
+	if f.flushTimer != nil {
+		f.flushTimer.Stop()
+		f.flushTimer = nil
+	}
+	if f.dirty {
+		fs.Logf(f, "Discarding unsaved changes to the file list")
+	}
+	// Post the new manifest rather than replacing the old one so the
+	// old one can still be found in the chat
+	_, err = f.saveFileList(ctx, m)
+	if err != nil {
+		return nil, err
+	}
+	f.fileList = m
+	f.dirty = false
+	f.toDelete = nil
+	f.readTime = time.Now()
+	return summary, nil
+}
+
+// rebuildFileList makes a manifest describing the files whose
+// documents are in the recent updates
+//
+// Telegram doesn't send bots the messages they post themselves so
+// only documents posted by other accounts are found, such as the
+// bot's documents forwarded back into the chat by a person.
+//
+// Call with listMu held.
+func (f *Fs) rebuildFileList(ctx context.Context) (*manifest, rebuildStats, error) {
+	var stats rebuildStats
+	documents, err := f.chatDocuments(ctx)
+	if err != nil {
+		return nil, stats, fmt.Errorf("failed to read documents in chat: %w", err)
+	}
+	var (
+		candidates []rebuildCandidate
+		parts      = map[documentCaption][]*api.Message{} // messages by part number for each chunked file
+		partCounts = map[documentCaption]int{}            // number of parts given by the last part of chunked files of unknown size
+		order      []documentCaption                      // chunked files in the order found
+	)
+	for _, message := range documents {
+		doc := message.File()
+		if doc.FileName == fileListName {
+			continue
+		}
+		caption := decodeCaption(message.Caption)
+		if caption == nil && doc.FileName == "" {
+			fs.Debugf(f, "Can't restore photo in message %d as it has no metadata to name it", message.MessageID)
+			continue
+		}
+		if caption == nil {
+			stats.NoMetadata++
+			candidates = append(candidates, rebuildCandidate{
+				entry:  f.documentEntry(message, nil),
+				newest: message.MessageID,
+			})
+			continue
+		}
+		if caption.Truncated {
+			fs.Logf(caption.Path, "Path was too long to fit in the caption so is missing its start")
+		}
+		if caption.Part > 0 {
+			// Parts of the same upload have the same caption apart
+			// from the part number
+			n := caption.Part
+			key := *caption.part(0)
+			key.Parts = 0
+			if _, ok := parts[key]; !ok {
+				order = append(order, key)
+			}
+			if caption.Parts > 0 {
+				partCounts[key] = caption.Parts
+			}
+			for len(parts[key]) < n {
+				parts[key] = append(parts[key], nil)
+			}
+			// A part sent again when resuming replaces the earlier one
+			parts[key][n-1] = message
+			continue
+		}
+		candidates = append(candidates, rebuildCandidate{
+			entry:  f.documentEntry(message, caption),
+			newest: message.MessageID,
+		})
+	}
+	for _, key := range order {
+		if key.Size < 0 && partCounts[key] == 0 {
+			// Older versions of rclone didn't record how many parts
+			// there are so there is no telling if the end is missing
+			fs.Logf(key.Path, "Not restoring chunked file of unknown size as its last part wasn't found")
+			stats.Incomplete++
+			continue
+		}
+		candidate, ok := chunkedCandidate(key, parts[key], partCounts[key])
+		if !ok {
+			fs.Logf(key.Path, "Not restoring chunked file as it is missing parts")
+			stats.Incomplete++
+			continue
+		}
+		candidate.entry.TopicID = f.messageTopic(parts[key][0])
+		candidates = append(candidates, candidate)
+	}
+	// Keep the newest file for each path
+	newest := map[string]rebuildCandidate{}
+	for _, candidate := range candidates {
+		old, ok := newest[candidate.entry.Path]
+		if ok {
+			stats.Superseded++
+			if old.newest > candidate.newest {
+				continue
+			}
+		}
+		newest[candidate.entry.Path] = candidate
+	}
+	m := &manifest{Version: manifestVersion}
+	// Carry on from the sequence of the current manifest, if it can
+	// be read, so other writers notice it has changed
+	if current, err := f.loadFileList(ctx); err == nil {
+		m.Sequence = current.Sequence
+	} else {
+		fs.Debugf(f, "Couldn't read current file list: %v", err)
+	}
+	for _, candidate := range newest {
+		m.add(candidate.entry)
+	}
+	slices.SortFunc(m.Entries, func(a, b *manifestEntry) int {
+		return strings.Compare(a.Path, b.Path)
+	})
+	stats.Recovered = len(m.Entries)
+	return m, stats, nil
+}
+
+// documentEntry makes the manifest entry for the file carried by
+// message, which mustn't be a part of a chunked file, from its caption
+//
+// If caption is nil the file is named after the document and dated
+// when it was posted.
+func (f *Fs) documentEntry(message *api.Message, caption *documentCaption) *manifestEntry {
+	doc := message.File()
+	entry := &manifestEntry{
+		Size:      doc.FileSize,
+		FileID:    doc.FileID,
+		MessageID: message.MessageID,
+		TopicID:   f.messageTopic(message),
+		MimeType:  doc.MimeType,
+		SentAs:    messageSentAs(message),
+	}
+	if caption == nil {
+		entry.Path = encodePath(f.opt.Enc.ToStandardName(doc.FileName))
+		entry.ModTime = message.Time()
+		return entry
+	}
+	entry.Path = caption.Path
+	entry.ModTime = caption.ModTime
+	// A photo's caption describes the image before it was recompressed
+	if entry.SentAs != sendAsPhoto {
+		entry.MD5 = caption.MD5
+		if caption.Size >= 0 {
+			entry.Size = caption.Size
+		}
+	}
+	return entry
+}
+
+// chunkedCandidate makes the candidate for the chunked file described
+// by caption from the messages carrying its parts in order
+//
+// count is the number of parts there should be if the size of the
+// file isn't known. It returns false if any parts are missing.
+func chunkedCandidate(caption documentCaption, messages []*api.Message, count int) (candidate rebuildCandidate, ok bool) {
+	entry := &manifestEntry{
+		Path:    caption.Path,
+		ModTime: caption.ModTime,
+		MD5:     caption.MD5,
+	}
+	for _, message := range messages {
+		if message == nil {
+			return candidate, false
+		}
+		entry.Chunks = append(entry.Chunks, &manifestChunk{
+			Size:      message.Document.FileSize,
+			FileID:    message.Document.FileID,
+			MessageID: message.MessageID,
+		})
+		entry.Size += message.Document.FileSize
+		candidate.newest = max(candidate.newest, message.MessageID)
+	}
+	// Any parts missing from the end show up as a short file, or as
+	// too few parts if the size isn't known
+	if caption.Size >= 0 && entry.Size != caption.Size {
+		return candidate, false
+	}
+	if caption.Size < 0 && len(messages) != count {
+		return candidate, false
+	}
+	candidate.entry = entry
+	return candidate, true
+}
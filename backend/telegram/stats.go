@@ -0,0 +1,138 @@
+package telegram
+
+import (
+	"cmp"
+	"context"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+)
+
+// fileListStats is the output of the stats command
+type fileListStats struct {
+	Files        int64     `json:"files"`                // number of files
+	Dirs         int64     `json:"dirs"`                 // number of directories, made explicitly or implied by files
+	Bytes        int64     `json:"bytes"`                // total size of the files
+	Chunked      int64     `json:"chunked"`              // number of files stored in parts
+	Parts        int64     `json:"parts"`                // total number of parts of the chunked files
+	Pending      int64     `json:"pending"`              // number of unfinished chunked uploads
+	PendingParts int64     `json:"pending_parts"`        // number of parts sent of unfinished uploads
+	Orphans      int64     `json:"orphans"`              // number of documents which couldn't be deleted
+	MessageID    int64     `json:"message_id,omitempty"` // id of the message carrying the manifest, 0 if not saved yet
+	Size         int64     `json:"size"`                 // size of the manifest document
+	Sequence     int64     `json:"sequence"`             // number of times the manifest has been saved
+	Saved        time.Time `json:"saved"`                // when the manifest was last saved
+	Unsaved      bool      `json:"unsaved,omitempty"`    // set if this rclone has changes not saved yet
+}
+
+// stats describes the manifest of the whole chat
+//
+// It is worked out from the cached manifest alone so it doesn't make
+// any API calls other than reading the manifest if it isn't cached.
+func (f *Fs) stats(ctx context.Context) (*fileListStats, error) {
+	var s fileListStats
+	err := f.readFileList(ctx, func(m *manifest) error {
+		for _, entry := range m.Entries {
+			s.Files++
+			s.Bytes += entry.Size
+			if len(entry.Chunks) > 0 {
+				s.Chunked++
+				s.Parts += int64(len(entry.Chunks))
+			}
+		}
+		_, dirs, _ := m.listR("")
+		s.Dirs = int64(len(dirs))
+		for _, p := range m.Pending {
+			s.Pending++
+			for _, chunk := range p.Chunks {
+				if chunk != nil {
+					s.PendingParts++
+				}
+			}
+		}
+		s.Orphans = int64(len(m.Orphans))
+		s.MessageID = m.messageID
+		s.Size = m.size
+		s.Sequence = m.Sequence
+		s.Saved = m.savedTime
+		s.Unsaved = f.dirty
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// dirUsage is the usage of a directory in the output of the du
+// command
+type dirUsage struct {
+	Path   string `json:"path"`   // path of the directory
+	Files  int64  `json:"files"`  // number of files anywhere inside it
+	Bytes  int64  `json:"bytes"`  // total size of the files
+	Stored int64  `json:"stored"` // total size of their documents in the chat
+}
+
+// du adds up the files in dir and in each directory inside it down to
+// depth levels, or all of them if depth is negative, returning the
+// largest first
+//
+// Photos sent with send_as_media are recompressed so their size isn't
+// known and only counts towards what is stored.
+func (f *Fs) du(ctx context.Context, dir string, depth int) ([]*dirUsage, error) {
+	var usage []*dirUsage
+	err := f.readFileList(ctx, func(m *manifest) error {
+		absDir := f.absPath(dir)
+		entries, dirs, found := m.listR(absDir)
+		if !found {
+			return fs.ErrorDirNotFound
+		}
+		prefix := ""
+		if absDir != "" {
+			prefix = absDir + "/"
+		}
+		// Directories are keyed by their path relative to dir
+		byDir := map[string]*dirUsage{}
+		get := func(key string) *dirUsage {
+			u := byDir[key]
+			if u == nil {
+				u = &dirUsage{Path: path.Join(dir, decodePath(key))}
+				byDir[key] = u
+				usage = append(usage, u)
+			}
+			return u
+		}
+		get("")
+		for _, subDir := range dirs {
+			key := strings.TrimPrefix(subDir, prefix)
+			if depth < 0 || strings.Count(key, "/") < depth {
+				get(key)
+			}
+		}
+		for _, entry := range entries {
+			size := entry.Size
+			if entry.SentAs == sendAsPhoto {
+				size = 0
+			}
+			// Add the entry to every directory holding it
+			names := strings.Split(strings.TrimPrefix(entry.Path, prefix), "/")
+			for i := 0; i < len(names) && (depth < 0 || i <= depth); i++ {
+				u := get(strings.Join(names[:i], "/"))
+				u.Files++
+				u.Bytes += size
+				u.Stored += entry.Size
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	slices.SortFunc(usage, func(a, b *dirUsage) int {
+		return cmp.Or(cmp.Compare(b.Bytes, a.Bytes), strings.Compare(a.Path, b.Path))
+	})
+	return usage, nil
+}
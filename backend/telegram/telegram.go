@@ -0,0 +1,3192 @@
+// Package telegram provides an interface to a Telegram chat used as
+// file storage via the Telegram Bot API.
+package telegram
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/rclone/rclone/backend/telegram/api"
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/accounting"
+	"github.com/rclone/rclone/fs/config"
+	"github.com/rclone/rclone/fs/config/configmap"
+	"github.com/rclone/rclone/fs/config/configstruct"
+	"github.com/rclone/rclone/fs/config/obscure"
+	"github.com/rclone/rclone/fs/fserrors"
+	"github.com/rclone/rclone/fs/hash"
+	"github.com/rclone/rclone/fs/list"
+	"github.com/rclone/rclone/fs/operations"
+	"github.com/rclone/rclone/lib/atexit"
+	"github.com/rclone/rclone/lib/encoder"
+	"github.com/rclone/rclone/lib/pacer"
+	"github.com/rclone/rclone/lib/readers"
+	"github.com/rclone/rclone/lib/rest"
+)
+
+const (
+	rootURL          = "https://api.telegram.org"
+	fileListName     = "filelist.json"    // name of the document holding the file list
+	manifestMimeType = "application/json" // MIME type of the manifest document
+	maxNameLength    = 255                // longest document name in bytes Telegram keeps
+
+	defaultChunkSize = 20 * fs.Mebi // the 20 MB download limit for bots
+
+	defaultMinSleep = fs.Duration(35 * time.Millisecond) // about 30 requests a second, the global limit for bots
+	maxSleep        = 2 * time.Second
+	decayConstant   = 2 // bigger for slower decay, exponential
+
+	defaultFlushInterval = fs.Duration(10 * time.Second)
+	defaultCacheTime     = fs.Duration(time.Minute)
+	defaultConcurrency   = 4
+	defaultMaxAge        = 24 * time.Hour
+	finishTimeout        = 30 * time.Second // how long to carry on saving what was sent once cancelled
+
+	maxUpdates = 100 // most updates getUpdates returns at once
+)
+
+// Values of merge_conflicts
+const (
+	conflictsKeep   = "keep"   // keep both versions, ours renamed
+	conflictsNewest = "newest" // keep the newer version only
+)
+
+// Register with Fs
+func init() {
+	fs.Register(&fs.RegInfo{
+		Name:        "telegram",
+		Description: "Telegram",
+		NewFs:       NewFs,
+		Config:      Config,
+		CommandHelp: commandHelp,
+		MetadataInfo: &fs.MetadataInfo{
+			System: systemMetadataInfo,
+			Help:   metadataHelp,
+		},
+		Options: []fs.Option{{
+			Name: "bot_token",
+			Help: `Bot API token.
+
+Create a bot by talking to @BotFather in Telegram and paste the token
+it gives you here. It looks like 123456789:AAHdqTcvCH1vGWJxfSeofSAs0K5PALDsaw.`,
+			Required:   true,
+			IsPassword: true,
+		}, {
+			Name: "chat_id",
+			Help: `ID of the chat to store files in.
+
+This is the numeric ID of the group, supergroup or channel the bot
+posts documents to, for example -1001234567890. Public channels may
+also be given as @channelusername.
+
+The bot must be a member of the chat and be allowed to post messages.
+
+Leave this blank to choose from the chats the bot has seen recently.`,
+			Sensitive: true,
+		}, {
+			Name: "chats",
+			Help: `Chats to use as the top level directories of the remote.
+
+Instead of chat_id, give a comma separated list of names and chat IDs
+like "photos=-100111,docs=-100222". The root of the remote then lists
+one directory for each name and everything in it is stored in that
+chat, each with its own manifest.`,
+			Sensitive: true,
+			Advanced:  true,
+		}, {
+			Name: "chunk_size",
+			Help: `Files larger than this are uploaded in chunks of this size.
+
+The Bot API doesn't let bots download documents larger than 20 MB so
+larger files are split into parts which are uploaded as separate
+documents named like file.part0001. Reading the file joins the parts
+back together.
+
+A self-hosted Bot API server (see base_url) accepts documents up to
+2 GB so this can be raised to 2000Mi to upload most files whole.`,
+			Default:  defaultChunkSize,
+			Advanced: true,
+		}, {
+			Name: "upload_concurrency",
+			Help: `Concurrency for chunked uploads.
+
+This is the number of parts of the same file which are uploaded at
+the same time. Each part is read into memory before it is sent, so it
+can be sent again if that fails, which uses up to
+upload_concurrency * chunk_size of memory for each transfer.
+
+Set to 1 to send the parts one after another, which is best with a
+large chunk_size.`,
+			Default:  defaultConcurrency,
+			Advanced: true,
+		}, {
+			Name: "write_captions",
+			Help: `Describe each document in the caption of its message.
+
+The path, size, modification time and MD5 of the file are written as
+JSON in the caption of each message carrying a document, so the files
+can be recovered if the manifest is lost. The manifest is still used
+for everything else.`,
+			Default:  true,
+			Advanced: true,
+		}, {
+			Name: "silent",
+			Help: `Send documents without notifying the members of the chat.
+
+Otherwise every file uploaded notifies everyone in the chat. The
+manifest is always sent silently.`,
+			Default:  true,
+			Advanced: true,
+		}, {
+			Name: "protect_content",
+			Help: `Stop the documents sent being forwarded or saved.
+
+Members of the chat can still download them in the Telegram apps but
+can't forward them out of the chat. rclone can still read them.`,
+			Default:  false,
+			Advanced: true,
+		}, {
+			Name: "use_topics",
+			Help: `Use the forum topics of the chat as top level directories.
+
+Documents uploaded to a top level directory are posted in a topic of
+the same name, which is made when needed. Files in the root are posted
+in the General topic. The chat must be a supergroup with topics
+enabled and the bot must be allowed to manage topics.`,
+			Default:  false,
+			Advanced: true,
+		}, {
+			Name: "send_as_media",
+			Help: `Send media files so Telegram shows them inline.
+
+Normally every file is sent as a document, which Telegram shows as a
+plain attachment. This sends files by their MIME type as videos, audio
+or photos instead so they can be previewed and played in the chat.
+Anything else, and anything too big to send as a photo, is still sent
+as a document.
+
+Telegram recompresses photos so the copy in the chat isn't the
+original. Files sent as photos are listed without a size or hash and
+read back as the recompressed JPEG.`,
+			Default: sendMediaNone,
+			Examples: []fs.OptionExample{{
+				Value: sendMediaNone,
+				Help:  "Send everything as documents so it is stored unchanged.",
+			}, {
+				Value: sendMediaVideoAudio,
+				Help:  "Send MP4 videos and MP3 and M4A audio as media.\nThese are stored unchanged.",
+			}, {
+				Value: sendMediaAll,
+				Help:  "Send JPEG, PNG and WebP images as photos as well.\nThe images are recompressed so aren't stored unchanged.",
+			}},
+			Exclusive: true,
+			Advanced:  true,
+		}, {
+			Name: "pacer_min_sleep",
+			Help: `Minimum time to sleep between API calls.
+
+Telegram also limits bots to about 20 messages a minute in a group.
+When a limit is hit Telegram says how long to wait and rclone waits
+for exactly that long before retrying.`,
+			Default:  defaultMinSleep,
+			Advanced: true,
+		}, {
+			Name: "manifest_flush_interval",
+			Help: `How long to wait before saving changes to the manifest.
+
+Changes to the manifest are batched up and saved this long after the
+first one, and when rclone finishes, which saves a lot of API calls
+when uploading many files. Set to 0 to save the manifest after every
+change.`,
+			Default:  defaultFlushInterval,
+			Advanced: true,
+		}, {
+			Name: "manifest_cache_time",
+			Help: `How long to use the manifest before reading it again.
+
+The manifest is read once and then used for listings until it is this
+old, so changes saved by other rclone processes can take this long to
+show up. Changes made by this rclone are always seen straight away.
+Set to 0 to read the manifest again for every listing.`,
+			Default:  defaultCacheTime,
+			Advanced: true,
+		}, {
+			Name: "merge_conflicts",
+			Help: `What to do when two rclones change the same file at once.
+
+Changes saved by other rclone processes since the manifest was read are
+merged in when it is saved. This chooses what happens to a file both
+changed if their contents differ.`,
+			Default: conflictsKeep,
+			Examples: []fs.OptionExample{{
+				Value: conflictsKeep,
+				Help:  "Keep both, saving ours as name.conflict-<host>-<time>.\nCounts as an error so a sync reports it.",
+			}, {
+				Value: conflictsNewest,
+				Help:  "Keep the newest change and delete the other.",
+			}},
+			Exclusive: true,
+			Advanced:  true,
+		}, {
+			Name: "import_documents",
+			Help: `Add documents other people post to the chat to the manifest.
+
+While rclone is polling for changes, as rclone mount does, documents
+posted to the chat by other accounts are added to the manifest so they
+show up as files. Documents sent by rclone, for example forwarded back
+into the chat, go back to the path in their caption. Others are put in
+the root of the chat, or in the directory of their topic with
+use_topics, named after the document. Documents whose name is already
+in use are left out.
+
+The bot only sees the messages other people post in a group if it is
+an admin or its privacy mode is turned off with @BotFather.`,
+			Default:  false,
+			Advanced: true,
+		}, {
+			Name: "base_url",
+			Help: `URL of the Bot API server.
+
+Leave this alone to use Telegram's servers. Set it to the URL of a
+self-hosted telegram-bot-api server, for example http://localhost:8081,
+to get rid of the limits on the size of documents.
+
+If the server is run with --local and on the same machine as rclone
+documents are read straight from its working directory.`,
+			Default:  rootURL,
+			Advanced: true,
+		}, {
+			Name: "skip_verify",
+			Help: `Don't check the bot token and chat when starting.
+
+Normally rclone checks the bot token is valid and the bot can see the
+chat before doing anything else so mistakes in the config are
+reported straight away. Set this to save the API calls this takes.`,
+			Default:  false,
+			Advanced: true,
+		}, {
+			Name: "assume_full_access",
+			Help: `Don't check what the bot is allowed to do in the chat.
+
+When the chat is a channel rclone checks the bot has the "Delete
+messages" admin right when starting. Without it files can be uploaded
+and read but moving and deleting them is turned off, as the documents
+couldn't be deleted. Set this to skip the check, for example if
+Telegram reports the bot's rights wrongly.`,
+			Default:  false,
+			Advanced: true,
+		}, {
+			Name:     config.ConfigEncoding,
+			Help:     config.ConfigEncodingHelp,
+			Advanced: true,
+			// Document names are the whole path so slashes must be
+			// encoded. Telegram drops control characters and spaces
+			// at either end of names.
+			Default: (encoder.EncodeSlash |
+				encoder.EncodeCtl |
+				encoder.EncodeDel |
+				encoder.EncodeLeftSpace |
+				encoder.EncodeRightSpace |
+				encoder.EncodeInvalidUtf8),
+		}},
+	})
+}
+
+// Options defines the configuration for this backend
+type Options struct {
+	BotToken              string               `config:"bot_token"`
+	ChatID                string               `config:"chat_id"`
+	Chats                 string               `config:"chats"`
+	ChunkSize             fs.SizeSuffix        `config:"chunk_size"`
+	UploadConcurrency     int                  `config:"upload_concurrency"`
+	WriteCaptions         bool                 `config:"write_captions"`
+	Silent                bool                 `config:"silent"`
+	ProtectContent        bool                 `config:"protect_content"`
+	UseTopics             bool                 `config:"use_topics"`
+	SendAsMedia           string               `config:"send_as_media"`
+	PacerMinSleep         fs.Duration          `config:"pacer_min_sleep"`
+	ManifestFlushInterval fs.Duration          `config:"manifest_flush_interval"`
+	ManifestCacheTime     fs.Duration          `config:"manifest_cache_time"`
+	MergeConflicts        string               `config:"merge_conflicts"`
+	ImportDocuments       bool                 `config:"import_documents"`
+	BaseURL               string               `config:"base_url"`
+	SkipVerify            bool                 `config:"skip_verify"`
+	AssumeFullAccess      bool                 `config:"assume_full_access"`
+	Enc                   encoder.MultiEncoder `config:"encoding"`
+}
+
+// Fs represents a Telegram chat used as storage
+type Fs struct {
+	name     string        // name of this remote
+	root     string        // the path we are working on
+	opt      Options       // parsed options
+	features *fs.Features  // optional features
+	srv      *rest.Client  // the connection to the server
+	pacer    *fs.Pacer     // pacer for API calls
+	endpoint string        // root URL of the Bot API
+	botName  string        // username of the bot, if known
+	chat     string        // name of the chat in chats, if used, which prefixes all paths
+	saves    *atomic.Int64 // manifests saved by this process for the chat
+	noDelete error         // why the bot can't delete messages, nil if it can
+
+	listMu     sync.Mutex       // protects the fields below
+	fileList   *manifest        // cached manifest, nil if not read yet
+	readTime   time.Time        // when fileList was last known to be current
+	dirty      bool             // set if fileList has unsaved changes
+	toDelete   []*manifestEntry // documents to delete once fileList is saved
+	fileListID int64            // id of the message last seen carrying the manifest, 0 if none
+	readSaves  int64            // value of saves when fileList was last known to be current
+	flushTimer *time.Timer      // pending save of fileList, if any
+	atexit     atexit.FnHandle  // saves fileList if rclone is interrupted, if registered
+}
+
+// Object describes a file stored in the chat
+type Object struct {
+	fs        *Fs              // what this object is part of
+	remote    string           // The remote path
+	size      int64            // size of the object
+	modTime   time.Time        // modification time of the object
+	fileID    string           // Telegram file_id of the document, if known
+	messageID int64            // id of the message carrying the document
+	chunks    []*manifestChunk // parts of the object if it was chunked
+	md5       string           // hex MD5 of the content, if known
+	mimeType  string           // MIME type of the content, if known
+	sentAs    string           // how the document was sent if not with sendDocument
+	metadata  fs.Metadata      // rclone metadata other than mtime and content-type, if any
+}
+
+// ------------------------------------------------------------
+
+// Name of the remote (as passed into NewFs)
+func (f *Fs) Name() string {
+	return f.name
+}
+
+// Root of the remote (as passed into NewFs)
+func (f *Fs) Root() string {
+	return f.root
+}
+
+// String converts this Fs to a string
+func (f *Fs) String() string {
+	if f.botName != "" {
+		return fmt.Sprintf("telegram @%s root '%s'", f.botName, f.root)
+	}
+	return fmt.Sprintf("telegram root '%s'", f.root)
+}
+
+// Features returns the optional features of this Fs
+func (f *Fs) Features() *fs.Features {
+	return f.features
+}
+
+// Precision of the remote
+//
+// Modification times are kept in the manifest to the nanosecond.
+func (f *Fs) Precision() time.Duration {
+	return time.Nanosecond
+}
+
+// Hashes returns the supported hash types
+func (f *Fs) Hashes() hash.Set {
+	return hash.Set(hash.MD5)
+}
+
+// checkUploadChunkSize checks cs can be used as the chunk_size
+func checkUploadChunkSize(cs fs.SizeSuffix) error {
+	if cs <= 0 {
+		return fmt.Errorf("chunk_size must be positive, got %v", cs)
+	}
+	return nil
+}
+
+// setUploadChunkSize sets the chunk_size returning the old one
+func (f *Fs) setUploadChunkSize(cs fs.SizeSuffix) (old fs.SizeSuffix, err error) {
+	err = checkUploadChunkSize(cs)
+	if err == nil {
+		old, f.opt.ChunkSize = f.opt.ChunkSize, cs
+	}
+	return
+}
+
+// NewFs constructs an Fs from the path, container:path
+func NewFs(ctx context.Context, name, root string, m configmap.Mapper) (fs.Fs, error) {
+	opt, err := parseOptions(m)
+	if err != nil {
+		return nil, err
+	}
+	if opt.Chats != "" {
+		if opt.ChatID != "" {
+			return nil, errors.New("only one of chat_id and chats can be set")
+		}
+		return newMultiFs(ctx, name, root, opt)
+	}
+	if opt.ChatID == "" {
+		return nil, errors.New("chat_id not set in config")
+	}
+	f := newFs(ctx, name, root, opt)
+	err = f.check(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return f.checkRoot(ctx)
+}
+
+// check checks the chat can be used as configured
+func (f *Fs) check(ctx context.Context) error {
+	if !f.opt.SkipVerify {
+		err := f.verify(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	if f.opt.UseTopics {
+		return f.checkForum(ctx)
+	}
+	return nil
+}
+
+// checkRoot returns f, or f pointing at the parent directory and
+// fs.ErrorIsFile if the root is a file
+func (f *Fs) checkRoot(ctx context.Context) (fs.Fs, error) {
+	if f.root != "" {
+		isFile, err := f.rootIsFile(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if isFile {
+			// return an error with an fs which points to the parent
+			return f, fs.ErrorIsFile
+		}
+	}
+	return f, nil
+}
+
+// parseOptions reads the config into an Options struct, checking
+// everything but the chat_id which is chosen in the config flow
+func parseOptions(m configmap.Mapper) (*Options, error) {
+	opt := new(Options)
+	err := configstruct.Set(m, opt)
+	if err != nil {
+		return nil, err
+	}
+	if opt.BotToken == "" {
+		return nil, errors.New("bot_token not set in config")
+	}
+	opt.BotToken, err = revealToken(opt.BotToken)
+	if err != nil {
+		return nil, err
+	}
+	err = checkUploadChunkSize(opt.ChunkSize)
+	if err != nil {
+		return nil, err
+	}
+	switch opt.SendAsMedia {
+	case "":
+		opt.SendAsMedia = sendMediaNone
+	case sendMediaNone, sendMediaVideoAudio, sendMediaAll:
+	default:
+		return nil, fmt.Errorf("send_as_media must be %q, %q or %q, got %q", sendMediaNone, sendMediaVideoAudio, sendMediaAll, opt.SendAsMedia)
+	}
+	opt.BaseURL = strings.TrimRight(opt.BaseURL, "/")
+	baseURL, err := url.Parse(opt.BaseURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid base_url: %w", err)
+	}
+	if (baseURL.Scheme != "http" && baseURL.Scheme != "https") || baseURL.Host == "" {
+		return nil, fmt.Errorf("invalid base_url %q: must be an http or https URL", opt.BaseURL)
+	}
+	return opt, nil
+}
+
+// newFs makes an Fs from opt without contacting the server
+func newFs(ctx context.Context, name, root string, opt *Options) *Fs {
+	f := &Fs{
+		name:  name,
+		root:  strings.Trim(root, "/"),
+		opt:   *opt,
+		srv:   rest.NewClient(newClient(ctx, opt.BotToken)),
+		pacer: fs.NewPacer(ctx, pacer.NewDefault(pacer.MinSleep(opt.PacerMinSleep), pacer.MaxSleep(maxSleep), pacer.DecayConstant(decayConstant))),
+		saves: chatSaves(opt.BaseURL, opt.ChatID),
+	}
+	f.setEndpoint(opt.BaseURL)
+	f.features = (&fs.Features{
+		CanHaveEmptyDirectories: true,
+		ReadMimeType:            true,
+		WriteMimeType:           true,
+		ReadMetadata:            true,
+		WriteMetadata:           true,
+		UserMetadata:            true,
+		ServerSideAcrossConfigs: true,
+	}).Fill(ctx, f)
+	return f
+}
+
+// savesMu protects saves
+var (
+	savesMu sync.Mutex
+	saves   = map[string]*atomic.Int64{}
+)
+
+// chatSaves returns the count of manifests this process has saved for
+// the chat
+//
+// Each root of a remote, and each alias pointing into it, gets an Fs
+// of its own with its own cached manifest. The count is shared by them
+// all so they know to read the manifest again when another changes it.
+func chatSaves(baseURL, chatID string) *atomic.Int64 {
+	savesMu.Lock()
+	defer savesMu.Unlock()
+	key := baseURL + " " + chatID
+	count := saves[key]
+	if count == nil {
+		count = new(atomic.Int64)
+		saves[key] = count
+	}
+	return count
+}
+
+// Config chooses the chat_id from the chats the bot has seen if it
+// wasn't entered
+func Config(ctx context.Context, name string, m configmap.Mapper, config fs.ConfigIn) (*fs.ConfigOut, error) {
+	switch config.State {
+	case "":
+		if chatID, _ := m.Get("chat_id"); chatID != "" {
+			return nil, nil
+		}
+		if chats, _ := m.Get("chats"); chats != "" {
+			return nil, nil
+		}
+		return fs.ConfigGoto("choose_chat")
+	case "choose_chat":
+		opt, err := parseOptions(m)
+		if err != nil {
+			return nil, err
+		}
+		chats, err := newFs(ctx, name, "", opt).recentChats(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the chats the bot has seen: %w", err)
+		}
+		if len(chats) == 0 {
+			return fs.ConfigInput("chat_id", "config_chat_id", `The bot hasn't seen any chats recently.
+
+Add the bot to the group or channel, send a message there and run
+"rclone config" again to choose it. Or enter the ID of the chat here.`)
+		}
+		return fs.ConfigChoose("chat_id", "config_chat_id", `Chat to store files in.
+
+These are the chats the bot has seen in the last 24 hours. If the chat
+isn't here, send a message in it and run "rclone config" again, or
+enter its ID.`, len(chats), func(i int) (string, string) {
+			return strconv.FormatInt(chats[i].ID, 10), chatName(&chats[i])
+		})
+	case "chat_id":
+		m.Set("chat_id", config.Result)
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unknown state %q", config.State)
+}
+
+// recentChats returns the chats which the bot has seen in the recent
+// updates, most recent first
+func (f *Fs) recentChats(ctx context.Context) (chats []api.Chat, err error) {
+	var updates []api.Update
+	err = f.call(ctx, "getUpdates", nil, &updates)
+	if err != nil {
+		return nil, err
+	}
+	seen := map[int64]struct{}{}
+	for i := len(updates) - 1; i >= 0; i-- {
+		var chat *api.Chat
+		if message := updates[i].GetMessage(); message != nil {
+			chat = &message.Chat
+		} else if member := updates[i].MyChatMember; member != nil {
+			chat = &member.Chat
+		} else {
+			continue
+		}
+		if _, ok := seen[chat.ID]; ok {
+			continue
+		}
+		seen[chat.ID] = struct{}{}
+		chats = append(chats, *chat)
+	}
+	return chats, nil
+}
+
+// chatName describes chat for the user
+func chatName(chat *api.Chat) string {
+	name := chat.Title
+	if name == "" {
+		name = chat.FirstName
+	}
+	if chat.Username != "" {
+		name += " @" + chat.Username
+	}
+	return fmt.Sprintf("%s (%s)", name, chat.Type)
+}
+
+// verify checks the bot token is valid and the bot can see the chat,
+// recording the name of the bot
+func (f *Fs) verify(ctx context.Context) error {
+	var me api.User
+	err := f.call(ctx, "getMe", nil, &me)
+	if isStatus(err, http.StatusUnauthorized) || isStatus(err, http.StatusNotFound) {
+		return fmt.Errorf("invalid bot token: %w", err)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to check bot token: %w", err)
+	}
+	f.botName = me.Username
+	chat, err := f.getChat(ctx)
+	if err != nil {
+		return fmt.Errorf("bot @%s can't access chat %s - check chat_id and that the bot is a member of the chat: %w", f.botName, f.opt.ChatID, err)
+	}
+	if !f.opt.AssumeFullAccess {
+		f.checkRights(ctx, me.ID, chat)
+	}
+	return nil
+}
+
+// checkRights checks the bot can delete messages in the chat
+//
+// Bots can only delete messages in a channel with the "Delete
+// messages" admin right. Without it moving and deleting files, which
+// deletes their documents, is turned off so it fails straight away
+// rather than part way through. Files can still be uploaded and read.
+func (f *Fs) checkRights(ctx context.Context, botID int64, chat *api.ChatFullInfo) {
+	if chat.Type != "channel" {
+		return
+	}
+	member, err := f.getChatMember(ctx, botID)
+	if err != nil {
+		fs.Debugf(f, "Couldn't read the bot's rights in the chat: %v", err)
+		return
+	}
+	if member.Status == "creator" || member.CanDeleteMessages {
+		return
+	}
+	f.noDelete = fmt.Errorf(`%w: bot @%s doesn't have the "Delete messages" admin right in the channel`, fs.ErrorPermissionDenied, f.botName)
+	f.features.Move = nil
+	f.features.Purge = nil
+	fs.Logf(f, `Bot can't delete messages in the channel so files can be uploaded and read but not moved or deleted - give it the "Delete messages" admin right to use them`)
+}
+
+// getChatMember reads the membership of the chat of the user given
+func (f *Fs) getChatMember(ctx context.Context, userID int64) (*api.ChatMember, error) {
+	var member api.ChatMember
+	err := f.call(ctx, "getChatMember", url.Values{
+		"chat_id": {f.opt.ChatID},
+		"user_id": {strconv.FormatInt(userID, 10)},
+	}, &member)
+	if err != nil {
+		return nil, err
+	}
+	return &member, nil
+}
+
+// plainToken matches a bot token which hasn't been obscured
+var plainToken = regexp.MustCompile(`^[0-9]+:[A-Za-z0-9_-]+$`)
+
+// revealToken decodes the obscured bot token from the config
+//
+// Tokens from configs made before it was obscured are used as they are.
+func revealToken(token string) (string, error) {
+	revealed, err := obscure.Reveal(token)
+	if err == nil {
+		return revealed, nil
+	}
+	if plainToken.MatchString(token) {
+		fs.Logf(nil, "telegram: bot_token isn't obscured in the config - run \"rclone config\" and enter it again to obscure it")
+		return token, nil
+	}
+	return "", fmt.Errorf("failed to decrypt bot_token: %w", err)
+}
+
+// rootIsFile checks whether the root is a file in the manifest and
+// if so points the root at its parent directory
+func (f *Fs) rootIsFile(ctx context.Context) (isFile bool, err error) {
+	err = f.readFileList(ctx, func(m *manifest) error {
+		isFile = m.find(f.absPath("")) != nil
+		return nil
+	})
+	if err != nil || !isFile {
+		return false, err
+	}
+	f.root = path.Dir(f.root)
+	if f.root == "." {
+		f.root = ""
+	}
+	return true, nil
+}
+
+// absPath returns the path in the manifest of remote, which is
+// relative to the root
+//
+// If the chat is one of several the root includes its name, which
+// isn't part of the path in its manifest.
+func (f *Fs) absPath(remote string) string {
+	absPath := path.Join(f.root, remote)
+	if f.chat != "" {
+		if absPath == f.chat {
+			absPath = ""
+		} else {
+			absPath = strings.TrimPrefix(absPath, f.chat+"/")
+		}
+	}
+	return encodePath(absPath)
+}
+
+// relPath returns the path relative to the root of the manifest path
+// given, which must be inside the root
+func (f *Fs) relPath(absPath string) string {
+	absPath = decodePath(absPath)
+	if f.chat != "" {
+		absPath = path.Join(f.chat, absPath)
+	}
+	if f.root == "" {
+		return absPath
+	}
+	return strings.TrimPrefix(absPath, f.root+"/")
+}
+
+// encodePath quotes any invalid UTF-8, which JSON can't hold, in the
+// path of a file so it is kept exactly in the manifest and captions
+//
+// Paths which are valid and don't have the quote character in are
+// left alone so the paths in existing manifests don't change.
+func encodePath(p string) string {
+	if utf8.ValidString(p) && !strings.ContainsRune(p, encoder.QuoteRune) {
+		return p
+	}
+	return encoder.EncodeInvalidUtf8.Encode(p)
+}
+
+// decodePath reverses encodePath
+func decodePath(p string) string {
+	if !strings.ContainsRune(p, encoder.QuoteRune) {
+		return p
+	}
+	return encoder.EncodeInvalidUtf8.Decode(p)
+}
+
+// setEndpoint sets the root URL of the Bot API
+//
+// Methods are called relative to the root with the bot token added.
+func (f *Fs) setEndpoint(endpoint string) {
+	f.endpoint = endpoint
+	f.srv.SetRoot(endpoint + "/bot" + f.opt.BotToken)
+}
+
+// fileURL returns the URL to download the file_path given by getFile
+func (f *Fs) fileURL(filePath string) string {
+	return f.endpoint + "/file/bot" + f.opt.BotToken + "/" + filePath
+}
+
+// retryErrorCodes is a slice of error codes that we will retry
+var retryErrorCodes = []int{
+	429, // Too Many Requests
+	500, // Internal Server Error
+	502, // Bad Gateway
+	503, // Service Unavailable
+	504, // Gateway Timeout
+}
+
+// shouldRetry returns a boolean as to whether this resp and err
+// deserve to be retried. It returns the err as a convenience
+//
+// When Telegram asks us to slow down it says for how long in
+// retry_after so the pacer is told to sleep for exactly that long.
+func shouldRetry(ctx context.Context, resp *http.Response, err error) (bool, error) {
+	if fserrors.ContextError(ctx, &err) {
+		return false, err
+	}
+	var apiErr *api.Error
+	if errors.As(err, &apiErr) && apiErr.RetryAfter() > 0 {
+		fs.Debugf(nil, "Too many requests - sleeping for %v: %v", apiErr.RetryAfter(), err)
+		return true, pacer.RetryAfterError(err, apiErr.RetryAfter())
+	}
+	return fserrors.ShouldRetry(err) || fserrors.ShouldRetryHTTP(resp, retryErrorCodes), err
+}
+
+// shouldRetryAfterWait is shouldRetry for calls made through the
+// pacer, waiting as long as Telegram asked before the call is retried
+//
+// The pacer only sleeps for retry_after before the call after the
+// retry, so without this the retry is sent straight away and refused.
+// Having waited, the pacer isn't told to wait again.
+func shouldRetryAfterWait(ctx context.Context, resp *http.Response, err error) (bool, error) {
+	retry, retryErr := shouldRetry(ctx, resp, err)
+	retryAfter, ok := pacer.IsRetryAfter(retryErr)
+	if !retry || !ok {
+		return retry, retryErr
+	}
+	select {
+	case <-ctx.Done():
+		return false, ctx.Err()
+	case <-time.After(retryAfter):
+	}
+	return true, err
+}
+
+// isStatus returns true if err is an api.Error with the error code given
+func isStatus(err error, errorCode int) bool {
+	var apiErr *api.Error
+	return errors.As(err, &apiErr) && apiErr.ErrorCode == errorCode
+}
+
+// classifyError marks the well known failures in apiErr so they are
+// handled properly by the rest of rclone
+func classifyError(apiErr *api.Error) error {
+	description := strings.ToLower(apiErr.Description)
+	switch {
+	case apiErr.ErrorCode == http.StatusUnauthorized:
+		return fserrors.FatalError(fmt.Errorf("bot_token was rejected - check it is correct: %w", apiErr))
+	case strings.Contains(description, "chat not found"):
+		return fserrors.FatalError(fmt.Errorf("chat_id not found - check it is correct and the bot is a member of the chat: %w", apiErr))
+	case apiErr.ErrorCode == http.StatusConflict:
+		return fserrors.NoRetryError(fmt.Errorf("can't read the bot's updates while it has a webhook or another program is reading them - use a separate bot for rclone: %w", apiErr))
+	case apiErr.ErrorCode == http.StatusRequestEntityTooLarge || strings.Contains(description, "file is too big"):
+		return fserrors.NoRetryError(fmt.Errorf("file is too big for the Bot API - try a smaller chunk_size: %w", apiErr))
+	}
+	return apiErr
+}
+
+// decodeResponse reads a Bot API response into result
+//
+// Failed calls return an *api.Error made from the response envelope,
+// or from the HTTP status if the body isn't an envelope.
+func decodeResponse(method string, resp *http.Response, result any) (err error) {
+	defer fs.CheckClose(resp.Body, &err)
+	var response api.Response
+	decodeErr := json.NewDecoder(resp.Body).Decode(&response)
+	if resp.StatusCode != http.StatusOK || (decodeErr == nil && !response.OK) {
+		apiErr := &api.Error{
+			Method:      method,
+			StatusCode:  resp.StatusCode,
+			ErrorCode:   response.ErrorCode,
+			Description: response.Description,
+			Parameters:  response.Parameters,
+		}
+		if apiErr.ErrorCode == 0 {
+			apiErr.ErrorCode = resp.StatusCode
+		}
+		if apiErr.Description == "" {
+			apiErr.Description = http.StatusText(resp.StatusCode)
+		}
+		return classifyError(apiErr)
+	}
+	if decodeErr != nil {
+		return fmt.Errorf("telegram %s: failed to decode response: %w", method, decodeErr)
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(response.Result, result)
+}
+
+// call calls the Bot API method with the form parameters given,
+// decoding the result into result
+func (f *Fs) call(ctx context.Context, method string, params url.Values, result any) error {
+	body := params.Encode()
+	tries := 0
+	return f.pacer.Call(func() (bool, error) {
+		countTry(ctx, &tries)
+		opts := rest.Opts{
+			Method:       "POST",
+			Path:         "/" + method,
+			Body:         strings.NewReader(body),
+			ContentType:  "application/x-www-form-urlencoded",
+			IgnoreStatus: true,
+		}
+		start := time.Now()
+		resp, err := f.srv.Call(ctx, &opts)
+		if err != nil {
+			err = fmt.Errorf("telegram %s failed: %w", method, f.redactError(err))
+		} else {
+			err = decodeResponse(method, resp, result)
+		}
+		f.logCall(method, params.Get("chat_id"), int64(len(body)), start, resp, err)
+		return shouldRetryAfterWait(ctx, resp, err)
+	})
+}
+
+// documentName returns the name to give the document carrying the file
+// at the path given
+//
+// The name is only for people looking at the chat as the path is kept
+// in the manifest, so the whole path is encoded into a single name and
+// long names lose their start rather than the file name at the end.
+// A file with the name of the manifest gets a full width dot so it
+// isn't taken for the manifest.
+func (f *Fs) documentName(filePath string) string {
+	name := f.opt.Enc.FromStandardName(decodePath(filePath))
+	for len(name) > maxNameLength {
+		_, size := utf8.DecodeRuneInString(name)
+		name = name[size:]
+	}
+	if name == fileListName {
+		name = strings.Replace(name, ".", "．", 1)
+	}
+	return name
+}
+
+// sendParams returns the parameters for posting a message to the chat
+// in the forum topic threadID, if not 0
+func (f *Fs) sendParams(threadID int64) url.Values {
+	params := url.Values{"chat_id": {f.opt.ChatID}}
+	if threadID != 0 {
+		params.Set("message_thread_id", strconv.FormatInt(threadID, 10))
+	}
+	if f.opt.Silent {
+		params.Set("disable_notification", "true")
+	}
+	if f.opt.ProtectContent {
+		params.Set("protect_content", "true")
+	}
+	return params
+}
+
+// sendDocument uploads in as a document for the file at filePath to
+// the forum topic threadID, if not 0, with caption, if not nil,
+// describing it
+//
+// Telegram records mimeType as the MIME type of the document, or
+// guesses one if it is empty.
+func (f *Fs) sendDocument(ctx context.Context, filePath string, threadID int64, caption *documentCaption, mimeType string, in io.Reader, size int64) (*api.Message, error) {
+	return f.sendMedia(ctx, sendAsDocument, filePath, threadID, caption, mimeType, in, size)
+}
+
+// sendMedia is sendDocument sending the file as kind
+func (f *Fs) sendMedia(ctx context.Context, kind string, filePath string, threadID int64, caption *documentCaption, mimeType string, in io.Reader, size int64) (*api.Message, error) {
+	params := f.sendParams(threadID)
+	if caption != nil {
+		params.Set("caption", caption.encode())
+	}
+	method, field := sendMethod(kind)
+	message, err := f.sendFile(ctx, method, field, params, f.documentName(filePath), mimeType, in, size)
+	if err != nil {
+		return nil, err
+	}
+	if message.File() == nil {
+		return nil, fmt.Errorf("telegram %s failed: no %s in reply", method, field)
+	}
+	return message, nil
+}
+
+// sendFile calls the Bot API method with params, uploading in as the
+// file parameter field called fileName with the MIME type given, if
+// any
+//
+// The request body is streamed from in. If size is known (>= 0) the
+// Content-Length of the request is set from it, otherwise the body is
+// sent with chunked encoding.
+func (f *Fs) sendFile(ctx context.Context, method, field string, params url.Values, fileName, mimeType string, in io.Reader, size int64) (message *api.Message, err error) {
+	// Only retry if the input can be rewound
+	seeker, canRetry := in.(io.Seeker)
+	call := f.pacer.CallNoRetry
+	if canRetry {
+		call = f.pacer.Call
+	}
+	tries := 0
+	err = call(func() (bool, error) {
+		countTry(ctx, &tries)
+		if canRetry {
+			_, err := seeker.Seek(0, io.SeekStart)
+			if err != nil {
+				return false, err
+			}
+		}
+		opts := rest.Opts{
+			Method:               "POST",
+			Path:                 "/" + method,
+			Body:                 in,
+			MultipartParams:      params,
+			MultipartContentName: field,
+			MultipartFileName:    fileName,
+			MultipartContentType: mimeType,
+			IgnoreStatus:         true,
+		}
+		if size >= 0 {
+			// CallJSON adds the multipart overhead to this
+			contentLength := size
+			opts.ContentLength = &contentLength
+		}
+		start := time.Now()
+		resp, err := f.srv.CallJSON(ctx, &opts, nil, nil)
+		if err != nil {
+			err = fmt.Errorf("telegram upload failed: %w", f.redactError(err))
+		} else {
+			message = new(api.Message)
+			err = decodeResponse(method, resp, message)
+		}
+		f.logCall(method, params.Get("chat_id"), size, start, resp, err)
+		return shouldRetryAfterWait(ctx, resp, err)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+// getFile resolves fileID into a File ready to be downloaded
+//
+// Telegram answers 400 Bad Request for file_ids which are unknown or
+// have expired so these return fs.ErrorObjectNotFound.
+func (f *Fs) getFile(ctx context.Context, fileID string) (*api.File, error) {
+	var file api.File
+	err := f.call(ctx, "getFile", url.Values{"file_id": {fileID}}, &file)
+	if isStatus(err, http.StatusBadRequest) {
+		return nil, fs.ErrorObjectNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &file, nil
+}
+
+// serverFilePath returns the path under the file endpoint of the
+// absolute path given by a server run with --local
+//
+// The server keeps the files for each bot in a directory named after
+// its token, which is what the file endpoint serves.
+func (f *Fs) serverFilePath(localPath string) string {
+	_, filePath, found := strings.Cut(localPath, "/"+f.opt.BotToken+"/")
+	if !found {
+		return strings.TrimPrefix(localPath, "/")
+	}
+	return filePath
+}
+
+// openLocalFile opens the file at localPath on this machine for
+// reading limit bytes from offset, or to the end if limit is -1
+func openLocalFile(localPath string, offset, limit int64) (io.ReadCloser, error) {
+	fd, err := os.Open(localPath)
+	if err != nil {
+		return nil, err
+	}
+	if offset > 0 {
+		_, err = fd.Seek(offset, io.SeekStart)
+		if err != nil {
+			_ = fd.Close()
+			return nil, err
+		}
+	}
+	if limit >= 0 {
+		return readers.NewLimitedReadCloser(fd, limit), nil
+	}
+	return fd, nil
+}
+
+// download opens the file at filePath for reading, sending the HTTP
+// headers in options
+func (f *Fs) download(ctx context.Context, filePath string, options ...fs.OpenOption) (resp *http.Response, err error) {
+	tries := 0
+	err = f.pacer.Call(func() (bool, error) {
+		countTry(ctx, &tries)
+		opts := rest.Opts{
+			Method:       "GET",
+			RootURL:      f.fileURL(filePath),
+			Options:      options,
+			IgnoreStatus: true,
+		}
+		start := time.Now()
+		resp, err = f.srv.Call(ctx, &opts)
+		if err != nil {
+			err = fmt.Errorf("telegram download failed: %w", f.redactError(err))
+			f.logCall("download", "", 0, start, resp, err)
+			return shouldRetryAfterWait(ctx, resp, err)
+		}
+		f.logCall("download", "", resp.ContentLength, start, resp, nil)
+		switch resp.StatusCode {
+		case http.StatusOK, http.StatusPartialContent:
+			return false, nil
+		case http.StatusNotFound:
+			_ = resp.Body.Close()
+			return false, fs.ErrorObjectNotFound
+		}
+		_ = resp.Body.Close()
+		return shouldRetryAfterWait(ctx, resp, fmt.Errorf("telegram download failed: %s", resp.Status))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// deleteMessage deletes the message with the id given from the chat
+//
+// Bots can't delete messages older than 48 hours in groups and
+// messages may already have been deleted by hand. Telegram replies
+// 400 Bad Request for both. A message which is already gone counts as
+// deleted, otherwise the error wraps errUndeletable.
+func (f *Fs) deleteMessage(ctx context.Context, messageID int64) error {
+	if messageID == 0 {
+		fs.Debugf(f, "No message recorded so not deleting it")
+		return nil
+	}
+	err := f.call(ctx, "deleteMessage", url.Values{
+		"chat_id":    {f.opt.ChatID},
+		"message_id": {strconv.FormatInt(messageID, 10)},
+	}, nil)
+	var apiErr *api.Error
+	if errors.As(err, &apiErr) && apiErr.ErrorCode == http.StatusBadRequest {
+		if strings.Contains(strings.ToLower(apiErr.Description), "not found") {
+			fs.Debugf(f, "Message %d was already deleted", messageID)
+			return nil
+		}
+		return fmt.Errorf("message %d: %w: %w", messageID, errUndeletable, err)
+	}
+	return err
+}
+
+// deleteDocuments deletes the message with messageID, if not 0, and
+// the messages carrying chunks
+//
+// It carries on deleting the rest if one can't be deleted and returns
+// the first error.
+func (f *Fs) deleteDocuments(ctx context.Context, messageID int64, chunks []*manifestChunk) (err error) {
+	for _, chunk := range chunks {
+		if chunkErr := f.deleteMessage(ctx, chunk.MessageID); chunkErr != nil && err == nil {
+			err = chunkErr
+		}
+	}
+	if messageID == 0 {
+		return err
+	}
+	if msgErr := f.deleteMessage(ctx, messageID); msgErr != nil && err == nil {
+		err = msgErr
+	}
+	return err
+}
+
+// isOurChat returns true if chat is the chat configured for this remote
+func (f *Fs) isOurChat(chat *api.Chat) bool {
+	return strconv.FormatInt(chat.ID, 10) == f.opt.ChatID ||
+		(chat.Username != "" && "@"+chat.Username == f.opt.ChatID)
+}
+
+// findMessage finds the newest message with a document called
+// fileName in the chat by scanning the recent updates
+//
+// Telegram only keeps updates for 24 hours so this can't find older
+// messages. It returns fs.ErrorObjectNotFound if there isn't one.
+func (f *Fs) findMessage(ctx context.Context, fileName string) (*api.Message, error) {
+	messages, err := f.recentDocuments(ctx)
+	if err != nil {
+		return nil, err
+	}
+	message, ok := messages[fileName]
+	if !ok {
+		return nil, fs.ErrorObjectNotFound
+	}
+	return message, nil
+}
+
+// recentDocuments returns the newest message carrying each document
+// posted to the chat in the recent updates, keyed by file name
+func (f *Fs) recentDocuments(ctx context.Context) (map[string]*api.Message, error) {
+	documents, err := f.chatDocuments(ctx)
+	if err != nil {
+		return nil, err
+	}
+	messages := map[string]*api.Message{}
+	for _, message := range documents {
+		if fileName := message.File().FileName; fileName != "" {
+			messages[fileName] = message
+		}
+	}
+	return messages, nil
+}
+
+// chatDocuments returns the messages carrying documents, or media sent
+// with send_as_media, posted to the chat in the recent updates, oldest
+// first
+//
+// Telegram doesn't send bots the messages they post themselves so
+// these are only the ones posted by other accounts.
+func (f *Fs) chatDocuments(ctx context.Context) (messages []*api.Message, err error) {
+	var updates []api.Update
+	err = f.call(ctx, "getUpdates", nil, &updates)
+	if err != nil {
+		return nil, err
+	}
+	// Reading further would confirm the updates read, which deletes
+	// them, so only the oldest are seen
+	if len(updates) >= maxUpdates {
+		fs.Logf(f, "Only the oldest %d recent updates can be read so documents posted since may be missed", len(updates))
+	}
+	for _, update := range updates {
+		message := update.GetMessage()
+		if message == nil || message.File() == nil || !f.isOurChat(&message.Chat) {
+			continue
+		}
+		messages = append(messages, message)
+	}
+	return messages, nil
+}
+
+// getChat reads the details of the chat
+func (f *Fs) getChat(ctx context.Context) (*api.ChatFullInfo, error) {
+	var chat api.ChatFullInfo
+	err := f.call(ctx, "getChat", url.Values{"chat_id": {f.opt.ChatID}}, &chat)
+	if err != nil {
+		return nil, err
+	}
+	return &chat, nil
+}
+
+// isFileList returns true if message carries a manifest
+func isFileList(message *api.Message) bool {
+	return message != nil && message.Document != nil && message.Document.FileName == fileListName
+}
+
+// findFileList finds the message carrying the current manifest
+//
+// The manifest message is pinned so it can be found however old it
+// is. Telegram only says which message was pinned most recently, so if
+// someone pins another message over it the manifest this Fs last saw
+// is pinned again. Failing that the recent updates are scanned for a
+// manifest. Telegram doesn't send bots their own messages so this only
+// finds one someone else posted, such as an old one forwarded into the
+// chat to restore it.
+//
+// It returns fs.ErrorObjectNotFound only if nothing is pinned and no
+// manifest can be found, as in a new chat. If another message is
+// pinned it returns an error rather than let a new manifest replace
+// the one which can't be found.
+//
+// Call with listMu held.
+func (f *Fs) findFileList(ctx context.Context) (*api.Message, error) {
+	chat, err := f.getChat(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if isFileList(chat.PinnedMessage) {
+		return chat.PinnedMessage, nil
+	}
+	if f.fileListID != 0 {
+		fs.Logf(f, "File list is no longer the newest pinned message - pinning it again")
+		err = f.pinMessage(ctx, f.fileListID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to pin file list message %d again - pin it by hand: %w", f.fileListID, err)
+		}
+		chat, err = f.getChat(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if isFileList(chat.PinnedMessage) {
+			return chat.PinnedMessage, nil
+		}
+	}
+	message, err := f.findMessage(ctx, fileListName)
+	if err == nil {
+		fs.Logf(f, "File list isn't pinned so using the newest one posted to the chat by someone else in the recent updates")
+		return message, nil
+	}
+	if err != fs.ErrorObjectNotFound {
+		return nil, err
+	}
+	if chat.PinnedMessage != nil {
+		return nil, fmt.Errorf("the newest pinned message %d in the chat isn't the file list - unpin it so the file list can be found", chat.PinnedMessage.MessageID)
+	}
+	return nil, fs.ErrorObjectNotFound
+}
+
+// pinMessage pins the message with the id given silently
+func (f *Fs) pinMessage(ctx context.Context, messageID int64) error {
+	return f.call(ctx, "pinChatMessage", url.Values{
+		"chat_id":              {f.opt.ChatID},
+		"message_id":           {strconv.FormatInt(messageID, 10)},
+		"disable_notification": {"true"},
+	}, nil)
+}
+
+// loadFileList finds the current manifest in the chat and reads it
+//
+// If no manifest has been uploaded yet it returns an empty one.
+//
+// Call with listMu held.
+func (f *Fs) loadFileList(ctx context.Context) (m *manifest, err error) {
+	message, err := f.findFileList(ctx)
+	if err == fs.ErrorObjectNotFound {
+		return &manifest{Version: manifestVersion}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	in, err := f.openDocument(ctx, message.Document.FileID, -1)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file list: %w", err)
+	}
+	defer fs.CheckClose(in, &err)
+	data, err := io.ReadAll(in)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file list: %w", err)
+	}
+	m, err = decodeManifest(data)
+	if err != nil {
+		return nil, err
+	}
+	m.messageID = message.MessageID
+	m.documentID = message.Document.FileUniqueID
+	m.size = int64(len(data))
+	m.savedTime = message.Changed()
+	f.fileListID = message.MessageID
+	m.duplicates = m.dedupe()
+	return m, nil
+}
+
+// saveFileList uploads m as the new manifest
+//
+// The document in the message carrying the current manifest is
+// replaced so the chat only ever holds one manifest. If that isn't
+// possible a new manifest is posted and pinned and the id of the
+// message carrying the old one is returned so it can be deleted.
+//
+// Telegram doesn't send bots the messages they post themselves so a
+// manifest which can't be pinned couldn't be found again. It is
+// deleted and an error returned instead.
+//
+// Call with listMu held.
+func (f *Fs) saveFileList(ctx context.Context, m *manifest) (oldMessageID int64, err error) {
+	data, err := m.encode()
+	if err != nil {
+		return 0, err
+	}
+	if m.messageID != 0 {
+		var edited *api.Message
+		edited, err = f.sendFile(ctx, "editMessageMedia", "document", url.Values{
+			"chat_id":    {f.opt.ChatID},
+			"message_id": {strconv.FormatInt(m.messageID, 10)},
+			"media":      {`{"type":"document","media":"attach://document"}`},
+		}, fileListName, manifestMimeType, bytes.NewReader(data), int64(len(data)))
+		if err == nil {
+			m.saved()
+			m.size, m.savedTime = int64(len(data)), time.Now()
+			m.documentID = ""
+			if edited != nil && edited.Document != nil {
+				m.documentID = edited.Document.FileUniqueID
+			}
+			return 0, nil
+		}
+		fs.Debugf(f, "Failed to replace file list, posting a new one: %v", err)
+	}
+	params := f.sendParams(0)
+	params.Set("disable_notification", "true")
+	message, err := f.sendFile(ctx, "sendDocument", "document", params, fileListName, manifestMimeType, bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return 0, fmt.Errorf("failed to save file list: %w", err)
+	}
+	err = f.pinMessage(ctx, message.MessageID)
+	if err != nil {
+		if delErr := f.deleteMessage(ctx, message.MessageID); delErr != nil {
+			fs.Debugf(f, "Failed to delete unpinned file list: %v", delErr)
+		}
+		return 0, fmt.Errorf("failed to pin file list - allow the bot to pin messages: %w", err)
+	}
+	m.saved()
+	m.size, m.savedTime = int64(len(data)), time.Now()
+	oldMessageID = m.messageID
+	m.messageID = message.MessageID
+	m.documentID = message.Document.FileUniqueID
+	f.fileListID = message.MessageID
+	return oldMessageID, nil
+}
+
+// getFileList returns the cached manifest, reading it if necessary
+//
+// The cached manifest is read again once it is older than
+// manifest_cache_time, or straight away if another Fs for the chat has
+// saved it since, unless it has unsaved changes, in which case it is
+// brought up to date when they are saved.
+//
+// Call with listMu held.
+func (f *Fs) getFileList(ctx context.Context) (*manifest, error) {
+	if f.fileList != nil && !f.dirty && time.Since(f.readTime) >= time.Duration(f.opt.ManifestCacheTime) {
+		fs.Debugf(f, "File list cache expired - reading it again")
+		f.forgetFileListLocked()
+	}
+	if f.fileList != nil && !f.dirty && f.saves.Load() != f.readSaves {
+		fs.Debugf(f, "File list saved by another remote for the chat - reading it again")
+		f.forgetFileListLocked()
+	}
+	if f.fileList == nil {
+		f.readSaves = f.saves.Load()
+		m, err := f.loadFileList(ctx)
+		if err != nil {
+			return nil, err
+		}
+		// Delete the documents of any duplicates dropped when the
+		// manifest is next saved without them
+		for _, entry := range m.duplicates {
+			if entry.id() != 0 {
+				f.toDelete = append(f.toDelete, entry)
+			}
+		}
+		f.fileList = m
+		f.readTime = time.Now()
+	}
+	return f.fileList, nil
+}
+
+// forgetFileListLocked forgets the cached manifest, which mustn't have
+// unsaved changes, so it is read again when next needed
+//
+// Call with listMu held.
+func (f *Fs) forgetFileListLocked() {
+	f.fileList = nil
+	// Only the documents of dropped duplicates can be waiting to be
+	// deleted and these are found again when the manifest is read
+	f.toDelete = nil
+}
+
+// readFileList calls fn with the cached manifest which it mustn't
+// modify
+func (f *Fs) readFileList(ctx context.Context, fn func(m *manifest) error) error {
+	f.listMu.Lock()
+	defer f.listMu.Unlock()
+	m, err := f.getFileList(ctx)
+	if err != nil {
+		return err
+	}
+	return fn(m)
+}
+
+// changeFileList calls change to modify the cached manifest
+//
+// The documents change returns are deleted once the change is saved.
+//
+// If manifest_flush_interval is 0 the change is saved before
+// returning, otherwise changes are batched up and saved in the
+// background.
+func (f *Fs) changeFileList(ctx context.Context, change func(m *manifest) (toDelete []*manifestEntry, err error)) error {
+	f.listMu.Lock()
+	toDelete, err := f.changeFileListLocked(ctx, change)
+	f.listMu.Unlock()
+	f.deleteOldDocuments(ctx, toDelete)
+	return err
+}
+
+// changeFileListLocked does the work of changeFileList, returning the
+// documents to delete if the change was saved
+//
+// Call with listMu held.
+func (f *Fs) changeFileListLocked(ctx context.Context, change func(m *manifest) (toDelete []*manifestEntry, err error)) ([]*manifestEntry, error) {
+	m, err := f.getFileList(ctx)
+	if err != nil {
+		return nil, err
+	}
+	toDelete, err := change(m)
+	if err != nil {
+		return nil, err
+	}
+	f.dirty = true
+	f.toDelete = append(f.toDelete, toDelete...)
+	if f.opt.ManifestFlushInterval <= 0 {
+		toDelete, err = f.flushFileListLocked(ctx)
+		if err != nil {
+			// Forget the change so the manifest is read again
+			f.fileList = nil
+			f.dirty = false
+			f.toDelete = nil
+		}
+		return toDelete, err
+	}
+	f.startFlushLocked()
+	return nil, nil
+}
+
+// startFlushLocked arranges for the unsaved changes to the manifest to
+// be saved after manifest_flush_interval, or when rclone is
+// interrupted if that is sooner
+//
+// Call with listMu held.
+func (f *Fs) startFlushLocked() {
+	if f.opt.ManifestFlushInterval > 0 && f.flushTimer == nil {
+		f.flushTimer = time.AfterFunc(time.Duration(f.opt.ManifestFlushInterval), f.backgroundFlush)
+	}
+	if f.atexit == nil {
+		f.atexit = atexit.Register(f.exitFlush)
+	}
+}
+
+// exitFlush saves the unsaved changes to the manifest when rclone is
+// interrupted so the files uploaded before then aren't lost track of
+func (f *Fs) exitFlush() {
+	ctx, cancel := context.WithTimeout(context.Background(), finishTimeout)
+	defer cancel()
+	err := f.flushFileList(ctx)
+	if err != nil {
+		fs.Errorf(f, "Failed to save file list: %v", err)
+	}
+}
+
+// finishContext returns a context for recording in the manifest what
+// has been sent while ctx was live
+//
+// It isn't cancelled with ctx, so a sync which is interrupted doesn't
+// leave documents which were sent but nothing refers to, but it gives
+// up finishTimeout after ctx is cancelled.
+func finishContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	finishCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	stop := context.AfterFunc(ctx, func() {
+		select {
+		case <-time.After(finishTimeout):
+			cancel()
+		case <-finishCtx.Done():
+		}
+	})
+	return finishCtx, func() {
+		stop()
+		cancel()
+	}
+}
+
+// backgroundFlush saves the manifest when the flush timer fires,
+// trying again later if that fails
+func (f *Fs) backgroundFlush() {
+	ctx := context.Background()
+	f.listMu.Lock()
+	f.flushTimer = nil
+	toDelete, err := f.flushFileListLocked(ctx)
+	if err != nil {
+		fs.Errorf(f, "Failed to save file list - will try again: %v", err)
+		f.flushTimer = time.AfterFunc(time.Duration(f.opt.ManifestFlushInterval), f.backgroundFlush)
+	}
+	f.listMu.Unlock()
+	f.deleteOldDocuments(ctx, toDelete)
+}
+
+// flushFileList saves the manifest now if it has unsaved changes
+func (f *Fs) flushFileList(ctx context.Context) error {
+	f.listMu.Lock()
+	if f.flushTimer != nil {
+		f.flushTimer.Stop()
+		f.flushTimer = nil
+	}
+	toDelete, err := f.flushFileListLocked(ctx)
+	f.listMu.Unlock()
+	f.deleteOldDocuments(ctx, toDelete)
+	return err
+}
+
+// flushFileListLocked saves the manifest if it has unsaved changes
+//
+// It returns the documents the manifest no longer references, and the
+// old manifest if a new one was posted, which the caller should delete
+// with deleteOldDocuments once it has released listMu.
+//
+// Call with listMu held.
+func (f *Fs) flushFileListLocked(ctx context.Context) (toDelete []*manifestEntry, err error) {
+	if !f.dirty {
+		return nil, nil
+	}
+	// Fold in any changes someone else saved since we read it
+	current, err := f.loadFileList(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if current.Sequence > f.fileList.Sequence {
+		fs.Debugf(f, "File list was saved by someone else (sequence %d > %d) - merging", current.Sequence, f.fileList.Sequence)
+		overridden, conflicts := f.fileList.merge(current, f.conflictSuffix())
+		f.toDelete = append(f.toDelete, overridden...)
+		for _, entry := range conflicts {
+			_ = accounting.Stats(ctx).Error(fmt.Errorf("someone else saved a different version of a file at the same time - ours was kept as %q", decodePath(entry.Path)))
+		}
+	}
+	oldMessageID, err := f.saveFileList(ctx, f.fileList)
+	if err != nil {
+		return nil, err
+	}
+	f.dirty = false
+	f.readTime = time.Now()
+	f.readSaves = f.saves.Add(1)
+	toDelete = f.toDelete
+	f.toDelete = nil
+	if oldMessageID != 0 {
+		toDelete = append(toDelete, &manifestEntry{Path: fileListName, MessageID: oldMessageID})
+	}
+	return toDelete, nil
+}
+
+// conflictSuffix returns what is added to the path of our change to a
+// file which someone else changed at the same time, or "" if only the
+// newest change is kept
+func (f *Fs) conflictSuffix() string {
+	if f.opt.MergeConflicts == conflictsNewest {
+		return ""
+	}
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		host = "unknown"
+	}
+	return ".conflict-" + host + "-" + time.Now().UTC().Format("20060102-150405")
+}
+
+// deleteOldDocuments deletes the documents returned by
+// flushFileListLocked
+//
+// The bot can't find its own messages again once the manifest no
+// longer refers to them, so any which can't be deleted are recorded
+// as orphans in the manifest for the cleanup command.
+//
+// Call without listMu held as each message is deleted with a separate
+// paced API call.
+func (f *Fs) deleteOldDocuments(ctx context.Context, toDelete []*manifestEntry) {
+	var orphans []*manifestEntry
+	for _, entry := range toDelete {
+		err := f.deleteDocuments(ctx, entry.MessageID, entry.Chunks)
+		if err != nil {
+			fs.Logf(f, "Failed to delete old document for %q - use the cleanup command to remove it later: %v", entry.Path, err)
+			orphans = append(orphans, entry)
+		}
+	}
+	if len(orphans) > 0 {
+		f.recordOrphans(ctx, orphans)
+	}
+}
+
+// recordOrphans records in the manifest the documents which couldn't
+// be deleted
+//
+// The change is saved with the next one, or by the flush timer or
+// Shutdown, rather than straight away so that saving it can't leave
+// more documents to delete.
+func (f *Fs) recordOrphans(ctx context.Context, orphans []*manifestEntry) {
+	f.listMu.Lock()
+	defer f.listMu.Unlock()
+	m, err := f.getFileList(ctx)
+	if err != nil {
+		fs.Errorf(f, "Failed to record %d documents which couldn't be deleted: %v", len(orphans), err)
+		return
+	}
+	for _, entry := range orphans {
+		m.addOrphan(entry)
+	}
+	f.dirty = true
+	f.startFlushLocked()
+}
+
+// forgetFileList saves any unsaved changes to the manifest then
+// forgets it so it is read again when next needed
+func (f *Fs) forgetFileList(ctx context.Context) error {
+	f.listMu.Lock()
+	if f.flushTimer != nil {
+		f.flushTimer.Stop()
+		f.flushTimer = nil
+	}
+	toDelete, err := f.flushFileListLocked(ctx)
+	if err == nil {
+		f.forgetFileListLocked()
+	}
+	f.listMu.Unlock()
+	f.deleteOldDocuments(ctx, toDelete)
+	return err
+}
+
+// DirCacheFlush forgets the cached manifest so it is read again when
+// next needed
+//
+// If it has unsaved changes it is brought up to date when they are
+// saved instead.
+func (f *Fs) DirCacheFlush() {
+	f.listMu.Lock()
+	defer f.listMu.Unlock()
+	if !f.dirty {
+		f.forgetFileListLocked()
+	}
+}
+
+// Shutdown the backend, saving any unsaved changes to the manifest
+func (f *Fs) Shutdown(ctx context.Context) error {
+	f.listMu.Lock()
+	if f.atexit != nil {
+		atexit.Unregister(f.atexit)
+		f.atexit = nil
+	}
+	f.listMu.Unlock()
+	return f.flushFileList(ctx)
+}
+
+// List the objects and directories in dir into entries.  The
+// entries can be returned in any order but should be for a
+// complete directory.
+//
+// dir should be "" to list the root, and should not have
+// trailing slashes.
+//
+// This should return ErrDirNotFound if the directory isn't
+// found.
+func (f *Fs) List(ctx context.Context, dir string) (entries fs.DirEntries, err error) {
+	err = f.readFileList(ctx, func(m *manifest) error {
+		objects, dirs, found := m.listDir(f.absPath(dir))
+		if !found {
+			return fs.ErrorDirNotFound
+		}
+		for _, subDir := range dirs {
+			entries = append(entries, fs.NewDir(f.relPath(subDir), time.Time{}))
+		}
+		for _, entry := range objects {
+			entries = append(entries, f.newObject(entry))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// newObject makes an Object from the manifest entry given
+func (f *Fs) newObject(entry *manifestEntry) *Object {
+	o := &Object{
+		fs:     f,
+		remote: f.relPath(entry.Path),
+	}
+	o.setMetaData(entry)
+	return o
+}
+
+// ListR lists the objects and directories of the Fs starting
+// from dir recursively into out.
+//
+// dir should be "" to start from the root, and should not
+// have trailing slashes.
+//
+// This should return ErrDirNotFound if the directory isn't
+// found.
+//
+// It should call callback for each tranche of entries read.
+// These need not be returned in any particular order.  If
+// callback returns an error then the listing will stop
+// immediately.
+//
+// The whole tree comes from the manifest so this needs a single read
+// of it however many directories there are.
+func (f *Fs) ListR(ctx context.Context, dir string, callback fs.ListRCallback) (err error) {
+	var entries fs.DirEntries
+	err = f.readFileList(ctx, func(m *manifest) error {
+		objects, dirs, found := m.listR(f.absPath(dir))
+		if !found {
+			return fs.ErrorDirNotFound
+		}
+		entries = make(fs.DirEntries, 0, len(dirs)+len(objects))
+		for _, subDir := range dirs {
+			entries = append(entries, fs.NewDir(f.relPath(subDir), time.Time{}))
+		}
+		for _, entry := range objects {
+			entries = append(entries, f.newObject(entry))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// Call back without holding the manifest lock
+	helper := list.NewHelper(callback)
+	for _, entry := range entries {
+		err = helper.Add(entry)
+		if err != nil {
+			return err
+		}
+	}
+	return helper.Flush()
+}
+
+// NewObject finds the Object at remote.  If it can't be found
+// it returns the error fs.ErrorObjectNotFound.
+//
+// If remote is a directory it returns fs.ErrorIsDir.
+func (f *Fs) NewObject(ctx context.Context, remote string) (o fs.Object, err error) {
+	err = f.readFileList(ctx, func(m *manifest) error {
+		entry := m.find(f.absPath(remote))
+		if entry == nil {
+			if m.isDir(f.absPath(remote)) {
+				return fs.ErrorIsDir
+			}
+			return fs.ErrorObjectNotFound
+		}
+		o = f.newObject(entry)
+		return nil
+	})
+	return o, err
+}
+
+// hashingReader works out the MD5 of what is read through it
+type hashingReader struct {
+	in     io.Reader
+	hasher *hash.MultiHasher
+}
+
+// hashingReadSeeker is a hashingReader which can be rewound
+type hashingReadSeeker struct {
+	*hashingReader
+	seeker io.Seeker
+}
+
+// newHashingReader returns a reader working out the MD5 of in
+//
+// The reader returned can be rewound if in can be so that uploads of
+// it can be retried.
+func newHashingReader(in io.Reader) (io.Reader, *hashingReader) {
+	r := &hashingReader{in: in}
+	r.reset()
+	if seeker, ok := in.(io.Seeker); ok {
+		return &hashingReadSeeker{hashingReader: r, seeker: seeker}, r
+	}
+	return r, r
+}
+
+// reset starts the hash again
+func (r *hashingReader) reset() {
+	r.hasher, _ = hash.NewMultiHasherTypes(hash.NewHashSet(hash.MD5))
+}
+
+// Read bytes, adding them to the hash
+func (r *hashingReader) Read(p []byte) (n int, err error) {
+	n, err = r.in.Read(p)
+	_, _ = r.hasher.Write(p[:n])
+	return n, err
+}
+
+// md5 returns the hex MD5 of everything read
+func (r *hashingReader) md5() string {
+	sum, _ := r.hasher.SumString(hash.MD5, false)
+	return sum
+}
+
+// Seek to the start, starting the hash again
+func (r *hashingReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	if offset != 0 || whence != io.SeekStart {
+		return 0, errors.New("can only seek to the start while hashing")
+	}
+	r.reset()
+	return r.seeker.Seek(offset, whence)
+}
+
+// upload sends the contents of in as a document and returns the
+// manifest entry describing it
+//
+// The MD5 of the contents is recorded in the entry. If src knows its
+// MD5 and it doesn't match the upload is deleted and an error returned.
+//
+// meta is the metadata read by readMetadata to record in the entry. Its
+// content-type, if set, is sent as the MIME type of the document.
+func (f *Fs) upload(ctx context.Context, in io.Reader, src fs.ObjectInfo, meta fs.Metadata) (*manifestEntry, error) {
+	mimeType := meta["content-type"]
+	if mimeType == "" {
+		mimeType = fs.MimeType(ctx, src)
+	}
+	in, hr := newHashingReader(in)
+	start := time.Now()
+	ctx, stats := withCallStats(ctx)
+	entry, err := f.uploadDocuments(ctx, in, src, mimeType)
+	if err != nil {
+		return nil, err
+	}
+	fs.Infof(src, "Uploaded as %d documents with %d retries in %v", entry.documents(), stats.retries.Load(), time.Since(start).Round(time.Millisecond))
+	entry.MD5 = hr.md5()
+	srcMD5, _ := src.Hash(ctx, hash.MD5)
+	if !hash.Equals(srcMD5, entry.MD5) {
+		if delErr := f.deleteDocuments(ctx, entry.MessageID, entry.Chunks); delErr != nil {
+			fs.Debugf(f, "Failed to delete corrupted upload of %q: %v", entry.Path, delErr)
+		}
+		if len(entry.Chunks) > 0 {
+			// Don't resume from any of the parts
+			delErr := f.changeFileList(ctx, func(m *manifest) ([]*manifestEntry, error) {
+				return m.finishPending(entry), nil
+			})
+			if delErr != nil {
+				fs.Debugf(f, "Failed to abandon corrupted upload of %q: %v", entry.Path, delErr)
+			}
+		}
+		return nil, fmt.Errorf("corrupted on transfer: MD5 hashes differ want %q vs got %q", srcMD5, entry.MD5)
+	}
+	if entry.MimeType == "" {
+		entry.MimeType = mimeType
+	}
+	entry.setMetadata(meta)
+	if entry.SentAs == sendAsPhoto {
+		// Telegram recompressed it so what is stored is a different JPEG
+		entry.MD5 = ""
+		entry.MimeType = "image/jpeg"
+	}
+	return entry, nil
+}
+
+// uploadDocuments sends in as one document or as a series of parts
+// if it is too big or its size is unknown
+func (f *Fs) uploadDocuments(ctx context.Context, in io.Reader, src fs.ObjectInfo, mimeType string) (*manifestEntry, error) {
+	remote := f.absPath(src.Remote())
+	if src.Size() == 0 {
+		// Telegram won't take empty documents so only record it
+		return &manifestEntry{Path: remote, ModTime: src.ModTime(ctx)}, nil
+	}
+	threadID, err := f.topicFor(ctx, remote)
+	if err != nil {
+		return nil, err
+	}
+	if size := src.Size(); size < 0 || size > int64(f.opt.ChunkSize) {
+		return f.uploadChunks(ctx, in, src, threadID)
+	}
+	kind := f.sendAs(mimeType, src.Size())
+	message, err := f.sendMedia(ctx, kind, remote, threadID, f.newCaption(ctx, src, remote), mimeType, in, src.Size())
+	if err != nil {
+		return nil, err
+	}
+	doc := message.File()
+	entry := &manifestEntry{
+		Path:      remote,
+		Size:      doc.FileSize,
+		ModTime:   src.ModTime(ctx),
+		FileID:    doc.FileID,
+		MessageID: message.MessageID,
+		TopicID:   threadID,
+		MimeType:  doc.MimeType,
+		SentAs:    kind,
+	}
+	if entry.Size == 0 {
+		entry.Size = src.Size()
+	}
+	return entry, nil
+}
+
+// Put the object
+//
+// Copy the reader in to the new object which is returned.
+//
+// Any existing file at the same path is replaced and its document
+// deleted once the manifest is saved.
+//
+// The new object may have been created if an error is returned
+func (f *Fs) Put(ctx context.Context, in io.Reader, src fs.ObjectInfo, options ...fs.OpenOption) (fs.Object, error) {
+	meta, err := f.readMetadata(ctx, src, options)
+	if err != nil {
+		return nil, err
+	}
+	entry, err := f.upload(ctx, in, src, meta)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := finishContext(ctx)
+	defer cancel()
+	err = f.changeFileList(ctx, func(m *manifest) ([]*manifestEntry, error) {
+		return append(m.put(entry), m.finishPending(entry)...), nil
+	})
+	if err != nil {
+		// The document couldn't be found again to clean it up as bots
+		// aren't sent their own messages. Parts of chunked files are
+		// kept so the upload can be resumed.
+		if len(entry.Chunks) == 0 && entry.MessageID != 0 {
+			if delErr := f.deleteDocuments(ctx, entry.MessageID, nil); delErr != nil {
+				fs.Debugf(f, "Failed to delete document after failed upload: %v", delErr)
+			}
+		}
+		return nil, err
+	}
+	return f.newObject(entry), nil
+}
+
+// PutStream uploads to the remote path with the modTime given of indeterminate size
+//
+// The data is uploaded in chunks as it arrives so it is never held in
+// memory or spooled to disk.
+func (f *Fs) PutStream(ctx context.Context, in io.Reader, src fs.ObjectInfo, options ...fs.OpenOption) (fs.Object, error) {
+	return f.Put(ctx, in, src, options...)
+}
+
+// Mkdir makes the directory (container, bucket)
+//
+// Directories only exist in the manifest. Ones which already exist,
+// because they have files in, aren't recorded.
+func (f *Fs) Mkdir(ctx context.Context, dir string) error {
+	dir = f.absPath(dir)
+	if f.opt.UseTopics && dir != "" {
+		// Top level directories are made with their topic
+		name, _, _ := strings.Cut(dir, "/")
+		_, err := f.ensureTopic(ctx, name)
+		if err != nil {
+			return err
+		}
+	}
+	// Parents which don't exist are made too so they are left when
+	// dir is removed
+	var missing []string
+	err := f.readFileList(ctx, func(m *manifest) error {
+		for p := dir; p != "" && !m.isDir(p); p = parentDir(p) {
+			missing = append(missing, p)
+		}
+		return nil
+	})
+	if err != nil || len(missing) == 0 {
+		return err
+	}
+	return f.changeFileList(ctx, func(m *manifest) ([]*manifestEntry, error) {
+		for _, p := range missing {
+			m.addDir(p)
+		}
+		return nil, nil
+	})
+}
+
+// Rmdir removes the directory (container, bucket) if empty
+//
+// Return an error if it doesn't exist or isn't empty
+func (f *Fs) Rmdir(ctx context.Context, dir string) error {
+	dir = f.absPath(dir)
+	if dir == "" {
+		return f.readFileList(ctx, func(m *manifest) error {
+			if !m.isEmptyDir(dir) {
+				return fs.ErrorDirectoryNotEmpty
+			}
+			return nil
+		})
+	}
+	var unused []*forumTopic
+	err := f.changeFileList(ctx, func(m *manifest) ([]*manifestEntry, error) {
+		if !m.isEmptyDir(dir) {
+			return nil, fs.ErrorDirectoryNotEmpty
+		}
+		if !m.removeDir(dir) {
+			return nil, fs.ErrorDirNotFound
+		}
+		m.keepParent(dir)
+		unused = m.unusedTopics(dir)
+		return nil, nil
+	})
+	if err != nil {
+		return err
+	}
+	return f.deleteTopics(ctx, unused)
+}
+
+// Purge deletes all the files in the directory
+//
+// The files are removed from the manifest in a single save and their
+// messages deleted afterwards. Messages which can't be deleted are
+// left in the chat.
+//
+// Optional interface: Only implement this if you have a way of
+// deleting all the files quicker than just running Remove() on the
+// result of List()
+func (f *Fs) Purge(ctx context.Context, dir string) error {
+	if f.noDelete != nil {
+		return f.noDelete
+	}
+	dir = f.absPath(dir)
+	var unused []*forumTopic
+	err := f.changeFileList(ctx, func(m *manifest) ([]*manifestEntry, error) {
+		if !m.isDir(dir) {
+			return nil, fs.ErrorDirNotFound
+		}
+		removed := m.purge(dir)
+		m.keepParent(dir)
+		unused = m.unusedTopics(dir)
+		return removed, nil
+	})
+	if err != nil {
+		return err
+	}
+	return f.deleteTopics(ctx, unused)
+}
+
+// deleteTopics deletes the forum topics which are no longer used
+//
+// The manifest is saved first so it never refers to documents in a
+// deleted topic.
+func (f *Fs) deleteTopics(ctx context.Context, topics []*forumTopic) error {
+	if len(topics) == 0 {
+		return nil
+	}
+	err := f.flushFileList(ctx)
+	if err != nil {
+		return err
+	}
+	for _, t := range topics {
+		f.deleteTopic(ctx, t)
+	}
+	return nil
+}
+
+// About gets quota information
+//
+// Telegram doesn't limit the total stored so this only reports what
+// the manifest holds for the whole chat.
+func (f *Fs) About(ctx context.Context) (usage *fs.Usage, err error) {
+	var used, objects int64
+	err = f.readFileList(ctx, func(m *manifest) error {
+		for _, entry := range m.Entries {
+			used += entry.Size
+			objects++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &fs.Usage{
+		Used:    fs.NewUsageValue(used),
+		Objects: fs.NewUsageValue(objects),
+	}, nil
+}
+
+// PublicLink generates a public link to the remote path (usually readable by anyone)
+//
+// Links are to the message carrying the document. Anyone can open
+// links to messages in public chats but those in private supergroups
+// and channels only work for their members. Telegram links don't
+// expire and can't be removed so any expiry asked for is ignored.
+func (f *Fs) PublicLink(ctx context.Context, remote string, expire fs.Duration, unlink bool) (link string, err error) {
+	if unlink {
+		return "", fmt.Errorf("telegram links can't be removed: %w", fs.ErrorNotImplemented)
+	}
+	if expire != fs.DurationOff {
+		fs.Logf(f, "Ignoring link expiry of %v as Telegram links don't expire", expire)
+	}
+	obj, err := f.NewObject(ctx, remote)
+	if errors.Is(err, fs.ErrorIsDir) {
+		return "", fs.ErrorCantShareDirectories
+	}
+	if err != nil {
+		return "", err
+	}
+	o := obj.(*Object)
+	switch {
+	case o.isEmpty():
+		return "", fmt.Errorf("can't link to %q: empty files aren't posted to the chat", remote)
+	case len(o.chunks) > 0:
+		return "", fmt.Errorf("can't link to %q: it is stored as %d separate parts", remote, len(o.chunks))
+	case o.messageID == 0:
+		return "", fmt.Errorf("can't link to %q: message not known", remote)
+	}
+	chat, err := f.getChat(ctx)
+	if err != nil {
+		return "", err
+	}
+	link, err = messageLink(chat, o.messageID)
+	if err != nil {
+		return "", fmt.Errorf("can't link to %q: %w", remote, err)
+	}
+	if chat.Username == "" {
+		fs.Logf(f, "Chat is private so only its members can open the link")
+	}
+	return link, nil
+}
+
+// UserInfo returns info about the bot and the chat it stores files in
+//
+// It doesn't need the manifest so it works before anything has been
+// stored.
+func (f *Fs) UserInfo(ctx context.Context) (map[string]string, error) {
+	var me api.User
+	err := f.call(ctx, "getMe", nil, &me)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read bot: %w", err)
+	}
+	chat, err := f.getChat(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read chat: %w", err)
+	}
+	member, err := f.getChatMember(ctx, me.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read bot's membership of chat: %w", err)
+	}
+	info := map[string]string{
+		"Bot":       "@" + me.Username,
+		"BotID":     strconv.FormatInt(me.ID, 10),
+		"ChatID":    strconv.FormatInt(chat.ID, 10),
+		"ChatType":  chat.Type,
+		"BotStatus": member.Status,
+		"Admin":     strconv.FormatBool(member.Status == "creator" || member.Status == "administrator"),
+	}
+	if chat.Title != "" {
+		info["Chat"] = chat.Title
+	}
+	if chat.Username != "" {
+		info["ChatUsername"] = "@" + chat.Username
+	}
+	if member.Status == "administrator" {
+		info["CanDeleteMessages"] = strconv.FormatBool(member.CanDeleteMessages)
+		info["CanPinMessages"] = strconv.FormatBool(member.CanPinMessages)
+	}
+	if f.opt.UseTopics {
+		info["Topics"] = strconv.FormatBool(chat.IsForum)
+	}
+	return info, nil
+}
+
+// sameChat returns true if other stores its files in the same chat
+func (f *Fs) sameChat(other *Fs) bool {
+	return f.sameBot(other) && f.opt.ChatID == other.opt.ChatID
+}
+
+// sameBot returns true if other uses the same bot, so the file_ids of
+// its documents can be sent to this chat
+func (f *Fs) sameBot(other *Fs) bool {
+	return f.opt.BotToken == other.opt.BotToken && f.endpoint == other.endpoint
+}
+
+// shareFileList prepares for a change by f involving src, another Fs
+// on the same chat
+//
+// Each Fs caches its own copy of the manifest so this makes sure both
+// start from the saved one. src should forget its copy again once the
+// change is made so it reads the result.
+func (f *Fs) shareFileList(ctx context.Context, src *Fs) error {
+	for _, g := range []*Fs{src, f} {
+		err := g.forgetFileList(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Move src to this remote using server-side move operations.
+//
+// This is stored with the remote path given.
+//
+// It returns the destination Object and a possible error.
+//
+// Documents can't be renamed so this only changes the path in the
+// manifest. Any existing file at remote is replaced.
+//
+// If it isn't possible then return fs.ErrorCantMove
+func (f *Fs) Move(ctx context.Context, src fs.Object, remote string) (fs.Object, error) {
+	srcObj, ok := src.(*Object)
+	if !ok || !f.sameChat(srcObj.fs) {
+		fs.Debugf(src, "Can't move - not same remote type")
+		return nil, fs.ErrorCantMove
+	}
+	if f.noDelete != nil {
+		return nil, f.noDelete
+	}
+	if srcObj.fs != f {
+		err := f.shareFileList(ctx, srcObj.fs)
+		if err != nil {
+			return nil, err
+		}
+		defer func() {
+			_ = srcObj.fs.forgetFileList(ctx)
+		}()
+	}
+	meta, err := f.readMetadata(ctx, src, fs.MetadataAsOpenOptions(ctx))
+	if err != nil {
+		return nil, err
+	}
+	srcPath := srcObj.fs.absPath(srcObj.remote)
+	dstPath := f.absPath(remote)
+	var moved *manifestEntry
+	err = f.changeFileList(ctx, func(m *manifest) (toDelete []*manifestEntry, err error) {
+		i := m.index(srcPath, srcObj.id())
+		if i < 0 {
+			return nil, fs.ErrorObjectNotFound
+		}
+		entry := *m.Entries[i]
+		entry.Path = dstPath
+		entry.setMetadata(meta)
+		m.remove(srcPath, srcObj.id())
+		m.keepParent(srcPath)
+		moved = &entry
+		return m.put(moved), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return f.newObject(moved), nil
+}
+
+// Copy src to this remote using server side copy operations.
+//
+// This is stored with the remote path given.
+//
+// It returns the destination Object and a possible error.
+//
+// Telegram lets a bot post a document it has already sent again by
+// its file_id so no data is transferred. This works in any chat the
+// bot is in, so files can be copied between remotes using the same
+// bot. Any existing file at remote is replaced.
+//
+// If it isn't possible then return fs.ErrorCantCopy
+func (f *Fs) Copy(ctx context.Context, src fs.Object, remote string) (fs.Object, error) {
+	srcObj, ok := src.(*Object)
+	if !ok || !f.sameBot(srcObj.fs) {
+		fs.Debugf(src, "Can't copy - not same bot")
+		return nil, fs.ErrorCantCopy
+	}
+	otherChat := !f.sameChat(srcObj.fs)
+	if otherChat && srcObj.fs.opt.ProtectContent {
+		fs.Debugf(src, "Can't copy to another chat - the source has protect_content set")
+		return nil, fs.ErrorCantCopy
+	}
+	if srcObj.fileID == "" && len(srcObj.chunks) == 0 && !srcObj.isEmpty() {
+		fs.Debugf(src, "Can't copy - file_id not known")
+		return nil, fs.ErrorCantCopy
+	}
+	meta, err := f.readMetadata(ctx, src, fs.MetadataAsOpenOptions(ctx))
+	if err != nil {
+		return nil, err
+	}
+	entry, err := f.resendDocuments(ctx, srcObj, f.absPath(remote))
+	if otherChat && isStatus(err, http.StatusBadRequest) {
+		// For instance the source chat has protected content
+		fs.Debugf(src, "Can't copy to another chat - downloading and uploading instead: %v", err)
+		return nil, fs.ErrorCantCopy
+	}
+	if err != nil {
+		return nil, err
+	}
+	entry.setMetadata(meta)
+	err = f.changeFileList(ctx, func(m *manifest) ([]*manifestEntry, error) {
+		return m.put(entry), nil
+	})
+	if err != nil {
+		if delErr := f.deleteDocuments(ctx, entry.MessageID, entry.Chunks); delErr != nil {
+			fs.Debugf(f, "Failed to delete copied document after failed copy: %v", delErr)
+		}
+		return nil, err
+	}
+	return f.newObject(entry), nil
+}
+
+// resendDocuments posts the documents carrying o to the chat again,
+// returning a manifest entry describing the copy at remote
+//
+// If this fails any documents already posted are deleted.
+func (f *Fs) resendDocuments(ctx context.Context, o *Object, remote string) (_ *manifestEntry, err error) {
+	entry := &manifestEntry{
+		Path:     remote,
+		Size:     o.size,
+		ModTime:  o.modTime,
+		MD5:      o.md5,
+		MimeType: o.mimeType,
+		Metadata: maps.Clone(o.metadata),
+	}
+	if o.isEmpty() {
+		return entry, nil
+	}
+	entry.TopicID, err = f.topicFor(ctx, remote)
+	if err != nil {
+		return nil, err
+	}
+	var caption *documentCaption
+	if f.opt.WriteCaptions {
+		caption = &documentCaption{
+			Path:    remote,
+			Size:    entry.Size,
+			ModTime: entry.ModTime,
+			MD5:     entry.MD5,
+		}
+	}
+	if len(o.chunks) == 0 {
+		message, err := f.resendDocument(ctx, o.sentAs, o.fileID, entry.TopicID, caption)
+		if err != nil {
+			return nil, err
+		}
+		entry.FileID = message.File().FileID
+		entry.SentAs = o.sentAs
+		entry.MessageID = message.MessageID
+		return entry, nil
+	}
+	defer func() {
+		if err == nil {
+			return
+		}
+		if delErr := f.deleteDocuments(ctx, 0, entry.Chunks); delErr != nil {
+			fs.Debugf(f, "Failed to delete copied parts after failed copy: %v", delErr)
+		}
+	}()
+	for i, chunk := range o.chunks {
+		message, err := f.resendDocument(ctx, sendAsDocument, chunk.FileID, entry.TopicID, caption.part(i+1))
+		if err != nil {
+			return nil, err
+		}
+		entry.Chunks = append(entry.Chunks, &manifestChunk{
+			Size:      chunk.Size,
+			FileID:    message.Document.FileID,
+			MessageID: message.MessageID,
+		})
+	}
+	return entry, nil
+}
+
+// resendDocument posts the document with fileID, which was sent as
+// kind, to the chat again in the forum topic threadID, if not 0, with
+// caption, if not nil, describing it
+func (f *Fs) resendDocument(ctx context.Context, kind string, fileID string, threadID int64, caption *documentCaption) (*api.Message, error) {
+	method, field := sendMethod(kind)
+	params := f.sendParams(threadID)
+	params.Set(field, fileID)
+	if caption != nil {
+		params.Set("caption", caption.encode())
+	}
+	var message api.Message
+	err := f.call(ctx, method, params, &message)
+	if err != nil {
+		return nil, err
+	}
+	if message.File() == nil {
+		return nil, fmt.Errorf("telegram %s failed: no %s in reply", method, field)
+	}
+	return &message, nil
+}
+
+// ------------------------------------------------------------
+
+// DirMove moves src, srcRemote to this remote at dstRemote
+// using server-side move operations.
+//
+// Will only be called if src.Fs().Name() == f.Name()
+//
+// Directories only exist in the manifest so this rewrites the paths
+// of everything inside srcRemote in a single manifest save.
+//
+// If it isn't possible then return fs.ErrorCantDirMove
+//
+// If destination exists then return fs.ErrorDirExists
+func (f *Fs) DirMove(ctx context.Context, src fs.Fs, srcRemote, dstRemote string) error {
+	srcFs, ok := src.(*Fs)
+	if !ok || !f.sameChat(srcFs) {
+		fs.Debugf(srcFs, "Can't move directory - not same remote type")
+		return fs.ErrorCantDirMove
+	}
+	srcPath := srcFs.absPath(srcRemote)
+	dstPath := f.absPath(dstRemote)
+	if srcPath == "" || strings.HasPrefix(dstPath, srcPath+"/") {
+		fs.Debugf(srcFs, "Can't move directory - destination overlaps source")
+		return fs.ErrorCantDirMove
+	}
+	if srcFs != f {
+		err := f.shareFileList(ctx, srcFs)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			_ = srcFs.forgetFileList(ctx)
+		}()
+	}
+	var renamed *forumTopic
+	err := f.changeFileList(ctx, func(m *manifest) ([]*manifestEntry, error) {
+		if !m.isDir(srcPath) {
+			return nil, fs.ErrorDirNotFound
+		}
+		if m.isDir(dstPath) || m.find(dstPath) != nil {
+			return nil, fs.ErrorDirExists
+		}
+		m.moveDir(srcPath, dstPath)
+		m.keepParent(srcPath)
+		// A top level directory moved to another keeps its topic.
+		// Otherwise the topic is kept for the documents in it.
+		if f.opt.UseTopics && !strings.Contains(srcPath, "/") && !strings.Contains(dstPath, "/") && m.findTopic(dstPath) == nil {
+			if t := m.removeTopic(srcPath); t != nil {
+				renamed = &forumTopic{Name: dstPath, ThreadID: t.ThreadID}
+				m.addTopic(renamed)
+			}
+		}
+		return nil, nil
+	})
+	if err != nil || renamed == nil {
+		return err
+	}
+	if err := f.renameTopic(ctx, renamed, dstPath); err != nil {
+		fs.Logf(f, "Topic keeps its old name: %v", err)
+	}
+	return nil
+}
+
+// setMetaData sets the metadata from the manifest entry
+func (o *Object) setMetaData(entry *manifestEntry) {
+	o.size = entry.Size
+	o.modTime = entry.ModTime
+	o.fileID = entry.FileID
+	o.messageID = entry.MessageID
+	o.chunks = entry.Chunks
+	o.md5 = entry.MD5
+	o.mimeType = entry.MimeType
+	o.sentAs = entry.SentAs
+	o.metadata = entry.Metadata
+}
+
+// id returns the id of the message identifying the object
+func (o *Object) id() int64 {
+	if len(o.chunks) > 0 {
+		return o.chunks[0].MessageID
+	}
+	return o.messageID
+}
+
+// isEmpty returns true if the object is a file of 0 bytes with no
+// document
+func (o *Object) isEmpty() bool {
+	return o.fileID == "" && len(o.chunks) == 0 && o.md5 != ""
+}
+
+// Fs returns the parent Fs
+func (o *Object) Fs() fs.Info {
+	return o.fs
+}
+
+// Return a string version
+func (o *Object) String() string {
+	if o == nil {
+		return "<nil>"
+	}
+	return o.remote
+}
+
+// Remote returns the remote path
+func (o *Object) Remote() string {
+	return o.remote
+}
+
+// Hash returns the requested hash of the object content
+func (o *Object) Hash(ctx context.Context, t hash.Type) (string, error) {
+	if t != hash.MD5 {
+		return "", hash.ErrUnsupported
+	}
+	return o.md5, nil
+}
+
+// Size returns the size of an object in bytes
+//
+// Photos sent with send_as_media are recompressed so their size isn't
+// known.
+func (o *Object) Size() int64 {
+	if o.sentAs == sendAsPhoto {
+		return -1
+	}
+	return o.size
+}
+
+// ModTime returns the modification time of the object
+func (o *Object) ModTime(ctx context.Context) time.Time {
+	return o.modTime
+}
+
+// MimeType returns the content type of the Object if known, or "" if not
+//
+// This is the MIME type Telegram recorded for the document.
+func (o *Object) MimeType(ctx context.Context) string {
+	return o.mimeType
+}
+
+// SetModTime sets the modification time of the object
+//
+// Only the manifest entry is changed, the document is left alone.
+func (o *Object) SetModTime(ctx context.Context, modTime time.Time) error {
+	remote := o.fs.absPath(o.remote)
+	var entry *manifestEntry
+	err := o.fs.changeFileList(ctx, func(m *manifest) ([]*manifestEntry, error) {
+		i := m.index(remote, o.id())
+		if i < 0 {
+			return nil, fs.ErrorObjectNotFound
+		}
+		newEntry := *m.Entries[i]
+		newEntry.ModTime = modTime
+		entry = &newEntry
+		m.replace(remote, o.id(), entry)
+		return nil, nil
+	})
+	if err != nil {
+		return err
+	}
+	o.setMetaData(entry)
+	return nil
+}
+
+// Storable returns a boolean showing whether this object storable
+func (o *Object) Storable() bool {
+	return true
+}
+
+// Open an object for read
+func (o *Object) Open(ctx context.Context, options ...fs.OpenOption) (in io.ReadCloser, err error) {
+	if len(o.chunks) > 0 {
+		return o.openChunks(ctx, options...)
+	}
+	if o.isEmpty() {
+		return io.NopCloser(bytes.NewReader(nil)), nil
+	}
+	if o.fileID == "" {
+		return nil, fmt.Errorf("no document recorded for %q - forward its message into the chat and run the rebuild command: %w", o.remote, fs.ErrorObjectNotFound)
+	}
+	size := o.Size()
+	if size == 0 {
+		// Not recorded by old manifests, as empty files were
+		// dealt with above
+		size = -1
+	}
+	return o.fs.openDocument(ctx, o.fileID, size, options...)
+}
+
+// decodeOpenOptions returns the offset and limit, -1 for none, of the
+// bytes of an object of size bytes asked for by options
+//
+// Any range and seek options are made absolute and kept within the
+// object, ready to be sent to the server. Other options are ignored.
+func decodeOpenOptions(what any, options []fs.OpenOption, size int64) (offset, limit int64) {
+	for i, option := range options {
+		// FixRangeOption gets a negative start if asked for more
+		// bytes from the end than there are
+		if x, ok := option.(*fs.RangeOption); ok && x.Start < 0 && x.End > size {
+			options[i] = &fs.RangeOption{Start: 0, End: -1}
+		}
+	}
+	fs.FixRangeOption(options, size)
+	offset, limit = 0, -1
+	for _, option := range options {
+		switch x := option.(type) {
+		case *fs.SeekOption:
+			offset = x.Offset
+		case *fs.RangeOption:
+			offset, limit = x.Decode(size)
+		default:
+			if option.Mandatory() {
+				fs.Logf(what, "Unsupported mandatory option: %v", option)
+			}
+		}
+	}
+	return offset, limit
+}
+
+// openDocument opens the document with fileID of size bytes for
+// reading, honouring any range or seek in options
+//
+// If size is -1 the size Telegram gives is used, if it gives one, as
+// file_size is optional.
+func (f *Fs) openDocument(ctx context.Context, fileID string, size int64, options ...fs.OpenOption) (in io.ReadCloser, err error) {
+	file, err := f.getFile(ctx, fileID)
+	if err != nil {
+		return nil, err
+	}
+	if size < 0 && file.FileSize > 0 {
+		size = file.FileSize
+	}
+	offset, limit := decodeOpenOptions(f, options, size)
+	if size >= 0 && offset >= size {
+		// Nothing to read and the server would reject the range
+		return io.NopCloser(bytes.NewReader(nil)), nil
+	}
+	filePath := file.FilePath
+	if path.IsAbs(filePath) {
+		// A self-hosted server run with --local gives the path to
+		// the file on its own disk. If it isn't on this machine or
+		// we can't read it, download it from the server instead.
+		in, err = openLocalFile(filePath, offset, limit)
+		if err == nil {
+			return in, nil
+		}
+		fs.Debugf(f, "Downloading file as it can't be read locally: %v", f.redactError(err))
+		filePath = f.serverFilePath(filePath)
+	}
+	resp, err := f.download(ctx, filePath, options...)
+	if err == fs.ErrorObjectNotFound && !path.IsAbs(file.FilePath) {
+		// The file_path is only valid for an hour so get a new one
+		// in case it expired
+		fs.Debugf(f, "Document not found at its file_path - getting it again")
+		file, err = f.getFile(ctx, fileID)
+		if err != nil {
+			return nil, err
+		}
+		resp, err = f.download(ctx, file.FilePath, options...)
+	}
+	if err != nil {
+		return nil, err
+	}
+	in = resp.Body
+	// Apply the range ourselves if the server ignored it
+	if resp.StatusCode == http.StatusOK {
+		if offset > 0 {
+			_, err = io.CopyN(io.Discard, in, offset)
+			if err != nil {
+				_ = in.Close()
+				return nil, fmt.Errorf("failed to seek to %d: %w", offset, err)
+			}
+		}
+		if limit >= 0 {
+			in = readers.NewLimitedReadCloser(in, limit)
+		}
+	}
+	return in, nil
+}
+
+// Update the object with the contents of the io.Reader, modTime and size
+//
+// The new content is uploaded as a new document and the manifest entry
+// replaced before the old message is deleted, so a failure leaves the
+// old entry in place.
+func (o *Object) Update(ctx context.Context, in io.Reader, src fs.ObjectInfo, options ...fs.OpenOption) error {
+	meta, err := o.fs.readMetadata(ctx, src, options)
+	if err != nil {
+		return err
+	}
+	entry, err := o.fs.upload(ctx, in, src, meta)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := finishContext(ctx)
+	defer cancel()
+	old := &manifestEntry{Path: o.fs.absPath(o.remote), Size: o.size, MessageID: o.messageID, Chunks: o.chunks}
+	entry.Path = old.Path
+	err = o.fs.changeFileList(ctx, func(m *manifest) ([]*manifestEntry, error) {
+		m.replace(old.Path, o.id(), entry)
+		return append(m.finishPending(entry), old), nil
+	})
+	if err != nil {
+		// Tidy up the new document as nothing references it,
+		// unless it is parts kept to resume the upload
+		if len(entry.Chunks) > 0 && src.Size() >= 0 {
+			return fmt.Errorf("failed to update manifest: %w", err)
+		}
+		if delErr := o.fs.deleteDocuments(ctx, entry.MessageID, entry.Chunks); delErr != nil {
+			fs.Debugf(o, "Failed to delete new document after failed update: %v", delErr)
+		}
+		return fmt.Errorf("failed to update manifest: %w", err)
+	}
+	o.setMetaData(entry)
+	return nil
+}
+
+// Remove an object
+//
+// The document is deleted once the manifest no longer refers to it.
+func (o *Object) Remove(ctx context.Context) error {
+	if o.fs.noDelete != nil {
+		return o.fs.noDelete
+	}
+	old := &manifestEntry{Path: o.fs.absPath(o.remote), Size: o.size, MessageID: o.messageID, Chunks: o.chunks}
+	return o.fs.changeFileList(ctx, func(m *manifest) ([]*manifestEntry, error) {
+		if !m.remove(old.Path, o.id()) {
+			return nil, fs.ErrorObjectNotFound
+		}
+		m.keepParent(old.Path)
+		return []*manifestEntry{old}, nil
+	})
+}
+
+var commandHelp = []fs.CommandHelp{{
+	Name:  "cleanup-pending",
+	Short: "Remove unfinished chunked uploads.",
+	Long: `This command removes the parts of unfinished chunked uploads which
+haven't been added to since max-age ago, which defaults to 24 hours.
+Uploading the same file again carries on from these parts, so only
+remove them if you don't intend to.
+
+Note that you can use --interactive/-i or --dry-run with this command to see what
+it would do.
+
+    rclone backend cleanup-pending telegram:
+    rclone backend cleanup-pending -o max-age=7d telegram:
+
+Durations are parsed as per the rest of rclone, 2h, 7d, 7w etc.
+`,
+	Opts: map[string]string{
+		"max-age": "Max age of upload to remove",
+	},
+}, {
+	Name:  "rebuild",
+	Short: "Rebuild the manifest from the documents in the chat.",
+	Long: `This command makes a new manifest from the documents in the recent
+updates Telegram keeps for the bot, for use if the manifest is lost or
+corrupted. The caption of each document says which file it belongs
+to. Documents without one are restored at the root under their file
+name with the time they were posted as their modification time. If
+the same path turns up more than once the newest is kept.
+
+Telegram doesn't send bots the messages they post themselves, so only
+documents posted by other accounts can be recovered. To recover the
+files rclone uploaded, forward their messages back into the chat from
+your own account first.
+
+The new manifest replaces the current one, which is left in the chat.
+Files whose documents are no longer in the updates are dropped so
+check what it would do first with
+
+    rclone backend rebuild -o dry-run=true telegram:
+
+which shows the new manifest without saving it. Then
+
+    rclone backend rebuild telegram:
+
+saves it and reports how many files were recovered.
+`,
+	Opts: map[string]string{
+		"dry-run": "Show the new manifest instead of saving it",
+	},
+}, {
+	Name:  "cleanup",
+	Short: "Delete documents the manifest doesn't refer to.",
+	Long: `This command finds the documents left in the chat which the manifest
+doesn't refer to.
+
+Telegram doesn't send bots the messages they post themselves, so when
+rclone fails to delete one of its documents, for instance the old
+version of a file which was replaced, it records it in the manifest.
+These orphans are listed by
+
+    rclone backend cleanup telegram:
+
+and deleted, reporting how many were deleted and the bytes reclaimed,
+by
+
+    rclone backend cleanup -o unsafe=true telegram:
+
+Telegram won't let bots delete messages more than 48 hours old unless
+they are an admin allowed to delete messages. The orphans it refuses
+to delete are reported separately as undeletable and stay listed
+until they are deleted by hand.
+
+Documents in the recent updates posted by other accounts which the
+manifest doesn't refer to are listed too, with who posted them, but
+are never deleted. Use cleanup-pending to remove the parts of
+unfinished uploads.
+
+Note that you can use --interactive/-i or --dry-run with this command to see what
+it would do.
+`,
+	Opts: map[string]string{
+		"unsafe": "Delete the orphans instead of listing them",
+	},
+}, {
+	Name:  "check-index",
+	Short: "Check the documents of the files in the manifest still exist.",
+	Long: `This command checks that Telegram still has the document of every file
+in the manifest of the chat, for instance after an admin deleted
+messages by hand.
+
+    rclone backend check-index telegram:
+
+It lists the files whose documents are missing, counts the documents
+posted by others which the manifest doesn't refer to, like cleanup,
+and fails if any are missing. The fix option removes the entries of
+the files which are missing instead, along with any of their parts
+which are left.
+
+    rclone backend check-index -o fix=true telegram:
+
+There is no way for a bot to read a message by id so each document is
+checked by asking for its file, one at a time, which takes a while for
+a big chat. Telegram keeps serving the documents of deleted messages
+for some time so these may only show up as missing later.
+
+Note that you can use --interactive/-i or --dry-run with this command to see what
+it would do.
+`,
+	Opts: map[string]string{
+		"fix": "Remove the entries of the missing files",
+	},
+}, {
+	Name:  "purge-chat",
+	Short: "Delete everything rclone posted to the chat.",
+	Long: `This command deletes every document rclone posted to the chat, the
+forum topics it made and the manifest, for instance when a remote is
+retired. The chat itself is left. As this can't be undone it must be
+confirmed with the yes option.
+
+    rclone backend purge-chat -o yes=true telegram:
+
+Telegram doesn't send bots the messages they post themselves so the
+documents are found from the manifest, including orphans and the parts
+of unfinished uploads. They are deleted one message at a time. Those
+Telegram refuses to delete, because they are more than 48 hours old
+and the bot isn't an admin allowed to delete messages, are listed so
+they can be deleted by hand, as are the documents posted by others,
+which are left alone. If it stops part way it can be run again.
+
+Note that you can use --interactive/-i or --dry-run with this command to see what
+it would do. With --dry-run the yes option isn't needed.
+`,
+	Opts: map[string]string{
+		"yes": "Confirm deleting everything",
+	},
+}, {
+	Name:  "migrate",
+	Short: "Copy every file to another chat.",
+	Long: `This command copies every file in the chat to another chat the bot is
+in, for instance when a group is being retired.
+
+    rclone backend migrate -o target-chat=-1009876543210 telegram:
+
+The documents are sent to the target chat again by file_id, so nothing
+is downloaded or uploaded, and a manifest describing them is saved in
+the target chat as they are copied. If the migration stops part way
+running it again skips the files already copied. Files which can't be
+copied, for instance because the chat has protected content, are
+reported and the rest carry on.
+
+With the delete-source option everything rclone posted to this chat is
+deleted afterwards, as purge-chat does, provided every file was copied.
+
+    rclone backend migrate -o target-chat=-1009876543210 -o delete-source=true telegram:
+
+Note that you can use --interactive/-i or --dry-run with this command to see what
+it would do.
+`,
+	Opts: map[string]string{
+		"target-chat":   "Chat ID or @username of the chat to copy the files to",
+		"delete-source": "Delete everything from this chat once all the files are copied",
+	},
+}, {
+	Name:  "get-link",
+	Short: "Show the links to the messages carrying files.",
+	Long: `This command shows the t.me links to the messages carrying the files
+given, so they can be opened in the Telegram app. Files stored in
+several parts have a link for each part.
+
+    rclone backend get-link telegram: path/to/file.txt other.txt
+
+Files in directories are linked to with the recursive option, which
+skips any files which can't be linked to.
+
+    rclone backend get-link -o recursive=true telegram: path/to/dir
+
+The links are the same as those made by rclone link. Messages in
+basic groups can't be linked to and links to messages in private
+chats only work for their members.
+`,
+	Opts: map[string]string{
+		"recursive": "Link to the files in the directories given",
+	},
+}, {
+	Name:  "download-url",
+	Short: "Show a URL to download a file directly.",
+	Long: `This command shows the Bot API URL the file can be downloaded from, for
+giving to tools which need an HTTP URL.
+
+    rclone backend download-url telegram: path/to/file.txt
+
+The URL contains the bot token, so anyone it is shared with can
+control the bot, and Telegram only promises it works for an hour. The
+redact option shows only the part of the URL after the token.
+
+    rclone backend download-url -o redact=true telegram: path/to/file.txt
+
+Files stored in several parts have no single URL so are refused.
+`,
+	Opts: map[string]string{
+		"redact": "Only show the part of the URL after the bot token",
+	},
+}, {
+	Name:  "stats",
+	Short: "Show statistics about the manifest.",
+	Long: `This command shows what the manifest of the whole chat holds: the
+number of files and directories, the total size of the files, how many
+were stored in parts and how many parts they have, the unfinished
+uploads and orphaned documents, and the id, size, sequence number and
+save time of the manifest itself.
+
+    rclone backend stats telegram:
+
+It only reads the manifest, so it is quick however many files there
+are.
+`,
+}, {
+	Name:  "du",
+	Short: "Show the disk usage of each directory.",
+	Long: `This command adds up the number and size of the files in a directory
+and in each directory inside it, like du, listing the largest first.
+
+    rclone backend du telegram:
+    rclone backend du -o depth=2 telegram: path/to/dir
+
+The depth option limits how many levels of directories are listed,
+with the files deeper down added to the directory holding them at the
+last level listed.
+
+The size of the documents stored in the chat is shown separately as
+photos sent with send_as_media are recompressed, so the size of the
+originals isn't known. Like stats it only reads the manifest.
+`,
+	Opts: map[string]string{
+		"depth": "Number of levels of directories to list",
+	},
+}}
+
+// Command the backend to run a named command
+//
+// The command run is name
+// args may be used to read arguments from
+// opts may be used to read optional arguments from
+//
+// The result should be capable of being JSON encoded
+// If it is a string or a []string it will be shown to the user
+// otherwise it will be JSON encoded and shown to the user like that
+func (f *Fs) Command(ctx context.Context, name string, arg []string, opt map[string]string) (out any, err error) {
+	switch name {
+	case "cleanup-pending":
+		maxAge := defaultMaxAge
+		if opt["max-age"] != "" {
+			maxAge, err = fs.ParseDuration(opt["max-age"])
+			if err != nil {
+				return nil, fmt.Errorf("bad max-age: %w", err)
+			}
+		}
+		return nil, f.cleanupPending(ctx, maxAge)
+	case "rebuild":
+		dryRun := false
+		if opt["dry-run"] != "" {
+			dryRun, err = strconv.ParseBool(opt["dry-run"])
+			if err != nil {
+				return nil, fmt.Errorf("bad dry-run: %w", err)
+			}
+		}
+		return f.rebuild(ctx, dryRun)
+	case "cleanup":
+		unsafe := false
+		if opt["unsafe"] != "" {
+			unsafe, err = strconv.ParseBool(opt["unsafe"])
+			if err != nil {
+				return nil, fmt.Errorf("bad unsafe: %w", err)
+			}
+		}
+		return f.cleanupOrphans(ctx, unsafe)
+	case "check-index":
+		fix := false
+		if opt["fix"] != "" {
+			fix, err = strconv.ParseBool(opt["fix"])
+			if err != nil {
+				return nil, fmt.Errorf("bad fix: %w", err)
+			}
+		}
+		return f.checkIndex(ctx, fix)
+	case "purge-chat":
+		yes := false
+		if opt["yes"] != "" {
+			yes, err = strconv.ParseBool(opt["yes"])
+			if err != nil {
+				return nil, fmt.Errorf("bad yes: %w", err)
+			}
+		}
+		if !yes && !fs.GetConfig(ctx).DryRun {
+			return nil, errors.New("this deletes everything rclone posted to the chat and can't be undone - use -o yes=true to confirm")
+		}
+		return f.purgeChat(ctx)
+	case "migrate":
+		deleteSource := false
+		if opt["delete-source"] != "" {
+			deleteSource, err = strconv.ParseBool(opt["delete-source"])
+			if err != nil {
+				return nil, fmt.Errorf("bad delete-source: %w", err)
+			}
+		}
+		return f.migrate(ctx, opt["target-chat"], deleteSource)
+	case "get-link":
+		recursive := false
+		if opt["recursive"] != "" {
+			recursive, err = strconv.ParseBool(opt["recursive"])
+			if err != nil {
+				return nil, fmt.Errorf("bad recursive: %w", err)
+			}
+		}
+		return f.getLinks(ctx, arg, recursive)
+	case "download-url":
+		if len(arg) != 1 {
+			return nil, errors.New("need exactly one path")
+		}
+		redact := false
+		if opt["redact"] != "" {
+			redact, err = strconv.ParseBool(opt["redact"])
+			if err != nil {
+				return nil, fmt.Errorf("bad redact: %w", err)
+			}
+		}
+		return f.downloadURL(ctx, arg[0], redact)
+	case "stats":
+		return f.stats(ctx)
+	case "du":
+		depth := -1
+		if opt["depth"] != "" {
+			depth, err = strconv.Atoi(opt["depth"])
+			if err != nil {
+				return nil, fmt.Errorf("bad depth: %w", err)
+			}
+		}
+		dir := ""
+		if len(arg) > 0 {
+			dir = arg[0]
+		}
+		return f.du(ctx, dir, depth)
+	default:
+		return nil, fs.ErrorCommandNotFound
+	}
+}
+
+// skipChange returns true if a command shouldn't carry out action on
+// subject because of --dry-run or --interactive, logging what it
+// would have done
+//
+// Commands check each change they make to the chat or the manifest
+// with this before making it and don't save the manifest if they
+// skipped every change.
+func skipChange(ctx context.Context, subject any, action string) bool {
+	return operations.SkipDestructive(ctx, subject, action)
+}
+
+// cleanupPending removes the unfinished uploads which haven't had a
+// part sent for maxAge and deletes their parts
+func (f *Fs) cleanupPending(ctx context.Context, maxAge time.Duration) error {
+	var stale []string
+	err := f.readFileList(ctx, func(m *manifest) error {
+		for _, p := range m.Pending {
+			if time.Since(p.Updated) >= maxAge && !skipChange(ctx, p.Path, "remove pending upload") {
+				stale = append(stale, p.Path)
+			}
+		}
+		return nil
+	})
+	if err != nil || len(stale) == 0 {
+		return err
+	}
+	return f.changeFileList(ctx, func(m *manifest) (toDelete []*manifestEntry, err error) {
+		for _, path := range stale {
+			// A part may have been sent since it was checked
+			if p := m.findPending(path); p == nil || time.Since(p.Updated) < maxAge {
+				continue
+			}
+			p := m.removePending(path)
+			toDelete = append(toDelete, &manifestEntry{Path: p.Path, Chunks: slices.DeleteFunc(p.Chunks, func(chunk *manifestChunk) bool {
+				return chunk == nil
+			})})
+		}
+		return toDelete, nil
+	})
+}
+
+// Check the interfaces are satisfied
+var (
+	_ fs.Fs              = &Fs{}
+	_ fs.Shutdowner      = &Fs{}
+	_ fs.Mover           = &Fs{}
+	_ fs.Copier          = &Fs{}
+	_ fs.DirMover        = &Fs{}
+	_ fs.Purger          = &Fs{}
+	_ fs.Abouter         = &Fs{}
+	_ fs.PutStreamer     = &Fs{}
+	_ fs.Commander       = &Fs{}
+	_ fs.ListRer         = &Fs{}
+	_ fs.DirCacheFlusher = &Fs{}
+	_ fs.PublicLinker    = &Fs{}
+	_ fs.UserInfoer      = &Fs{}
+	_ fs.ChangeNotifier  = &Fs{}
+	_ fs.Object          = &Object{}
+	_ fs.Metadataer      = &Object{}
+	_ fs.MimeTyper       = &Object{}
+)
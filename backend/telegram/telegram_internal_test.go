@@ -0,0 +1,6216 @@
+package telegram
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"runtime"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	_ "github.com/rclone/rclone/backend/alias"
+	_ "github.com/rclone/rclone/backend/chunker"
+	"github.com/rclone/rclone/backend/crypt"
+	"github.com/rclone/rclone/backend/local"
+	"github.com/rclone/rclone/backend/telegram/api"
+	_ "github.com/rclone/rclone/backend/union"
+	"github.com/rclone/rclone/cmd/bisync"
+	_ "github.com/rclone/rclone/cmd/serve/http"
+	_ "github.com/rclone/rclone/cmd/serve/restic"
+	_ "github.com/rclone/rclone/cmd/serve/s3"
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/accounting"
+	"github.com/rclone/rclone/fs/cache"
+	"github.com/rclone/rclone/fs/config"
+	"github.com/rclone/rclone/fs/config/configmap"
+	"github.com/rclone/rclone/fs/config/obscure"
+	"github.com/rclone/rclone/fs/fserrors"
+	"github.com/rclone/rclone/fs/hash"
+	"github.com/rclone/rclone/fs/log"
+	"github.com/rclone/rclone/fs/object"
+	"github.com/rclone/rclone/fs/operations"
+	"github.com/rclone/rclone/fs/rc"
+	fssync "github.com/rclone/rclone/fs/sync"
+	"github.com/rclone/rclone/fs/walk"
+	"github.com/rclone/rclone/fstest"
+	"github.com/rclone/rclone/fstest/fstests"
+	"github.com/rclone/rclone/lib/encoder"
+	"github.com/rclone/rclone/lib/pacer"
+	"github.com/rclone/rclone/lib/readers"
+	"github.com/rclone/rclone/vfs"
+	"github.com/rclone/rclone/vfs/vfscommon"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	testToken  = "123456:TESTTOKEN"
+	testChatID = -1001234567890
+)
+
+var (
+	testBot  = api.User{ID: 123456, IsBot: true, FirstName: "rclone", Username: "rclone_test_bot"}
+	testUser = api.User{ID: 42, FirstName: "Alice", Username: "alice"}
+)
+
+// mockServer is a fake Telegram Bot API server holding a single chat
+type mockServer struct {
+	t           testing.TB
+	srv         *httptest.Server
+	mu          sync.Mutex
+	nextID      int64                               // next message_id to hand out
+	updates     []api.Update                        // the messages in the chat, which getUpdates returns unless sent by the bot
+	files       map[string][]byte                   // file contents by file_id
+	calls       map[string]int                      // number of calls by method
+	ignoreRange bool                                // if set, downloads ignore Range headers
+	noFileSize  bool                                // if set, getFile leaves out the optional file_size
+	failUpload  string                              // if set, uploads of documents with this name fail
+	discard     bool                                // if set, uploaded contents other than manifests are counted but not kept
+	lengths     []int64                             // Content-Length of each sendDocument request
+	sentFields  map[string]url.Values               // form fields of the last sendDocument for each document name
+	forum       bool                                // if set, the chat has topics enabled
+	username    string                              // if set, the chat is public with this username
+	otherChats  []int64                             // ids of more chats the bot is a member of
+	topics      map[int64]string                    // names of the forum topics by message_thread_id
+	failures    map[string][]int                    // HTTP status, or cutReply, to fail the next calls to each method with
+	resends     int                                 // number of documents sent again by file_id
+	pinned      []int64                             // ids of the pinned messages, oldest first
+	noPin       bool                                // if set, the bot isn't allowed to pin messages
+	status      string                              // if set, the bot's status in the chat, otherwise it is an administrator
+	noDelete    bool                                // if set, the bot isn't allowed to delete messages
+	chatType    string                              // if set, the type of the chat, otherwise it is a supergroup
+	expired     bool                                // if set, getUpdates returns nothing as if the updates expired
+	expirePaths int                                 // number of downloads to fail as if their file_path expired
+	manifests   [][]byte                            // every manifest uploaded, oldest first
+	old         map[int64]bool                      // messages too old for the bot to delete
+	onDelete    func(messageID int64)               // if set, called with the mutex held before each message is deleted
+	onCall      func(method string)                 // if set, called before each call to a method is carried out
+	localDir    string                              // if set, getFile gives absolute paths under this like a server run with --local
+	uploadDelay func(fileName string) time.Duration // if set, how long each upload takes
+	inFlight    int                                 // number of uploads being received
+	maxInFlight int                                 // most uploads received at once
+
+	downloadDelay       time.Duration // if set, how long each download waits before replying
+	downloadsInFlight   int           // number of downloads being served
+	maxDownloadInFlight int           // most downloads served at once
+	downloaded          int64         // number of bytes of documents served
+}
+
+// cutReply in failures makes the mock server carry out the call but
+// cut the connection halfway through sending the reply
+const cutReply = -1
+
+// cuttingWriter sends the first half of the reply then cuts the
+// connection
+type cuttingWriter struct {
+	http.ResponseWriter
+}
+
+func (w *cuttingWriter) Write(p []byte) (int, error) {
+	w.Header().Set("Content-Length", strconv.Itoa(len(p)))
+	_, _ = w.ResponseWriter.Write(p[:len(p)/2])
+	w.ResponseWriter.(http.Flusher).Flush()
+	panic(http.ErrAbortHandler)
+}
+
+// newMockServer starts a mock server which is shut down when the test ends
+func newMockServer(t testing.TB) *mockServer {
+	m := &mockServer{
+		t:        t,
+		nextID:   1,
+		files:    map[string][]byte{},
+		calls:    map[string]int{},
+		failures: map[string][]int{},
+		old:      map[int64]bool{},
+
+		sentFields: map[string]url.Values{},
+		topics:     map[int64]string{},
+	}
+	m.srv = httptest.NewServer(http.HandlerFunc(m.handle))
+	t.Cleanup(m.srv.Close)
+	return m
+}
+
+// newTestFs makes an Fs talking to a new mock server
+func newTestFs(t testing.TB) (*Fs, *mockServer) {
+	m := newMockServer(t)
+	return m.newFs(), m
+}
+
+// newFs makes another Fs talking to the mock server
+func (m *mockServer) newFs() *Fs {
+	f, err := NewFs(context.Background(), "TestTelegram", "", m.config())
+	require.NoError(m.t, err)
+	return f.(*Fs)
+}
+
+// config returns the config for an Fs talking to the mock server
+func (m *mockServer) config() configmap.Simple {
+	return configmap.Simple{
+		"bot_token":           obscure.MustObscure(testToken),
+		"chat_id":             strconv.Itoa(testChatID),
+		"chunk_size":          defaultChunkSize.String(),
+		"base_url":            m.srv.URL,
+		"encoding":            fs.MustFind("telegram").Options.Get("encoding").String(),
+		"manifest_cache_time": defaultCacheTime.String(),
+		"upload_concurrency":  strconv.Itoa(defaultConcurrency),
+		"write_captions":      "true",
+		"silent":              "true",
+	}
+}
+
+// callCount returns the number of times method was called
+func (m *mockServer) callCount(method string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.calls[method]
+}
+
+// mutatingMethods are the methods which change the chat
+var mutatingMethods = []string{
+	"sendDocument", "sendPhoto", "sendVideo", "sendAudio", "editMessageMedia", "deleteMessage",
+	"pinChatMessage", "unpinChatMessage", "createForumTopic", "editForumTopic", "deleteForumTopic",
+}
+
+// mutatingCalls returns the number of calls to each of the methods
+// which change the chat
+func (m *mockServer) mutatingCalls() map[string]int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	calls := make(map[string]int, len(mutatingMethods))
+	for _, method := range mutatingMethods {
+		calls[method] = m.calls[method]
+	}
+	return calls
+}
+
+// addDocument posts a document to the chat as if sent by a person
+func (m *mockServer) addDocument(fileName string, data []byte) *api.Message {
+	return m.postDocument(&testUser, fileName, data)
+}
+
+// postDocument posts a document to the chat as if sent by from
+func (m *mockServer) postDocument(from *api.User, fileName string, data []byte) *api.Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	id := m.nextID
+	m.nextID++
+	fileID := fmt.Sprintf("file%d", id)
+	m.files[fileID] = data
+	message := &api.Message{
+		MessageID: id,
+		From:      from,
+		Date:      time.Now().Unix(),
+		Chat:      api.Chat{ID: testChatID, Type: "supergroup", Title: "rclone"},
+		Document: &api.Document{
+			FileID:       fileID,
+			FileUniqueID: "unique" + fileID,
+			FileName:     fileName,
+			FileSize:     int64(len(data)),
+		},
+	}
+	m.updates = append(m.updates, api.Update{UpdateID: id, Message: message})
+	return message
+}
+
+// forwardAll forwards every message the bot posted back into the chat
+// as if by a person, so they appear in the updates
+func (m *mockServer) forwardAll() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, update := range slices.Clone(m.updates) {
+		message := update.GetMessage()
+		if message == nil || message.From == nil || message.From.ID != testBot.ID {
+			continue
+		}
+		forwarded := *message
+		forwarded.MessageID = m.nextID
+		forwarded.From = &testUser
+		m.nextID++
+		m.updates = append(m.updates, api.Update{UpdateID: forwarded.MessageID, Message: &forwarded})
+	}
+}
+
+// reply sends result to the client wrapped in a successful envelope
+func (m *mockServer) reply(w http.ResponseWriter, result any) {
+	data, err := json.Marshal(result)
+	require.NoError(m.t, err)
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(api.Response{OK: true, Result: data})
+}
+
+// replyError sends an error envelope to the client
+func (m *mockServer) replyError(w http.ResponseWriter, code int, description string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(api.Response{ErrorCode: code, Description: description})
+}
+
+func (m *mockServer) handle(w http.ResponseWriter, r *http.Request) {
+	if filePath, ok := strings.CutPrefix(r.URL.Path, "/file/bot"+testToken+"/"); ok {
+		m.mu.Lock()
+		m.calls["file"]++
+		m.mu.Unlock()
+		m.serveFile(w, r, filePath)
+		return
+	}
+	method, ok := strings.CutPrefix(r.URL.Path, "/bot"+testToken+"/")
+	if !ok {
+		m.replyError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	m.mu.Lock()
+	m.calls[method]++
+	var failure int
+	if failures := m.failures[method]; len(failures) > 0 {
+		failure, m.failures[method] = failures[0], failures[1:]
+	}
+	onCall := m.onCall
+	m.mu.Unlock()
+	if onCall != nil {
+		onCall(method)
+	}
+	switch failure {
+	case 0:
+	case cutReply:
+		w = &cuttingWriter{ResponseWriter: w}
+	case http.StatusTooManyRequests:
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(failure)
+		_ = json.NewEncoder(w).Encode(api.Response{
+			ErrorCode:   failure,
+			Description: "Too Many Requests: retry after 1",
+			Parameters:  &api.ResponseParameters{RetryAfter: 1},
+		})
+		return
+	default:
+		m.replyError(w, failure, http.StatusText(failure))
+		return
+	}
+	switch method {
+	case "getMe":
+		m.reply(w, testBot)
+	case "sendDocument", "sendPhoto", "sendVideo", "sendAudio":
+		m.sendDocument(w, r, method)
+	case "getUpdates":
+		// Like Telegram, bots aren't sent their own messages
+		var updates []api.Update
+		m.mu.Lock()
+		for _, update := range m.updates {
+			if message := update.GetMessage(); m.expired || (message != nil && message.From != nil && message.From.ID == testBot.ID) {
+				continue
+			}
+			updates = append(updates, update)
+		}
+		m.mu.Unlock()
+		// Like Telegram, only the oldest updates are returned
+		limit := maxUpdates
+		if r.FormValue("limit") != "" {
+			limit, _ = strconv.Atoi(r.FormValue("limit"))
+		}
+		if len(updates) > limit {
+			updates = updates[:limit]
+		}
+		m.reply(w, updates)
+	case "getChat":
+		m.getChat(w, r)
+	case "getChatMember":
+		m.getChatMember(w, r)
+	case "pinChatMessage", "unpinChatMessage":
+		m.pinChatMessage(w, r, method == "pinChatMessage")
+	case "getFile":
+		m.getFile(w, r)
+	case "editMessageMedia":
+		m.editMessageMedia(w, r)
+	case "deleteMessage":
+		m.deleteMessage(w, r)
+	case "createForumTopic", "editForumTopic", "deleteForumTopic":
+		m.forumTopic(w, r, method)
+	default:
+		m.replyError(w, http.StatusNotFound, "Not Found")
+	}
+}
+
+// chatOf returns the chat with the chat_id given or 0 if the bot
+// isn't a member of it
+func (m *mockServer) chatOf(chatID string) int64 {
+	id, _ := strconv.ParseInt(chatID, 10, 64)
+	if id == testChatID || slices.Contains(m.otherChats, id) {
+		return id
+	}
+	return 0
+}
+
+// upload is a document uploaded to the mock server
+type upload struct {
+	chatID   int64      // chat it was sent to
+	mimeType string     // Content-Type of the document part
+	fields   url.Values // the other form fields
+	fileName string     // name of the document
+	data     []byte     // contents unless discarded
+	size     int64      // size of the contents
+}
+
+// readUpload reads the multipart form carrying a document
+//
+// It replies with an error and returns nil if the upload should fail,
+// and returns nil without replying if the client gave up sending it.
+func (m *mockServer) readUpload(w http.ResponseWriter, r *http.Request) *upload {
+	m.mu.Lock()
+	m.lengths = append(m.lengths, r.ContentLength)
+	discard := m.discard
+	m.mu.Unlock()
+	mr, err := r.MultipartReader()
+	require.NoError(m.t, err)
+	u := &upload{fields: url.Values{}}
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil
+		}
+		if part.FileName() == "" {
+			value, err := io.ReadAll(part)
+			if err != nil {
+				return nil
+			}
+			u.fields.Add(part.FormName(), string(value))
+			continue
+		}
+		u.fileName = part.FileName()
+		u.mimeType = part.Header.Get("Content-Type")
+		if discard && u.fileName != fileListName {
+			u.size, err = io.Copy(io.Discard, part)
+		} else {
+			u.data, err = io.ReadAll(part)
+			u.size = int64(len(u.data))
+		}
+		if err != nil {
+			return nil
+		}
+	}
+	u.chatID = m.chatOf(u.fields.Get("chat_id"))
+	assert.NotZero(m.t, u.chatID, "unknown chat %q", u.fields.Get("chat_id"))
+	if u.fileName == "" {
+		m.replyError(w, http.StatusBadRequest, "Bad Request: there is no document in the request")
+		return nil
+	}
+	if u.fileName == fileListName && u.fields.Has("disable_notification") {
+		assert.Equal(m.t, "true", u.fields.Get("disable_notification"))
+	}
+	m.mu.Lock()
+	fail := m.failUpload != "" && m.failUpload == u.fileName
+	m.inFlight++
+	m.maxInFlight = max(m.maxInFlight, m.inFlight)
+	uploadDelay := m.uploadDelay
+	m.mu.Unlock()
+	if uploadDelay != nil {
+		time.Sleep(uploadDelay(u.fileName))
+	}
+	m.mu.Lock()
+	m.inFlight--
+	m.mu.Unlock()
+	if fail {
+		m.replyError(w, http.StatusInternalServerError, "Internal Server Error")
+		return nil
+	}
+	if u.fileName == fileListName {
+		m.mu.Lock()
+		m.manifests = append(m.manifests, u.data)
+		m.mu.Unlock()
+	}
+	return u
+}
+
+func (m *mockServer) sendDocument(w http.ResponseWriter, r *http.Request, method string) {
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/") {
+		m.resendDocument(w, r, method)
+		return
+	}
+	u := m.readUpload(w, r)
+	if u == nil {
+		return
+	}
+	message := m.postDocument(&testBot, u.fileName, u.data)
+	message.Document.FileSize = u.size
+	message.Document.MimeType = u.mimeType
+	message.Caption = u.fields.Get("caption")
+	m.mu.Lock()
+	message.Chat.ID = u.chatID
+	if !m.setThread(w, message, u.fields.Get("message_thread_id")) {
+		m.mu.Unlock()
+		return
+	}
+	m.sentFields[u.fileName] = u.fields
+	m.asMedia(message, method, true)
+	m.mu.Unlock()
+	m.reply(w, message)
+}
+
+// asMedia changes the document in message into the media sent by
+// method, recompressing new photos like Telegram does
+//
+// Call with the mutex held.
+func (m *mockServer) asMedia(message *api.Message, method string, recompress bool) {
+	doc := message.Document
+	switch method {
+	case "sendPhoto":
+		fileID := doc.FileID
+		if recompress {
+			fileID = fmt.Sprintf("file%d", m.nextID)
+			m.nextID++
+			m.files[fileID] = append([]byte("recompressed "), m.files[doc.FileID]...)
+		}
+		message.Photo = []api.PhotoSize{
+			{FileID: doc.FileID + "thumb", FileUniqueID: doc.FileUniqueID + "thumb", Width: 90, Height: 90, FileSize: 1},
+			{FileID: fileID, FileUniqueID: "unique" + fileID, Width: 800, Height: 600, FileSize: int64(len(m.files[fileID]))},
+		}
+	case "sendVideo":
+		message.Video = &api.Video{FileID: doc.FileID, FileUniqueID: doc.FileUniqueID, FileName: doc.FileName, MimeType: doc.MimeType, FileSize: doc.FileSize}
+	case "sendAudio":
+		message.Audio = &api.Audio{FileID: doc.FileID, FileUniqueID: doc.FileUniqueID, FileName: doc.FileName, MimeType: doc.MimeType, FileSize: doc.FileSize}
+	default:
+		return
+	}
+	message.Document = nil
+}
+
+// resendDocument sends a document which was sent before by file_id
+func (m *mockServer) resendDocument(w http.ResponseWriter, r *http.Request, method string) {
+	chatID := m.chatOf(r.FormValue("chat_id"))
+	assert.NotZero(m.t, chatID, "unknown chat %q", r.FormValue("chat_id"))
+	field := strings.ToLower(strings.TrimPrefix(method, "send"))
+	fileID := r.FormValue(field)
+	m.mu.Lock()
+	data, ok := m.files[fileID]
+	fileName := field
+	sentAs := field
+	if method == "sendDocument" {
+		sentAs = sendAsDocument
+	}
+	for _, update := range m.updates {
+		if doc := update.GetMessage().File(); doc != nil && doc.FileID == fileID {
+			fileName = doc.FileName
+			// Telegram won't send a file as a different type
+			ok = ok && messageSentAs(update.GetMessage()) == sentAs
+		}
+	}
+	m.resends++
+	m.sentFields[fileName] = r.Form
+	m.mu.Unlock()
+	if !ok {
+		m.replyError(w, http.StatusBadRequest, "Bad Request: wrong file identifier/HTTP URL specified")
+		return
+	}
+	message := m.postDocument(&testBot, fileName, data)
+	message.Caption = r.FormValue("caption")
+	m.mu.Lock()
+	message.Chat.ID = chatID
+	ok = m.setThread(w, message, r.FormValue("message_thread_id"))
+	m.asMedia(message, method, false)
+	m.mu.Unlock()
+	if ok {
+		m.reply(w, message)
+	}
+}
+
+// setThread puts message in the forum topic threadID, if set,
+// replying with an error and returning false if there isn't one
+//
+// Call with the mutex held.
+func (m *mockServer) setThread(w http.ResponseWriter, message *api.Message, threadID string) bool {
+	if threadID == "" {
+		return true
+	}
+	id, err := strconv.ParseInt(threadID, 10, 64)
+	require.NoError(m.t, err)
+	if _, ok := m.topics[id]; !ok {
+		m.replyError(w, http.StatusBadRequest, "Bad Request: message thread not found")
+		return false
+	}
+	message.MessageThreadID = id
+	return true
+}
+
+// forumTopic handles the methods which manage forum topics
+func (m *mockServer) forumTopic(w http.ResponseWriter, r *http.Request, method string) {
+	assert.Equal(m.t, strconv.Itoa(testChatID), r.FormValue("chat_id"))
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.forum {
+		m.replyError(w, http.StatusBadRequest, "Bad Request: the chat is not a forum")
+		return
+	}
+	if method == "createForumTopic" {
+		id := m.nextID
+		m.nextID++
+		m.topics[id] = r.FormValue("name")
+		m.reply(w, api.ForumTopic{MessageThreadID: id, Name: r.FormValue("name")})
+		return
+	}
+	id, err := strconv.ParseInt(r.FormValue("message_thread_id"), 10, 64)
+	require.NoError(m.t, err)
+	if _, ok := m.topics[id]; !ok {
+		m.replyError(w, http.StatusBadRequest, "Bad Request: TOPIC_ID_INVALID")
+		return
+	}
+	if method == "editForumTopic" {
+		m.topics[id] = r.FormValue("name")
+	} else {
+		// Deleting a topic deletes the messages in it
+		delete(m.topics, id)
+		m.updates = slices.DeleteFunc(m.updates, func(update api.Update) bool {
+			return update.GetMessage().MessageThreadID == id
+		})
+	}
+	m.reply(w, true)
+}
+
+func (m *mockServer) editMessageMedia(w http.ResponseWriter, r *http.Request) {
+	u := m.readUpload(w, r)
+	if u == nil {
+		return
+	}
+	assert.JSONEq(m.t, `{"type":"document","media":"attach://document"}`, u.fields.Get("media"))
+	messageID, err := strconv.ParseInt(u.fields.Get("message_id"), 10, 64)
+	require.NoError(m.t, err)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	message := m.message(messageID)
+	if message == nil {
+		m.replyError(w, http.StatusBadRequest, "Bad Request: message to edit not found")
+		return
+	}
+	fileID := fmt.Sprintf("file%d", m.nextID)
+	m.nextID++
+	m.files[fileID] = u.data
+	message.EditDate = time.Now().Unix()
+	message.Document = &api.Document{
+		FileID:       fileID,
+		FileUniqueID: "unique" + fileID,
+		FileName:     u.fileName,
+		FileSize:     u.size,
+		MimeType:     u.mimeType,
+	}
+	m.reply(w, message)
+}
+
+func (m *mockServer) deleteMessage(w http.ResponseWriter, r *http.Request) {
+	messageID, err := strconv.ParseInt(r.FormValue("message_id"), 10, 64)
+	require.NoError(m.t, err)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.onDelete != nil {
+		m.onDelete(messageID)
+	}
+	if m.old[messageID] || m.noDelete {
+		m.replyError(w, http.StatusBadRequest, "Bad Request: message can't be deleted")
+		return
+	}
+	for i, update := range m.updates {
+		if update.GetMessage().MessageID == messageID {
+			m.updates = append(m.updates[:i], m.updates[i+1:]...)
+			m.reply(w, true)
+			return
+		}
+	}
+	m.replyError(w, http.StatusBadRequest, "Bad Request: message to delete not found")
+}
+
+// message returns the message with the id given or nil if not found
+//
+// Call with the mutex held.
+func (m *mockServer) message(messageID int64) *api.Message {
+	for _, update := range m.updates {
+		if message := update.GetMessage(); message.MessageID == messageID {
+			return message
+		}
+	}
+	return nil
+}
+
+func (m *mockServer) getChat(w http.ResponseWriter, r *http.Request) {
+	chatID := m.chatOf(r.FormValue("chat_id"))
+	if chatID == 0 {
+		m.replyError(w, http.StatusBadRequest, "Bad Request: chat not found")
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	chat := api.ChatFullInfo{ID: chatID, Type: "supergroup", Title: "rclone", Username: m.username, IsForum: m.forum}
+	if m.chatType != "" {
+		chat.Type = m.chatType
+	}
+	for i := len(m.pinned) - 1; i >= 0; i-- {
+		if message := m.message(m.pinned[i]); message != nil && message.Chat.ID == chatID {
+			chat.PinnedMessage = message
+			break
+		}
+	}
+	m.reply(w, chat)
+}
+
+func (m *mockServer) getChatMember(w http.ResponseWriter, r *http.Request) {
+	if m.chatOf(r.FormValue("chat_id")) == 0 {
+		m.replyError(w, http.StatusBadRequest, "Bad Request: chat not found")
+		return
+	}
+	assert.Equal(m.t, strconv.FormatInt(testBot.ID, 10), r.FormValue("user_id"))
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	member := api.ChatMember{Status: m.status, User: testBot}
+	if member.Status == "" {
+		member.Status = "administrator"
+		member.CanDeleteMessages = !m.noDelete
+		member.CanPinMessages = !m.noPin
+	}
+	m.reply(w, member)
+}
+
+func (m *mockServer) pinChatMessage(w http.ResponseWriter, r *http.Request, pin bool) {
+	messageID, err := strconv.ParseInt(r.FormValue("message_id"), 10, 64)
+	require.NoError(m.t, err)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.noPin {
+		m.replyError(w, http.StatusBadRequest, "Bad Request: not enough rights to manage pinned messages in the chat")
+		return
+	}
+	if m.message(messageID) == nil {
+		m.replyError(w, http.StatusBadRequest, "Bad Request: message to pin not found")
+		return
+	}
+	m.pinned = slices.DeleteFunc(m.pinned, func(id int64) bool { return id == messageID })
+	if pin {
+		m.pinned = append(m.pinned, messageID)
+	}
+	m.reply(w, true)
+}
+
+// hasMessage returns true if the message with the id given is in the chat
+func (m *mockServer) hasMessage(messageID int64) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, update := range m.updates {
+		if update.GetMessage().MessageID == messageID {
+			return true
+		}
+	}
+	return false
+}
+
+// strandedDocuments returns the ids of the documents in the chat which
+// the manifest doesn't refer to, not even as orphans to clean up
+func (m *mockServer) strandedDocuments() (ids []int64) {
+	saved := m.manifest()
+	if saved == nil {
+		saved = &manifest{}
+	}
+	refs := manifestReferences(saved)
+	for _, entry := range saved.Orphans {
+		refs.add(entry.MessageID, entry.FileID)
+		for _, chunk := range entry.Chunks {
+			refs.add(chunk.MessageID, chunk.FileID)
+		}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, update := range m.updates {
+		message := update.GetMessage()
+		if message.Document == nil || message.Document.FileName == fileListName {
+			continue
+		}
+		if _, ok := refs.messageIDs[message.MessageID]; !ok {
+			ids = append(ids, message.MessageID)
+		}
+	}
+	return ids
+}
+
+// manifest returns the newest manifest posted to the chat
+func (m *mockServer) manifest() *manifest {
+	return m.manifestIn(testChatID)
+}
+
+// manifestIn returns the newest manifest posted to the chat chatID
+func (m *mockServer) manifestIn(chatID int64) *manifest {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := len(m.updates) - 1; i >= 0; i-- {
+		message := m.updates[i].GetMessage()
+		if doc := message.Document; doc != nil && doc.FileName == fileListName && message.Chat.ID == chatID {
+			manifest, err := decodeManifest(m.files[doc.FileID])
+			require.NoError(m.t, err)
+			return manifest
+		}
+	}
+	return nil
+}
+
+// manifestPaths returns the paths in the newest manifest
+func (m *mockServer) manifestPaths() (paths []string) {
+	manifest := m.manifest()
+	if manifest == nil {
+		return nil
+	}
+	for _, entry := range manifest.Entries {
+		paths = append(paths, entry.Path)
+	}
+	return paths
+}
+
+func (m *mockServer) getFile(w http.ResponseWriter, r *http.Request) {
+	fileID := r.FormValue("file_id")
+	m.mu.Lock()
+	data, ok := m.files[fileID]
+	localDir := m.localDir
+	noFileSize := m.noFileSize
+	m.mu.Unlock()
+	if !ok {
+		m.replyError(w, http.StatusBadRequest, "Bad Request: invalid file_id")
+		return
+	}
+	filePath := "documents/" + fileID
+	if localDir != "" {
+		filePath = path.Join(localDir, testToken, filePath)
+	}
+	file := api.File{
+		FileID:   fileID,
+		FileSize: int64(len(data)),
+		FilePath: filePath,
+	}
+	if noFileSize {
+		file.FileSize = 0
+	}
+	m.reply(w, file)
+}
+
+func (m *mockServer) serveFile(w http.ResponseWriter, r *http.Request, filePath string) {
+	m.mu.Lock()
+	data, ok := m.files[strings.TrimPrefix(filePath, "documents/")]
+	if ok && m.expirePaths > 0 {
+		m.expirePaths--
+		ok = false
+	}
+	m.mu.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	m.mu.Lock()
+	m.downloadsInFlight++
+	m.maxDownloadInFlight = max(m.maxDownloadInFlight, m.downloadsInFlight)
+	delay := m.downloadDelay
+	m.mu.Unlock()
+	defer func() {
+		m.mu.Lock()
+		m.downloadsInFlight--
+		m.mu.Unlock()
+	}()
+	time.Sleep(delay)
+	w = &countingWriter{ResponseWriter: w, m: m}
+	if m.ignoreRange {
+		_, _ = w.Write(data)
+		return
+	}
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+}
+
+// countingWriter counts the bytes of documents served
+type countingWriter struct {
+	http.ResponseWriter
+	m *mockServer
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.m.mu.Lock()
+	w.m.downloaded += int64(len(p))
+	w.m.mu.Unlock()
+	return w.ResponseWriter.Write(p)
+}
+
+func TestNewFsConfig(t *testing.T) {
+	ctx := context.Background()
+	for _, test := range []struct {
+		name    string
+		m       configmap.Simple
+		wantErr string
+	}{{
+		name:    "missing token",
+		m:       configmap.Simple{"chat_id": "-100123"},
+		wantErr: "bot_token",
+	}, {
+		name:    "missing chat",
+		m:       configmap.Simple{"bot_token": "123:ABC", "chunk_size": "20Mi", "base_url": "http://localhost:8081"},
+		wantErr: "chat_id",
+	}, {
+		name:    "bad chunk size",
+		m:       configmap.Simple{"bot_token": "123:ABC", "chat_id": "-100123", "chunk_size": "0"},
+		wantErr: "chunk_size",
+	}, {
+		name:    "bad send as media",
+		m:       configmap.Simple{"bot_token": "123:ABC", "chat_id": "-100123", "chunk_size": "20Mi", "base_url": "http://localhost:8081", "send_as_media": "photos"},
+		wantErr: "send_as_media",
+	}, {
+		name:    "bad base url",
+		m:       configmap.Simple{"bot_token": "123:ABC", "chat_id": "-100123", "chunk_size": "20Mi", "base_url": "localhost:8081"},
+		wantErr: "base_url",
+	}, {
+		name:    "missing base url",
+		m:       configmap.Simple{"bot_token": "123:ABC", "chat_id": "-100123", "chunk_size": "20Mi"},
+		wantErr: "base_url",
+	}, {
+		name:    "bad token",
+		m:       configmap.Simple{"bot_token": "not a token", "chat_id": "-100123", "chunk_size": "20Mi", "base_url": "http://localhost:8081"},
+		wantErr: "bot_token",
+	}, {
+		name: "ok",
+		m:    configmap.Simple{"bot_token": obscure.MustObscure("123:ABC"), "chat_id": "-100123", "chunk_size": "20Mi", "base_url": "http://localhost:8081/", "skip_verify": "true"},
+	}, {
+		name: "token not obscured",
+		m:    configmap.Simple{"bot_token": "123:ABC", "chat_id": "-100123", "chunk_size": "20Mi", "base_url": "http://localhost:8081/", "skip_verify": "true"},
+	}} {
+		t.Run(test.name, func(t *testing.T) {
+			f, err := NewFs(ctx, "TestTelegram", "", test.m)
+			if test.wantErr != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), test.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			tf := f.(*Fs)
+			assert.Equal(t, "123:ABC", tf.opt.BotToken)
+			assert.Equal(t, "-100123", tf.opt.ChatID)
+			assert.Equal(t, "http://localhost:8081", tf.endpoint)
+		})
+	}
+}
+
+func TestOpen(t *testing.T) {
+	ctx := context.Background()
+	f, m := newTestFs(t)
+	payload := []byte("0123456789abcdef")
+	message := m.addDocument("file.txt", payload)
+
+	for _, ignoreRange := range []bool{false, true} {
+		m.ignoreRange = ignoreRange
+		for _, test := range []struct {
+			options []fs.OpenOption
+			want    string
+		}{
+			{nil, "0123456789abcdef"},
+			{[]fs.OpenOption{&fs.RangeOption{Start: 2, End: 5}}, "2345"},
+			{[]fs.OpenOption{&fs.RangeOption{Start: 10, End: -1}}, "abcdef"},
+			{[]fs.OpenOption{&fs.RangeOption{Start: -1, End: 4}}, "cdef"},
+			{[]fs.OpenOption{&fs.SeekOption{Offset: 3}}, "3456789abcdef"},
+		} {
+			t.Run(fmt.Sprintf("ignoreRange=%v,%v", ignoreRange, test.options), func(t *testing.T) {
+				o := &Object{fs: f, remote: "file.txt", fileID: message.Document.FileID}
+				in, err := o.Open(ctx, test.options...)
+				require.NoError(t, err)
+				got, err := io.ReadAll(in)
+				require.NoError(t, err)
+				require.NoError(t, in.Close())
+				assert.Equal(t, test.want, string(got))
+			})
+		}
+	}
+}
+
+// TestOpenBoundaryRanges reads every range starting and ending next
+// to a part boundary of a chunked file, and the same ranges of a file
+// stored whole, checking them against the source
+func TestOpenBoundaryRanges(t *testing.T) {
+	ctx := context.Background()
+	f, m := newTestFs(t)
+	const content = "0123456789abcde"
+	const size = int64(len(content))
+	whole := putFile(ctx, t, f, "whole.txt", content)
+	require.Empty(t, whole.chunks)
+	f.opt.ChunkSize = 4
+	chunked := putFile(ctx, t, f, "chunked.txt", content)
+	require.Len(t, chunked.chunks, 4)
+
+	// Offsets either side of each part boundary and the ends
+	var offsets []int64
+	for boundary := int64(0); boundary <= size+4; boundary += 4 {
+		for _, offset := range []int64{boundary - 1, boundary, boundary + 1} {
+			if offset >= 0 && offset <= size+1 && !slices.Contains(offsets, offset) {
+				offsets = append(offsets, offset)
+			}
+		}
+	}
+	offsets = append(offsets, size-1, size)
+	type rangeTest struct {
+		option fs.OpenOption
+		want   string
+	}
+	var tests []rangeTest
+	for _, start := range offsets {
+		if start >= size {
+			continue
+		}
+		tests = append(tests, rangeTest{&fs.RangeOption{Start: start, End: -1}, content[start:]})
+		tests = append(tests, rangeTest{&fs.SeekOption{Offset: start}, content[start:]})
+		for _, end := range offsets {
+			if end >= start {
+				tests = append(tests, rangeTest{&fs.RangeOption{Start: start, End: end}, content[start:min(end+1, size)]})
+			}
+		}
+	}
+	for _, offset := range offsets {
+		if offset > 0 {
+			tests = append(tests, rangeTest{&fs.RangeOption{Start: -1, End: offset}, content[size-min(offset, size):]})
+		}
+	}
+	tests = append(tests, rangeTest{&fs.SeekOption{Offset: size}, ""})
+
+	// Telegram may not say how big the file is so the size known
+	// from the manifest is used
+	for _, noFileSize := range []bool{false, true} {
+		for _, ignoreRange := range []bool{false, true} {
+			m.mu.Lock()
+			m.ignoreRange = ignoreRange
+			m.noFileSize = noFileSize
+			m.mu.Unlock()
+			for _, o := range []*Object{whole, chunked} {
+				for _, test := range tests {
+					// Options which don't apply are ignored
+					in, err := o.Open(ctx, test.option, &fs.HashesOption{Hashes: hash.Set(hash.MD5)})
+					require.NoError(t, err)
+					got, err := io.ReadAll(in)
+					require.NoError(t, err)
+					require.NoError(t, in.Close())
+					assert.Equal(t, test.want, string(got), "%s ignoreRange=%v noFileSize=%v %v", o.remote, ignoreRange, noFileSize, test.option)
+				}
+			}
+		}
+	}
+}
+
+func TestOpenNotFound(t *testing.T) {
+	ctx := context.Background()
+	f, _ := newTestFs(t)
+
+	o := &Object{fs: f, remote: "missing.txt"}
+	_, err := o.Open(ctx)
+	assert.ErrorIs(t, err, fs.ErrorObjectNotFound)
+
+	o = &Object{fs: f, remote: "expired.txt", fileID: "expired"}
+	_, err = o.Open(ctx)
+	assert.ErrorIs(t, err, fs.ErrorObjectNotFound)
+}
+
+func TestPutReturnsObject(t *testing.T) {
+	ctx := context.Background()
+	f, m := newTestFs(t)
+	payload := "hello telegram"
+	modTime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	src := object.NewStaticObjectInfo("dir/hello.txt", modTime, int64(len(payload)), true, nil, nil)
+
+	obj, err := f.Put(ctx, strings.NewReader(payload), src)
+	require.NoError(t, err)
+	require.NotNil(t, obj)
+
+	o := obj.(*Object)
+	assert.Equal(t, "dir/hello.txt", o.Remote())
+	assert.Equal(t, int64(len(payload)), o.Size())
+	assert.Equal(t, "file1", o.fileID)
+	assert.Equal(t, int64(1), o.messageID)
+	assert.True(t, modTime.Equal(o.ModTime(ctx)))
+	assert.Equal(t, 2, m.callCount("sendDocument")) // document and file list
+
+	in, err := o.Open(ctx)
+	require.NoError(t, err)
+	got, err := io.ReadAll(in)
+	require.NoError(t, err)
+	require.NoError(t, in.Close())
+	assert.Equal(t, payload, string(got))
+}
+
+func TestListFromManifest(t *testing.T) {
+	ctx := context.Background()
+	f, m := newTestFs(t)
+	modTime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	// Start with a legacy manifest holding a bare list of names
+	old := m.addDocument("old.txt", []byte("old"))
+	m.addDocument(fileListName, []byte(`["old.txt", "gone.txt"]`))
+
+	src := object.NewStaticObjectInfo("new.txt", modTime, 5, true, nil, nil)
+	_, err := f.Put(ctx, strings.NewReader("hello"), src)
+	require.NoError(t, err)
+
+	entries, err := f.List(ctx, "")
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+	// Nothing is known about the legacy files but their names
+	assert.Equal(t, "old.txt", entries[0].Remote())
+	assert.Equal(t, int64(0), entries[0].Size())
+	assert.Equal(t, "gone.txt", entries[1].Remote())
+	assert.Equal(t, int64(0), entries[1].Size())
+	assert.Equal(t, "new.txt", entries[2].Remote())
+	assert.Equal(t, int64(5), entries[2].Size())
+	assert.True(t, modTime.Equal(entries[2].ModTime(ctx)))
+
+	// The manifest has been upgraded to the current version
+	manifest, err := f.loadFileList(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, manifestVersion, manifest.Version)
+
+	// so they can't be read until the manifest is rebuilt from the
+	// messages carrying them
+	_, err = entries[0].(fs.Object).Open(ctx)
+	assert.ErrorIs(t, err, fs.ErrorObjectNotFound)
+	assert.ErrorContains(t, err, "rebuild")
+	_, err = f.Command(ctx, "rebuild", nil, nil)
+	require.NoError(t, err)
+	o, err := f.NewObject(ctx, "old.txt")
+	require.NoError(t, err)
+	assert.Equal(t, old.MessageID, o.(*Object).messageID)
+	assert.Equal(t, "old", readObject(ctx, t, o.(*Object)))
+}
+
+// putFile uploads a file called remote containing content
+func putFile(ctx context.Context, t *testing.T, f *Fs, remote, content string) *Object {
+	src := object.NewStaticObjectInfo(remote, time.Now(), int64(len(content)), true, nil, nil)
+	obj, err := f.Put(ctx, strings.NewReader(content), src)
+	require.NoError(t, err)
+	return obj.(*Object)
+}
+
+func TestPutReplaces(t *testing.T) {
+	ctx := context.Background()
+	f, m := newTestFs(t)
+	var objs []*Object
+	for _, content := range []string{"one", "two", "three"} {
+		objs = append(objs, putFile(ctx, t, f, "file.txt", content))
+	}
+	assert.Equal(t, []string{"file.txt"}, m.manifestPaths())
+	entries, err := f.List(ctx, "")
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "three", readObject(ctx, t, entries[0].(fs.Object)))
+
+	// The replaced documents are deleted
+	assert.False(t, m.hasMessage(objs[0].messageID))
+	assert.False(t, m.hasMessage(objs[1].messageID))
+	assert.True(t, m.hasMessage(objs[2].messageID))
+}
+
+func TestDuplicatesInManifest(t *testing.T) {
+	ctx := context.Background()
+	f, m := newTestFs(t)
+	modTime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	older := m.addDocument("file.txt", []byte("older"))
+	newer := m.addDocument("file.txt", []byte("newer"))
+	data, err := json.Marshal(&manifest{Version: manifestVersion, Sequence: 1, Entries: []*manifestEntry{
+		{Path: "file.txt", Size: 5, ModTime: modTime, FileID: older.Document.FileID, MessageID: older.MessageID, Sequence: 1},
+		{Path: "file.txt", Size: 5, ModTime: modTime.Add(time.Hour), FileID: newer.Document.FileID, MessageID: newer.MessageID, Sequence: 1},
+	}})
+	require.NoError(t, err)
+	m.addDocument(fileListName, data)
+
+	// Only the newest is listed
+	entries, err := f.List(ctx, "")
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "newer", readObject(ctx, t, entries[0].(fs.Object)))
+	assert.True(t, m.hasMessage(older.MessageID))
+
+	// and the older is dropped, and its document deleted, on the next save
+	putFile(ctx, t, f, "other.txt", "other")
+	assert.Equal(t, []string{"file.txt", "other.txt"}, m.manifestPaths())
+	assert.False(t, m.hasMessage(older.MessageID))
+	assert.True(t, m.hasMessage(newer.MessageID))
+}
+
+func TestRemove(t *testing.T) {
+	ctx := context.Background()
+	f, m := newTestFs(t)
+	putFile(ctx, t, f, "a.txt", "aaa")
+	b := putFile(ctx, t, f, "b.txt", "bbb")
+	c := putFile(ctx, t, f, "c.txt", "ccc")
+
+	require.True(t, m.hasMessage(b.messageID))
+	require.NoError(t, b.Remove(ctx))
+	assert.False(t, m.hasMessage(b.messageID))
+	assert.Equal(t, []string{"a.txt", "c.txt"}, m.manifestPaths())
+
+	// A message which has already gone still has its entry removed
+	m.mu.Lock()
+	for i, update := range m.updates {
+		if update.GetMessage().MessageID == c.messageID {
+			m.updates = append(m.updates[:i], m.updates[i+1:]...)
+			break
+		}
+	}
+	m.mu.Unlock()
+	require.NoError(t, c.Remove(ctx))
+	assert.Equal(t, []string{"a.txt"}, m.manifestPaths())
+
+	// Removing it again is an error
+	assert.ErrorIs(t, c.Remove(ctx), fs.ErrorObjectNotFound)
+}
+
+// readObject reads the whole content of o
+func readObject(ctx context.Context, t *testing.T, o fs.Object) string {
+	in, err := o.Open(ctx)
+	require.NoError(t, err)
+	data, err := io.ReadAll(in)
+	require.NoError(t, err)
+	require.NoError(t, in.Close())
+	return string(data)
+}
+
+func TestUpdate(t *testing.T) {
+	ctx := context.Background()
+	f, m := newTestFs(t)
+	a := putFile(ctx, t, f, "a.txt", "old")
+	putFile(ctx, t, f, "b.txt", "bbb")
+	oldMessageID := a.messageID
+
+	content := "new content"
+	src := object.NewStaticObjectInfo("a.txt", time.Now(), int64(len(content)), true, nil, nil)
+	require.NoError(t, a.Update(ctx, strings.NewReader(content), src))
+
+	assert.Equal(t, int64(len(content)), a.Size())
+	assert.NotEqual(t, oldMessageID, a.messageID)
+	assert.False(t, m.hasMessage(oldMessageID))
+	assert.Equal(t, []string{"a.txt", "b.txt"}, m.manifestPaths())
+	assert.Equal(t, content, readObject(ctx, t, a))
+
+	o, err := f.NewObject(ctx, "a.txt")
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(content)), o.Size())
+}
+
+func TestUpdateManifestFailure(t *testing.T) {
+	ctx := context.Background()
+	f, m := newTestFs(t)
+	a := putFile(ctx, t, f, "a.txt", "old")
+	oldMessageID := a.messageID
+
+	m.failUpload = fileListName
+	src := object.NewStaticObjectInfo("a.txt", time.Now(), 3, true, nil, nil)
+	err := a.Update(ctx, strings.NewReader("new"), src)
+	require.Error(t, err)
+	m.failUpload = ""
+
+	// The old entry and message are untouched
+	assert.Equal(t, oldMessageID, a.messageID)
+	assert.True(t, m.hasMessage(oldMessageID))
+	entry := m.manifest().find("a.txt")
+	require.NotNil(t, entry)
+	assert.Equal(t, oldMessageID, entry.MessageID)
+	assert.Equal(t, "old", readObject(ctx, t, a))
+}
+
+func TestChunkedUpload(t *testing.T) {
+	ctx := context.Background()
+	f, m := newTestFs(t)
+	f.opt.ChunkSize = 4
+	a := putFile(ctx, t, f, "a.txt", "0123456789")
+
+	require.Len(t, a.chunks, 3)
+	assert.Equal(t, int64(10), a.size)
+	for i, size := range []int64{4, 4, 2} {
+		assert.Equal(t, size, a.chunks[i].Size)
+		assert.True(t, m.hasMessage(a.chunks[i].MessageID))
+	}
+	entry := m.manifest().find("a.txt")
+	require.NotNil(t, entry)
+	assert.Equal(t, a.chunks, entry.Chunks)
+	assert.Equal(t, "0123456789", readObject(ctx, t, a))
+
+	for _, test := range []struct {
+		options []fs.OpenOption
+		want    string
+	}{
+		{[]fs.OpenOption{&fs.RangeOption{Start: 2, End: 5}}, "2345"},
+		{[]fs.OpenOption{&fs.RangeOption{Start: 4, End: 7}}, "4567"},
+		{[]fs.OpenOption{&fs.RangeOption{Start: -1, End: 3}}, "789"},
+		{[]fs.OpenOption{&fs.SeekOption{Offset: 9}}, "9"},
+		{[]fs.OpenOption{&fs.SeekOption{Offset: 10}}, ""},
+	} {
+		in, err := a.Open(ctx, test.options...)
+		require.NoError(t, err)
+		data, err := io.ReadAll(in)
+		require.NoError(t, err)
+		require.NoError(t, in.Close())
+		assert.Equal(t, test.want, string(data), fmt.Sprint(test.options))
+	}
+
+	// Unknown size is always chunked
+	src := object.NewStaticObjectInfo("b.txt", time.Now(), -1, true, nil, nil)
+	obj, err := f.Put(ctx, strings.NewReader("abcdefgh"), src)
+	require.NoError(t, err)
+	b := obj.(*Object)
+	require.Len(t, b.chunks, 2)
+	assert.Equal(t, int64(8), b.size)
+	assert.Equal(t, "abcdefgh", readObject(ctx, t, b))
+
+	// Updating and removing delete every part
+	oldChunks := a.chunks
+	require.NoError(t, a.Update(ctx, strings.NewReader("xyz"), object.NewStaticObjectInfo("a.txt", time.Now(), 3, true, nil, nil)))
+	for _, chunk := range oldChunks {
+		assert.False(t, m.hasMessage(chunk.MessageID))
+	}
+	assert.Empty(t, a.chunks)
+	assert.Equal(t, "xyz", readObject(ctx, t, a))
+	bChunks := b.chunks
+	require.NoError(t, b.Remove(ctx))
+	for _, chunk := range bChunks {
+		assert.False(t, m.hasMessage(chunk.MessageID))
+	}
+	assert.Equal(t, []string{"a.txt"}, m.manifestPaths())
+}
+
+func TestChunkedRanges(t *testing.T) {
+	ctx := context.Background()
+	f, m := newTestFs(t)
+	f.opt.ChunkSize = 4
+	a := putFile(ctx, t, f, "a.txt", "0123456789abcdefghij")
+	for _, test := range []struct {
+		start, end int64
+		want       string
+	}{
+		{0, 19, "0123456789abcdefghij"},
+		{1, 2, "12"},
+		{3, 4, "34"},
+		{4, 7, "4567"},
+		{6, 13, "6789abcd"},
+		{19, 19, "j"},
+	} {
+		m.mu.Lock()
+		m.downloaded = 0
+		m.mu.Unlock()
+		in, err := a.Open(ctx, &fs.RangeOption{Start: test.start, End: test.end})
+		require.NoError(t, err)
+		data, err := io.ReadAll(in)
+		require.NoError(t, err)
+		require.NoError(t, in.Close())
+		assert.Equal(t, test.want, string(data))
+		// Only the bytes in the range are downloaded
+		m.mu.Lock()
+		assert.Equal(t, int64(len(test.want)), m.downloaded, "range %d-%d", test.start, test.end)
+		m.mu.Unlock()
+	}
+}
+
+// TestChunkBoundaries checks files which end on and just past the
+// end of a part with chunk_size set in the config
+func TestChunkBoundaries(t *testing.T) {
+	ctx := context.Background()
+	const chunkSize = 4 * 1024
+	for _, test := range []struct {
+		size  int
+		parts int // 0 if sent as one document
+	}{
+		{1, 0},
+		{chunkSize - 1, 0},
+		{chunkSize, 0},
+		{chunkSize + 1, 2},
+		{2 * chunkSize, 2},
+		{2*chunkSize + 1, 3},
+		{3 * chunkSize, 3},
+	} {
+		t.Run(fmt.Sprint(test.size), func(t *testing.T) {
+			m := newMockServer(t)
+			config := m.config()
+			config["chunk_size"] = "4Ki"
+			fsys, err := NewFs(ctx, "TestTelegram", "", config)
+			require.NoError(t, err)
+			f := fsys.(*Fs)
+			data := make([]byte, test.size)
+			_, err = io.ReadFull(readers.NewPatternReader(int64(test.size)), data)
+			require.NoError(t, err)
+			a := putFile(ctx, t, f, "a.bin", string(data))
+
+			require.Len(t, a.chunks, test.parts)
+			for i, chunk := range a.chunks {
+				m.mu.Lock()
+				assert.Equal(t, chunkName("a.bin", i+1), m.message(chunk.MessageID).Document.FileName)
+				m.mu.Unlock()
+				assert.Equal(t, int64(min(chunkSize, test.size-i*chunkSize)), chunk.Size)
+			}
+			o, err := m.newFs().NewObject(ctx, "a.bin")
+			require.NoError(t, err)
+			assert.Equal(t, string(data), readObject(ctx, t, o))
+			sum, err := o.Hash(ctx, hash.MD5)
+			require.NoError(t, err)
+			assert.Equal(t, fmt.Sprintf("%x", md5.Sum(data)), sum)
+
+			// A range over the end of each part only downloads
+			// the bytes asked for
+			for end := chunkSize - 1; end < test.size-1; end += chunkSize {
+				m.mu.Lock()
+				m.downloaded = 0
+				m.mu.Unlock()
+				in, err := o.Open(ctx, &fs.RangeOption{Start: int64(end - 1), End: int64(end + 2)})
+				require.NoError(t, err)
+				got, err := io.ReadAll(in)
+				require.NoError(t, err)
+				require.NoError(t, in.Close())
+				want := data[end-1 : min(end+3, test.size)]
+				assert.Equal(t, want, got)
+				m.mu.Lock()
+				assert.Equal(t, int64(len(want)), m.downloaded)
+				m.mu.Unlock()
+			}
+
+			if test.parts > 0 {
+				// An upload failing at the last part carries on
+				// from there when sent again
+				require.NoError(t, a.Remove(ctx))
+				m.mu.Lock()
+				m.failUpload = chunkName("b.bin", test.parts)
+				m.mu.Unlock()
+				src := object.NewStaticObjectInfo("b.bin", time.Now(), int64(test.size), true, nil, nil)
+				_, err = f.Put(ctx, bytes.NewReader(data), src)
+				require.ErrorContains(t, err, fmt.Sprintf("part %d", test.parts))
+				m.mu.Lock()
+				m.failUpload = ""
+				m.mu.Unlock()
+				p := m.manifest().findPending("b.bin")
+				require.NotNil(t, p)
+				a = putFile(ctx, t, f, "b.bin", string(data))
+				require.Len(t, a.chunks, test.parts)
+				for i, chunk := range p.Chunks[:test.parts-1] {
+					assert.Equal(t, chunk.MessageID, a.chunks[i].MessageID, "part %d", i+1)
+				}
+				assert.Equal(t, string(data), readObject(ctx, t, a))
+			}
+
+			// Updating and removing delete every part
+			oldID, oldChunks := a.messageID, a.chunks
+			src := object.NewStaticObjectInfo(a.Remote(), time.Now(), 3, true, nil, nil)
+			require.NoError(t, a.Update(ctx, strings.NewReader("new"), src))
+			newID := a.messageID
+			require.NoError(t, a.Remove(ctx))
+			for _, chunk := range oldChunks {
+				assert.False(t, m.hasMessage(chunk.MessageID))
+			}
+			assert.False(t, m.hasMessage(oldID))
+			assert.False(t, m.hasMessage(newID))
+			assert.Empty(t, m.manifestPaths())
+		})
+	}
+}
+
+func TestMultiThreadDownload(t *testing.T) {
+	ctx := context.Background()
+	f, m := newTestFs(t)
+	f.opt.ChunkSize = 64 * fs.Kibi
+	const size = 1024 * 1024
+	data := make([]byte, size)
+	_, err := io.ReadFull(readers.NewPatternReader(size), data)
+	require.NoError(t, err)
+	src := putFile(ctx, t, f, "big.bin", string(data))
+	require.Len(t, src.chunks, 16)
+	m.mu.Lock()
+	m.downloadDelay = 20 * time.Millisecond
+	m.mu.Unlock()
+
+	dst, err := local.NewFs(ctx, "local", t.TempDir(), configmap.Simple{})
+	require.NoError(t, err)
+	download := func(streams int) time.Duration {
+		ctx, ci := fs.AddConfig(ctx)
+		ci.MultiThreadStreams = streams
+		ci.MultiThreadCutoff = 256 * fs.Kibi
+		ci.MultiThreadChunkSize = 256 * fs.Kibi
+		m.mu.Lock()
+		m.maxDownloadInFlight = 0
+		m.downloaded = 0
+		m.mu.Unlock()
+		start := time.Now()
+		obj, err := operations.Copy(ctx, dst, nil, fmt.Sprintf("big%d.bin", streams), src)
+		require.NoError(t, err)
+		elapsed := time.Since(start)
+		assert.Equal(t, string(data), readObject(ctx, t, obj))
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		assert.Equal(t, int64(size), m.downloaded, "each part downloaded once")
+		assert.Equal(t, streams, m.maxDownloadInFlight)
+		return elapsed
+	}
+	single := download(1)
+	multi := download(4)
+	assert.Less(t, multi, single/2, "4 streams took %v, 1 stream took %v", multi, single)
+}
+
+func TestChunkedUploadFailure(t *testing.T) {
+	ctx := context.Background()
+	f, m := newTestFs(t)
+	f.opt.ChunkSize = 4
+	m.failUpload = chunkName("a.txt", 3)
+	// Uploads of unknown size can't be resumed so the parts are deleted
+	src := object.NewStaticObjectInfo("a.txt", time.Now(), -1, true, nil, nil)
+	_, err := f.Put(ctx, strings.NewReader("0123456789"), src)
+	require.ErrorContains(t, err, "part 3")
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	assert.Empty(t, m.updates)
+}
+
+func TestResumeUpload(t *testing.T) {
+	ctx := context.Background()
+	const content = "0123456789abcdefghij"
+	for _, concurrency := range []int{1, 4} {
+		t.Run(fmt.Sprint(concurrency), func(t *testing.T) {
+			f, m := newTestFs(t)
+			f.opt.ChunkSize = 4
+			f.opt.UploadConcurrency = concurrency
+			put := func(content string) (*Object, error) {
+				src := object.NewStaticObjectInfo("a.txt", time.Now(), int64(len(content)), true, nil, nil)
+				obj, err := f.Put(ctx, strings.NewReader(content), src)
+				if err != nil {
+					return nil, err
+				}
+				return obj.(*Object), nil
+			}
+			failAt := func(n int) *pendingUpload {
+				m.mu.Lock()
+				m.failUpload = chunkName("a.txt", n)
+				m.mu.Unlock()
+				_, err := put(content)
+				require.ErrorContains(t, err, fmt.Sprintf("part %d", n))
+				m.mu.Lock()
+				m.failUpload = ""
+				m.mu.Unlock()
+				p := m.manifest().findPending("a.txt")
+				require.NotNil(t, p)
+				assert.Equal(t, int64(len(content)), p.Size)
+				require.NotNil(t, p.Chunks[0])
+				assert.True(t, len(p.Chunks) < n || p.Chunks[n-1] == nil, "failed part recorded")
+				return p
+			}
+
+			// The parts sent before the failure are kept and used
+			// when the same file is uploaded again
+			p := failAt(4)
+			a, err := put(content)
+			require.NoError(t, err)
+			require.Len(t, a.chunks, 5)
+			for i, chunk := range p.Chunks {
+				if chunk != nil {
+					assert.Equal(t, chunk.MessageID, a.chunks[i].MessageID, "part %d", i+1)
+				}
+			}
+			assert.Equal(t, content, readObject(ctx, t, a))
+			assert.Empty(t, m.manifest().Pending)
+			require.NoError(t, a.Remove(ctx))
+
+			// but not if the file has changed
+			p = failAt(4)
+			changed := "X" + content[1:]
+			a, err = put(changed)
+			require.NoError(t, err)
+			assert.Equal(t, changed, readObject(ctx, t, a))
+			for _, chunk := range p.Chunks {
+				if chunk != nil {
+					assert.False(t, m.hasMessage(chunk.MessageID))
+				}
+			}
+			assert.Empty(t, m.manifest().Pending)
+
+			// or is a different size
+			p = failAt(4)
+			a, err = put(content + "!")
+			require.NoError(t, err)
+			assert.Equal(t, content+"!", readObject(ctx, t, a))
+			for _, chunk := range p.Chunks {
+				if chunk != nil {
+					assert.False(t, m.hasMessage(chunk.MessageID))
+				}
+			}
+			assert.Empty(t, m.manifest().Pending)
+		})
+	}
+}
+
+func TestCleanupPending(t *testing.T) {
+	ctx := context.Background()
+	f, m := newTestFs(t)
+	f.opt.ChunkSize = 4
+	m.failUpload = chunkName("a.txt", 3)
+	src := object.NewStaticObjectInfo("a.txt", time.Now(), 10, true, nil, nil)
+	_, err := f.Put(ctx, strings.NewReader("0123456789"), src)
+	require.Error(t, err)
+	p := m.manifest().findPending("a.txt")
+	require.NotNil(t, p)
+
+	// Recent uploads are kept
+	_, err = f.Command(ctx, "cleanup-pending", nil, nil)
+	require.NoError(t, err)
+	assert.NotNil(t, m.manifest().findPending("a.txt"))
+
+	_, err = f.Command(ctx, "cleanup-pending", nil, map[string]string{"max-age": "bad"})
+	assert.ErrorContains(t, err, "bad max-age")
+
+	_, err = f.Command(ctx, "cleanup-pending", nil, map[string]string{"max-age": "0s"})
+	require.NoError(t, err)
+	assert.Empty(t, m.manifest().Pending)
+	for _, chunk := range p.Chunks {
+		if chunk != nil {
+			assert.False(t, m.hasMessage(chunk.MessageID))
+		}
+	}
+
+	_, err = f.Command(ctx, "unknown", nil, nil)
+	assert.Equal(t, fs.ErrorCommandNotFound, err)
+}
+
+func TestPublicLink(t *testing.T) {
+	ctx := context.Background()
+	f, m := newTestFs(t)
+	a := putFile(ctx, t, f, "dir/a.txt", "aaa")
+	putFile(ctx, t, f, "empty.txt", "")
+	f.opt.ChunkSize = 4
+	putFile(ctx, t, f, "big.txt", "0123456789")
+	messageID := a.messageID
+
+	// Private supergroups give links only members can open
+	link, err := f.PublicLink(ctx, "dir/a.txt", fs.DurationOff, false)
+	require.NoError(t, err)
+	assert.Equal(t, fmt.Sprintf("https://t.me/c/1234567890/%d", messageID), link)
+
+	// Public chats are linked to by username
+	m.mu.Lock()
+	m.username = "rclone_files"
+	m.mu.Unlock()
+	link, err = f.PublicLink(ctx, "dir/a.txt", fs.DurationOff, false)
+	require.NoError(t, err)
+	assert.Equal(t, fmt.Sprintf("https://t.me/rclone_files/%d", messageID), link)
+
+	// Links don't expire so the expiry is ignored
+	link, err = f.PublicLink(ctx, "dir/a.txt", fs.Duration(time.Hour), false)
+	require.NoError(t, err)
+	assert.Equal(t, fmt.Sprintf("https://t.me/rclone_files/%d", messageID), link)
+	_, err = f.PublicLink(ctx, "dir", fs.DurationOff, false)
+	assert.ErrorIs(t, err, fs.ErrorCantShareDirectories)
+	_, err = f.PublicLink(ctx, "dir/a.txt", fs.DurationOff, true)
+	assert.ErrorIs(t, err, fs.ErrorNotImplemented)
+	_, err = f.PublicLink(ctx, "big.txt", fs.DurationOff, false)
+	assert.ErrorContains(t, err, "stored as 3 separate parts")
+	_, err = f.PublicLink(ctx, "empty.txt", fs.DurationOff, false)
+	assert.ErrorContains(t, err, "empty files")
+	_, err = f.PublicLink(ctx, "missing.txt", fs.DurationOff, false)
+	assert.ErrorIs(t, err, fs.ErrorObjectNotFound)
+}
+
+func TestGetLink(t *testing.T) {
+	ctx := context.Background()
+	f, m := newTestFs(t)
+	a := putFile(ctx, t, f, "dir/a.txt", "aaa")
+	putFile(ctx, t, f, "dir/empty.txt", "")
+	f.opt.ChunkSize = 4
+	big := putFile(ctx, t, f, "dir/sub/big.txt", "0123456789")
+	putFile(ctx, t, f, "other.txt", "ooo")
+	link := func(messageID int64) string {
+		return fmt.Sprintf("https://t.me/c/1234567890/%d", messageID)
+	}
+
+	out, err := f.Command(ctx, "get-link", []string{"dir/a.txt", "dir/sub/big.txt"}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, map[string][]string{
+		"dir/a.txt":       {link(a.messageID)},
+		"dir/sub/big.txt": {link(big.chunks[0].MessageID), link(big.chunks[1].MessageID), link(big.chunks[2].MessageID)},
+	}, out)
+
+	// Directories need recursive and skip files which can't be linked to
+	_, err = f.Command(ctx, "get-link", []string{"dir"}, nil)
+	assert.ErrorContains(t, err, "use -o recursive=true")
+	out, err = f.Command(ctx, "get-link", []string{"dir"}, map[string]string{"recursive": "true"})
+	require.NoError(t, err)
+	links := out.(map[string][]string)
+	assert.ElementsMatch(t, []string{"dir/a.txt", "dir/sub/big.txt"}, slices.Collect(maps.Keys(links)))
+
+	// Public chats are linked to by username
+	m.mu.Lock()
+	m.username = "rclone_files"
+	m.mu.Unlock()
+	out, err = f.Command(ctx, "get-link", []string{"dir/a.txt"}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, map[string][]string{"dir/a.txt": {fmt.Sprintf("https://t.me/rclone_files/%d", a.messageID)}}, out)
+
+	_, err = f.Command(ctx, "get-link", []string{"dir/empty.txt"}, nil)
+	assert.ErrorContains(t, err, "empty files")
+	_, err = f.Command(ctx, "get-link", []string{"missing.txt"}, nil)
+	assert.ErrorIs(t, err, fs.ErrorObjectNotFound)
+	_, err = f.Command(ctx, "get-link", nil, nil)
+	assert.ErrorContains(t, err, "need at least one path")
+	_, err = f.Command(ctx, "get-link", []string{"dir"}, map[string]string{"recursive": "potato"})
+	assert.ErrorContains(t, err, "bad recursive")
+}
+
+func TestDownloadURL(t *testing.T) {
+	ctx := context.Background()
+	f, m := newTestFs(t)
+	a := putFile(ctx, t, f, "dir/a.txt", "aaa")
+	putFile(ctx, t, f, "empty.txt", "")
+	f.opt.ChunkSize = 2
+	putFile(ctx, t, f, "big.txt", "01234")
+
+	out, err := f.Command(ctx, "download-url", []string{"dir/a.txt"}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, m.srv.URL+"/file/bot"+testToken+"/documents/"+a.fileID, out)
+	resp, err := http.Get(out.(string))
+	require.NoError(t, err)
+	data, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	assert.Equal(t, "aaa", string(data))
+
+	out, err = f.Command(ctx, "download-url", []string{"dir/a.txt"}, map[string]string{"redact": "true"})
+	require.NoError(t, err)
+	assert.Equal(t, "documents/"+a.fileID, out)
+
+	// Servers run with --local give the path on their disk
+	m.mu.Lock()
+	m.localDir = "/var/lib/telegram-bot-api"
+	m.mu.Unlock()
+	out, err = f.Command(ctx, "download-url", []string{"dir/a.txt"}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, m.srv.URL+"/file/bot"+testToken+"/documents/"+a.fileID, out)
+
+	_, err = f.Command(ctx, "download-url", []string{"big.txt"}, nil)
+	assert.ErrorContains(t, err, "stored as 3 separate parts")
+	_, err = f.Command(ctx, "download-url", []string{"empty.txt"}, nil)
+	assert.ErrorContains(t, err, "empty files")
+	_, err = f.Command(ctx, "download-url", []string{"missing.txt"}, nil)
+	assert.ErrorIs(t, err, fs.ErrorObjectNotFound)
+	_, err = f.Command(ctx, "download-url", nil, nil)
+	assert.ErrorContains(t, err, "need exactly one path")
+	_, err = f.Command(ctx, "download-url", []string{"dir/a.txt"}, map[string]string{"redact": "potato"})
+	assert.ErrorContains(t, err, "bad redact")
+}
+
+func TestMetadata(t *testing.T) {
+	ctx := context.Background()
+	ctx, ci := fs.AddConfig(ctx)
+	ci.Metadata = true
+	f, m := newTestFs(t)
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 6, time.UTC)
+	meta := fs.Metadata{
+		"mtime":        "2021-06-07T08:09:10.123456789Z",
+		"btime":        "2019-01-01T00:00:00Z",
+		"content-type": "text/plain",
+		"colour":       "blue",
+	}
+	src := object.NewStaticObjectInfo("a.txt", modTime, 3, true, nil, nil).WithMetadata(meta)
+	obj, err := f.Put(ctx, strings.NewReader("aaa"), src)
+	require.NoError(t, err)
+	b := putFile(ctx, t, f, "b.txt", "bbb")
+
+	// mtime is kept as the modification time of the entry
+	entry := m.manifest().find("a.txt")
+	require.NotNil(t, entry)
+	assert.Equal(t, "2021-06-07 08:09:10.123456789 +0000 UTC", entry.ModTime.String())
+	assert.Equal(t, fs.Metadata{"btime": meta["btime"], "colour": "blue"}, entry.Metadata)
+	assert.Equal(t, "text/plain", entry.MimeType)
+	assert.Nil(t, m.manifest().find("b.txt").Metadata)
+	got, err := obj.(*Object).Metadata(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, meta, got)
+
+	// Read back from the manifest
+	require.NoError(t, f.forgetFileList(ctx))
+	obj, err = f.NewObject(ctx, "a.txt")
+	require.NoError(t, err)
+	got, err = obj.(*Object).Metadata(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, meta, got)
+	got, err = b.Metadata(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, fs.Metadata{"mtime": b.modTime.Format(time.RFC3339Nano), "content-type": "text/plain; charset=utf-8"}, got)
+
+	// Server side copies and moves keep the metadata
+	ci.Metadata = false
+	copied, err := f.Copy(ctx, obj, "c.txt")
+	require.NoError(t, err)
+	got, err = copied.(*Object).Metadata(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, meta, got)
+	moved, err := f.Move(ctx, copied, "d.txt")
+	require.NoError(t, err)
+	got, err = moved.(*Object).Metadata(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, meta, got)
+
+	// Setting the modification time keeps the other keys
+	newModTime := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	require.NoError(t, moved.SetModTime(ctx, newModTime))
+	got, err = moved.(*Object).Metadata(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "blue", got["colour"])
+	assert.Equal(t, "2022-01-01T00:00:00Z", got["mtime"])
+
+	// Updating with --metadata-set changes the keys
+	ci.Metadata = true
+	err = obj.Update(ctx, strings.NewReader("AAAA"), object.NewStaticObjectInfo("a.txt", modTime, 4, true, nil, nil), fs.MetadataOption{"colour": "red"})
+	require.NoError(t, err)
+	assert.Equal(t, fs.Metadata{"colour": "red"}, m.manifest().find("a.txt").Metadata)
+	assert.True(t, modTime.Equal(obj.ModTime(ctx)))
+
+	// Bad times are rejected before anything is uploaded
+	src = object.NewStaticObjectInfo("e.txt", modTime, 3, true, nil, nil).WithMetadata(fs.Metadata{"btime": "yesterday"})
+	_, err = f.Put(ctx, strings.NewReader("eee"), src)
+	assert.ErrorContains(t, err, "failed to parse metadata btime")
+	assert.Nil(t, m.manifest().find("e.txt"))
+}
+
+func TestMimeType(t *testing.T) {
+	ctx := context.Background()
+	f, m := newTestFs(t)
+	sentMimeType := func(fileName string) string {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		for i := len(m.updates) - 1; i >= 0; i-- {
+			if doc := m.updates[i].GetMessage().Document; doc != nil && doc.FileName == fileName {
+				return doc.MimeType
+			}
+		}
+		return ""
+	}
+
+	assert.True(t, f.Features().ReadMimeType)
+	assert.True(t, f.Features().WriteMimeType)
+
+	// The MIME type is guessed from the name and sent with the document
+	for remote, want := range map[string]string{
+		"doc.pdf":   "application/pdf",
+		"image.jpg": "image/jpeg",
+		"video.mp4": "video/mp4",
+		"unknown":   "application/octet-stream",
+	} {
+		o := putFile(ctx, t, f, remote, "data")
+		assert.Equal(t, want, o.MimeType(ctx), remote)
+		assert.Equal(t, want, sentMimeType(remote), remote)
+		assert.Equal(t, want, m.manifest().find(remote).MimeType, remote)
+	}
+	assert.Equal(t, manifestMimeType, sentMimeType(fileListName))
+
+	// The type of the source is used if it has one
+	src := object.NewStaticObjectInfo("photo.dat", time.Now(), 4, true, nil, nil).WithMimeType("image/png")
+	o, err := f.Put(ctx, strings.NewReader("data"), src)
+	require.NoError(t, err)
+	assert.Equal(t, "image/png", o.(*Object).MimeType(ctx))
+	assert.Equal(t, "image/png", sentMimeType("photo.dat"))
+
+	// and the content-type metadata overrides it
+	ctx2, ci := fs.AddConfig(ctx)
+	ci.Metadata = true
+	src = object.NewStaticObjectInfo("notes.txt", time.Now(), 4, true, nil, nil).WithMetadata(fs.Metadata{"content-type": "text/markdown"})
+	o, err = f.Put(ctx2, strings.NewReader("data"), src)
+	require.NoError(t, err)
+	assert.Equal(t, "text/markdown", o.(*Object).MimeType(ctx))
+	assert.Equal(t, "text/markdown", sentMimeType("notes.txt"))
+
+	// Parts of chunked files are sent as plain data
+	f.opt.ChunkSize = 4
+	big := putFile(ctx, t, f, "big.pdf", "0123456789")
+	f.opt.ChunkSize = defaultChunkSize
+	assert.Equal(t, "application/pdf", big.MimeType(ctx))
+	assert.Equal(t, "application/octet-stream", sentMimeType(chunkName("big.pdf", 1)))
+
+	// Empty files and copies keep their types
+	empty := putFile(ctx, t, f, "empty.html", "")
+	assert.Equal(t, "text/html; charset=utf-8", empty.MimeType(ctx))
+	copied, err := f.Copy(ctx, big, "copy.pdf")
+	require.NoError(t, err)
+	assert.Equal(t, "application/pdf", copied.(*Object).MimeType(ctx))
+
+	// and the types are read back from the manifest
+	require.NoError(t, f.forgetFileList(ctx))
+	o, err = f.NewObject(ctx, "image.jpg")
+	require.NoError(t, err)
+	assert.Equal(t, "image/jpeg", fs.MimeType(ctx, o))
+}
+
+func TestSendAs(t *testing.T) {
+	for _, test := range []struct {
+		mode     string
+		mimeType string
+		size     int64
+		want     string
+	}{
+		{sendMediaNone, "image/jpeg", 100, sendAsDocument},
+		{sendMediaNone, "video/mp4", 100, sendAsDocument},
+		{sendMediaVideoAudio, "image/jpeg", 100, sendAsDocument},
+		{sendMediaVideoAudio, "video/mp4", 100, sendAsVideo},
+		{sendMediaVideoAudio, "audio/mpeg", 100, sendAsAudio},
+		{sendMediaVideoAudio, "text/plain; charset=utf-8", 100, sendAsDocument},
+		{sendMediaAll, "image/png", 100, sendAsPhoto},
+		{sendMediaAll, "image/png", maxPhotoSize + 1, sendAsDocument},
+		{sendMediaAll, "image/gif", 100, sendAsDocument},
+		{sendMediaAll, "audio/mp4", 100, sendAsAudio},
+		{sendMediaAll, "application/pdf", 100, sendAsDocument},
+	} {
+		f := &Fs{opt: Options{SendAsMedia: test.mode}}
+		assert.Equal(t, test.want, f.sendAs(test.mimeType, test.size), "%s %s %d", test.mode, test.mimeType, test.size)
+	}
+}
+
+func TestSendAsMedia(t *testing.T) {
+	ctx := context.Background()
+	f, m := newTestFs(t)
+	f.opt.SendAsMedia = sendMediaAll
+	photo := putFile(ctx, t, f, "photo.jpg", "jpeg data")
+	video := putFile(ctx, t, f, "video.mp4", "mp4 data")
+	audio := putFile(ctx, t, f, "song.mp3", "mp3 data")
+	doc := putFile(ctx, t, f, "doc.pdf", "pdf data")
+	f.opt.ChunkSize = 4
+	big := putFile(ctx, t, f, "big.mp4", "0123456789")
+	f.opt.ChunkSize = defaultChunkSize
+	for method, want := range map[string]int{"sendPhoto": 1, "sendVideo": 1, "sendAudio": 1} {
+		assert.Equal(t, want, m.callCount(method), method)
+	}
+
+	// Videos and audio are stored unchanged
+	for _, o := range []*Object{video, audio, doc, big} {
+		if o != big {
+			assert.Equal(t, int64(8), o.Size(), o.remote)
+		}
+		md5, err := o.Hash(ctx, hash.MD5)
+		require.NoError(t, err)
+		assert.NotEmpty(t, md5, o.remote)
+	}
+	assert.Equal(t, "mp4 data", readObject(ctx, t, video))
+	assert.Equal(t, "mp3 data", readObject(ctx, t, audio))
+	assert.Equal(t, "0123456789", readObject(ctx, t, big))
+	manifest := m.manifest()
+	assert.Equal(t, sendAsVideo, manifest.find("video.mp4").SentAs)
+	assert.Equal(t, sendAsAudio, manifest.find("song.mp3").SentAs)
+	assert.Equal(t, sendAsDocument, manifest.find("doc.pdf").SentAs)
+	assert.Equal(t, sendAsDocument, manifest.find("big.mp4").SentAs)
+
+	// Photos are recompressed so have no known size or hash
+	assert.Equal(t, int64(-1), photo.Size())
+	md5, err := photo.Hash(ctx, hash.MD5)
+	require.NoError(t, err)
+	assert.Empty(t, md5)
+	assert.Equal(t, "image/jpeg", photo.MimeType(ctx))
+	assert.Equal(t, "recompressed jpeg data", readObject(ctx, t, photo))
+	entry := manifest.find("photo.jpg")
+	assert.Equal(t, sendAsPhoto, entry.SentAs)
+	assert.Equal(t, int64(len("recompressed jpeg data")), entry.Size)
+	assert.Empty(t, entry.MD5)
+
+	// Copies are sent the same way as the original
+	copied, err := f.Copy(ctx, photo, "photo copy.jpg")
+	require.NoError(t, err)
+	assert.Equal(t, int64(-1), copied.Size())
+	assert.Equal(t, "recompressed jpeg data", readObject(ctx, t, copied))
+	copied, err = f.Copy(ctx, video, "video copy.mp4")
+	require.NoError(t, err)
+	assert.Equal(t, "mp4 data", readObject(ctx, t, copied))
+	assert.Equal(t, 2, m.callCount("sendPhoto"))
+	assert.Equal(t, 2, m.callCount("sendVideo"))
+
+	// Media forwarded back into the chat are found by rebuild
+	m.forwardAll()
+	_, err = f.Command(ctx, "rebuild", nil, nil)
+	require.NoError(t, err)
+	manifest = m.manifest()
+	entry = manifest.find("photo.jpg")
+	require.NotNil(t, entry)
+	assert.Equal(t, sendAsPhoto, entry.SentAs)
+	assert.Empty(t, entry.MD5)
+	assert.Equal(t, int64(len("recompressed jpeg data")), entry.Size)
+	entry = manifest.find("video.mp4")
+	require.NotNil(t, entry)
+	assert.Equal(t, sendAsVideo, entry.SentAs)
+	assert.Equal(t, int64(8), entry.Size)
+}
+
+func TestSendOptions(t *testing.T) {
+	ctx := context.Background()
+	for _, test := range []struct {
+		silent, protect bool
+	}{
+		{false, false},
+		{true, false},
+		{false, true},
+		{true, true},
+	} {
+		t.Run(fmt.Sprintf("silent=%v,protect=%v", test.silent, test.protect), func(t *testing.T) {
+			f, m := newTestFs(t)
+			f.opt.Silent = test.silent
+			f.opt.ProtectContent = test.protect
+			f.opt.ChunkSize = 4
+			a := putFile(ctx, t, f, "a.txt", "aaa")
+			putFile(ctx, t, f, "b.txt", "0123456789")
+			f.opt.ChunkSize = defaultChunkSize
+			_, err := f.Copy(ctx, a, "c.txt")
+			require.NoError(t, err)
+			for _, fileName := range []string{"a.txt", chunkName("b.txt", 1), chunkName("b.txt", 3), fileListName} {
+				m.mu.Lock()
+				fields := m.sentFields[fileName]
+				m.mu.Unlock()
+				require.NotNil(t, fields, fileName)
+				wantSilent := test.silent || fileName == fileListName
+				assert.Equal(t, wantSilent, fields.Get("disable_notification") == "true", fileName)
+				assert.Equal(t, test.protect, fields.Get("protect_content") == "true", fileName)
+			}
+			// a.txt was sent again by Copy
+			assert.Equal(t, 1, m.resends)
+		})
+	}
+}
+
+func TestTopics(t *testing.T) {
+	ctx := context.Background()
+	m := newMockServer(t)
+	config := m.config()
+	config["use_topics"] = "true"
+
+	// Chats without topics are rejected
+	_, err := NewFs(ctx, "TestTelegram", "", config)
+	assert.ErrorContains(t, err, "doesn't have topics enabled")
+
+	m.forum = true
+	fsys, err := NewFs(ctx, "TestTelegram", "", config)
+	require.NoError(t, err)
+	f := fsys.(*Fs)
+	// threadOf returns the forum topic holding the message with id
+	threadOf := func(id int64) int64 {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		return m.message(id).MessageThreadID
+	}
+	// topicNames returns the names of the topics in the chat
+	topicNames := func() (names []string) {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		for _, name := range m.topics {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+		return names
+	}
+
+	// Top level directories are topics
+	require.NoError(t, f.Mkdir(ctx, "photos"))
+	assert.Equal(t, []string{"photos"}, topicNames())
+	photos := m.manifest().findTopic("photos")
+	require.NotNil(t, photos)
+	x := putFile(ctx, t, f, "photos/x.jpg", "xxx")
+	assert.Equal(t, photos.ThreadID, threadOf(x.messageID))
+	f.opt.ChunkSize = 4
+	big := putFile(ctx, t, f, "photos/sub/big.bin", "0123456789")
+	f.opt.ChunkSize = defaultChunkSize
+	for _, chunk := range big.chunks {
+		assert.Equal(t, photos.ThreadID, threadOf(chunk.MessageID))
+	}
+
+	// and are made when files are uploaded to them
+	a := putFile(ctx, t, f, "docs/a.txt", "aaa")
+	assert.Equal(t, []string{"docs", "photos"}, topicNames())
+	docs := m.manifest().findTopic("docs")
+	require.NotNil(t, docs)
+	assert.Equal(t, docs.ThreadID, threadOf(a.messageID))
+	assert.Equal(t, docs.ThreadID, m.manifest().find("docs/a.txt").TopicID)
+	y, err := f.Copy(ctx, x, "docs/y.jpg")
+	require.NoError(t, err)
+	assert.Equal(t, docs.ThreadID, threadOf(y.(*Object).messageID))
+
+	// Files in the root are in the General topic
+	r := putFile(ctx, t, f, "r.txt", "rrr")
+	assert.Zero(t, threadOf(r.messageID))
+	// listRoot returns the sorted entries in the root
+	listRoot := func() string {
+		entries, err := f.List(ctx, "")
+		require.NoError(t, err)
+		sort.Sort(entries)
+		return fmt.Sprint(entries)
+	}
+	assert.Equal(t, "[docs photos r.txt]", listRoot())
+
+	// Removing the files leaves the topic until the directory is removed
+	require.NoError(t, a.Remove(ctx))
+	require.NoError(t, y.Remove(ctx))
+	assert.Equal(t, "[docs photos r.txt]", listRoot())
+	assert.Equal(t, []string{"docs", "photos"}, topicNames())
+	require.NoError(t, f.Rmdir(ctx, "docs"))
+	assert.Equal(t, []string{"photos"}, topicNames())
+	assert.Nil(t, m.manifest().findTopic("docs"))
+
+	// Renaming a top level directory renames its topic
+	require.NoError(t, f.DirMove(ctx, f, "photos", "pictures"))
+	assert.Equal(t, []string{"pictures"}, topicNames())
+	assert.Equal(t, photos.ThreadID, m.manifest().findTopic("pictures").ThreadID)
+	z := putFile(ctx, t, f, "pictures/z.jpg", "zzz")
+	assert.Equal(t, photos.ThreadID, threadOf(z.messageID))
+
+	// Topics holding documents of files elsewhere aren't deleted
+	moved, err := f.Move(ctx, z, "z.jpg")
+	require.NoError(t, err)
+	require.NoError(t, f.Purge(ctx, "pictures"))
+	assert.Equal(t, []string{"pictures"}, topicNames())
+	assert.Equal(t, "zzz", readObject(ctx, t, moved))
+	assert.Equal(t, "[r.txt z.jpg]", listRoot())
+	require.NoError(t, moved.Remove(ctx))
+	creates := m.callCount("createForumTopic")
+	require.NoError(t, f.Mkdir(ctx, "pictures"))
+	assert.Equal(t, creates, m.callCount("createForumTopic"), "topic not reused")
+	require.NoError(t, f.Purge(ctx, ""))
+	assert.Empty(t, topicNames())
+}
+
+func TestChats(t *testing.T) {
+	ctx := context.Background()
+	const docsChatID = -1009999999999
+	m := newMockServer(t)
+	m.otherChats = []int64{docsChatID}
+	config := m.config()
+	delete(config, "chat_id")
+	config["chats"] = fmt.Sprintf("photos=%d, docs=%d", testChatID, docsChatID)
+	fsys, err := NewFs(ctx, "TestTelegram", "", config)
+	require.NoError(t, err)
+	f, ok := fsys.(*multiFs)
+	require.True(t, ok)
+
+	// The chats are the top level directories
+	entries, err := f.List(ctx, "")
+	require.NoError(t, err)
+	assert.Equal(t, "[photos docs]", fmt.Sprint(entries))
+	put := func(remote, content string) (fs.Object, error) {
+		return f.Put(ctx, strings.NewReader(content), object.NewStaticObjectInfo(remote, time.Now(), int64(len(content)), true, nil, nil))
+	}
+	_, err = put("a.txt", "aaa")
+	assert.ErrorContains(t, err, "can't upload \"a.txt\" to the root")
+	_, err = put("unknown/a.txt", "aaa")
+	assert.ErrorContains(t, err, "no chat called \"unknown\"")
+	for remote, content := range map[string]string{"photos/p.jpg": "ppp", "docs/d.txt": "ddd", "docs/sub/e.txt": "eee"} {
+		o, err := put(remote, content)
+		require.NoError(t, err)
+		assert.Equal(t, remote, o.Remote())
+	}
+
+	// Each chat has its own manifest without the name of the chat
+	assert.Equal(t, []string{"p.jpg"}, m.manifestPaths())
+	var docsPaths []string
+	for _, entry := range m.manifestIn(docsChatID).Entries {
+		docsPaths = append(docsPaths, entry.Path)
+	}
+	assert.ElementsMatch(t, []string{"d.txt", "sub/e.txt"}, docsPaths)
+	entries, err = f.List(ctx, "docs")
+	require.NoError(t, err)
+	sort.Sort(entries)
+	assert.Equal(t, "[docs/d.txt docs/sub]", fmt.Sprint(entries))
+	var all []string
+	require.NoError(t, f.ListR(ctx, "", func(entries fs.DirEntries) error {
+		for _, entry := range entries {
+			all = append(all, entry.Remote())
+		}
+		return nil
+	}))
+	assert.ElementsMatch(t, []string{"photos", "photos/p.jpg", "docs", "docs/d.txt", "docs/sub", "docs/sub/e.txt"}, all)
+	d, err := f.NewObject(ctx, "docs/d.txt")
+	require.NoError(t, err)
+	assert.Equal(t, "ddd", readObject(ctx, t, d))
+	_, err = f.NewObject(ctx, "docs")
+	assert.Equal(t, fs.ErrorObjectNotFound, err)
+
+	// Moves only work within a chat but the bot can send its
+	// documents to any chat it is in
+	_, err = f.Move(ctx, d, "photos/d.txt")
+	assert.Equal(t, fs.ErrorCantMove, err)
+	assert.Equal(t, fs.ErrorCantDirMove, f.DirMove(ctx, f, "docs/sub", "photos/sub"))
+	copied, err := f.Copy(ctx, d, "photos/d.txt")
+	require.NoError(t, err)
+	assert.Equal(t, "ddd", readObject(ctx, t, copied))
+	moved, err := f.Move(ctx, d, "docs/moved.txt")
+	require.NoError(t, err)
+	assert.Equal(t, "docs/moved.txt", moved.Remote())
+	require.NoError(t, f.DirMove(ctx, f, "docs/sub", "docs/sub2"))
+	// and the core copies between chats instead
+	_, err = operations.Move(ctx, f, nil, "photos/moved.txt", moved)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"p.jpg", "d.txt", "moved.txt"}, m.manifestPaths())
+
+	usage, err := f.About(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), *usage.Objects)
+	assert.Equal(t, int64(12), *usage.Used)
+
+	out, err := f.Command(ctx, "cleanup-pending", nil, nil)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]any{"photos": nil, "docs": nil}, out)
+
+	// Links are got from the chat holding each path
+	out, err = f.Command(ctx, "get-link", []string{"photos/p.jpg", "docs"}, map[string]string{"recursive": "true"})
+	require.NoError(t, err)
+	links := out.(map[string][]string)
+	require.Len(t, links, 2)
+	assert.Regexp(t, `^https://t\.me/c/1234567890/\d+$`, links["photos/p.jpg"][0])
+	assert.Regexp(t, `^https://t\.me/c/9999999999/\d+$`, links["docs/sub2/e.txt"][0])
+	_, err = f.Command(ctx, "get-link", []string{"nope/x"}, nil)
+	assert.ErrorContains(t, err, "no chat called \"nope\"")
+	out, err = f.Command(ctx, "du", []string{"docs"}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []*dirUsage{{"docs", 1, 3, 3}, {"docs/sub2", 1, 3, 3}}, out)
+	info, err := f.UserInfo(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "@rclone_test_bot", info["Bot"])
+	assert.Equal(t, strconv.Itoa(testChatID), info["photos.ChatID"])
+	assert.Equal(t, strconv.Itoa(docsChatID), info["docs.ChatID"])
+
+	// Roots inside a chat use just that chat
+	fsys, err = NewFs(ctx, "TestTelegram", "docs/sub2", config)
+	require.NoError(t, err)
+	entries, err = fsys.List(ctx, "")
+	require.NoError(t, err)
+	assert.Equal(t, "[e.txt]", fmt.Sprint(entries))
+	fsys, err = NewFs(ctx, "TestTelegram", "photos/p.jpg", config)
+	assert.Equal(t, fs.ErrorIsFile, err)
+	assert.Equal(t, "photos", fsys.Root())
+	_, err = NewFs(ctx, "TestTelegram", "nope/x", config)
+	assert.ErrorContains(t, err, "no chat called \"nope\"")
+
+	for _, test := range []struct {
+		chats, wantErr string
+	}{
+		{"photos", "must be name=chat_id"},
+		{"photos=1,photos=2", "used more than once"},
+		{"a/b=1", "can't contain /"},
+	} {
+		config := m.config()
+		config["chats"] = test.chats
+		delete(config, "chat_id")
+		_, err = NewFs(ctx, "TestTelegram", "", config)
+		assert.ErrorContains(t, err, test.wantErr, test.chats)
+	}
+	config = m.config()
+	config["chats"] = "photos=1"
+	_, err = NewFs(ctx, "TestTelegram", "", config)
+	assert.ErrorContains(t, err, "only one of chat_id and chats")
+}
+
+func TestRebuild(t *testing.T) {
+	ctx := context.Background()
+	f, m := newTestFs(t)
+	modTime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	put := func(remote, content string) *Object {
+		obj, err := f.Put(ctx, strings.NewReader(content), object.NewStaticObjectInfo(remote, modTime, int64(len(content)), true, nil, nil))
+		require.NoError(t, err)
+		return obj.(*Object)
+	}
+	// An older document for the same path is ignored
+	m.addDocument("a.txt", []byte("old")).Caption = `{"path":"dir/a.txt","size":3,"modtime":"2024-05-01T12:00:00Z"}`
+	put("dir/a.txt", "aaa")
+	put("dir/a.txt", "newer")
+	f.opt.ChunkSize = 4
+	put("b.txt", "0123456789")
+	_, err := f.Copy(ctx, put("c.txt", "ccc"), "dir/copy.txt")
+	require.NoError(t, err)
+	m.failUpload = chunkName("pending.txt", 2)
+	_, err = f.Put(ctx, strings.NewReader("0123456789"), object.NewStaticObjectInfo("pending.txt", modTime, 10, true, nil, nil))
+	require.Error(t, err)
+	m.failUpload = ""
+	// Files of unknown size are only restored if their last part is
+	// found
+	for _, remote := range []string{"streamed.txt", "truncated.txt"} {
+		_, err = f.Put(ctx, strings.NewReader("0123456789"), object.NewStaticObjectInfo(remote, modTime, -1, true, nil, nil))
+		require.NoError(t, err)
+	}
+	f.opt.WriteCaptions = false
+	put("nocaption.txt", "nnn")
+	// Documents posted by someone else are restored by name
+	m.addDocument("photo.jpg", []byte("jpg")).Caption = "holiday"
+	want := m.manifest()
+
+	// The manifest is lost
+	m.mu.Lock()
+	m.pinned = nil
+	for i, update := range m.updates {
+		if update.GetMessage().Document.FileName == fileListName {
+			m.files[update.GetMessage().Document.FileID] = []byte("{corrupt")
+			m.updates[i].Message.Document.FileName = "broken.json"
+		}
+	}
+	m.mu.Unlock()
+	f = m.newFs()
+	entries, err := f.List(ctx, "")
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+
+	// Dry runs show the manifest without saving it. Bots aren't sent
+	// their own messages so only the documents posted by someone else
+	// are found at first
+	out, err := f.Command(ctx, "rebuild", nil, map[string]string{"dry-run": "true"})
+	require.NoError(t, err)
+	rebuilt, ok := out.(*manifest)
+	require.True(t, ok)
+	assert.Nil(t, m.manifest())
+	var paths []string
+	for _, entry := range rebuilt.Entries {
+		paths = append(paths, entry.Path)
+	}
+	assert.Equal(t, []string{"dir/a.txt", "photo.jpg"}, paths)
+
+	// Once the bot's documents are forwarded back into the chat they
+	// are found too, apart from the last part of truncated.txt
+	m.forwardAll()
+	m.mu.Lock()
+	m.updates = slices.DeleteFunc(m.updates, func(update api.Update) bool {
+		doc := update.GetMessage().Document
+		return doc != nil && doc.FileName == chunkName("truncated.txt", 3)
+	})
+	m.mu.Unlock()
+	out, err = f.Command(ctx, "rebuild", nil, map[string]string{"dry-run": "true"})
+	require.NoError(t, err)
+	rebuilt, ok = out.(*manifest)
+	require.True(t, ok)
+	assert.Nil(t, m.manifest())
+	paths = nil
+	for _, entry := range rebuilt.Entries {
+		paths = append(paths, entry.Path)
+	}
+	assert.Equal(t, []string{"b.txt", "broken.json", "c.txt", "dir/a.txt", "dir/copy.txt", "nocaption.txt", "photo.jpg", "streamed.txt"}, paths)
+	for _, entry := range want.Entries {
+		if entry.Path == "truncated.txt" {
+			continue
+		}
+		got := rebuilt.find(entry.Path)
+		require.NotNil(t, got, entry.Path)
+		assert.Equal(t, entry.Size, got.Size, entry.Path)
+		assert.Equal(t, entry.FileID, got.FileID, entry.Path)
+		if entry.Path != "nocaption.txt" {
+			assert.True(t, got.ModTime.Equal(entry.ModTime), entry.Path)
+		}
+	}
+	assert.Len(t, rebuilt.find("b.txt").Chunks, 3)
+
+	_, err = f.Command(ctx, "rebuild", nil, map[string]string{"dry-run": "bad"})
+	assert.ErrorContains(t, err, "bad dry-run")
+
+	// Otherwise it is saved and used
+	out, err = f.Command(ctx, "rebuild", nil, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "Recovered 8 files. 3 documents had no metadata so were restored by name. Skipped 2 incomplete chunked files and 1 older files at the same path.", out)
+	assert.Equal(t, paths, m.manifestPaths())
+	for remote, content := range map[string]string{"dir/a.txt": "newer", "b.txt": "0123456789", "dir/copy.txt": "ccc", "nocaption.txt": "nnn", "streamed.txt": "0123456789"} {
+		o, err := m.newFs().NewObject(ctx, remote)
+		require.NoError(t, err)
+		assert.Equal(t, content, readObject(ctx, t, o))
+	}
+}
+
+func TestCleanupOrphans(t *testing.T) {
+	ctx := context.Background()
+	f, m := newTestFs(t)
+	a := putFile(ctx, t, f, "a.txt", "aaa")
+	f.opt.ChunkSize = 4
+	b := putFile(ctx, t, f, "b.txt", "0123456789")
+	m.failUpload = chunkName("pending.txt", 2)
+	_, err := f.Put(ctx, strings.NewReader("0123456789"), object.NewStaticObjectInfo("pending.txt", time.Now(), 10, true, nil, nil))
+	require.Error(t, err)
+	m.failUpload = ""
+	stray := m.addDocument("stray.bin", []byte("stray"))
+	channel := m.addDocument("channel.bin", []byte("channel"))
+	channel.SenderChat = &api.Chat{ID: -100555, Type: "channel", Title: "Archive"}
+
+	// The old version of a.txt is too old to delete and the first
+	// part of b.txt fails to delete so both are recorded
+	m.old[a.messageID] = true
+	newA := putFile(ctx, t, f, "a.txt", "AAAA")
+	m.failures["deleteMessage"] = []int{http.StatusForbidden}
+	require.NoError(t, b.Remove(ctx))
+	for _, chunk := range b.chunks[1:] {
+		assert.False(t, m.hasMessage(chunk.MessageID))
+	}
+	wantA := orphan{Path: "a.txt", Size: 3, MessageID: a.messageID}
+	wantB := orphan{Path: "b.txt", Size: 10, MessageID: b.chunks[0].MessageID, Parts: 3}
+
+	// By default they are only listed, along with the documents
+	// posted by others
+	deletes := m.callCount("deleteMessage")
+	out, err := f.Command(ctx, "cleanup", nil, nil)
+	require.NoError(t, err)
+	result := out.(*cleanupResult)
+	assert.Equal(t, []orphan{wantA, wantB}, result.Orphans)
+	assert.Zero(t, result.Deleted)
+	assert.Empty(t, result.Undeletable)
+	require.Len(t, result.Unreferenced, 2)
+	assert.Equal(t, stray.MessageID, result.Unreferenced[0].MessageID)
+	assert.Equal(t, "stray.bin", result.Unreferenced[0].FileName)
+	assert.Equal(t, int64(len("stray")), result.Unreferenced[0].Size)
+	assert.Equal(t, "@alice", result.Unreferenced[0].PostedBy)
+	assert.Equal(t, "Archive (channel)", result.Unreferenced[1].PostedBy)
+	assert.Equal(t, deletes, m.callCount("deleteMessage"))
+	assert.Len(t, m.manifest().Orphans, 2, "orphans not saved in the manifest")
+
+	// Nothing is deleted with --dry-run
+	dryCtx, ci := fs.AddConfig(ctx)
+	ci.DryRun = true
+	out, err = f.Command(dryCtx, "cleanup", nil, map[string]string{"unsafe": "true"})
+	require.NoError(t, err)
+	assert.Zero(t, out.(*cleanupResult).Deleted)
+	assert.Equal(t, deletes, m.callCount("deleteMessage"))
+
+	// With unsafe the orphans are deleted except the one which is too
+	// old, which stays recorded, but the documents of others are kept
+	out, err = f.Command(ctx, "cleanup", nil, map[string]string{"unsafe": "true"})
+	require.NoError(t, err)
+	result = out.(*cleanupResult)
+	assert.Equal(t, 1, result.Deleted)
+	assert.Equal(t, int64(10), result.DeletedBytes)
+	assert.Equal(t, []orphan{wantA}, result.Undeletable)
+	assert.False(t, m.hasMessage(b.chunks[0].MessageID))
+	assert.True(t, m.hasMessage(a.messageID))
+	assert.True(t, m.hasMessage(stray.MessageID))
+	assert.True(t, m.hasMessage(channel.MessageID))
+	orphans := m.manifest().Orphans
+	require.Len(t, orphans, 1)
+	assert.Equal(t, a.messageID, orphans[0].MessageID)
+
+	assert.Equal(t, "AAAA", readObject(ctx, t, newA))
+	_, err = f.Command(ctx, "cleanup", nil, map[string]string{"unsafe": "potato"})
+	assert.ErrorContains(t, err, "bad unsafe")
+
+	// Documents forwarded into the chat which the manifest refers to
+	// after a rebuild aren't listed but the incomplete upload isn't
+	// restored so is
+	m.forwardAll()
+	_, err = f.Command(ctx, "rebuild", nil, nil)
+	require.NoError(t, err)
+	out, err = f.Command(ctx, "cleanup", nil, nil)
+	require.NoError(t, err)
+	var names []string
+	for _, doc := range out.(*cleanupResult).Unreferenced {
+		names = append(names, doc.FileName)
+	}
+	assert.Contains(t, names, chunkName("pending.txt", 1))
+	assert.NotContains(t, names, chunkName("pending.txt", 2))
+}
+
+func TestCheckIndex(t *testing.T) {
+	ctx := context.Background()
+	f, m := newTestFs(t)
+	a := putFile(ctx, t, f, "dir/a.txt", "aaa")
+	f.opt.ChunkSize = 4
+	b := putFile(ctx, t, f, "b.txt", "0123456789")
+	putFile(ctx, t, f, "c.txt", "ccc")
+	putFile(ctx, t, f, "empty.txt", "")
+	stray := m.addDocument("stray.bin", []byte("stray"))
+
+	// Nothing is wrong to start with
+	out, err := f.Command(ctx, "check-index", nil, nil)
+	require.NoError(t, err)
+	result := out.(*checkResult)
+	assert.Equal(t, 4, result.Files)
+	assert.Equal(t, 5, result.Documents)
+	assert.Empty(t, result.Broken)
+	require.Len(t, result.Unreferenced, 1)
+	assert.Equal(t, stray.MessageID, result.Unreferenced[0].MessageID)
+
+	// Telegram loses the document of a.txt and the second part of b.txt
+	m.mu.Lock()
+	delete(m.files, a.fileID)
+	delete(m.files, b.chunks[1].FileID)
+	m.mu.Unlock()
+	want := []brokenEntry{
+		{Path: "dir/a.txt", MessageID: a.messageID, Error: "document not found"},
+		{Path: "b.txt", MessageID: b.chunks[1].MessageID, Part: 2, Error: "document not found"},
+	}
+	out, err = f.Command(ctx, "check-index", nil, nil)
+	assert.ErrorContains(t, err, "found 2 broken entries")
+	result = out.(*checkResult)
+	assert.Equal(t, want, result.Broken)
+	assert.Zero(t, result.Removed)
+
+	// Nothing is removed with --dry-run
+	dryCtx, ci := fs.AddConfig(ctx)
+	ci.DryRun = true
+	out, err = f.Command(dryCtx, "check-index", nil, map[string]string{"fix": "true"})
+	require.NoError(t, err)
+	assert.Zero(t, out.(*checkResult).Removed)
+	assert.Len(t, m.manifestPaths(), 4)
+
+	// With fix the broken entries are removed along with the parts
+	// of b.txt which are left
+	out, err = f.Command(ctx, "check-index", nil, map[string]string{"fix": "true"})
+	require.NoError(t, err)
+	result = out.(*checkResult)
+	assert.Equal(t, want, result.Broken)
+	assert.Equal(t, 2, result.Removed)
+	assert.ElementsMatch(t, []string{"c.txt", "empty.txt"}, m.manifestPaths())
+	for _, chunk := range b.chunks {
+		assert.False(t, m.hasMessage(chunk.MessageID))
+	}
+	assert.True(t, m.hasMessage(stray.MessageID))
+
+	out, err = f.Command(ctx, "check-index", nil, nil)
+	require.NoError(t, err)
+	assert.Empty(t, out.(*checkResult).Broken)
+	_, err = f.Command(ctx, "check-index", nil, map[string]string{"fix": "potato"})
+	assert.ErrorContains(t, err, "bad fix")
+}
+
+func TestPurgeChat(t *testing.T) {
+	ctx := context.Background()
+	f, m := newTestFs(t)
+	m.forum = true
+	f.opt.UseTopics = true
+	a := putFile(ctx, t, f, "a.txt", "aaa")
+	putFile(ctx, t, f, "dir/b.txt", "bbbb")
+	putFile(ctx, t, f, "empty.txt", "")
+	f.opt.ChunkSize = 4
+	c := putFile(ctx, t, f, "c.txt", "0123456789")
+	m.failUpload = chunkName("pending.txt", 2)
+	_, err := f.Put(ctx, strings.NewReader("0123456789"), object.NewStaticObjectInfo("pending.txt", time.Now(), 10, true, nil, nil))
+	require.Error(t, err)
+	m.failUpload = ""
+	// The parts uploaded alongside the failed one may or may not have
+	// been sent
+	wantDeleted, pendingBytes := 2, int64(0)
+	for _, chunk := range m.manifest().Pending[0].Chunks {
+		if chunk != nil {
+			pendingBytes += chunk.Size
+		}
+	}
+	if pendingBytes > 0 {
+		wantDeleted++
+	}
+	stray := m.addDocument("stray.bin", []byte("stray"))
+	manifestID := f.fileListID
+	require.NotZero(t, manifestID)
+	require.Len(t, m.topics, 1)
+
+	// It must be confirmed
+	_, err = f.Command(ctx, "purge-chat", nil, nil)
+	assert.ErrorContains(t, err, "use -o yes=true to confirm")
+	_, err = f.Command(ctx, "purge-chat", nil, map[string]string{"yes": "potato"})
+	assert.ErrorContains(t, err, "bad yes")
+
+	// Nothing is deleted with --dry-run
+	deletes := m.callCount("deleteMessage")
+	dryCtx, ci := fs.AddConfig(ctx)
+	ci.DryRun = true
+	out, err := f.Command(dryCtx, "purge-chat", nil, map[string]string{"yes": "true"})
+	require.NoError(t, err)
+	result := out.(*purgeResult)
+	assert.Equal(t, 4, result.Files)
+	assert.Zero(t, result.Deleted)
+	assert.Equal(t, deletes, m.callCount("deleteMessage"))
+	assert.Len(t, m.topics, 1)
+
+	// Everything is deleted apart from the document which is too old
+	// and the one posted by someone else
+	m.old[a.messageID] = true
+	out, err = f.Command(ctx, "purge-chat", nil, map[string]string{"yes": "true"})
+	require.NoError(t, err)
+	result = out.(*purgeResult)
+	assert.Equal(t, wantDeleted, result.Deleted)
+	assert.Equal(t, 4+10+pendingBytes, result.DeletedBytes)
+	assert.Equal(t, []orphan{{Path: "a.txt", Size: 3, MessageID: a.messageID}}, result.Undeletable)
+	require.Len(t, result.Unreferenced, 1)
+	assert.Equal(t, stray.MessageID, result.Unreferenced[0].MessageID)
+	for _, chunk := range c.chunks {
+		assert.False(t, m.hasMessage(chunk.MessageID))
+	}
+	assert.False(t, m.hasMessage(manifestID))
+	assert.True(t, m.hasMessage(a.messageID))
+	assert.True(t, m.hasMessage(stray.MessageID))
+	assert.Empty(t, m.topics)
+	assert.Nil(t, m.manifest())
+
+	// The chat starts afresh
+	entries, err := f.List(ctx, "")
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+
+	// A manifest which can't be deleted is unpinned instead
+	putFile(ctx, t, f, "d.txt", "ddd")
+	manifestID = f.fileListID
+	m.old[manifestID] = true
+	out, err = f.Command(ctx, "purge-chat", nil, map[string]string{"yes": "true"})
+	require.NoError(t, err)
+	result = out.(*purgeResult)
+	require.Len(t, result.Undeletable, 1)
+	assert.Equal(t, fileListName, result.Undeletable[0].Path)
+	assert.Equal(t, manifestID, result.Undeletable[0].MessageID)
+	assert.NotContains(t, m.pinned, manifestID)
+	entries, err = f.List(ctx, "")
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestMigrate(t *testing.T) {
+	ctx := context.Background()
+	const newChatID = -1009999999999
+	f, m := newTestFs(t)
+	m.otherChats = []int64{newChatID}
+	putFile(ctx, t, f, "a.txt", "aaa")
+	f.opt.ChunkSize = 4
+	putFile(ctx, t, f, "dir/b.txt", "0123456789")
+	putFile(ctx, t, f, "empty.txt", "")
+	require.NoError(t, f.Mkdir(ctx, "empty dir"))
+	resends := m.resends
+
+	_, err := f.Command(ctx, "migrate", nil, nil)
+	assert.ErrorContains(t, err, "use -o target-chat=ID")
+	_, err = f.Command(ctx, "migrate", nil, map[string]string{"target-chat": strconv.Itoa(testChatID)})
+	assert.ErrorContains(t, err, "can't migrate a chat to itself")
+	_, err = f.Command(ctx, "migrate", nil, map[string]string{"target-chat": "-1001"})
+	assert.Error(t, err)
+	opt := map[string]string{"target-chat": strconv.Itoa(newChatID)}
+
+	// Nothing is copied with --dry-run
+	dryCtx, ci := fs.AddConfig(ctx)
+	ci.DryRun = true
+	out, err := f.Command(dryCtx, "migrate", nil, opt)
+	require.NoError(t, err)
+	assert.Zero(t, out.(*migrateResult).Copied)
+	assert.Nil(t, m.manifestIn(newChatID))
+
+	// A file which can't be copied is reported and the rest carry on
+	m.failures["sendDocument"] = []int{http.StatusBadRequest}
+	out, err = f.Command(ctx, "migrate", nil, opt)
+	require.NoError(t, err)
+	result := out.(*migrateResult)
+	assert.Equal(t, 2, result.Copied)
+	assert.Equal(t, int64(10), result.CopiedBytes)
+	require.Len(t, result.Failed, 1)
+	assert.Equal(t, "a.txt", result.Failed[0].Path)
+	var paths []string
+	for _, entry := range m.manifestIn(newChatID).Entries {
+		paths = append(paths, entry.Path)
+	}
+	assert.ElementsMatch(t, []string{"dir/b.txt", "empty.txt"}, paths)
+
+	// delete-source is refused while a file is missing
+	deleteOpt := map[string]string{"target-chat": strconv.Itoa(newChatID), "delete-source": "true"}
+	m.failures["sendDocument"] = []int{http.StatusBadRequest}
+	out, err = f.Command(ctx, "migrate", nil, deleteOpt)
+	assert.ErrorContains(t, err, "not deleting the source as 1 files failed")
+	assert.Len(t, out.(*migrateResult).Failed, 1)
+	assert.NotNil(t, m.manifest())
+
+	// Running it again only copies what is left then deletes the
+	// source
+	out, err = f.Command(ctx, "migrate", nil, deleteOpt)
+	require.NoError(t, err)
+	result = out.(*migrateResult)
+	assert.Equal(t, 1, result.Copied)
+	assert.Equal(t, 2, result.Skipped)
+	assert.Empty(t, result.Failed)
+	require.NotNil(t, result.Deleted)
+	assert.Equal(t, 3, result.Deleted.Files)
+	assert.Nil(t, m.manifest())
+	// Each document was sent again by file_id once
+	assert.Equal(t, resends+4, m.resends)
+
+	// The files are all in the new chat
+	config := m.config()
+	config["chat_id"] = strconv.Itoa(newChatID)
+	fsys, err := NewFs(ctx, "TestTelegram", "", config)
+	require.NoError(t, err)
+	target := fsys.(*Fs)
+	for remote, want := range map[string]string{"a.txt": "aaa", "dir/b.txt": "0123456789", "empty.txt": ""} {
+		o, err := target.NewObject(ctx, remote)
+		require.NoError(t, err, remote)
+		assert.Equal(t, want, readObject(ctx, t, o))
+	}
+	entries, err := target.List(ctx, "empty dir")
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+// None of the commands change the chat with --dry-run
+func TestCommandsDryRun(t *testing.T) {
+	ctx := context.Background()
+	const newChatID = -1009999999999
+	f, m := newTestFs(t)
+	m.forum = true
+	m.otherChats = []int64{newChatID}
+	f.opt.UseTopics = true
+	a := putFile(ctx, t, f, "dir/a.txt", "aaa")
+	c := putFile(ctx, t, f, "c.txt", "ccc")
+	f.opt.ChunkSize = 4
+	putFile(ctx, t, f, "b.txt", "0123456789")
+	m.failUpload = chunkName("pending.txt", 2)
+	_, err := f.Put(ctx, strings.NewReader("0123456789"), object.NewStaticObjectInfo("pending.txt", time.Now(), 10, true, nil, nil))
+	require.Error(t, err)
+	m.failUpload = ""
+	// The old version of a.txt is too old to delete so is an orphan
+	m.old[a.messageID] = true
+	putFile(ctx, t, f, "dir/a.txt", "AAAA")
+	// Telegram loses the document of c.txt
+	m.mu.Lock()
+	delete(m.files, c.fileID)
+	m.mu.Unlock()
+	m.addDocument("stray.bin", []byte("stray"))
+	require.NoError(t, f.flushFileList(ctx))
+	before := m.manifest()
+	require.Len(t, before.Pending, 1)
+	require.Len(t, before.Orphans, 1)
+
+	dryCtx, ci := fs.AddConfig(ctx)
+	ci.DryRun = true
+	for _, test := range []struct {
+		name string
+		opt  map[string]string
+	}{
+		{"cleanup-pending", map[string]string{"max-age": "0s"}},
+		{"rebuild", nil},
+		{"cleanup", map[string]string{"unsafe": "true"}},
+		{"check-index", map[string]string{"fix": "true"}},
+		{"purge-chat", nil},
+		{"migrate", map[string]string{"target-chat": strconv.Itoa(newChatID), "delete-source": "true"}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			calls := m.mutatingCalls()
+			_, err := f.Command(dryCtx, test.name, nil, test.opt)
+			require.NoError(t, err)
+			assert.Equal(t, calls, m.mutatingCalls())
+			assert.Equal(t, before, m.manifest())
+			assert.Nil(t, m.manifestIn(newChatID))
+		})
+	}
+
+	// Without --dry-run the changes are made
+	calls := m.mutatingCalls()
+	_, err = f.Command(ctx, "cleanup-pending", nil, map[string]string{"max-age": "0s"})
+	require.NoError(t, err)
+	assert.NotEqual(t, calls, m.mutatingCalls())
+	assert.Empty(t, m.manifest().Pending)
+}
+
+// The long running commands show their progress in the stats
+func TestCommandStats(t *testing.T) {
+	f, m := newTestFs(t)
+	m.otherChats = []int64{-1009999999999}
+	ctx := accounting.WithStatsGroup(context.Background(), "TestCommandStats")
+	stats := accounting.StatsGroup(ctx, "TestCommandStats")
+	putFile(ctx, t, f, "a.txt", "aaa")
+	putFile(ctx, t, f, "b.txt", "bbbb")
+	putFile(ctx, t, f, "c.txt", "ccccc")
+	stats.ResetCounters()
+
+	_, err := f.Command(ctx, "check-index", nil, nil)
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), stats.GetChecks())
+
+	_, err = f.Command(ctx, "migrate", nil, map[string]string{"target-chat": "-1009999999999"})
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), stats.GetTransfers())
+	assert.Equal(t, int64(12), stats.GetBytes())
+
+	// purge-chat stops at --max-delete
+	ctx, ci := fs.AddConfig(ctx)
+	ci.MaxDelete = 2
+	_, err = f.Command(ctx, "purge-chat", nil, map[string]string{"yes": "true"})
+	assert.ErrorContains(t, err, "max-delete")
+	assert.Equal(t, int64(2), stats.GetDeletes())
+	assert.NotNil(t, m.manifest())
+}
+
+func TestChunkedUploadConcurrency(t *testing.T) {
+	ctx := context.Background()
+	f, m := newTestFs(t)
+	f.opt.ChunkSize = 4
+	f.opt.UploadConcurrency = 3
+	// The first part takes longest so the parts finish out of order
+	m.uploadDelay = func(fileName string) time.Duration {
+		if fileName == chunkName("a.txt", 1) {
+			return 50 * time.Millisecond
+		}
+		return 10 * time.Millisecond
+	}
+	const content = "0123456789abcdefghijklmnopqrstuvwxyz!"
+	for _, size := range []int64{int64(len(content)), -1} {
+		src := object.NewStaticObjectInfo("a.txt", time.Now(), size, true, nil, nil)
+		obj, err := f.Put(ctx, strings.NewReader(content), src)
+		require.NoError(t, err)
+		a := obj.(*Object)
+		require.Len(t, a.chunks, 10)
+		for i, chunk := range a.chunks {
+			assert.Equal(t, chunkName("a.txt", i+1), m.message(chunk.MessageID).Document.FileName)
+			assert.Equal(t, min(4, int64(len(content)-4*i)), chunk.Size)
+		}
+		assert.Equal(t, int64(len(content)), a.size)
+		assert.Equal(t, content, readObject(ctx, t, a))
+	}
+	m.mu.Lock()
+	assert.Equal(t, 3, m.maxInFlight)
+	m.mu.Unlock()
+}
+
+func TestUploadStreams(t *testing.T) {
+	ctx := context.Background()
+	f, m := newTestFs(t)
+	f.opt.ChunkSize = 1 * fs.Gibi
+	m.discard = true
+	const size = 256 * 1024 * 1024
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	src := object.NewStaticObjectInfo("big.bin", time.Now(), size, true, nil, nil)
+	entry, err := f.upload(ctx, readers.NewPatternReader(size), src, nil)
+	require.NoError(t, err)
+	runtime.ReadMemStats(&after)
+
+	assert.Equal(t, int64(size), entry.Size)
+	allocated := after.TotalAlloc - before.TotalAlloc
+	assert.Less(t, allocated, uint64(size/8), "upload allocated %d bytes", allocated)
+	require.Len(t, m.lengths, 1)
+	assert.Greater(t, m.lengths[0], int64(size))
+
+	// Parts of files of unknown size are read into memory first so
+	// they are sent with their length
+	f.opt.UploadConcurrency = 1
+	src = object.NewStaticObjectInfo("small.bin", time.Now(), -1, true, nil, nil)
+	_, err = f.upload(ctx, readers.NewPatternReader(1024), src, nil)
+	require.NoError(t, err)
+	require.Len(t, m.lengths, 2)
+	assert.Greater(t, m.lengths[1], int64(1024))
+}
+
+// peakHeap samples the heap in use until the function it returns is
+// called, which returns the most seen in bytes
+//
+// This includes the documents the mock server keeps.
+func peakHeap() (stop func() uint64) {
+	var (
+		peak uint64
+		done = make(chan struct{})
+		wg   sync.WaitGroup
+	)
+	sample := func() {
+		var ms runtime.MemStats
+		runtime.ReadMemStats(&ms)
+		peak = max(peak, ms.HeapInuse)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(10 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			sample()
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return func() uint64 {
+		close(done)
+		wg.Wait()
+		return peak
+	}
+}
+
+// benchmarkSizes are the sizes of file the upload and download
+// benchmarks use
+var benchmarkSizes = []fs.SizeSuffix{fs.Kibi, fs.Mebi, 64 * fs.Mebi}
+
+func BenchmarkPut(b *testing.B) {
+	ctx := context.Background()
+	for _, size := range benchmarkSizes {
+		b.Run(size.String(), func(b *testing.B) {
+			f, m := newTestFs(b)
+			m.discard = true
+			b.ReportAllocs()
+			b.SetBytes(int64(size))
+			stop := peakHeap()
+			b.ResetTimer()
+			for range b.N {
+				src := object.NewStaticObjectInfo("file.bin", time.Now(), int64(size), true, nil, nil)
+				_, err := f.Put(ctx, readers.NewPatternReader(int64(size)), src)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.StopTimer()
+			b.ReportMetric(float64(stop())/float64(fs.Mebi), "peak-heap-MiB")
+		})
+	}
+}
+
+func BenchmarkOpen(b *testing.B) {
+	ctx := context.Background()
+	for _, size := range benchmarkSizes {
+		b.Run(size.String(), func(b *testing.B) {
+			f, _ := newTestFs(b)
+			src := object.NewStaticObjectInfo("file.bin", time.Now(), int64(size), true, nil, nil)
+			o, err := f.Put(ctx, readers.NewPatternReader(int64(size)), src)
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.ReportAllocs()
+			b.SetBytes(int64(size))
+			stop := peakHeap()
+			b.ResetTimer()
+			for range b.N {
+				in, err := o.Open(ctx)
+				if err != nil {
+					b.Fatal(err)
+				}
+				_, err = io.Copy(io.Discard, in)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if err = in.Close(); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.StopTimer()
+			b.ReportMetric(float64(stop())/float64(fs.Mebi), "peak-heap-MiB")
+		})
+	}
+}
+
+func TestPutStream(t *testing.T) {
+	ctx := context.Background()
+	f, m := newTestFs(t)
+	f.opt.ChunkSize = 4 * fs.Mebi
+	m.discard = true
+	const size = 100 * 1024 * 1024
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	src := object.NewStaticObjectInfo("backup.tar", time.Now(), -1, true, nil, nil)
+	obj, err := f.PutStream(ctx, readers.NewPatternReader(size), src)
+	require.NoError(t, err)
+	runtime.ReadMemStats(&after)
+
+	// The size and hash are worked out as the data arrives
+	assert.Equal(t, int64(size), obj.Size())
+	hasher := md5.New()
+	_, err = io.Copy(hasher, readers.NewPatternReader(size))
+	require.NoError(t, err)
+	gotMD5, err := obj.Hash(ctx, hash.MD5)
+	require.NoError(t, err)
+	assert.Equal(t, hex.EncodeToString(hasher.Sum(nil)), gotMD5)
+	assert.Len(t, obj.(*Object).chunks, 25)
+	// Only the parts being sent are held in memory
+	allocated := after.TotalAlloc - before.TotalAlloc
+	assert.Less(t, allocated, uint64(size/4), "upload allocated %d bytes", allocated)
+}
+
+func TestEmptyFile(t *testing.T) {
+	ctx := context.Background()
+	f, m := newTestFs(t)
+	sends := m.callCount("sendDocument") + m.callCount("editMessageMedia")
+
+	// Telegram won't take empty documents so they are only recorded
+	// in the manifest, whether the size is known or not
+	src := object.NewStaticObjectInfo("stream.txt", time.Now(), -1, true, nil, nil)
+	stream, err := f.PutStream(ctx, strings.NewReader(""), src)
+	require.NoError(t, err)
+	empty := putFile(ctx, t, f, "empty.txt", "")
+	assert.Equal(t, sends+2, m.callCount("sendDocument")+m.callCount("editMessageMedia"), "only manifests sent")
+	for _, o := range []fs.Object{stream, empty} {
+		assert.Equal(t, int64(0), o.Size())
+		gotMD5, err := o.Hash(ctx, hash.MD5)
+		require.NoError(t, err)
+		assert.Equal(t, "d41d8cd98f00b204e9800998ecf8427e", gotMD5)
+		assert.Equal(t, "", readObject(ctx, t, o))
+	}
+
+	// They survive reading the manifest again
+	g := m.newFs()
+	o, err := g.NewObject(ctx, "empty.txt")
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), o.Size())
+	assert.True(t, empty.ModTime(ctx).Equal(o.ModTime(ctx)))
+	assert.Equal(t, "", readObject(ctx, t, o))
+
+	// and can be copied, updated and removed
+	c, err := g.Copy(ctx, o, "copy.txt")
+	require.NoError(t, err)
+	assert.Equal(t, "", readObject(ctx, t, c))
+	require.NoError(t, c.Update(ctx, strings.NewReader("full"), object.NewStaticObjectInfo("copy.txt", time.Now(), 4, true, nil, nil)))
+	assert.Equal(t, "full", readObject(ctx, t, c))
+	deletes := m.callCount("deleteMessage")
+	require.NoError(t, o.Remove(ctx))
+	assert.Equal(t, deletes, m.callCount("deleteMessage"))
+	assert.Equal(t, []string{"stream.txt", "copy.txt"}, m.manifestPaths())
+}
+
+func TestUploadCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	f, _ := newTestFs(t)
+	in, out := io.Pipe()
+	go func() {
+		_, _ = out.Write(make([]byte, 1024))
+		cancel()
+	}()
+	src := object.NewStaticObjectInfo("a.bin", time.Now(), 1<<20, true, nil, nil)
+	_, err := f.upload(ctx, in, src, nil)
+	require.Error(t, err)
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestRetry(t *testing.T) {
+	ctx := context.Background()
+	f, m := newTestFs(t)
+	a := putFile(ctx, t, f, "a.txt", "aaa")
+
+	// Server errors are retried, seekable uploads included
+	m.failures["getChat"] = []int{http.StatusBadGateway, http.StatusServiceUnavailable}
+	m.failures["sendDocument"] = []int{http.StatusInternalServerError}
+	putFile(ctx, t, f, "b.txt", "bbb")
+	assert.Equal(t, []string{"a.txt", "b.txt"}, m.manifestPaths())
+
+	// Client errors are not retried
+	m.failures["getChat"] = []int{http.StatusForbidden}
+	_, err := f.loadFileList(ctx)
+	require.Error(t, err)
+	assert.True(t, isStatus(err, http.StatusForbidden))
+
+	// Telegram's retry_after is obeyed
+	m.failures["getFile"] = []int{http.StatusTooManyRequests}
+	calls := m.callCount("getFile")
+	start := time.Now()
+	assert.Equal(t, "aaa", readObject(ctx, t, a))
+	assert.GreaterOrEqual(t, time.Since(start), time.Second)
+	assert.Equal(t, calls+2, m.callCount("getFile"))
+
+	// and the part of a chunked upload it was sending is sent again,
+	// whether the parts are sent one at a time or not
+	f.opt.ChunkSize = 4
+	for _, concurrency := range []int{1, 4} {
+		f.opt.UploadConcurrency = concurrency
+		m.failures["sendDocument"] = []int{0, http.StatusTooManyRequests}
+		sends := m.callCount("sendDocument")
+		c := putFile(ctx, t, f, "c.txt", "0123456789")
+		assert.Equal(t, sends+4, m.callCount("sendDocument"), "concurrency %d", concurrency)
+		require.Len(t, c.chunks, 3)
+		assert.Equal(t, "0123456789", readObject(ctx, t, c))
+	}
+}
+
+func TestRetrySequences(t *testing.T) {
+	ctx := context.Background()
+	// Each action makes one call to method
+	actions := []struct {
+		method   string
+		action   func(f *Fs, a *Object) error
+		fallback bool // if set, failing calls are followed by posting a new manifest
+	}{{
+		method: "sendDocument",
+		action: func(f *Fs, a *Object) error {
+			_, err := f.Put(ctx, strings.NewReader("bbb"), object.NewStaticObjectInfo("b.txt", time.Now(), 3, true, nil, nil))
+			return err
+		},
+	}, {
+		method: "editMessageMedia",
+		action: func(f *Fs, a *Object) error {
+			err := f.Mkdir(ctx, "dir")
+			if err != nil {
+				return err
+			}
+			return f.flushFileList(ctx)
+		},
+		fallback: true,
+	}, {
+		method: "getFile",
+		action: func(f *Fs, a *Object) error {
+			_, err := f.getFile(ctx, a.fileID)
+			return err
+		},
+	}, {
+		method: "deleteMessage",
+		action: func(f *Fs, a *Object) error {
+			return f.deleteMessage(ctx, a.messageID)
+		},
+	}}
+	for _, test := range []struct {
+		name       string
+		failures   []int
+		wantCalls  int
+		wantStatus int           // status of the error returned, if any
+		minElapsed time.Duration // least time the retries should take
+	}{{
+		name:       "retry after",
+		failures:   []int{http.StatusTooManyRequests, http.StatusTooManyRequests},
+		wantCalls:  3,
+		minElapsed: 2 * time.Second,
+	}, {
+		name:       "server errors",
+		failures:   slices.Repeat([]int{http.StatusServiceUnavailable}, 10),
+		wantCalls:  3,
+		wantStatus: http.StatusServiceUnavailable,
+	}, {
+		name:       "client error",
+		failures:   []int{http.StatusForbidden},
+		wantCalls:  1,
+		wantStatus: http.StatusForbidden,
+	}, {
+		name:      "cut reply",
+		failures:  []int{cutReply},
+		wantCalls: 2,
+	}} {
+		for _, action := range actions {
+			t.Run(test.name+"/"+action.method, func(t *testing.T) {
+				t.Parallel()
+				f, m := newTestFs(t)
+				a := putFile(ctx, t, f, "a.txt", "aaa")
+				require.NoError(t, f.flushFileList(ctx))
+				f.pacer.SetRetries(3)
+				m.mu.Lock()
+				m.failures[action.method] = slices.Clone(test.failures)
+				m.mu.Unlock()
+				calls := m.callCount(action.method)
+				sends := m.callCount("sendDocument")
+				start := time.Now()
+				err := action.action(f, a)
+				elapsed := time.Since(start)
+				assert.Equal(t, test.wantCalls, m.callCount(action.method)-calls)
+				assert.GreaterOrEqual(t, elapsed, test.minElapsed)
+				assert.Less(t, elapsed, test.minElapsed+time.Second, "waited too long")
+				if test.wantStatus != 0 && action.fallback {
+					// The manifest which couldn't be replaced is
+					// posted again instead
+					require.NoError(t, err)
+					assert.Equal(t, sends+1, m.callCount("sendDocument"))
+					assert.Equal(t, []string{"dir"}, m.manifest().Dirs)
+					return
+				}
+				if test.wantStatus != 0 {
+					assert.True(t, isStatus(err, test.wantStatus), "want status %d: %v", test.wantStatus, err)
+					return
+				}
+				require.NoError(t, err)
+				if test.failures[0] == cutReply && action.method == "sendDocument" {
+					// Telegram posted the document before the
+					// reply was cut, which can't be told from a
+					// failure before it, so it is left in the chat
+					m.mu.Lock()
+					assert.Equal(t, 4, len(m.updates), "a.txt, the manifest and both b.txt")
+					m.mu.Unlock()
+				}
+			})
+		}
+	}
+}
+
+func TestDecodeResponseErrors(t *testing.T) {
+	ctx := context.Background()
+	for _, test := range []struct {
+		name       string
+		status     int
+		body       string
+		wantCode   int
+		wantText   string
+		fatal      bool
+		noRetry    bool
+		retry      bool
+		retryAfter time.Duration
+	}{{
+		name:     "bad request",
+		status:   http.StatusBadRequest,
+		body:     `{"ok":false,"error_code":400,"description":"Bad Request: message to delete not found"}`,
+		wantCode: 400,
+		wantText: "telegram sendDocument failed: 400 Bad Request: message to delete not found",
+	}, {
+		name:     "unauthorized",
+		status:   http.StatusUnauthorized,
+		body:     `{"ok":false,"error_code":401,"description":"Unauthorized"}`,
+		wantCode: 401,
+		wantText: "bot_token was rejected",
+		fatal:    true,
+	}, {
+		name:     "chat not found",
+		status:   http.StatusBadRequest,
+		body:     `{"ok":false,"error_code":400,"description":"Bad Request: chat not found"}`,
+		wantCode: 400,
+		wantText: "chat_id not found",
+		fatal:    true,
+	}, {
+		name:     "webhook conflict",
+		status:   http.StatusConflict,
+		body:     `{"ok":false,"error_code":409,"description":"Conflict: can't use getUpdates method while webhook is active; use deleteWebhook to delete the webhook first"}`,
+		wantCode: 409,
+		wantText: "use a separate bot for rclone",
+		noRetry:  true,
+	}, {
+		name:       "too many requests",
+		status:     http.StatusTooManyRequests,
+		body:       `{"ok":false,"error_code":429,"description":"Too Many Requests: retry after 7","parameters":{"retry_after":7}}`,
+		wantCode:   429,
+		wantText:   "retry after 7",
+		retry:      true,
+		retryAfter: 7 * time.Second,
+	}, {
+		name:     "file too big",
+		status:   http.StatusBadRequest,
+		body:     `{"ok":false,"error_code":400,"description":"Bad Request: file is too big"}`,
+		wantCode: 400,
+		wantText: "file is too big",
+		noRetry:  true,
+	}, {
+		name:     "not ok with 200",
+		status:   http.StatusOK,
+		body:     `{"ok":false,"error_code":400,"description":"Bad Request: wrong file_id"}`,
+		wantCode: 400,
+		wantText: "wrong file_id",
+	}, {
+		name:     "no envelope",
+		status:   http.StatusBadGateway,
+		body:     `<html>Bad Gateway</html>`,
+		wantCode: 502,
+		wantText: "502 Bad Gateway",
+		retry:    true,
+	}} {
+		t.Run(test.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			rec.WriteHeader(test.status)
+			_, _ = rec.WriteString(test.body)
+			resp := rec.Result()
+			err := decodeResponse("sendDocument", resp, nil)
+			require.Error(t, err)
+			var apiErr *api.Error
+			require.True(t, errors.As(err, &apiErr))
+			assert.Equal(t, test.wantCode, apiErr.ErrorCode)
+			assert.Equal(t, test.status, apiErr.StatusCode)
+			assert.ErrorContains(t, err, test.wantText)
+			assert.Equal(t, test.fatal, fserrors.IsFatalError(err))
+			assert.Equal(t, test.noRetry, fserrors.IsNoRetryError(err))
+			retry, retryErr := shouldRetry(ctx, resp, err)
+			assert.Equal(t, test.retry, retry)
+			retryAfter, _ := pacer.IsRetryAfter(retryErr)
+			assert.Equal(t, test.retryAfter, retryAfter)
+		})
+	}
+}
+
+func TestFileListPinned(t *testing.T) {
+	ctx := context.Background()
+	f, m := newTestFs(t)
+	putFile(ctx, t, f, "a.txt", "aaa")
+	putFile(ctx, t, f, "b.txt", "bbb")
+
+	// Only the newest manifest stays pinned
+	require.Len(t, m.pinned, 1)
+	m.mu.Lock()
+	pinned := m.message(m.pinned[0])
+	m.mu.Unlock()
+	require.NotNil(t, pinned)
+	assert.Equal(t, fileListName, pinned.Document.FileName)
+
+	// The manifest is found even when the updates have expired
+	m.expired = true
+	calls := m.callCount("getUpdates")
+	entries, err := f.List(ctx, "")
+	require.NoError(t, err)
+	assert.Len(t, entries, 2)
+	assert.Equal(t, calls, m.callCount("getUpdates"))
+}
+
+func TestFileListNotPinned(t *testing.T) {
+	ctx := context.Background()
+	f, m := newTestFs(t)
+	m.noPin = true
+
+	// A manifest which can't be pinned couldn't be found again as
+	// bots aren't sent their own messages, so saving it fails
+	_, err := f.Put(ctx, strings.NewReader("aaa"), object.NewStaticObjectInfo("a.txt", time.Now(), 3, true, nil, nil))
+	assert.ErrorContains(t, err, "allow the bot to pin messages")
+	assert.Nil(t, m.manifest())
+	assert.Empty(t, m.pinned)
+	m.mu.Lock()
+	assert.Empty(t, m.updates, "the document uploaded is deleted too")
+	m.mu.Unlock()
+
+	m.noPin = false
+	putFile(ctx, t, f, "a.txt", "aaa")
+	putFile(ctx, t, f, "b.txt", "bbb")
+	manifestID := m.pinned[0]
+
+	// Someone pins another message over the manifest. Without knowing
+	// where the manifest is the remote can't be used, rather than
+	// appearing empty and having a new manifest replace the old one
+	pin := func() {
+		notes := m.addDocument("notes.txt", []byte("notes"))
+		m.mu.Lock()
+		m.pinned = append(m.pinned, notes.MessageID)
+		m.mu.Unlock()
+	}
+	pin()
+	other := m.newFs()
+	_, err = other.List(ctx, "")
+	assert.ErrorContains(t, err, "isn't the file list")
+	_, err = other.Put(ctx, strings.NewReader("ccc"), object.NewStaticObjectInfo("c.txt", time.Now(), 3, true, nil, nil))
+	assert.ErrorContains(t, err, "isn't the file list")
+	assert.Equal(t, []string{"a.txt", "b.txt"}, m.manifestPaths())
+
+	// An Fs which has seen the manifest pins it again
+	f.DirCacheFlush()
+	entries, err := f.List(ctx, "")
+	require.NoError(t, err)
+	assert.Len(t, entries, 2)
+	assert.Equal(t, manifestID, m.pinned[len(m.pinned)-1])
+	entries, err = other.List(ctx, "")
+	require.NoError(t, err)
+	assert.Len(t, entries, 2)
+
+	// Otherwise a manifest forwarded into the chat by someone else is
+	// found in the updates
+	pin()
+	m.forwardAll()
+	calls := m.callCount("getUpdates")
+	entries, err = m.newFs().List(ctx, "")
+	require.NoError(t, err)
+	assert.Len(t, entries, 2)
+	assert.Greater(t, m.callCount("getUpdates"), calls)
+}
+
+func TestFileListReplaced(t *testing.T) {
+	ctx := context.Background()
+	f, m := newTestFs(t)
+	for _, remote := range []string{"a.txt", "b.txt", "c.txt"} {
+		putFile(ctx, t, f, remote, remote)
+	}
+
+	// The chat holds the three documents and a single pinned manifest
+	m.mu.Lock()
+	var names []string
+	for _, update := range m.updates {
+		names = append(names, update.GetMessage().Document.FileName)
+	}
+	pinned := append([]int64{}, m.pinned...)
+	m.mu.Unlock()
+	assert.ElementsMatch(t, []string{"a.txt", "b.txt", "c.txt", fileListName}, names)
+	require.Len(t, pinned, 1)
+	assert.Equal(t, 2, m.callCount("editMessageMedia"))
+	assert.Equal(t, []string{"a.txt", "b.txt", "c.txt"}, m.manifestPaths())
+
+	// If the manifest can't be edited a new one replaces it
+	manifest, err := f.loadFileList(ctx)
+	require.NoError(t, err)
+	oldMessageID := manifest.messageID
+	require.NotZero(t, oldMessageID)
+	m.mu.Lock()
+	m.pinned = nil
+	m.mu.Unlock()
+	m.failures["editMessageMedia"] = []int{http.StatusBadRequest}
+	gotOldMessageID, err := f.saveFileList(ctx, manifest)
+	require.NoError(t, err)
+	assert.Equal(t, oldMessageID, gotOldMessageID)
+	assert.NotEqual(t, oldMessageID, manifest.messageID)
+	assert.Equal(t, []int64{manifest.messageID}, m.pinned)
+
+	// The old manifest is left for the caller to delete
+	assert.True(t, m.hasMessage(oldMessageID))
+	require.NoError(t, f.forgetFileList(ctx))
+	m.failures["editMessageMedia"] = []int{http.StatusBadRequest}
+	putFile(ctx, t, f, "d.txt", "d.txt")
+	assert.False(t, m.hasMessage(manifest.messageID))
+	assert.True(t, m.hasMessage(oldMessageID))
+}
+
+func TestLoadFileList(t *testing.T) {
+	ctx := context.Background()
+	// unpin leaves the manifest to be found in the updates
+	unpin := func(m *mockServer) {
+		m.mu.Lock()
+		m.pinned = nil
+		m.mu.Unlock()
+	}
+	for _, test := range []struct {
+		name      string
+		setup     func(t *testing.T, m *mockServer, f *Fs)
+		failures  map[string][]int // failures for the Fs reading the manifest
+		wantPaths []string
+		wantErr   string
+		wantErrIs error
+		fatal     bool
+		noRetry   bool
+	}{{
+		name:  "no manifest",
+		setup: func(t *testing.T, m *mockServer, f *Fs) {},
+	}, {
+		name: "pinned",
+		setup: func(t *testing.T, m *mockServer, f *Fs) {
+			putFile(ctx, t, f, "a.txt", "aaa")
+		},
+		wantPaths: []string{"a.txt"},
+	}, {
+		name: "malformed",
+		setup: func(t *testing.T, m *mockServer, f *Fs) {
+			message := m.addDocument(fileListName, []byte(`{"version":`))
+			m.mu.Lock()
+			m.pinned = append(m.pinned, message.MessageID)
+			m.mu.Unlock()
+		},
+		wantErr: "failed to decode manifest",
+	}, {
+		name: "forwarded",
+		setup: func(t *testing.T, m *mockServer, f *Fs) {
+			putFile(ctx, t, f, "a.txt", "aaa")
+			unpin(m)
+			m.forwardAll()
+		},
+		wantPaths: []string{"a.txt"},
+	}, {
+		name: "channel post",
+		setup: func(t *testing.T, m *mockServer, f *Fs) {
+			putFile(ctx, t, f, "a.txt", "aaa")
+			unpin(m)
+			m.forwardAll()
+			m.mu.Lock()
+			defer m.mu.Unlock()
+			for i := range m.updates {
+				if message := m.updates[i].Message; message != nil && message.From == &testUser {
+					message.Chat.Type = "channel"
+					message.SenderChat = &message.Chat
+					message.From = nil
+					m.updates[i].Message, m.updates[i].ChannelPost = nil, message
+				}
+			}
+		},
+		wantPaths: []string{"a.txt"},
+	}, {
+		// Reading past the first page of updates would confirm and
+		// so delete them, so a manifest beyond it isn't found
+		name: "beyond first page",
+		setup: func(t *testing.T, m *mockServer, f *Fs) {
+			putFile(ctx, t, f, "a.txt", "aaa")
+			unpin(m)
+			for i := range 2 * maxUpdates {
+				m.addDocument(fmt.Sprintf("notes%d.txt", i), []byte("notes"))
+			}
+			m.forwardAll()
+		},
+	}, {
+		name: "webhook conflict",
+		setup: func(t *testing.T, m *mockServer, f *Fs) {
+			putFile(ctx, t, f, "a.txt", "aaa")
+			unpin(m)
+		},
+		failures: map[string][]int{"getUpdates": {http.StatusConflict}},
+		wantErr:  "has a webhook",
+		noRetry:  true,
+	}, {
+		name: "expired file_path",
+		setup: func(t *testing.T, m *mockServer, f *Fs) {
+			putFile(ctx, t, f, "a.txt", "aaa")
+			m.mu.Lock()
+			m.expirePaths = 1
+			m.mu.Unlock()
+		},
+		wantPaths: []string{"a.txt"},
+	}, {
+		name: "document gone",
+		setup: func(t *testing.T, m *mockServer, f *Fs) {
+			putFile(ctx, t, f, "a.txt", "aaa")
+			m.mu.Lock()
+			m.expirePaths = 2
+			m.mu.Unlock()
+		},
+		wantErr:   "failed to read file list",
+		wantErrIs: fs.ErrorObjectNotFound,
+	}, {
+		name:     "token rejected",
+		setup:    func(t *testing.T, m *mockServer, f *Fs) {},
+		failures: map[string][]int{"getChat": {http.StatusUnauthorized}},
+		wantErr:  "bot_token was rejected",
+		fatal:    true,
+	}} {
+		t.Run(test.name, func(t *testing.T) {
+			m := newMockServer(t)
+			test.setup(t, m, m.newFs())
+			f := m.newFs()
+			m.mu.Lock()
+			maps.Copy(m.failures, test.failures)
+			m.mu.Unlock()
+			f.listMu.Lock()
+			manifest, err := f.loadFileList(ctx)
+			f.listMu.Unlock()
+			if test.wantErr != "" {
+				require.ErrorContains(t, err, test.wantErr)
+				if test.wantErrIs != nil {
+					assert.ErrorIs(t, err, test.wantErrIs)
+				}
+				assert.Equal(t, test.fatal, fserrors.IsFatalError(err))
+				assert.Equal(t, test.noRetry, fserrors.IsNoRetryError(err))
+				return
+			}
+			require.NoError(t, err)
+			var paths []string
+			for _, entry := range manifest.Entries {
+				paths = append(paths, entry.Path)
+			}
+			assert.Equal(t, test.wantPaths, paths)
+		})
+	}
+}
+
+func TestFileListDeleteUnlocked(t *testing.T) {
+	ctx := context.Background()
+	f, m := newTestFs(t)
+	old := putFile(ctx, t, f, "a.txt", "aaa").messageID
+
+	// Record whether listMu was held for each message deleted
+	var deleted []int64
+	var locked []bool
+	m.mu.Lock()
+	m.onDelete = func(messageID int64) {
+		ok := f.listMu.TryLock()
+		if ok {
+			f.listMu.Unlock()
+		}
+		deleted = append(deleted, messageID)
+		locked = append(locked, !ok)
+	}
+	m.mu.Unlock()
+
+	// Replacing a file deletes its old document and failing to edit
+	// the manifest deletes the old one too
+	putFile(ctx, t, f, "a.txt", "AAA")
+	m.mu.Lock()
+	m.failures["editMessageMedia"] = []int{http.StatusBadRequest}
+	m.mu.Unlock()
+	putFile(ctx, t, f, "b.txt", "bbb")
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	require.Len(t, deleted, 2)
+	assert.Equal(t, old, deleted[0])
+	assert.Equal(t, []bool{false, false}, locked)
+}
+
+func TestManifestBatched(t *testing.T) {
+	ctx := context.Background()
+	f, m := newTestFs(t)
+	f.opt.ManifestFlushInterval = fs.Duration(time.Hour)
+
+	// Upload concurrently - run with -race to check the locking
+	var wg sync.WaitGroup
+	var remotes []string
+	for i := range 8 {
+		remote := fmt.Sprintf("file%d.txt", i)
+		remotes = append(remotes, remote)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			putFile(ctx, t, f, remote, remote)
+		}()
+	}
+	wg.Wait()
+	assert.Nil(t, m.manifest(), "manifest saved before flush")
+
+	// Listing shows the changes without saving them
+	entries, err := f.List(ctx, "")
+	require.NoError(t, err)
+	assert.Len(t, entries, len(remotes))
+	require.NoError(t, f.ListR(ctx, "", func(fs.DirEntries) error { return nil }))
+	assert.Nil(t, m.manifest(), "manifest saved by listing")
+	require.NoError(t, f.Shutdown(ctx))
+	assert.ElementsMatch(t, remotes, m.manifestPaths())
+	calls := m.callCount("sendDocument") + m.callCount("editMessageMedia")
+
+	// Removed documents are deleted when the manifest is saved
+	o := entries[0].(*Object)
+	require.NoError(t, o.Remove(ctx))
+	assert.True(t, m.hasMessage(o.messageID))
+	assert.Len(t, m.manifestPaths(), len(remotes))
+	require.NoError(t, f.Shutdown(ctx))
+	assert.False(t, m.hasMessage(o.messageID))
+	assert.Len(t, m.manifestPaths(), len(remotes)-1)
+	assert.Equal(t, calls+1, m.callCount("sendDocument")+m.callCount("editMessageMedia"))
+
+	// Nothing to do if there are no changes
+	require.NoError(t, f.Shutdown(ctx))
+	assert.Equal(t, calls+1, m.callCount("sendDocument")+m.callCount("editMessageMedia"))
+}
+
+func TestManifestFlushTimer(t *testing.T) {
+	ctx := context.Background()
+	f, m := newTestFs(t)
+	f.opt.ManifestFlushInterval = fs.Duration(10 * time.Millisecond)
+	putFile(ctx, t, f, "a.txt", "aaa")
+	assert.Eventually(t, func() bool {
+		return slices.Equal([]string{"a.txt"}, m.manifestPaths())
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestConcurrentWriters(t *testing.T) {
+	ctx := context.Background()
+	f1, m := newTestFs(t)
+	putFile(ctx, t, f1, "shared.txt", "original")
+	putFile(ctx, t, f1, "doomed.txt", "doomed")
+	f2 := m.newFs()
+	for _, f := range []*Fs{f1, f2} {
+		f.opt.ManifestFlushInterval = fs.Duration(time.Hour)
+		_, err := f.List(ctx, "")
+		require.NoError(t, err)
+	}
+
+	// Interleave changes from both writers based on the same manifest
+	putFile(ctx, t, f1, "one.txt", "one")
+	putFile(ctx, t, f2, "two.txt", "two")
+	o, err := f2.NewObject(ctx, "doomed.txt")
+	require.NoError(t, err)
+	require.NoError(t, o.Remove(ctx))
+	old := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	newer := old.Add(time.Hour)
+	for _, f := range []*Fs{f1, f2} {
+		modTime := old
+		if f == f2 {
+			modTime = newer
+		}
+		o, err := f.NewObject(ctx, "shared.txt")
+		require.NoError(t, err)
+		src := object.NewStaticObjectInfo("shared.txt", modTime, 3, true, nil, nil)
+		require.NoError(t, o.Update(ctx, strings.NewReader(f.String()[:3]), src))
+	}
+	require.NoError(t, f1.Shutdown(ctx))
+	require.NoError(t, f2.Shutdown(ctx))
+
+	// Nothing is lost and the newest change to shared.txt wins
+	final := m.manifest()
+	require.NotNil(t, final)
+	assert.Equal(t, int64(4), final.Sequence)
+	var paths []string
+	for _, entry := range final.Entries {
+		paths = append(paths, entry.Path)
+	}
+	assert.ElementsMatch(t, []string{"shared.txt", "one.txt", "two.txt"}, paths)
+	assert.True(t, final.find("shared.txt").ModTime.Equal(newer))
+
+	// The documents nobody refers to are deleted
+	m.mu.Lock()
+	messages := len(m.updates)
+	m.mu.Unlock()
+	assert.Equal(t, len(final.Entries)+1, messages)
+}
+
+// TestMergeConflicts checks that when two rclones change the same file
+// at once both versions are kept, unless merge_conflicts is newest
+func TestMergeConflicts(t *testing.T) {
+	for _, mode := range []string{conflictsKeep, conflictsNewest} {
+		t.Run(mode, func(t *testing.T) {
+			ctx := accounting.WithStatsGroup(context.Background(), "TestMergeConflicts"+mode)
+			f1, m := newTestFs(t)
+			putFile(ctx, t, f1, "shared.txt", "original")
+			f2 := m.newFs()
+			for _, f := range []*Fs{f1, f2} {
+				f.opt.MergeConflicts = mode
+				f.opt.ManifestFlushInterval = fs.Duration(time.Hour)
+				_, err := f.List(ctx, "")
+				require.NoError(t, err)
+			}
+
+			// Both change shared.txt before either saves, f2 last
+			old := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+			for i, f := range []*Fs{f1, f2} {
+				o, err := f.NewObject(ctx, "shared.txt")
+				require.NoError(t, err)
+				content := fmt.Sprintf("version %d", i+1)
+				src := object.NewStaticObjectInfo("shared.txt", old.Add(time.Duration(i)*time.Hour), int64(len(content)), true, nil, nil)
+				require.NoError(t, o.Update(ctx, strings.NewReader(content), src))
+			}
+			require.NoError(t, f1.Shutdown(ctx))
+			require.NoError(t, f2.Shutdown(ctx))
+
+			g := m.newFs()
+			read := func(remote string) string {
+				o, err := g.NewObject(ctx, remote)
+				require.NoError(t, err)
+				return readObject(ctx, t, o)
+			}
+			paths := m.manifestPaths()
+			if mode == conflictsKeep {
+				// The change saved first keeps the name
+				require.Len(t, paths, 2)
+				conflict := paths[slices.IndexFunc(paths, func(p string) bool { return p != "shared.txt" })]
+				assert.Regexp(t, `^shared\.txt\.conflict-.+-\d{8}-\d{6}$`, conflict)
+				assert.Equal(t, "version 1", read("shared.txt"))
+				assert.Equal(t, "version 2", read(conflict))
+				assert.Equal(t, int64(1), accounting.Stats(ctx).GetErrors())
+			} else {
+				assert.Equal(t, []string{"shared.txt"}, paths)
+				assert.Equal(t, "version 2", read("shared.txt"))
+				assert.Zero(t, accounting.Stats(ctx).GetErrors())
+			}
+
+			// The documents nobody refers to are deleted
+			m.mu.Lock()
+			messages := len(m.updates)
+			m.mu.Unlock()
+			assert.Equal(t, len(paths)+1, messages)
+		})
+	}
+}
+
+func TestConcurrentPutRemoveList(t *testing.T) {
+	ctx := context.Background()
+	for _, test := range []struct {
+		name  string
+		flush time.Duration
+	}{
+		{name: "immediate", flush: 0},
+		{name: "batched", flush: time.Duration(defaultFlushInterval)},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			f, m := newTestFs(t)
+			f.opt.ManifestFlushInterval = fs.Duration(test.flush)
+			const n = 16
+			for i := range n {
+				putFile(ctx, t, f, fmt.Sprintf("old%02d.txt", i), "old")
+			}
+
+			// Run with -race to check the locking
+			var (
+				wg   sync.WaitGroup
+				want []string
+			)
+			run := func(fn func() error) {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					assert.NoError(t, fn())
+				}()
+			}
+			for i := range n {
+				remote := fmt.Sprintf("new%02d.txt", i)
+				want = append(want, remote)
+				run(func() error {
+					_, err := f.Put(ctx, strings.NewReader("new"), object.NewStaticObjectInfo(remote, time.Now(), 3, true, nil, nil))
+					return err
+				})
+				old := fmt.Sprintf("old%02d.txt", i)
+				if i%2 == 0 {
+					want = append(want, old)
+				} else {
+					run(func() error {
+						o, err := f.NewObject(ctx, old)
+						if err != nil {
+							return err
+						}
+						return o.Remove(ctx)
+					})
+				}
+				run(func() error {
+					_, err := f.List(ctx, "")
+					return err
+				})
+			}
+			wg.Wait()
+			require.NoError(t, f.Shutdown(ctx))
+			assert.ElementsMatch(t, want, m.manifestPaths())
+			entries, err := m.newFs().List(ctx, "")
+			require.NoError(t, err)
+			assert.Len(t, entries, len(want))
+
+			// Every manifest uploaded is whole and follows the one
+			// before it
+			m.mu.Lock()
+			manifests := slices.Clone(m.manifests)
+			m.mu.Unlock()
+			require.NotEmpty(t, manifests)
+			for i, data := range manifests {
+				saved, err := decodeManifest(data)
+				require.NoError(t, err)
+				assert.Equal(t, int64(i+1), saved.Sequence)
+				seen := map[string]bool{}
+				for _, entry := range saved.Entries {
+					assert.False(t, seen[entry.Path], "%q twice in manifest %d", entry.Path, saved.Sequence)
+					seen[entry.Path] = true
+					assert.NotZero(t, entry.MessageID, "%q has no message in manifest %d", entry.Path, saved.Sequence)
+				}
+			}
+		})
+	}
+}
+
+func TestManifestCache(t *testing.T) {
+	ctx := context.Background()
+	f, m := newTestFs(t)
+	// g stands for another rclone process
+	g := m.newFs()
+	g.saves = new(atomic.Int64)
+	putFile(ctx, t, f, "a.txt", "aaa")
+
+	names := func() (names []string) {
+		entries, err := f.List(ctx, "")
+		require.NoError(t, err)
+		for _, entry := range entries {
+			names = append(names, entry.Remote())
+		}
+		return names
+	}
+	assert.Equal(t, []string{"a.txt"}, names())
+
+	// Changes saved by someone else aren't seen while the cache is fresh
+	putFile(ctx, t, g, "b.txt", "bbb")
+	downloads := m.callCount("file")
+	assert.Equal(t, []string{"a.txt"}, names())
+	assert.Equal(t, downloads, m.callCount("file"))
+
+	// but our own changes are
+	putFile(ctx, t, f, "c.txt", "ccc")
+	assert.Equal(t, []string{"a.txt", "b.txt", "c.txt"}, names())
+
+	// Flushing the cache reads the manifest again
+	putFile(ctx, t, g, "d.txt", "ddd")
+	f.DirCacheFlush()
+	assert.Equal(t, []string{"a.txt", "b.txt", "c.txt", "d.txt"}, names())
+
+	// as does the cache expiring, once however many listings want it
+	putFile(ctx, t, g, "e.txt", "eee")
+	f.listMu.Lock()
+	f.readTime = time.Now().Add(-time.Duration(defaultCacheTime))
+	f.listMu.Unlock()
+	downloads = m.callCount("file")
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := f.List(ctx, "")
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, downloads+1, m.callCount("file"))
+	assert.Equal(t, []string{"a.txt", "b.txt", "c.txt", "d.txt", "e.txt"}, names())
+
+	// Changes saved by another Fs in this process, such as one for a
+	// different root, are seen straight away
+	h := m.newFs()
+	h.root = "dir"
+	putFile(ctx, t, h, "f.txt", "fff")
+	assert.Equal(t, []string{"dir", "a.txt", "b.txt", "c.txt", "d.txt", "e.txt"}, names())
+
+	// A cache time of 0 reads the manifest for every listing
+	f.opt.ManifestCacheTime = 0
+	downloads = m.callCount("file")
+	names()
+	names()
+	assert.Equal(t, downloads+2, m.callCount("file"))
+}
+
+func TestRootIsFile(t *testing.T) {
+	ctx := context.Background()
+	f, m := newTestFs(t)
+	putFile(ctx, t, f, "a.txt", "aaa")
+	putFile(ctx, t, f, "dir/b.txt", "bbb")
+
+	for _, test := range []struct {
+		root     string
+		isFile   bool
+		wantRoot string
+	}{
+		{"a.txt", true, ""},
+		{"dir/b.txt", true, "dir"},
+		{"dir", false, "dir"},
+		{"missing.txt", false, "missing.txt"},
+	} {
+		f := m.newFs()
+		f.root = test.root
+		isFile, err := f.rootIsFile(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, test.isFile, isFile, test.root)
+		assert.Equal(t, test.wantRoot, f.Root(), test.root)
+	}
+}
+
+func TestNewObject(t *testing.T) {
+	ctx := context.Background()
+	f, m := newTestFs(t)
+	modTime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	src := object.NewStaticObjectInfo("dir/a.txt", modTime, 3, true, nil, nil)
+	_, err := f.Put(ctx, strings.NewReader("aaa"), src)
+	require.NoError(t, err)
+	calls := m.callCount("getChat")
+
+	t.Run("Found", func(t *testing.T) {
+		obj, err := f.NewObject(ctx, "dir/a.txt")
+		require.NoError(t, err)
+		o := obj.(*Object)
+		assert.Equal(t, "dir/a.txt", o.Remote())
+		assert.Equal(t, int64(3), o.Size())
+		assert.True(t, o.ModTime(ctx).Equal(modTime))
+		assert.NotEmpty(t, o.fileID)
+		assert.NotZero(t, o.messageID)
+		assert.Equal(t, "aaa", readObject(ctx, t, o))
+	})
+
+	t.Run("NotFound", func(t *testing.T) {
+		_, err := f.NewObject(ctx, "dir/missing.txt")
+		assert.Equal(t, fs.ErrorObjectNotFound, err)
+		_, err = f.NewObject(ctx, "di")
+		assert.Equal(t, fs.ErrorObjectNotFound, err)
+	})
+
+	t.Run("IsDir", func(t *testing.T) {
+		_, err := f.NewObject(ctx, "dir")
+		assert.Equal(t, fs.ErrorIsDir, err)
+	})
+
+	// The cached manifest is used rather than reading it again
+	assert.Equal(t, calls, m.callCount("getChat"))
+}
+
+func TestDirectories(t *testing.T) {
+	ctx := context.Background()
+	f, _ := newTestFs(t)
+	putFile(ctx, t, f, "a.txt", "aaa")
+	putFile(ctx, t, f, "dir/b.txt", "bbb")
+	putFile(ctx, t, f, "dir/sub/c.txt", "ccc")
+	require.NoError(t, f.Mkdir(ctx, "empty"))
+	require.NoError(t, f.Mkdir(ctx, "dir"))
+
+	list := func(dir string) (names []string) {
+		entries, err := f.List(ctx, dir)
+		require.NoError(t, err)
+		for _, entry := range entries {
+			name := entry.Remote()
+			if _, ok := entry.(fs.Directory); ok {
+				name += "/"
+			}
+			names = append(names, name)
+		}
+		return names
+	}
+	assert.Equal(t, []string{"dir/", "empty/", "a.txt"}, list(""))
+	assert.Equal(t, []string{"dir/sub/", "dir/b.txt"}, list("dir"))
+	assert.Equal(t, []string{}, append([]string{}, list("empty")...))
+	_, err := f.List(ctx, "missing")
+	assert.Equal(t, fs.ErrorDirNotFound, err)
+
+	// A directory with files in it isn't recorded
+	m, err := f.loadFileList(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"empty"}, m.Dirs)
+
+	assert.Equal(t, fs.ErrorDirectoryNotEmpty, f.Rmdir(ctx, "dir"))
+	assert.Equal(t, fs.ErrorDirectoryNotEmpty, f.Rmdir(ctx, ""))
+	require.NoError(t, f.Rmdir(ctx, "empty"))
+	assert.Equal(t, fs.ErrorDirNotFound, f.Rmdir(ctx, "empty"))
+	assert.Equal(t, []string{"dir/", "a.txt"}, list(""))
+}
+
+func TestListR(t *testing.T) {
+	ctx := context.Background()
+	f, m := newTestFs(t)
+	putFile(ctx, t, f, "a.txt", "aaa")
+	putFile(ctx, t, f, "dir/b.txt", "bbb")
+	putFile(ctx, t, f, "dir/sub/deep/c.txt", "ccc")
+	require.NoError(t, f.Mkdir(ctx, "empty/made"))
+
+	listR := func(f *Fs, dir string) (names []string) {
+		err := f.ListR(ctx, dir, func(entries fs.DirEntries) error {
+			for _, entry := range entries {
+				name := entry.Remote()
+				if _, ok := entry.(fs.Directory); ok {
+					name += "/"
+				}
+				names = append(names, name)
+			}
+			return nil
+		})
+		require.NoError(t, err)
+		return names
+	}
+
+	// The whole tree comes from a single read of the manifest
+	g := m.newFs()
+	downloads := m.callCount("file")
+	assert.Equal(t, []string{
+		"dir/",
+		"dir/sub/",
+		"dir/sub/deep/",
+		"empty/",
+		"empty/made/",
+		"a.txt",
+		"dir/b.txt",
+		"dir/sub/deep/c.txt",
+	}, listR(g, ""))
+	assert.Equal(t, downloads+1, m.callCount("file"))
+
+	assert.Equal(t, []string{"dir/sub/", "dir/sub/deep/", "dir/b.txt", "dir/sub/deep/c.txt"}, listR(f, "dir"))
+	assert.Equal(t, []string{"empty/made/"}, listR(f, "empty"))
+	nested := m.newFs()
+	nested.root = "dir"
+	assert.Equal(t, []string{"sub/", "sub/deep/", "b.txt", "sub/deep/c.txt"}, listR(nested, ""))
+
+	err := f.ListR(ctx, "missing", func(fs.DirEntries) error { return nil })
+	assert.Equal(t, fs.ErrorDirNotFound, err)
+
+	// An error from the callback stops the listing
+	for i := range 200 {
+		require.NoError(t, f.Mkdir(ctx, fmt.Sprintf("many/%03d", i)))
+	}
+	errStop := errors.New("stop")
+	calls := 0
+	err = f.ListR(ctx, "", func(fs.DirEntries) error {
+		calls++
+		return errStop
+	})
+	assert.Equal(t, errStop, err)
+	assert.Equal(t, 1, calls)
+}
+
+func TestNestedRoot(t *testing.T) {
+	ctx := context.Background()
+	top, m := newTestFs(t)
+	putFile(ctx, t, top, "outside.txt", "out")
+	putFile(ctx, t, top, "backups/other.txt", "other")
+	putFile(ctx, t, top, "backups/photos/in.txt", "in")
+	putFile(ctx, t, top, "backups/photos/2024/deep.txt", "deep")
+
+	// NewFs trims slashes from the root
+	f := m.newFs()
+	f.root = strings.Trim("/backups/photos/", "/")
+
+	list := func(dir string) (names []string) {
+		entries, err := f.List(ctx, dir)
+		require.NoError(t, err)
+		for _, entry := range entries {
+			names = append(names, entry.Remote())
+		}
+		return names
+	}
+	assert.Equal(t, []string{"2024", "in.txt"}, list(""))
+	assert.Equal(t, []string{"2024/deep.txt"}, list("2024"))
+
+	o, err := f.NewObject(ctx, "in.txt")
+	require.NoError(t, err)
+	assert.Equal(t, "in.txt", o.Remote())
+	assert.Equal(t, "in", readObject(ctx, t, o))
+	_, err = f.NewObject(ctx, "outside.txt")
+	assert.Equal(t, fs.ErrorObjectNotFound, err)
+	_, err = f.NewObject(ctx, "2024")
+	assert.Equal(t, fs.ErrorIsDir, err)
+
+	// Writes land inside the root
+	putFile(ctx, t, f, "new.txt", "new")
+	require.NoError(t, f.Mkdir(ctx, "empty"))
+	assert.Equal(t, fs.ErrorDirectoryNotEmpty, f.Rmdir(ctx, ""))
+	require.NoError(t, o.Remove(ctx))
+	assert.ElementsMatch(t, []string{"outside.txt", "backups/other.txt", "backups/photos/2024/deep.txt", "backups/photos/new.txt"}, m.manifestPaths())
+	assert.Equal(t, []string{"backups/photos/empty"}, m.manifest().Dirs)
+	assert.Equal(t, []string{"2024", "empty", "new.txt"}, list(""))
+
+	// A root which doesn't exist can be made
+	f = m.newFs()
+	f.root = "missing"
+	_, err = f.List(ctx, "")
+	assert.Equal(t, fs.ErrorDirNotFound, err)
+	require.NoError(t, f.Mkdir(ctx, ""))
+	assert.Equal(t, []string(nil), list(""))
+	require.NoError(t, f.Rmdir(ctx, ""))
+	_, err = f.List(ctx, "")
+	assert.Equal(t, fs.ErrorDirNotFound, err)
+}
+
+// TestAlias checks an alias pointing into the chat, used with a root
+// below that
+func TestAlias(t *testing.T) {
+	ctx := context.Background()
+	m := newMockServer(t)
+	name := m.setenvRemote(t, nil)
+	setenvConfig(t, name+"work", configmap.Simple{
+		"type":   "alias",
+		"remote": name + ":clients/acme",
+	})
+	top, err := fs.NewFs(ctx, name+":")
+	require.NoError(t, err)
+	putFile(ctx, t, top.(*Fs), "clients/acme-old/old.txt", "old")
+	putFile(ctx, t, top.(*Fs), "clients/acme.txt", "acme")
+	list := func(f fs.Fs, dir string) (names []string) {
+		entries, err := f.List(ctx, dir)
+		require.NoError(t, err)
+		for _, entry := range entries {
+			names = append(names, entry.Remote())
+		}
+		return names
+	}
+
+	// The root doesn't have to exist
+	f, err := fs.NewFs(ctx, name+"work:reports/2024")
+	require.NoError(t, err)
+	assert.Equal(t, "clients/acme/reports/2024", f.Root())
+	_, err = f.List(ctx, "")
+	assert.Equal(t, fs.ErrorDirNotFound, err)
+	_, err = f.NewObject(ctx, "new/file")
+	assert.Equal(t, fs.ErrorObjectNotFound, err)
+
+	// Putting a file makes the directories above it
+	src := object.NewStaticObjectInfo("new/file", time.Now(), 3, true, nil, nil)
+	o, err := f.Put(ctx, strings.NewReader("new"), src)
+	require.NoError(t, err)
+	assert.Equal(t, "new/file", o.Remote())
+	assert.Equal(t, []string{"clients/acme-old/old.txt", "clients/acme.txt", "clients/acme/reports/2024/new/file"}, m.manifestPaths())
+	assert.Equal(t, []string{"new"}, list(f, ""))
+	assert.Equal(t, []string{"new/file"}, list(f, "new"))
+	work, err := fs.NewFs(ctx, name+"work:")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"reports"}, list(work, ""))
+	assert.Equal(t, []string{"reports/2024"}, list(work, "reports"))
+	assert.Equal(t, map[string]int64{"reports/2024/new/file": 3}, listSizes(ctx, t, work))
+	assert.ElementsMatch(t, []string{"clients/acme", "clients/acme-old", "clients/acme.txt"}, list(top, "clients"))
+
+	// A root pointing at a file gives its directory
+	f, err = fs.NewFs(ctx, name+"work:reports/2024/new/file")
+	assert.Equal(t, fs.ErrorIsFile, err)
+	assert.Equal(t, "clients/acme/reports/2024/new", f.Root())
+	assert.Equal(t, []string{"file"}, list(f, ""))
+
+	// Removing the file leaves its directories behind, and removing
+	// each of those leaves the one above
+	require.NoError(t, o.Remove(ctx))
+	assert.Equal(t, []string(nil), list(work, "reports/2024/new"))
+	require.NoError(t, operations.Rmdirs(ctx, work, "", false))
+	_, err = work.List(ctx, "")
+	assert.Equal(t, fs.ErrorDirNotFound, err)
+	assert.ElementsMatch(t, []string{"clients/acme-old", "clients/acme.txt"}, list(top, "clients"))
+	assert.Empty(t, m.manifest().Dirs)
+}
+
+func TestMove(t *testing.T) {
+	ctx := context.Background()
+	f, m := newTestFs(t)
+	a := putFile(ctx, t, f, "a.txt", "aaa")
+	existing := putFile(ctx, t, f, "b/renamed.txt", "old")
+	uploads := m.callCount("sendDocument")
+
+	dst, err := f.Move(ctx, a, "b/renamed.txt")
+	require.NoError(t, err)
+	assert.Equal(t, uploads, m.callCount("sendDocument"), "document uploaded by Move")
+	moved := dst.(*Object)
+	assert.Equal(t, "b/renamed.txt", moved.Remote())
+	assert.Equal(t, a.messageID, moved.messageID)
+	assert.True(t, moved.ModTime(ctx).Equal(a.ModTime(ctx)))
+	assert.Equal(t, "aaa", readObject(ctx, t, moved))
+	assert.True(t, m.hasMessage(a.messageID))
+	assert.False(t, m.hasMessage(existing.messageID), "replaced destination not deleted")
+	assert.Equal(t, []string{"b/renamed.txt"}, m.manifestPaths())
+	_, err = f.NewObject(ctx, "a.txt")
+	assert.Equal(t, fs.ErrorObjectNotFound, err)
+
+	// Chunked objects keep their parts
+	f.opt.ChunkSize = 2
+	c := putFile(ctx, t, f, "c.txt", "cccccc")
+	require.Len(t, c.chunks, 3)
+	dst, err = f.Move(ctx, c, "d.txt")
+	require.NoError(t, err)
+	assert.Equal(t, c.chunks, dst.(*Object).chunks)
+	assert.Equal(t, "cccccc", readObject(ctx, t, dst))
+
+	// Between remotes with different roots in the same chat
+	sub := m.newFs()
+	sub.root = "sub"
+	dst, err = sub.Move(ctx, dst, "e.txt")
+	require.NoError(t, err)
+	assert.Equal(t, "e.txt", dst.Remote())
+	assert.Equal(t, []string{"b/renamed.txt", "sub/e.txt"}, m.manifestPaths())
+	_, err = f.NewObject(ctx, "d.txt")
+	assert.Equal(t, fs.ErrorObjectNotFound, err)
+
+	// Moving a file which has gone fails
+	_, err = f.Move(ctx, c, "f.txt")
+	assert.Equal(t, fs.ErrorObjectNotFound, err)
+}
+
+func TestCopy(t *testing.T) {
+	ctx := context.Background()
+	f, m := newTestFs(t)
+	a := putFile(ctx, t, f, "a.txt", "aaa")
+	existing := putFile(ctx, t, f, "b.txt", "old")
+
+	dst, err := f.Copy(ctx, a, "b.txt")
+	require.NoError(t, err)
+	assert.Equal(t, 1, m.resends, "document not sent by file_id")
+	copied := dst.(*Object)
+	assert.Equal(t, "b.txt", copied.Remote())
+	assert.NotEqual(t, a.messageID, copied.messageID)
+	assert.Equal(t, a.size, copied.size)
+	assert.True(t, copied.ModTime(ctx).Equal(a.ModTime(ctx)))
+	assert.Equal(t, "aaa", readObject(ctx, t, copied))
+	assert.False(t, m.hasMessage(existing.messageID), "replaced destination not deleted")
+	assert.Equal(t, []string{"a.txt", "b.txt"}, m.manifestPaths())
+
+	// Removing the source leaves the copy intact
+	require.NoError(t, a.Remove(ctx))
+	assert.Equal(t, "aaa", readObject(ctx, t, copied))
+
+	// Chunked objects are copied part by part
+	f.opt.ChunkSize = 2
+	c := putFile(ctx, t, f, "c.txt", "cccccc")
+	dst, err = f.Copy(ctx, c, "dir/c.txt")
+	require.NoError(t, err)
+	require.Len(t, dst.(*Object).chunks, 3)
+	assert.Equal(t, 4, m.resends)
+	assert.Equal(t, "cccccc", readObject(ctx, t, dst))
+
+	// Failed part copies are tidied up
+	messages := len(m.updates)
+	m.failures["sendDocument"] = []int{0, http.StatusBadRequest}
+	_, err = f.Copy(ctx, c, "e.txt")
+	require.Error(t, err)
+	assert.Equal(t, messages, len(m.updates))
+}
+
+// TestChannelWithoutDelete checks files can be uploaded to and read
+// from a channel where the bot can't delete messages but moving and
+// deleting them fails straight away, unless assume_full_access is set
+func TestChannelWithoutDelete(t *testing.T) {
+	ctx := context.Background()
+	m := newMockServer(t)
+	m.chatType = "channel"
+	m.noDelete = true
+	f := m.newFs()
+	assert.Nil(t, f.Features().Move)
+	assert.Nil(t, f.Features().Purge)
+	o := putFile(ctx, t, f, "dir/a.txt", "aaa")
+	assert.Equal(t, "aaa", readObject(ctx, t, o))
+
+	err := o.Remove(ctx)
+	assert.ErrorIs(t, err, fs.ErrorPermissionDenied)
+	assert.ErrorContains(t, err, `"Delete messages" admin right`)
+	_, err = f.Move(ctx, o, "b.txt")
+	assert.ErrorIs(t, err, fs.ErrorPermissionDenied)
+	assert.ErrorIs(t, f.Purge(ctx, "dir"), fs.ErrorPermissionDenied)
+	assert.Equal(t, []string{"dir/a.txt"}, m.manifestPaths())
+	assert.Zero(t, m.callCount("deleteMessage"))
+
+	// Overwriting still works, leaving the old document as an orphan
+	putFile(ctx, t, f, "dir/a.txt", "new")
+	require.NoError(t, f.Shutdown(ctx))
+	assert.Len(t, m.manifest().Orphans, 1)
+
+	// The bot can delete with the right, or in a group
+	m.noDelete = false
+	assert.NotNil(t, m.newFs().Features().Move)
+	m.noDelete = true
+	m.chatType = ""
+	assert.NotNil(t, m.newFs().Features().Move)
+
+	// The check can be skipped
+	m.chatType = "channel"
+	calls := m.callCount("getChatMember")
+	config := m.config()
+	config["assume_full_access"] = "true"
+	g, err := NewFs(ctx, "TestTelegram", "", config)
+	require.NoError(t, err)
+	assert.NotNil(t, g.Features().Move)
+	assert.Equal(t, calls, m.callCount("getChatMember"))
+}
+
+// TestCopyBetweenRemotes checks files are copied without transferring
+// them between remotes for different chats using the same bot, and
+// are downloaded and uploaded when that isn't possible
+func TestCopyBetweenRemotes(t *testing.T) {
+	ctx := context.Background()
+	const archiveChatID = -1009999999999
+	hot, m := newTestFs(t)
+	m.otherChats = []int64{archiveChatID}
+	config := m.config()
+	config["chat_id"] = strconv.Itoa(archiveChatID)
+	archiveFs, err := NewFs(ctx, "TestTelegramArchive", "", config)
+	require.NoError(t, err)
+	archive := archiveFs.(*Fs)
+
+	a := putFile(ctx, t, hot, "a.txt", "aaa")
+	hot.opt.ChunkSize = 2
+	big := putFile(ctx, t, hot, "big.iso", "0123456789")
+
+	// copyTo copies src into the archive as rclone copy does
+	copyTo := func(src fs.Object, remote string) fs.Object {
+		dst, err := operations.Copy(ctx, archive, nil, remote, src)
+		require.NoError(t, err)
+		return dst
+	}
+	copied := copyTo(a, "a.txt")
+	assert.Equal(t, 1, m.resends, "document not sent by file_id")
+	copiedBig := copyTo(big, "iso/big.iso")
+	assert.Equal(t, 6, m.resends, "parts not sent by file_id")
+	for _, entry := range m.manifestIn(archiveChatID).Entries {
+		var ids []int64
+		ids = append(ids, entry.MessageID)
+		for _, chunk := range entry.Chunks {
+			ids = append(ids, chunk.MessageID)
+		}
+		for _, id := range ids {
+			if id == 0 {
+				continue
+			}
+			m.mu.Lock()
+			assert.Equal(t, int64(archiveChatID), m.message(id).Chat.ID, entry.Path)
+			m.mu.Unlock()
+		}
+	}
+	assert.Equal(t, "aaa", readObject(ctx, t, copied))
+	assert.Equal(t, "0123456789", readObject(ctx, t, copiedBig))
+	assert.Equal(t, a.md5, copied.(*Object).md5)
+	assert.True(t, big.ModTime(ctx).Equal(copiedBig.ModTime(ctx)))
+
+	// Sources which can't be sent to the archive are downloaded and
+	// uploaded instead
+	b := putFile(ctx, t, hot, "b.txt", "bb")
+	resends := m.resends
+	m.failures["sendDocument"] = []int{http.StatusBadRequest}
+	assert.Equal(t, "bb", readObject(ctx, t, copyTo(b, "b.txt")))
+	hot.opt.ProtectContent = true
+	assert.Equal(t, "bb", readObject(ctx, t, copyTo(b, "protected.txt")))
+	assert.Equal(t, resends, m.resends)
+	hot.opt.ProtectContent = false
+
+	// as are files from another bot
+	config = m.config()
+	config["bot_token"] = obscure.MustObscure("456:other")
+	config["skip_verify"] = "true"
+	other, err := NewFs(ctx, "TestTelegramOther", "", config)
+	require.NoError(t, err)
+	_, err = other.(*Fs).Copy(ctx, b, "b.txt")
+	assert.Equal(t, fs.ErrorCantCopy, err)
+	var paths []string
+	for _, entry := range m.manifestIn(archiveChatID).Entries {
+		paths = append(paths, entry.Path)
+	}
+	assert.ElementsMatch(t, []string{"a.txt", "iso/big.iso", "b.txt", "protected.txt"}, paths)
+}
+
+// caption decodes the caption of the message with messageID
+func (m *mockServer) caption(t *testing.T, messageID int64) (caption documentCaption) {
+	m.mu.Lock()
+	message := m.message(messageID)
+	m.mu.Unlock()
+	require.NotNil(t, message)
+	require.NoError(t, json.Unmarshal([]byte(message.Caption), &caption))
+	return caption
+}
+
+func TestCaptions(t *testing.T) {
+	ctx := context.Background()
+	f, m := newTestFs(t)
+	modTime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	content := "hello world"
+	hashes := map[hash.Type]string{hash.MD5: "5eb63bbbe01eeed093cb22bb8f5acdc3"}
+	src := object.NewStaticObjectInfo("dir/a.txt", modTime, int64(len(content)), true, hashes, nil)
+	obj, err := f.Put(ctx, strings.NewReader(content), src)
+	require.NoError(t, err)
+	a := obj.(*Object)
+	caption := m.caption(t, a.messageID)
+	assert.Equal(t, "dir/a.txt", caption.Path)
+	assert.Equal(t, int64(len(content)), caption.Size)
+	assert.True(t, caption.ModTime.Equal(modTime), "got %v", caption.ModTime)
+	assert.Equal(t, hashes[hash.MD5], caption.MD5)
+	assert.Zero(t, caption.Part)
+
+	// Each part of a chunked file says which it is
+	f.opt.ChunkSize = 4
+	obj, err = f.Put(ctx, strings.NewReader(content), object.NewStaticObjectInfo("b.txt", modTime, int64(len(content)), true, nil, nil))
+	require.NoError(t, err)
+	b := obj.(*Object)
+	require.Len(t, b.chunks, 3)
+	for i, chunk := range b.chunks {
+		caption := m.caption(t, chunk.MessageID)
+		assert.Equal(t, "b.txt", caption.Path)
+		assert.Equal(t, int64(len(content)), caption.Size)
+		assert.Equal(t, i+1, caption.Part)
+		assert.Zero(t, caption.Parts)
+	}
+
+	// If the size isn't known the last part says how many there are,
+	// including when it is a whole part
+	for _, content := range []string{content, content + "!"} {
+		obj, err = f.Put(ctx, strings.NewReader(content), object.NewStaticObjectInfo("streamed.txt", modTime, -1, true, nil, nil))
+		require.NoError(t, err)
+		streamed := obj.(*Object)
+		require.Len(t, streamed.chunks, 3)
+		for i, chunk := range streamed.chunks {
+			caption := m.caption(t, chunk.MessageID)
+			assert.Equal(t, int64(-1), caption.Size)
+			assert.Equal(t, i+1, caption.Part)
+			if i == 2 {
+				assert.Equal(t, 3, caption.Parts)
+			} else {
+				assert.Zero(t, caption.Parts)
+			}
+		}
+	}
+
+	// Copies describe their new path
+	dst, err := f.Copy(ctx, a, "c.txt")
+	require.NoError(t, err)
+	caption = m.caption(t, dst.(*Object).messageID)
+	assert.Equal(t, "c.txt", caption.Path)
+	assert.Equal(t, hashes[hash.MD5], caption.MD5)
+	dst, err = f.Copy(ctx, b, "d.txt")
+	require.NoError(t, err)
+	assert.Equal(t, 2, m.caption(t, dst.(*Object).chunks[1].MessageID).Part)
+
+	// No captions are written if disabled
+	f.opt.WriteCaptions = false
+	e := putFile(ctx, t, f, "e.txt", "eee")
+	m.mu.Lock()
+	assert.Empty(t, m.message(e.messageID).Caption)
+	m.mu.Unlock()
+}
+
+func TestCaptionEncode(t *testing.T) {
+	modTime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	// Quotes, HTML and emoji survive the round trip
+	c := documentCaption{Path: `dir/"quoted" <b>&amp;</b> 🎉.txt`, Size: 3, ModTime: modTime}
+	encoded := c.encode()
+	assert.Contains(t, encoded, "<b>", "HTML shouldn't be escaped")
+	var decoded documentCaption
+	require.NoError(t, json.Unmarshal([]byte(encoded), &decoded))
+	assert.Equal(t, c.Path, decoded.Path)
+	assert.False(t, decoded.Truncated)
+
+	// Long paths lose their start to fit, keeping the file name
+	for _, long := range []string{
+		strings.Repeat("a/", 1000) + "file.txt",
+		strings.Repeat("🎉/", 1000) + "file.txt",
+		strings.Repeat(`"/`, 1000) + "file.txt",
+	} {
+		c := documentCaption{Path: long, Size: 3, ModTime: modTime, MD5: "5eb63bbbe01eeed093cb22bb8f5acdc3", Part: 12}
+		encoded := c.encode()
+		assert.LessOrEqual(t, utf16Length(encoded), maxCaptionLength)
+		var decoded documentCaption
+		require.NoError(t, json.Unmarshal([]byte(encoded), &decoded))
+		assert.True(t, decoded.Truncated)
+		assert.True(t, strings.HasSuffix(long, decoded.Path), "got %q", decoded.Path)
+		assert.Greater(t, utf16Length(decoded.Path), maxCaptionLength/2, "dropped too much")
+		assert.Equal(t, 12, decoded.Part)
+	}
+
+	// The manifest keeps the full path
+	ctx := context.Background()
+	f, m := newTestFs(t)
+	long := strings.Repeat("d/", 600) + "file.txt"
+	a := putFile(ctx, t, f, long, "aaa")
+	assert.True(t, m.caption(t, a.messageID).Truncated)
+	assert.Equal(t, []string{long}, m.manifestPaths())
+}
+
+func TestDirMove(t *testing.T) {
+	ctx := context.Background()
+	f, m := newTestFs(t)
+	a := putFile(ctx, t, f, "photos/a.jpg", "aaa")
+	putFile(ctx, t, f, "photos/2023/b.jpg", "bbb")
+	putFile(ctx, t, f, "photos/2023/raw/c.raw", "ccc")
+	putFile(ctx, t, f, "photoshop.txt", "ddd")
+	require.NoError(t, f.Mkdir(ctx, "photos/empty"))
+	sends, deletes := m.callCount("sendDocument"), m.callCount("deleteMessage")
+	edits := m.callCount("editMessageMedia")
+
+	require.NoError(t, f.DirMove(ctx, f, "photos", "archive/photos-2023"))
+	assert.Equal(t, sends, m.callCount("sendDocument"), "document sent by DirMove")
+	assert.Equal(t, deletes, m.callCount("deleteMessage"), "message deleted by DirMove")
+	assert.Equal(t, edits+1, m.callCount("editMessageMedia"), "manifest not saved once")
+	assert.ElementsMatch(t, []string{
+		"archive/photos-2023/a.jpg",
+		"archive/photos-2023/2023/b.jpg",
+		"archive/photos-2023/2023/raw/c.raw",
+		"photoshop.txt",
+	}, m.manifestPaths())
+	assert.Equal(t, []string{"archive/photos-2023/empty"}, m.manifest().Dirs)
+	o, err := f.NewObject(ctx, "archive/photos-2023/a.jpg")
+	require.NoError(t, err)
+	assert.Equal(t, a.messageID, o.(*Object).messageID)
+	assert.Equal(t, "aaa", readObject(ctx, t, o))
+	_, err = f.List(ctx, "photos")
+	assert.Equal(t, fs.ErrorDirNotFound, err)
+
+	// Moving onto an existing directory or file fails
+	require.NoError(t, f.Mkdir(ctx, "other"))
+	assert.Equal(t, fs.ErrorDirExists, f.DirMove(ctx, f, "other", "archive"))
+	assert.Equal(t, fs.ErrorDirExists, f.DirMove(ctx, f, "other", "photoshop.txt"))
+	assert.Equal(t, fs.ErrorDirNotFound, f.DirMove(ctx, f, "missing", "new"))
+	assert.Equal(t, fs.ErrorCantDirMove, f.DirMove(ctx, f, "archive", "archive/inside"))
+
+	// An empty directory keeps its marker
+	require.NoError(t, f.DirMove(ctx, f, "other", "moved"))
+	assert.ElementsMatch(t, []string{"archive/photos-2023/empty", "moved"}, m.manifest().Dirs)
+
+	// Between remotes with different roots in the same chat
+	sub := m.newFs()
+	sub.root = "archive"
+	require.NoError(t, sub.DirMove(ctx, f, "moved", "moved"))
+	assert.ElementsMatch(t, []string{"archive/photos-2023/empty", "archive/moved"}, m.manifest().Dirs)
+	require.NoError(t, f.DirMove(ctx, sub, "photos-2023", "photos"))
+	_, err = sub.NewObject(ctx, "photos-2023/a.jpg")
+	assert.Equal(t, fs.ErrorObjectNotFound, err)
+	_, err = f.NewObject(ctx, "photos/a.jpg")
+	assert.NoError(t, err)
+}
+
+func TestPurge(t *testing.T) {
+	ctx := context.Background()
+	f, m := newTestFs(t)
+	a := putFile(ctx, t, f, "old/a.txt", "aaa")
+	b := putFile(ctx, t, f, "old/sub/b.txt", "bbb")
+	keep := putFile(ctx, t, f, "older.txt", "ddd")
+	f.opt.ChunkSize = 2
+	c := putFile(ctx, t, f, "old/sub/c.txt", "cccccc")
+	require.Len(t, c.chunks, 3)
+	require.NoError(t, f.Mkdir(ctx, "old/empty"))
+	m.old[b.messageID] = true
+	edits := m.callCount("editMessageMedia")
+
+	require.NoError(t, f.Purge(ctx, "old"))
+	assert.Equal(t, edits+1, m.callCount("editMessageMedia"), "manifest not saved once")
+	assert.Equal(t, []string{"older.txt"}, m.manifestPaths())
+	assert.Empty(t, m.manifest().Dirs)
+	assert.False(t, m.hasMessage(a.messageID))
+	assert.True(t, m.hasMessage(b.messageID), "message too old to delete")
+	for _, chunk := range c.chunks {
+		assert.False(t, m.hasMessage(chunk.MessageID))
+	}
+	assert.True(t, m.hasMessage(keep.messageID))
+	_, err := f.List(ctx, "old")
+	assert.Equal(t, fs.ErrorDirNotFound, err)
+	assert.Equal(t, fs.ErrorDirNotFound, f.Purge(ctx, "old"))
+
+	// Purging the root empties it
+	require.NoError(t, f.Purge(ctx, ""))
+	assert.Empty(t, m.manifestPaths())
+	assert.False(t, m.hasMessage(keep.messageID))
+}
+
+func TestAbout(t *testing.T) {
+	ctx := context.Background()
+	f, m := newTestFs(t)
+	usage, err := f.About(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), *usage.Used)
+	assert.Equal(t, int64(0), *usage.Objects)
+	assert.Nil(t, usage.Total)
+	assert.Nil(t, usage.Free)
+
+	putFile(ctx, t, f, "a.txt", "aaa")
+	f.opt.ChunkSize = 2
+	putFile(ctx, t, f, "dir/b.txt", "bbbbb")
+	downloads := m.callCount("getFile")
+	usage, err = f.About(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(8), *usage.Used)
+	assert.Equal(t, int64(2), *usage.Objects)
+	assert.Equal(t, downloads, m.callCount("getFile"), "manifest read again")
+}
+
+func TestStats(t *testing.T) {
+	ctx := context.Background()
+	f, m := newTestFs(t)
+	stats, err := f.stats(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, fileListStats{}, *stats)
+
+	putFile(ctx, t, f, "a.txt", "aaa")
+	require.NoError(t, f.Mkdir(ctx, "empty"))
+	f.opt.ChunkSize = 2
+	putFile(ctx, t, f, "dir/sub/b.txt", "bbbbb")
+	m.mu.Lock()
+	m.failUpload = chunkName("c.txt", 2)
+	m.mu.Unlock()
+	_, err = f.Put(ctx, strings.NewReader("cccc"), object.NewStaticObjectInfo("c.txt", time.Now(), 4, true, nil, nil))
+	require.Error(t, err)
+
+	// A new Fs reads the saved manifest then makes no more calls
+	g := m.newFs()
+	calls := m.callCount("getChat") + m.callCount("getFile")
+	stats, err = g.stats(ctx)
+	require.NoError(t, err)
+	assert.Greater(t, m.callCount("getChat")+m.callCount("getFile"), calls)
+	manifest := m.manifest()
+	assert.Equal(t, int64(2), stats.Files)
+	assert.Equal(t, int64(3), stats.Dirs)
+	assert.Equal(t, int64(8), stats.Bytes)
+	assert.Equal(t, int64(1), stats.Chunked)
+	assert.Equal(t, int64(3), stats.Parts)
+	assert.Equal(t, int64(1), stats.Pending)
+	assert.Equal(t, int64(1), stats.PendingParts)
+	assert.Equal(t, int64(0), stats.Orphans)
+	assert.Equal(t, f.fileListID, stats.MessageID)
+	assert.Equal(t, manifest.Sequence, stats.Sequence)
+	data, err := json.Marshal(manifest)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(data)), stats.Size)
+	assert.WithinDuration(t, time.Now(), stats.Saved, 5*time.Second)
+	assert.False(t, stats.Unsaved)
+	calls = m.callCount("getChat") + m.callCount("getFile") + m.callCount("getUpdates")
+	_, err = g.stats(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, calls, m.callCount("getChat")+m.callCount("getFile")+m.callCount("getUpdates"), "API called again")
+
+	// Unsaved changes are reported
+	f.opt.ManifestFlushInterval = fs.Duration(time.Hour)
+	putFile(ctx, t, f, "d.txt", "d")
+	stats, err = f.stats(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), stats.Files)
+	assert.True(t, stats.Unsaved)
+	require.NoError(t, f.Shutdown(ctx))
+
+	out, err := f.Command(ctx, "stats", nil, nil)
+	require.NoError(t, err)
+	assert.IsType(t, &fileListStats{}, out)
+}
+
+func TestDu(t *testing.T) {
+	ctx := context.Background()
+	f, m := newTestFs(t)
+	putFile(ctx, t, f, "a.txt", "aaa")
+	putFile(ctx, t, f, "dir/b.txt", "bbbbb")
+	f.opt.ChunkSize = 2
+	putFile(ctx, t, f, "dir/sub/c.txt", "cccc")
+	f.opt.ChunkSize = defaultChunkSize
+	putFile(ctx, t, f, "dir/sub/deep/d.txt", "dd")
+	require.NoError(t, f.Mkdir(ctx, "empty"))
+	f.opt.SendAsMedia = sendMediaAll
+	putFile(ctx, t, f, "photos/p.jpg", "jpeg data")
+	stored := m.manifest().find("photos/p.jpg").Size
+	calls := m.callCount("getChat") + m.callCount("getFile")
+
+	du := func(dir string, depth string) (usage []dirUsage) {
+		t.Helper()
+		out, err := f.Command(ctx, "du", []string{dir}, map[string]string{"depth": depth})
+		require.NoError(t, err)
+		for _, u := range out.([]*dirUsage) {
+			usage = append(usage, *u)
+		}
+		return usage
+	}
+	assert.Equal(t, []dirUsage{
+		{"", 5, 14, 14 + stored},
+		{"dir", 3, 11, 11},
+		{"dir/sub", 2, 6, 6},
+		{"dir/sub/deep", 1, 2, 2},
+		{"empty", 0, 0, 0},
+		{"photos", 1, 0, stored},
+	}, du("", ""))
+	assert.Equal(t, []dirUsage{
+		{"", 5, 14, 14 + stored},
+		{"dir", 3, 11, 11},
+		{"empty", 0, 0, 0},
+		{"photos", 1, 0, stored},
+	}, du("", "1"))
+	assert.Equal(t, []dirUsage{
+		{"dir", 3, 11, 11},
+		{"dir/sub", 2, 6, 6},
+	}, du("dir", "1"))
+	assert.Equal(t, []dirUsage{{"dir/sub", 2, 6, 6}}, du("dir/sub", "0"))
+	assert.Equal(t, calls, m.callCount("getChat")+m.callCount("getFile"), "API called")
+
+	_, err := f.Command(ctx, "du", []string{"missing"}, nil)
+	assert.Equal(t, fs.ErrorDirNotFound, err)
+	_, err = f.Command(ctx, "du", nil, map[string]string{"depth": "potato"})
+	assert.ErrorContains(t, err, "bad depth")
+}
+
+func TestUserInfo(t *testing.T) {
+	ctx := context.Background()
+	f, m := newTestFs(t)
+	m.noPin = true
+	info, err := f.UserInfo(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"Bot":               "@rclone_test_bot",
+		"BotID":             "123456",
+		"Chat":              "rclone",
+		"ChatID":            strconv.Itoa(testChatID),
+		"ChatType":          "supergroup",
+		"BotStatus":         "administrator",
+		"Admin":             "true",
+		"CanDeleteMessages": "true",
+		"CanPinMessages":    "false",
+	}, info)
+	// The manifest isn't needed
+	assert.Equal(t, 0, m.callCount("getFile")+m.callCount("getUpdates"))
+
+	m.mu.Lock()
+	m.status = "member"
+	m.username = "rclone_files"
+	m.forum = true
+	m.mu.Unlock()
+	f.opt.UseTopics = true
+	info, err = f.UserInfo(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "member", info["BotStatus"])
+	assert.Equal(t, "false", info["Admin"])
+	assert.Equal(t, "@rclone_files", info["ChatUsername"])
+	assert.Equal(t, "true", info["Topics"])
+	assert.NotContains(t, info, "CanDeleteMessages")
+
+	f.opt.ChatID = "-1001"
+	_, err = f.UserInfo(ctx)
+	assert.ErrorContains(t, err, "failed to read chat")
+}
+
+func TestHash(t *testing.T) {
+	ctx := context.Background()
+	f, m := newTestFs(t)
+	const aaaMD5 = "47bce5c74f589f4867dbd57e9ca9f808"
+	assert.True(t, f.Hashes().Contains(hash.MD5))
+
+	// An upload which is retried is only hashed once
+	m.failures["sendDocument"] = []int{http.StatusInternalServerError}
+	a := putFile(ctx, t, f, "a.txt", "aaa")
+	sum, err := a.Hash(ctx, hash.MD5)
+	require.NoError(t, err)
+	assert.Equal(t, aaaMD5, sum)
+	_, err = a.Hash(ctx, hash.SHA1)
+	assert.Equal(t, hash.ErrUnsupported, err)
+	assert.Equal(t, aaaMD5, m.manifest().Entries[0].MD5)
+
+	// Chunked objects are hashed as a whole
+	f.opt.ChunkSize = 2
+	b := putFile(ctx, t, f, "b.txt", "aaa")
+	require.Len(t, b.chunks, 2)
+	o, err := f.NewObject(ctx, "b.txt")
+	require.NoError(t, err)
+	sum, err = o.Hash(ctx, hash.MD5)
+	require.NoError(t, err)
+	assert.Equal(t, aaaMD5, sum)
+
+	// Copies keep the hash
+	c, err := f.Copy(ctx, o, "c.txt")
+	require.NoError(t, err)
+	sum, err = c.Hash(ctx, hash.MD5)
+	require.NoError(t, err)
+	assert.Equal(t, aaaMD5, sum)
+
+	// An upload which doesn't match the source hash is deleted
+	f.opt.ChunkSize = defaultChunkSize
+	messages := len(m.updates)
+	src := object.NewStaticObjectInfo("d.txt", time.Now(), 3, true, map[hash.Type]string{hash.MD5: aaaMD5}, nil)
+	_, err = f.Put(ctx, strings.NewReader("bbb"), src)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "corrupted on transfer")
+	assert.Equal(t, messages, len(m.updates))
+	_, err = f.NewObject(ctx, "d.txt")
+	assert.Equal(t, fs.ErrorObjectNotFound, err)
+}
+
+func TestSetModTime(t *testing.T) {
+	ctx := context.Background()
+	f, m := newTestFs(t)
+	a := putFile(ctx, t, f, "a.txt", "aaa")
+	sends, deletes := m.callCount("sendDocument"), m.callCount("deleteMessage")
+	modTime := time.Date(2023, 4, 5, 6, 7, 8, 123456789, time.UTC)
+
+	require.NoError(t, a.SetModTime(ctx, modTime))
+	assert.True(t, a.ModTime(ctx).Equal(modTime))
+	assert.Equal(t, sends, m.callCount("sendDocument"), "document sent by SetModTime")
+	assert.Equal(t, deletes, m.callCount("deleteMessage"), "message deleted by SetModTime")
+	assert.True(t, m.hasMessage(a.messageID))
+
+	// The new time is read back from the manifest to the nanosecond
+	o, err := m.newFs().NewObject(ctx, "a.txt")
+	require.NoError(t, err)
+	assert.True(t, o.ModTime(ctx).Equal(modTime), "got %v", o.ModTime(ctx))
+	assert.Equal(t, "aaa", readObject(ctx, t, o))
+
+	require.NoError(t, a.Remove(ctx))
+	assert.Equal(t, fs.ErrorObjectNotFound, a.SetModTime(ctx, modTime))
+}
+
+func TestTokenRedacted(t *testing.T) {
+	ctx := context.Background()
+	f, m := newTestFs(t)
+	m.srv.Close()
+	_, err := f.getChat(ctx)
+	require.Error(t, err)
+	assert.NotContains(t, err.Error(), testToken)
+	assert.Contains(t, err.Error(), "/bot<redacted>/getChat")
+	_, err = f.download(ctx, "documents/file1")
+	require.Error(t, err)
+	assert.NotContains(t, err.Error(), testToken)
+	_, err = f.sendDocument(ctx, "a.txt", 0, nil, "", strings.NewReader("aaa"), 3)
+	require.Error(t, err)
+	assert.NotContains(t, err.Error(), testToken)
+
+	// Dumps of the traffic don't show it either
+	ctx, ci := fs.AddConfig(ctx)
+	ci.Dump = fs.DumpHeaders
+	client := newClient(ctx, testToken)
+	dump, ok := client.Transport.(*dumpTransport)
+	require.True(t, ok)
+	assert.Equal(t, "POST /bot<redacted>/getMe", dump.redact("POST /bot"+testToken+"/getMe"))
+}
+
+func TestCallLogging(t *testing.T) {
+	ctx := context.Background()
+	f, m := newTestFs(t)
+	var buf strings.Builder
+	ci := fs.GetConfig(ctx)
+	oldLevel := ci.LogLevel
+	oldHandlerLevel := log.Handler.SetLevel(slog.LevelDebug)
+	ci.LogLevel = fs.LogLevelDebug
+	log.Handler.SetOutput(func(level slog.Level, text string) {
+		buf.WriteString(text)
+	})
+	defer func() {
+		log.Handler.ResetOutput()
+		log.Handler.SetLevel(oldHandlerLevel)
+		ci.LogLevel = oldLevel
+	}()
+
+	// Each try of each call is logged and the upload summed up
+	m.failures["sendDocument"] = []int{http.StatusInternalServerError}
+	a := putFile(ctx, t, f, "a.txt", "aaa")
+	assert.Equal(t, "aaa", readObject(ctx, t, a))
+	m.srv.Close()
+	_, err := f.getChat(ctx)
+	require.Error(t, err)
+	out := buf.String()
+	chat := strconv.Itoa(testChatID)
+	assert.Contains(t, out, `API sendDocument chat=`+chat+` size=3 status="500 Internal Server Error"`)
+	assert.Contains(t, out, `API sendDocument chat=`+chat+` size=3 status="200 OK"`)
+	assert.Contains(t, out, `API getFile chat=- size=`)
+	assert.Contains(t, out, `API download chat=- size=3 status="200 OK"`)
+	assert.Contains(t, out, `API getChat chat=`+chat+` size=`)
+	assert.Contains(t, out, `status="no response"`)
+	assert.Contains(t, out, "a.txt: Uploaded as 1 documents with 1 retries in ")
+	assert.NotContains(t, out, testToken)
+}
+
+func TestLocalServer(t *testing.T) {
+	ctx := context.Background()
+	f, m := newTestFs(t)
+	m.localDir = t.TempDir()
+	a := putFile(ctx, t, f, "a.txt", "hello world")
+
+	// Files on this machine are read directly
+	localPath := path.Join(m.localDir, testToken, "documents", a.fileID)
+	require.NoError(t, os.MkdirAll(path.Dir(localPath), 0777))
+	require.NoError(t, os.WriteFile(localPath, []byte("HELLO WORLD"), 0666))
+	downloads := m.callCount("file")
+	assert.Equal(t, "HELLO WORLD", readObject(ctx, t, a))
+	in, err := a.Open(ctx, &fs.RangeOption{Start: 6, End: 8})
+	require.NoError(t, err)
+	got, err := io.ReadAll(in)
+	require.NoError(t, err)
+	require.NoError(t, in.Close())
+	assert.Equal(t, "WOR", string(got))
+	assert.Equal(t, downloads, m.callCount("file"))
+
+	// Otherwise they are fetched from the file endpoint
+	require.NoError(t, os.Remove(localPath))
+	assert.Equal(t, "hello world", readObject(ctx, t, a))
+	assert.Equal(t, downloads+1, m.callCount("file"))
+
+	// Including when the file can't be opened for another reason
+	documents := path.Dir(localPath)
+	require.NoError(t, os.RemoveAll(documents))
+	require.NoError(t, os.WriteFile(documents, nil, 0666))
+	_, err = openLocalFile(localPath, 0, -1)
+	require.Error(t, err)
+	require.False(t, os.IsNotExist(err))
+	assert.Equal(t, "hello world", readObject(ctx, t, a))
+	assert.Equal(t, downloads+2, m.callCount("file"))
+
+	// The token in the path isn't shown in errors
+	err = f.redactError(err)
+	assert.NotContains(t, err.Error(), testToken)
+	assert.Contains(t, err.Error(), "/<redacted>/documents/")
+}
+
+func TestVerify(t *testing.T) {
+	ctx := context.Background()
+	m := newMockServer(t)
+	newFs := func(token, chatID, skipVerify string) (*Fs, error) {
+		f, err := NewFs(ctx, "TestTelegram", "", configmap.Simple{
+			"bot_token":   obscure.MustObscure(token),
+			"chat_id":     chatID,
+			"chunk_size":  defaultChunkSize.String(),
+			"base_url":    m.srv.URL,
+			"skip_verify": skipVerify,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return f.(*Fs), nil
+	}
+
+	f, err := newFs(testToken, strconv.Itoa(testChatID), "false")
+	require.NoError(t, err)
+	assert.Equal(t, "rclone_test_bot", f.botName)
+	assert.Equal(t, "telegram @rclone_test_bot root ''", f.String())
+
+	_, err = newFs("123456:WRONG", strconv.Itoa(testChatID), "false")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid bot token")
+	assert.True(t, fserrors.IsFatalError(err))
+
+	_, err = newFs(testToken, "-100123", "false")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "bot @rclone_test_bot can't access chat -100123")
+
+	// Nothing is checked when skipped
+	calls := m.callCount("getMe") + m.callCount("getChat")
+	f, err = newFs("123456:WRONG", "-100123", "true")
+	require.NoError(t, err)
+	assert.Equal(t, calls, m.callCount("getMe")+m.callCount("getChat"))
+	assert.Equal(t, "telegram root ''", f.String())
+}
+
+func TestConfig(t *testing.T) {
+	ctx := context.Background()
+	m := newMockServer(t)
+	config := configmap.Simple{
+		"bot_token":  obscure.MustObscure(testToken),
+		"chunk_size": defaultChunkSize.String(),
+		"base_url":   m.srv.URL,
+	}
+	run := func(state, result string) *fs.ConfigOut {
+		out, err := Config(ctx, "TestTelegram", config, fs.ConfigIn{State: state, Result: result})
+		require.NoError(t, err)
+		return out
+	}
+
+	// With no updates the chat has to be entered by hand
+	out := run("", "")
+	require.Equal(t, "choose_chat", out.State)
+	out = run(out.State, "")
+	require.NotNil(t, out.Option)
+	assert.Empty(t, out.Option.Examples)
+	assert.Contains(t, out.Option.Help, "hasn't seen any chats")
+
+	// Otherwise the chats seen are offered, newest first
+	m.addDocument("a.txt", []byte("aaa"))
+	m.updates = append(m.updates, api.Update{
+		UpdateID:     100,
+		MyChatMember: &api.ChatMemberUpdated{Chat: api.Chat{ID: -100555, Type: "channel", Title: "Archive", Username: "archive"}},
+	}, api.Update{
+		UpdateID: 101,
+		Message:  &api.Message{MessageID: 1, Chat: api.Chat{ID: 42, Type: "private", FirstName: "Alex"}},
+	}, api.Update{
+		UpdateID:    102,
+		ChannelPost: &api.Message{MessageID: 2, Chat: api.Chat{ID: -100555, Type: "channel", Title: "Archive", Username: "archive"}},
+	})
+	out = run("choose_chat", "")
+	require.NotNil(t, out.Option)
+	assert.Equal(t, fs.OptionExamples{
+		{Value: "-100555", Help: "Archive @archive (channel)"},
+		{Value: "42", Help: "Alex (private)"},
+		{Value: strconv.Itoa(testChatID), Help: "rclone (supergroup)"},
+	}, out.Option.Examples)
+	assert.Equal(t, "chat_id", out.State)
+
+	out = run(out.State, "-100555")
+	assert.Nil(t, out)
+	assert.Equal(t, "-100555", config["chat_id"])
+
+	// Nothing is asked if the chat was entered
+	assert.Nil(t, run("", ""))
+}
+
+func TestEncoding(t *testing.T) {
+	ctx := context.Background()
+	f, m := newTestFs(t)
+	long := strings.Repeat("ü", 150) + ".txt"
+	for _, test := range []struct {
+		remote  string
+		docName string
+	}{
+		{"report:final?.txt", "report:final?.txt"},
+		{"dir/sub/file.txt", "dir／sub／file.txt"},
+		{"emoji 😀/🎉.txt", "emoji 😀／🎉.txt"},
+		{"עברית/שלום.txt", "עברית／שלום.txt"},
+		{"...", "..."},
+		{" spaces ", "␠spaces␠"},
+		// rclone names hold control characters in the Standard encoding
+		{encoder.Standard.Encode("ctl\x01\x7f.txt"), "ctl␁␡.txt"},
+		{"dir/" + long, long[50:]},
+		{fileListName, "filelist．json"},
+	} {
+		t.Run(test.remote, func(t *testing.T) {
+			o := putFile(ctx, t, f, test.remote, "data")
+			m.mu.Lock()
+			docName := m.message(o.messageID).Document.FileName
+			m.mu.Unlock()
+			assert.Equal(t, test.docName, docName)
+			assert.LessOrEqual(t, len(docName), maxNameLength)
+
+			// The path comes back exactly as it was uploaded
+			g := m.newFs()
+			obj, err := g.NewObject(ctx, test.remote)
+			require.NoError(t, err)
+			assert.Equal(t, test.remote, obj.Remote())
+			entries, err := g.List(ctx, path.Dir(test.remote))
+			if path.Dir(test.remote) == "." {
+				entries, err = g.List(ctx, "")
+			}
+			require.NoError(t, err)
+			var names []string
+			for _, entry := range entries {
+				names = append(names, entry.Remote())
+			}
+			assert.Contains(t, names, test.remote)
+			assert.Equal(t, "data", readObject(ctx, t, obj))
+		})
+	}
+}
+
+// BenchmarkChunkedUpload shows the speed up from sending parts at
+// once against a server taking 10ms over each
+// hostileNames are file names which have tripped up encoders, held as
+// rclone holds them in the Standard encoding
+var hostileNames = []string{
+	"slash／in name.txt",
+	"quoted ‛／ slash.txt",
+	encoder.Standard.Encode("nul\x00.txt"),
+	encoder.Standard.Encode("ctl\x01\x1f\x7f.txt"),
+	"bad\xff\xfeutf8.txt",
+	"bad\xffdir/file.txt",
+	"literal ‛FF quote.txt",
+	".hidden",
+	"trailing.",
+	"...",
+	" leading space",
+	"trailing space ",
+	"\u202eexe.txt",
+	"rtl \u200fمرحبا\u200e.txt",
+	"emoji 😀🎉👩‍👩‍👧.txt",
+	"zero\u200bwidth\ufeff.txt",
+	strings.Repeat("a", 255),
+	strings.Repeat("é", 127) + "a",
+	fileListName,
+	"dir/" + fileListName,
+	"dir with spaces /sub./file",
+}
+
+func TestHostileNames(t *testing.T) {
+	ctx := context.Background()
+	f, m := newTestFs(t)
+	objects := map[string]*Object{}
+	for _, remote := range hostileNames {
+		objects[remote] = putFile(ctx, t, f, remote, "data:"+remote)
+	}
+
+	// checkNames checks the names read back by a new Fs are exactly
+	// those uploaded
+	checkNames := func(t *testing.T, prefix string) {
+		g := m.newFs()
+		var listed []string
+		require.NoError(t, g.ListR(ctx, "", func(entries fs.DirEntries) error {
+			for _, entry := range entries {
+				if _, ok := entry.(fs.Object); ok {
+					listed = append(listed, entry.Remote())
+				}
+			}
+			return nil
+		}))
+		for _, remote := range hostileNames {
+			assert.Contains(t, listed, prefix+remote)
+			obj, err := g.NewObject(ctx, prefix+remote)
+			require.NoError(t, err, remote)
+			assert.Equal(t, prefix+remote, obj.Remote())
+			assert.Equal(t, "data:"+remote, readObject(ctx, t, obj))
+			dir := path.Dir(prefix + remote)
+			if dir == "." {
+				dir = ""
+			}
+			entries, err := g.List(ctx, dir)
+			require.NoError(t, err, remote)
+			var names []string
+			for _, entry := range entries {
+				names = append(names, entry.Remote())
+			}
+			assert.Contains(t, names, prefix+remote)
+		}
+	}
+	checkNames(t, "")
+	// Only invalid UTF-8 and quotes are quoted so the paths in
+	// existing manifests are read the same
+	assert.Equal(t, "nul␀.txt", encodePath("nul␀.txt"))
+	assert.Equal(t, "bad‛FF.txt", encodePath("bad\xff.txt"))
+	assert.Equal(t, "‛‛FF.txt", encodePath("‛FF.txt"))
+
+	for _, remote := range hostileNames {
+		o := objects[remote]
+		// The document name is valid with no slashes or control
+		// characters and isn't mistaken for the manifest
+		m.mu.Lock()
+		docName := m.message(o.messageID).Document.FileName
+		m.mu.Unlock()
+		assert.True(t, utf8.ValidString(docName), remote)
+		assert.LessOrEqual(t, len(docName), maxNameLength, remote)
+		assert.NotContains(t, docName, "/", remote)
+		assert.NotEqual(t, fileListName, docName)
+		for _, c := range docName {
+			assert.False(t, unicode.IsControl(c), "%q has control character %U", docName, c)
+		}
+		// The caption holds the path as it is in the manifest
+		assert.Equal(t, encodePath(remote), m.caption(t, o.messageID).Path)
+	}
+	assert.Equal(t, len(hostileNames), len(m.manifest().Entries))
+
+	for _, remote := range hostileNames {
+		_, err := f.Move(ctx, objects[remote], "moved/"+remote)
+		require.NoError(t, err, remote)
+	}
+	checkNames(t, "moved/")
+
+	// The captions give back the paths the files were uploaded to
+	m.forwardAll()
+	out, err := f.Command(ctx, "rebuild", nil, nil)
+	require.NoError(t, err)
+	assert.Contains(t, out, fmt.Sprintf("Recovered %d files", len(hostileNames)))
+	checkNames(t, "")
+}
+
+// TestLongNames checks the names `rclone test info` probes with, which
+// are far longer than a document name or caption can be, are kept
+// whole in the manifest
+func TestLongNames(t *testing.T) {
+	ctx := context.Background()
+	f, m := newTestFs(t)
+	names := []string{
+		strings.Repeat("a", 16383),
+		strings.Repeat("é", 16383),
+		strings.Repeat("😀", 16383),
+		strings.Repeat("dir/", 4095) + "file",
+	}
+	for _, remote := range names {
+		o := putFile(ctx, t, f, remote, "data")
+		m.mu.Lock()
+		docName := m.message(o.messageID).Document.FileName
+		m.mu.Unlock()
+		assert.LessOrEqual(t, len(docName), maxNameLength)
+		assert.LessOrEqual(t, utf16Length(m.caption(t, o.messageID).encode()), maxCaptionLength)
+		assert.True(t, m.caption(t, o.messageID).Truncated)
+	}
+
+	g := m.newFs()
+	for _, remote := range names {
+		obj, err := g.NewObject(ctx, remote)
+		require.NoError(t, err)
+		assert.Equal(t, remote, obj.Remote())
+		assert.Equal(t, "data", readObject(ctx, t, obj))
+		require.NoError(t, obj.Remove(ctx))
+	}
+	entries, err := g.List(ctx, "")
+	require.NoError(t, err)
+	assert.Len(t, entries, 1) // the empty "dir" is kept
+	assert.Empty(t, m.manifest().Entries)
+}
+
+// TestVFSWrites checks files written, renamed and deleted through the
+// VFS with --vfs-cache-mode writes, as a mount does, end up in the chat
+func TestVFSWrites(t *testing.T) {
+	ctx := context.Background()
+	oldCacheDir := config.GetCacheDir()
+	require.NoError(t, config.SetCacheDir(t.TempDir()))
+	t.Cleanup(func() {
+		_ = config.SetCacheDir(oldCacheDir)
+	})
+	f, m := newTestFs(t)
+	opt := vfscommon.Opt
+	opt.CacheMode = vfscommon.CacheModeWrites
+	opt.WriteBack = 0
+	v := vfs.New(f, &opt)
+	t.Cleanup(v.Shutdown)
+
+	// writeFile writes data to name through the VFS and waits for it
+	// to be uploaded
+	writeFile := func(name, data string) {
+		require.NoError(t, v.WriteFile(name, []byte(data), 0666))
+		v.WaitForWriters(10 * time.Second)
+	}
+	// remoteContent reads name from the chat with a new Fs
+	remoteContent := func(name string) string {
+		o, err := m.newFs().NewObject(ctx, name)
+		require.NoError(t, err)
+		return readObject(ctx, t, o)
+	}
+
+	require.NoError(t, v.Mkdir("dir", 0777))
+	assert.Equal(t, []string{"dir"}, m.manifest().Dirs)
+	writeFile("dir/a.txt", "hello")
+	assert.Equal(t, []string{"dir/a.txt"}, m.manifestPaths())
+	assert.Equal(t, "hello", remoteContent("dir/a.txt"))
+
+	// Renaming only changes the manifest
+	sent := m.callCount("sendDocument")
+	require.NoError(t, v.Rename("dir/a.txt", "dir/b.txt"))
+	assert.Equal(t, []string{"dir/b.txt"}, m.manifestPaths())
+	assert.Equal(t, sent, m.callCount("sendDocument"))
+
+	// Overwriting replaces the document
+	oldID := m.manifest().find("dir/b.txt").MessageID
+	writeFile("dir/b.txt", "goodbye")
+	assert.False(t, m.hasMessage(oldID))
+	assert.Equal(t, "goodbye", remoteContent("dir/b.txt"))
+	data, err := v.ReadFile("dir/b.txt")
+	require.NoError(t, err)
+	assert.Equal(t, "goodbye", string(data))
+	info, err := v.Stat("dir/b.txt")
+	require.NoError(t, err)
+	assert.Equal(t, int64(len("goodbye")), info.Size())
+
+	newID := m.manifest().find("dir/b.txt").MessageID
+	require.NoError(t, v.Remove("dir/b.txt"))
+	assert.False(t, m.hasMessage(newID))
+	assert.Empty(t, m.manifestPaths())
+	require.NoError(t, v.Remove("dir"))
+	assert.Empty(t, m.manifest().Dirs)
+}
+
+// TestFingerprint checks the size, modification time and hash the VFS
+// cache uses to tell whether a file changed are the same whichever Fs
+// reads them and change when the file does
+func TestFingerprint(t *testing.T) {
+	ctx := context.Background()
+	f, m := newTestFs(t)
+	assert.False(t, f.Features().SlowHash)
+	assert.False(t, f.Features().SlowModTime)
+	modTime := time.Date(2024, 5, 1, 12, 0, 0, 123456789, time.FixedZone("CEST", 2*60*60))
+	put := func(remote, content string) fs.Object {
+		src := object.NewStaticObjectInfo(remote, modTime, int64(len(content)), true, nil, nil)
+		o, err := f.Put(ctx, strings.NewReader(content), src)
+		require.NoError(t, err)
+		return o
+	}
+	put("a.txt", "aaa")
+	f.opt.ChunkSize = 2
+	put("chunked.txt", "01234")
+	f.opt.ChunkSize = defaultChunkSize
+	src := object.NewStaticObjectInfo("streamed.txt", modTime, -1, true, nil, nil)
+	streamed, err := f.PutStream(ctx, strings.NewReader("stream"), src)
+	require.NoError(t, err)
+
+	// fingerprints reads the fingerprints of remote with a new Fs, as
+	// another rclone process would, and checks they are the same as
+	// those of o
+	fingerprints := func(o fs.Object, remote string) string {
+		other, err := m.newFs().NewObject(ctx, remote)
+		require.NoError(t, err)
+		for _, fast := range []bool{true, false} {
+			assert.Equal(t, fs.Fingerprint(ctx, o, fast), fs.Fingerprint(ctx, other, fast), remote)
+		}
+		return fs.Fingerprint(ctx, other, true)
+	}
+	for _, remote := range []string{"a.txt", "chunked.txt", "streamed.txt"} {
+		o, err := f.NewObject(ctx, remote)
+		require.NoError(t, err)
+		fingerprint := fingerprints(o, remote)
+		assert.Contains(t, fingerprint, "2024-05-01 10:00:00.123456789 +0000 UTC", remote)
+		md5, err := o.Hash(ctx, hash.MD5)
+		require.NoError(t, err)
+		assert.NotEmpty(t, md5, remote)
+		assert.Contains(t, fingerprint, md5, remote)
+	}
+	assert.Equal(t, fs.Fingerprint(ctx, streamed, true), fingerprints(streamed, "streamed.txt"))
+
+	// Changing the modification time or the contents changes it
+	o, err := f.NewObject(ctx, "a.txt")
+	require.NoError(t, err)
+	before := fs.Fingerprint(ctx, o, true)
+	newTime := modTime.Add(time.Hour)
+	require.NoError(t, o.SetModTime(ctx, newTime))
+	afterSetModTime := fingerprints(o, "a.txt")
+	assert.Equal(t, strings.Replace(before, "10:00:00", "11:00:00", 1), afterSetModTime)
+	src = object.NewStaticObjectInfo("a.txt", newTime, 4, true, nil, nil)
+	require.NoError(t, o.Update(ctx, strings.NewReader("bbbb"), src))
+	afterUpdate := fingerprints(o, "a.txt")
+	assert.Equal(t, fmt.Sprintf("4,2024-05-01 11:00:00.123456789 +0000 UTC,%x", md5.Sum([]byte("bbbb"))), afterUpdate)
+}
+
+// TestChangeNotify checks a VFS polling for changes, as a mount does,
+// sees documents posted to the chat and files changed by another
+// rclone without its directory cache expiring
+func TestChangeNotify(t *testing.T) {
+	ctx := context.Background()
+	f, m := newTestFs(t)
+	f.opt.ImportDocuments = true
+	// g stands for another rclone process
+	g := m.newFs()
+	g.saves = new(atomic.Int64)
+	putFile(ctx, t, g, "dir/a.txt", "aaa")
+
+	opt := vfscommon.Opt
+	opt.PollInterval = fs.Duration(20 * time.Millisecond)
+	v := vfs.New(f, &opt)
+	t.Cleanup(v.Shutdown)
+
+	// names lists dir through the VFS
+	names := func(dir string) (names []string) {
+		infos, err := v.ReadDir(dir)
+		require.NoError(t, err)
+		for _, info := range infos {
+			names = append(names, info.Name())
+		}
+		return names
+	}
+	// eventually waits for dir to list as want
+	eventually := func(dir string, want ...string) {
+		t.Helper()
+		assert.Eventually(t, func() bool {
+			return slices.Equal(want, names(dir))
+		}, 5*time.Second, 10*time.Millisecond)
+	}
+	assert.Equal(t, []string{"dir"}, names(""))
+	assert.Equal(t, []string{"a.txt"}, names("dir"))
+
+	// A document posted by a person shows up in the root
+	report := m.addDocument("report.pdf", []byte("report"))
+	eventually("", "dir", "report.pdf")
+	data, err := v.ReadFile("report.pdf")
+	require.NoError(t, err)
+	assert.Equal(t, "report", string(data))
+	assert.Equal(t, report.MessageID, m.manifest().find("report.pdf").MessageID)
+
+	// A document rclone sent, forwarded back into the chat, goes
+	// back to the path in its caption, making the directories in it
+	modTime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	forwarded := m.addDocument("b.txt", []byte("bb"))
+	m.mu.Lock()
+	forwarded.Caption = documentCaption{Path: "dir/sub/b.txt", Size: 2, ModTime: modTime}.encode()
+	m.mu.Unlock()
+	eventually("dir", "a.txt", "sub")
+	eventually("dir/sub", "b.txt")
+	info, err := v.Stat("dir/sub/b.txt")
+	require.NoError(t, err)
+	assert.True(t, modTime.Equal(info.ModTime()))
+
+	// Documents whose name is in use and parts of chunked files are
+	// left out, and nothing is imported twice
+	m.addDocument("report.pdf", []byte("another report"))
+	part := m.addDocument("c.txt.part1", []byte("c"))
+	m.mu.Lock()
+	part.Caption = documentCaption{Path: "c.txt", Size: 2, ModTime: modTime, Part: 1}.encode()
+	m.mu.Unlock()
+	assert.Eventually(t, func() bool {
+		return m.manifest().Imported == part.MessageID
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.ElementsMatch(t, []string{"dir/a.txt", "dir/sub/b.txt", "report.pdf"}, m.manifestPaths())
+	assert.Equal(t, report.MessageID, m.manifest().find("report.pdf").MessageID)
+
+	// Changes saved by another rclone show up too
+	putFile(ctx, t, g, "dir/d.txt", "ddd")
+	eventually("dir", "a.txt", "d.txt", "sub")
+	o, err := g.NewObject(ctx, "dir/a.txt")
+	require.NoError(t, err)
+	require.NoError(t, o.Remove(ctx))
+	eventually("dir", "d.txt", "sub")
+	require.NoError(t, g.Purge(ctx, "dir/sub"))
+	eventually("dir", "d.txt")
+	_, err = v.Stat("dir/sub/b.txt")
+	assert.Equal(t, vfs.ENOENT, err)
+}
+
+// TestServeHTTP checks `rclone serve http` can serve a file in parts
+// to several readers at once, as a media player seeking does, while
+// files are uploaded
+func TestServeHTTP(t *testing.T) {
+	ctx := context.Background()
+	m := newMockServer(t)
+	f, addr := serveRemote(ctx, t, m, configmap.Simple{"chunk_size": "16Ki"}, "http", nil)
+	const size = 64 * 1024
+	data := make([]byte, size)
+	_, err := io.ReadFull(readers.NewPatternReader(size), data)
+	require.NoError(t, err)
+	putFile(ctx, t, f, "media/video.mp4", string(data))
+	serveURL := "http://" + addr + "/"
+
+	resp, err := http.Head(serveURL + "media/video.mp4")
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, int64(size), resp.ContentLength)
+	assert.Equal(t, "video/mp4", resp.Header.Get("Content-Type"))
+
+	// get fetches start to end of the file checking it was sent
+	// as a partial response
+	get := func(start, end int) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, serveURL+"media/video.mp4", nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			_ = resp.Body.Close()
+		}()
+		got, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusPartialContent {
+			return fmt.Errorf("range %d-%d: status %s", start, end, resp.Status)
+		}
+		if !bytes.Equal(data[start:end+1], got) {
+			return fmt.Errorf("range %d-%d: wrong data", start, end)
+		}
+		return nil
+	}
+	require.NoError(t, get(20000, 40000))
+
+	// Several readers seeking in the same file while files are
+	// uploaded and the directory is listed
+	var g errgroup.Group
+	for i := range 8 {
+		g.Go(func() error {
+			return get(i*size/8, min(i*size/8+size/4, size-1))
+		})
+	}
+	for i := range 4 {
+		g.Go(func() error {
+			_, err := f.Put(ctx, strings.NewReader("upload"), object.NewStaticObjectInfo(fmt.Sprintf("media/new%d.txt", i), time.Now(), 6, true, nil, nil))
+			return err
+		})
+		g.Go(func() error {
+			resp, err := http.Get(serveURL + "media/")
+			if err != nil {
+				return err
+			}
+			_ = resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				return fmt.Errorf("listing: status %s", resp.Status)
+			}
+			return nil
+		})
+	}
+	require.NoError(t, g.Wait())
+
+	// Listings use the cached manifest
+	reads := m.callCount("getChat")
+	for range 3 {
+		resp, err := http.Get(serveURL + "media/")
+		require.NoError(t, err)
+		listing, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		assert.Contains(t, string(listing), "video.mp4")
+	}
+	assert.Equal(t, reads, m.callCount("getChat"))
+}
+
+// setenvConfig configures the remote name with environment variables
+// so it can be used like a remote in the config file
+func setenvConfig(t *testing.T, name string, config configmap.Simple) {
+	for key, value := range config {
+		t.Setenv("RCLONE_CONFIG_"+strings.ToUpper(name+"_"+key), value)
+	}
+}
+
+// setenvRemote configures a remote talking to m, with the settings in
+// override replacing its config, returning its name
+//
+// The name is unique to m as the Fs cache outlives the test.
+func (m *mockServer) setenvRemote(t *testing.T, override configmap.Simple) string {
+	name := "TestTelegram" + strings.TrimPrefix(m.srv.URL, "http://127.0.0.1:")
+	config := m.config()
+	// Save changes straight away and don't pace calls as Fs made
+	// from m.config() do
+	config["manifest_flush_interval"] = "0"
+	config["pacer_min_sleep"] = "0"
+	maps.Copy(config, override)
+	config["type"] = "telegram"
+	setenvConfig(t, name, config)
+	return name
+}
+
+// serveRemote serves a new remote talking to m, with the settings in
+// override replacing its config, with `rclone serve serveType`,
+// returning the address it listens on
+func serveRemote(ctx context.Context, t *testing.T, m *mockServer, override configmap.Simple, serveType string, in rc.Params) (*Fs, string) {
+	name := m.setenvRemote(t, override)
+	// The server uses the same Fs from the cache
+	f, err := cache.Get(ctx, name+":")
+	require.NoError(t, err)
+	params := rc.Params{
+		"type": serveType,
+		"fs":   name + ":",
+		"addr": "127.0.0.1:0",
+	}
+	maps.Copy(params, in)
+	out, err := rc.Calls.Get("serve/start").Fn(ctx, params)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_, err := rc.Calls.Get("serve/stop").Fn(ctx, rc.Params{"id": out["id"]})
+		assert.NoError(t, err)
+	})
+	return f.(*Fs), out["addr"].(string)
+}
+
+// TestServeS3 checks S3 clients can use the chat through `rclone serve
+// s3`, including multipart uploads
+func TestServeS3(t *testing.T) {
+	ctx := context.Background()
+	m := newMockServer(t)
+	f, addr := serveRemote(ctx, t, m, configmap.Simple{"chunk_size": "1Mi"}, "s3", rc.Params{
+		"auth_key": []string{"key,secret"},
+	})
+	require.NoError(t, f.Mkdir(ctx, "bucket"))
+	client, err := minio.New(addr, &minio.Options{
+		Creds: credentials.NewStaticV4("key", "secret", ""),
+	})
+	require.NoError(t, err)
+
+	objects := map[string][]byte{
+		"a.txt":       []byte("hello"),
+		"dir/b.bin":   make([]byte, 64*1024),
+		"dir/big.bin": make([]byte, 11*1024*1024),
+	}
+	for key, data := range objects {
+		_, err = io.ReadFull(readers.NewPatternReader(int64(len(data))), data)
+		require.NoError(t, err)
+		// big.bin is sent in 5 MiB parts
+		_, err = client.PutObject(ctx, "bucket", key, bytes.NewReader(data), int64(len(data)), minio.PutObjectOptions{PartSize: 5 * 1024 * 1024})
+		require.NoError(t, err, key)
+	}
+
+	buckets, err := client.ListBuckets(ctx)
+	require.NoError(t, err)
+	require.Len(t, buckets, 1)
+	assert.Equal(t, "bucket", buckets[0].Name)
+	listed := map[string]int64{}
+	for info := range client.ListObjects(ctx, "bucket", minio.ListObjectsOptions{Recursive: true}) {
+		require.NoError(t, info.Err)
+		listed[info.Key] = info.Size
+	}
+	assert.Equal(t, map[string]int64{"a.txt": 5, "dir/b.bin": 64 * 1024, "dir/big.bin": 11 * 1024 * 1024}, listed)
+
+	for key, data := range objects {
+		info, err := client.StatObject(ctx, "bucket", key, minio.StatObjectOptions{})
+		require.NoError(t, err, key)
+		assert.Equal(t, int64(len(data)), info.Size, key)
+		assert.Equal(t, fmt.Sprintf("%x", md5.Sum(data)), info.ETag, key)
+		obj, err := client.GetObject(ctx, "bucket", key, minio.GetObjectOptions{})
+		require.NoError(t, err, key)
+		got, err := io.ReadAll(obj)
+		require.NoError(t, err, key)
+		require.NoError(t, obj.Close())
+		assert.True(t, bytes.Equal(data, got), key)
+	}
+
+	for key := range objects {
+		require.NoError(t, client.RemoveObject(ctx, "bucket", key, minio.RemoveObjectOptions{}))
+	}
+	for info := range client.ListObjects(ctx, "bucket", minio.ListObjectsOptions{Recursive: true}) {
+		assert.Fail(t, "object not removed", info.Key)
+	}
+	assert.Empty(t, m.manifestPaths())
+}
+
+// TestServeRestic checks restic can keep a repository in the chat
+// through `rclone serve restic` with the many small files it writes
+// saved to the manifest in batches
+func TestServeRestic(t *testing.T) {
+	ctx := context.Background()
+	m := newMockServer(t)
+	f, addr := serveRemote(ctx, t, m, configmap.Simple{"manifest_flush_interval": "1h"}, "restic", nil)
+	repoURL := "http://" + addr + "/repo/"
+
+	// do makes a request checking the status is want
+	do := func(method, path string, body []byte, want int) *http.Response {
+		req, err := http.NewRequestWithContext(ctx, method, repoURL+path, bytes.NewReader(body))
+		require.NoError(t, err)
+		req.Header.Set("Accept", "application/vnd.x.restic.rest.v2")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		require.Equal(t, want, resp.StatusCode, "%s %s", method, path)
+		return resp
+	}
+	require.NoError(t, do("POST", "?create=true", nil, http.StatusOK).Body.Close())
+	require.NoError(t, do("POST", "config", []byte("config"), http.StatusOK).Body.Close())
+
+	// Save blobs as a backup does
+	const blobs = 200
+	ids := make([]string, blobs)
+	data := map[string][]byte{}
+	for i := range ids {
+		blob := []byte(fmt.Sprintf("blob %d", i))
+		ids[i] = fmt.Sprintf("%x", sha256.Sum256(blob))
+		data[ids[i]] = blob
+	}
+	var g errgroup.Group
+	g.SetLimit(8)
+	for _, id := range ids {
+		g.Go(func() error {
+			req, err := http.NewRequestWithContext(ctx, "POST", repoURL+"data/"+id, bytes.NewReader(data[id]))
+			if err != nil {
+				return err
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				return err
+			}
+			_ = resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				return fmt.Errorf("POST data/%s: status %s", id, resp.Status)
+			}
+			return nil
+		})
+	}
+	require.NoError(t, g.Wait())
+	lock := fmt.Sprintf("%x", sha256.Sum256([]byte("lock")))
+	require.NoError(t, do("POST", "locks/"+lock, []byte("lock"), http.StatusOK).Body.Close())
+
+	// The blobs are kept in data/xx/ directories but listed together
+	resp := do("GET", "data/", nil, http.StatusOK)
+	var listing []struct {
+		Name string `json:"name"`
+		Size int64  `json:"size"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&listing))
+	require.NoError(t, resp.Body.Close())
+	listed := map[string]int64{}
+	for _, item := range listing {
+		listed[item.Name] = item.Size
+	}
+	require.Len(t, listed, blobs)
+	for _, id := range ids {
+		assert.Equal(t, int64(len(data[id])), listed[id], id)
+	}
+	for _, id := range ids[:10] {
+		resp := do("HEAD", "data/"+id, nil, http.StatusOK)
+		require.NoError(t, resp.Body.Close())
+		assert.Equal(t, int64(len(data[id])), resp.ContentLength)
+		resp = do("GET", "data/"+id, nil, http.StatusOK)
+		got, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		assert.Equal(t, data[id], got)
+	}
+	require.NoError(t, do("HEAD", "data/"+lock, nil, http.StatusNotFound).Body.Close())
+	require.NoError(t, do("DELETE", "locks/"+lock, nil, http.StatusOK).Body.Close())
+	require.NoError(t, do("GET", "locks/"+lock, nil, http.StatusNotFound).Body.Close())
+
+	// Nothing was saved to the manifest until the flush
+	assert.Nil(t, m.manifest())
+	require.NoError(t, f.Shutdown(ctx))
+	assert.Len(t, m.manifestPaths(), blobs+1)
+	assert.Equal(t, blobs+3, m.callCount("sendDocument"), "blobs, config, lock and manifest")
+	assert.Equal(t, 0, m.callCount("editMessageMedia"))
+}
+
+// TestBisync syncs a local directory both ways with a directory in the
+// chat, including an empty file and the RCLONE_TEST file --check-access
+// looks for
+func TestBisync(t *testing.T) {
+	// Bisync stops if the stats hold errors from other tests
+	ctx := accounting.WithStatsGroup(context.Background(), "TestBisync")
+	m := newMockServer(t)
+	fsys, err := NewFs(ctx, "TestTelegram", "notes", m.config())
+	require.NoError(t, err)
+	f := fsys.(*Fs)
+	dir := t.TempDir()
+	writeLocal := func(name, content string) {
+		require.NoError(t, os.MkdirAll(path.Dir(path.Join(dir, name)), 0777))
+		require.NoError(t, os.WriteFile(path.Join(dir, name), []byte(content), 0666))
+	}
+	writeLocal(bisync.DefaultCheckFilename, "")
+	writeLocal("a.txt", "a")
+	writeLocal("empty.txt", "")
+	writeLocal("sub/b.txt", "b")
+	localFs, err := local.NewFs(ctx, "local", dir, configmap.Simple{})
+	require.NoError(t, err)
+	// --check-access needs the check file at both ends to start with,
+	// with the same time as a resync doesn't fix times which differ
+	// even between local disks
+	info, err := os.Stat(path.Join(dir, bisync.DefaultCheckFilename))
+	require.NoError(t, err)
+	src := object.NewStaticObjectInfo(bisync.DefaultCheckFilename, info.ModTime(), 0, true, nil, nil)
+	_, err = f.Put(ctx, strings.NewReader(""), src)
+	require.NoError(t, err)
+
+	workdir := t.TempDir()
+	run := func(resync bool) {
+		require.NoError(t, bisync.Bisync(ctx, localFs, f, &bisync.Options{
+			Resync:      resync,
+			CheckAccess: true,
+			CheckSync:   bisync.CheckSyncTrue,
+			MaxDelete:   bisync.DefaultMaxDelete,
+			Workdir:     workdir,
+		}))
+		require.NoError(t, operations.Check(ctx, &operations.CheckOpt{Fdst: f, Fsrc: localFs}))
+	}
+	run(true)
+	assert.ElementsMatch(t, []string{"notes/" + bisync.DefaultCheckFilename, "notes/a.txt", "notes/empty.txt", "notes/sub/b.txt"}, m.manifestPaths())
+
+	// Changes on both sides are copied the other way
+	time.Sleep(10 * time.Millisecond)
+	writeLocal("a.txt", "changed")
+	writeLocal("c.txt", "")
+	require.NoError(t, os.Remove(path.Join(dir, "sub/b.txt")))
+	putFile(ctx, t, f, "remote.txt", "remote")
+	run(false)
+	data, err := os.ReadFile(path.Join(dir, "remote.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "remote", string(data))
+	assert.ElementsMatch(t, []string{"notes/" + bisync.DefaultCheckFilename, "notes/a.txt", "notes/c.txt", "notes/empty.txt", "notes/remote.txt"}, m.manifestPaths())
+
+	// The listings are the same next time so nothing is copied
+	sent := m.callCount("sendDocument")
+	run(false)
+	assert.Equal(t, sent, m.callCount("sendDocument"))
+}
+
+// listSizes returns the size of every object in f by path
+func listSizes(ctx context.Context, t *testing.T, f fs.Fs) map[string]int64 {
+	sizes := map[string]int64{}
+	require.NoError(t, walk.ListR(ctx, f, "", true, -1, walk.ListObjects, func(entries fs.DirEntries) error {
+		for _, entry := range entries {
+			sizes[entry.Remote()] = entry.Size()
+		}
+		return nil
+	}))
+	return sizes
+}
+
+// TestCrypt checks a crypt remote wrapping the chat, whose encrypted
+// names are longer than Telegram allows for documents
+func TestCrypt(t *testing.T) {
+	ctx := context.Background()
+	m := newMockServer(t)
+	name := m.setenvRemote(t, configmap.Simple{"chunk_size": "4Ki"})
+	setenvConfig(t, name+"crypt", configmap.Simple{
+		"type":     "crypt",
+		"remote":   name + ":secret",
+		"password": obscure.MustObscure("potato"),
+	})
+	cf, err := fs.NewFs(ctx, name+"crypt:")
+	require.NoError(t, err)
+
+	big := make([]byte, 10*1024)
+	_, err = io.ReadFull(readers.NewPatternReader(int64(len(big))), big)
+	require.NoError(t, err)
+	files := map[string]string{
+		"a.txt":     "hello",
+		"empty.txt": "",
+		"dir/" + strings.Repeat("long name ", 20) + ".txt": "long",
+		"dir/sub/big.bin": string(big),
+	}
+	for remote, content := range files {
+		src := object.NewStaticObjectInfo(remote, time.Now(), int64(len(content)), true, nil, nil)
+		o, err := cf.Put(ctx, strings.NewReader(content), src)
+		require.NoError(t, err, remote)
+		assert.Equal(t, int64(len(content)), o.Size(), remote)
+	}
+	for _, entry := range m.manifest().Entries {
+		assert.True(t, strings.HasPrefix(entry.Path, "secret/"), entry.Path)
+		assert.NotContains(t, entry.Path, "long name")
+	}
+
+	sizes := listSizes(ctx, t, cf)
+	for remote, content := range files {
+		assert.Equal(t, int64(len(content)), sizes[remote], remote)
+		o, err := cf.NewObject(ctx, remote)
+		require.NoError(t, err, remote)
+		assert.Equal(t, content, readObject(ctx, t, o), remote)
+
+		// The MD5 of the encrypted document lets cryptcheck
+		// check the file without downloading it
+		cryptObj := o.(*crypt.Object)
+		want, err := cryptObj.UnWrap().Hash(ctx, hash.MD5)
+		require.NoError(t, err)
+		require.NotEmpty(t, want, remote)
+		got, err := cf.(*crypt.Fs).ComputeHash(ctx, cryptObj, cryptObj, hash.MD5)
+		require.NoError(t, err)
+		assert.Equal(t, want, got, remote)
+	}
+
+	o, err := cf.NewObject(ctx, "a.txt")
+	require.NoError(t, err)
+	moved, err := cf.Features().Move(ctx, o, "dir/moved.txt")
+	require.NoError(t, err)
+	assert.Equal(t, "hello", readObject(ctx, t, moved))
+	require.NoError(t, operations.Purge(ctx, cf, "dir"))
+	assert.Equal(t, map[string]int64{"empty.txt": 0}, listSizes(ctx, t, cf))
+	assert.Len(t, m.manifestPaths(), 1)
+}
+
+// TestChunker checks a chunker remote wrapping the chat splits files
+// into parts of its own which are joined back and cleaned up
+func TestChunker(t *testing.T) {
+	ctx := context.Background()
+	m := newMockServer(t)
+	name := m.setenvRemote(t, nil)
+	setenvConfig(t, name+"chunker", configmap.Simple{
+		"type":       "chunker",
+		"remote":     name + ":chunks",
+		"chunk_size": "4Ki",
+	})
+	cf, err := fs.NewFs(ctx, name+"chunker:")
+	require.NoError(t, err)
+	data := make([]byte, 5*4*1024+100)
+	_, err = io.ReadFull(readers.NewPatternReader(int64(len(data))), data)
+	require.NoError(t, err)
+	src := putFile(ctx, t, m.newFs(), "src/big.bin", string(data))
+	for i := range 3 {
+		// Copying again replaces the parts
+		dst, err := operations.Copy(ctx, cf, nil, "dir/big.bin", src)
+		require.NoError(t, err, i)
+		assert.Equal(t, int64(len(data)), dst.Size())
+		sum, err := dst.Hash(ctx, hash.MD5)
+		require.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf("%x", md5.Sum(data)), sum)
+	}
+
+	// The parts are listed as one file
+	assert.Equal(t, map[string]int64{"dir/big.bin": int64(len(data))}, listSizes(ctx, t, cf))
+	var parts []string
+	for _, p := range m.manifestPaths() {
+		if strings.HasPrefix(p, "chunks/") {
+			parts = append(parts, p)
+		}
+	}
+	// with a small file holding chunker's metadata
+	assert.ElementsMatch(t, []string{
+		"chunks/dir/big.bin",
+		"chunks/dir/big.bin.rclone_chunk.001",
+		"chunks/dir/big.bin.rclone_chunk.002",
+		"chunks/dir/big.bin.rclone_chunk.003",
+		"chunks/dir/big.bin.rclone_chunk.004",
+		"chunks/dir/big.bin.rclone_chunk.005",
+		"chunks/dir/big.bin.rclone_chunk.006",
+	}, parts)
+	o, err := cf.NewObject(ctx, "dir/big.bin")
+	require.NoError(t, err)
+	assert.Equal(t, string(data), readObject(ctx, t, o))
+
+	require.NoError(t, o.Remove(ctx))
+	assert.Equal(t, []string{"src/big.bin"}, m.manifestPaths())
+}
+
+// TestUnion checks the chat as an upstream of a union with a local
+// directory, where it counts as having unlimited free space
+func TestUnion(t *testing.T) {
+	ctx := accounting.WithStatsGroup(context.Background(), "TestUnion")
+	m := newMockServer(t)
+	name := m.setenvRemote(t, nil)
+	localDir := t.TempDir()
+	srcDir := t.TempDir()
+	files := map[string]string{
+		"a.txt":         "aaa",
+		"dir/b.txt":     "bbbbb",
+		"dir/sub/c.txt": "c",
+	}
+	for remote, content := range files {
+		require.NoError(t, os.MkdirAll(path.Join(srcDir, path.Dir(remote)), 0o777))
+		require.NoError(t, os.WriteFile(path.Join(srcDir, remote), []byte(content), 0o666))
+	}
+	src, err := fs.NewFs(ctx, srcDir)
+	require.NoError(t, err)
+	newUnion := func(policy string) fs.Fs {
+		setenvConfig(t, name+policy, configmap.Simple{
+			"type":          "union",
+			"upstreams":     localDir + " " + name + ":overflow",
+			"create_policy": policy,
+		})
+		uf, err := fs.NewFs(ctx, name+policy+":")
+		require.NoError(t, err)
+		return uf
+	}
+
+	// Most free space picks the chat
+	uf := newUnion("mfs")
+	features := uf.Features()
+	assert.True(t, features.CanHaveEmptyDirectories)
+	assert.NotNil(t, features.Move)
+	assert.NotNil(t, features.About)
+	require.NoError(t, fssync.Sync(ctx, uf, src, false))
+	assert.ElementsMatch(t, []string{"overflow/a.txt", "overflow/dir/b.txt", "overflow/dir/sub/c.txt"}, m.manifestPaths())
+	local, err := fs.NewFs(ctx, localDir)
+	require.NoError(t, err)
+	assert.Empty(t, listSizes(ctx, t, local))
+	assert.Equal(t, map[string]int64{"a.txt": 3, "dir/b.txt": 5, "dir/sub/c.txt": 1}, listSizes(ctx, t, uf))
+	_, err = uf.NewObject(ctx, "missing.txt")
+	assert.ErrorIs(t, err, fs.ErrorObjectNotFound)
+	usage, err := features.About(ctx)
+	require.NoError(t, err)
+	assert.Nil(t, usage.Free, "telegram has no free space to add")
+	assert.NotNil(t, usage.Used)
+
+	// Least free space picks the local directory for new files while
+	// changes to those in the chat stay there
+	uf = newUnion("lfs")
+	require.NoError(t, os.WriteFile(path.Join(srcDir, "new.txt"), []byte("new"), 0o666))
+	require.NoError(t, os.WriteFile(path.Join(srcDir, "dir/b.txt"), []byte("bbbbbb"), 0o666))
+	require.NoError(t, os.Remove(path.Join(srcDir, "a.txt")))
+	require.NoError(t, fssync.Sync(ctx, uf, src, false))
+	assert.Equal(t, map[string]int64{"new.txt": 3}, listSizes(ctx, t, local))
+	assert.ElementsMatch(t, []string{"overflow/dir/b.txt", "overflow/dir/sub/c.txt"}, m.manifestPaths())
+	require.NoError(t, operations.Check(ctx, &operations.CheckOpt{Fdst: uf, Fsrc: src}))
+
+	o, err := uf.NewObject(ctx, "dir/b.txt")
+	require.NoError(t, err)
+	_, err = operations.Move(ctx, uf, nil, "dir/moved.txt", o)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"overflow/dir/moved.txt", "overflow/dir/sub/c.txt"}, m.manifestPaths())
+	assert.ErrorIs(t, uf.Rmdir(ctx, "dir"), fs.ErrorDirectoryNotEmpty)
+}
+
+// TestTrackRenames checks sync --track-renames moves renamed files in
+// the manifest rather than uploading them again
+func TestTrackRenames(t *testing.T) {
+	for _, strategy := range []string{"hash", "modtime", "modtime,leaf"} {
+		t.Run(strategy, func(t *testing.T) {
+			ctx := accounting.WithStatsGroup(context.Background(), "TestTrackRenames"+strategy)
+			ctx, ci := fs.AddConfig(ctx)
+			ci.TrackRenames = true
+			ci.TrackRenamesStrategy = strategy
+			m := newMockServer(t)
+			f := m.newFs()
+			dir := t.TempDir()
+			require.NoError(t, os.Mkdir(path.Join(dir, "old"), 0777))
+			start := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+			const files = 100
+			for i := range files {
+				name := path.Join(dir, "old", fmt.Sprintf("file%03d.txt", i))
+				require.NoError(t, os.WriteFile(name, []byte(fmt.Sprintf("content of %d", i)), 0666))
+				modTime := start.Add(time.Duration(i) * time.Minute)
+				require.NoError(t, os.Chtimes(name, modTime, modTime))
+			}
+			localFs, err := local.NewFs(ctx, "local", dir, configmap.Simple{})
+			require.NoError(t, err)
+			require.NoError(t, fssync.Sync(ctx, f, localFs, false))
+			sends := m.callCount("sendDocument")
+			assert.Equal(t, files+1, sends)
+
+			// Renaming the directory keeps the leaf names, which the
+			// modtime,leaf strategy needs
+			require.NoError(t, os.Rename(path.Join(dir, "old"), path.Join(dir, "new")))
+			require.NoError(t, fssync.Sync(ctx, f, localFs, false))
+			assert.Equal(t, sends, m.callCount("sendDocument"), "files uploaded again")
+			assert.Equal(t, int64(files), accounting.Stats(ctx).Renames(0))
+			for _, p := range m.manifestPaths() {
+				assert.True(t, strings.HasPrefix(p, "new/"), p)
+			}
+			assert.Len(t, m.manifestPaths(), files)
+			require.NoError(t, operations.Check(ctx, &operations.CheckOpt{Fdst: f, Fsrc: localFs}))
+		})
+	}
+}
+
+// TestBackupDir checks sync --backup-dir moves the files it replaces
+// or deletes into a backup directory in the chat which doesn't exist
+// yet, without uploading them again
+func TestBackupDir(t *testing.T) {
+	ctx := accounting.WithStatsGroup(context.Background(), "TestBackupDir")
+	ctx, ci := fs.AddConfig(ctx)
+	m := newMockServer(t)
+	name := m.setenvRemote(t, nil)
+	ci.BackupDir = name + ":archive/2024-05-01"
+	f, err := fs.NewFs(ctx, name+":current")
+	require.NoError(t, err)
+	dir := t.TempDir()
+	writeLocal := func(name, content string) {
+		require.NoError(t, os.MkdirAll(path.Dir(path.Join(dir, name)), 0777))
+		require.NoError(t, os.WriteFile(path.Join(dir, name), []byte(content), 0666))
+	}
+	writeLocal("a.txt", "old a")
+	writeLocal("b.txt", "b")
+	writeLocal("dir/c.txt", "c")
+	writeLocal("dir/d.txt", "d")
+	localFs, err := local.NewFs(ctx, "local", dir, configmap.Simple{})
+	require.NoError(t, err)
+	require.NoError(t, fssync.Sync(ctx, f, localFs, false))
+	assert.ElementsMatch(t, []string{"current/a.txt", "current/b.txt", "current/dir/c.txt", "current/dir/d.txt"}, m.manifestPaths())
+
+	writeLocal("a.txt", "new a")
+	require.NoError(t, os.RemoveAll(path.Join(dir, "dir")))
+	sends := m.callCount("sendDocument")
+	require.NoError(t, fssync.Sync(ctx, f, localFs, false))
+	assert.Equal(t, sends+1, m.callCount("sendDocument"), "only the new a.txt should be uploaded")
+	assert.ElementsMatch(t, []string{
+		"current/a.txt",
+		"current/b.txt",
+		"archive/2024-05-01/a.txt",
+		"archive/2024-05-01/dir/c.txt",
+		"archive/2024-05-01/dir/d.txt",
+	}, m.manifestPaths())
+	require.NoError(t, operations.Check(ctx, &operations.CheckOpt{Fdst: f, Fsrc: localFs}))
+
+	backup, err := fs.NewFs(ctx, ci.BackupDir)
+	require.NoError(t, err)
+	for remote, content := range map[string]string{
+		"a.txt":     "old a",
+		"dir/c.txt": "c",
+		"dir/d.txt": "d",
+	} {
+		o, err := backup.NewObject(ctx, remote)
+		require.NoError(t, err)
+		assert.Equal(t, content, readObject(ctx, t, o), remote)
+	}
+}
+
+// TestCompareDest checks copies with --compare-dest skip the files
+// already in the comparison directory and those with --copy-dest copy
+// them from it without uploading them
+func TestCompareDest(t *testing.T) {
+	m := newMockServer(t)
+	name := m.setenvRemote(t, nil)
+	dir := t.TempDir()
+	writeLocal := func(name, content string) {
+		require.NoError(t, os.MkdirAll(path.Dir(path.Join(dir, name)), 0777))
+		require.NoError(t, os.WriteFile(path.Join(dir, name), []byte(content), 0666))
+	}
+	writeLocal("a.txt", "a")
+	writeLocal("b.txt", "old b")
+	writeLocal("dir/c.txt", "c")
+	ctx := accounting.WithStatsGroup(context.Background(), "TestCompareDest")
+	localFs, err := local.NewFs(ctx, "local", dir, configmap.Simple{})
+	require.NoError(t, err)
+	full, err := fs.NewFs(ctx, name+":full")
+	require.NoError(t, err)
+	require.NoError(t, fssync.CopyDir(ctx, full, localFs, false))
+
+	writeLocal("b.txt", "new b")
+	writeLocal("new.txt", "new")
+	for _, test := range []struct {
+		name      string
+		setDest   func(ci *fs.ConfigInfo, dest string)
+		wantFiles []string
+	}{{
+		name:      "CompareDest",
+		setDest:   func(ci *fs.ConfigInfo, dest string) { ci.CompareDest = []string{dest} },
+		wantFiles: []string{"b.txt", "new.txt"},
+	}, {
+		name:      "CopyDest",
+		setDest:   func(ci *fs.ConfigInfo, dest string) { ci.CopyDest = []string{dest} },
+		wantFiles: []string{"a.txt", "b.txt", "dir/c.txt", "new.txt"},
+	}} {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := accounting.WithStatsGroup(context.Background(), "TestCompareDest"+test.name)
+			ctx, ci := fs.AddConfig(ctx)
+			test.setDest(ci, name+":full")
+			incr, err := fs.NewFs(ctx, name+":incr-"+test.name)
+			require.NoError(t, err)
+			// uploads counts the documents sent which weren't
+			// sent again by file_id
+			uploads := func() int {
+				return m.callCount("sendDocument") - m.resends
+			}
+			sent, resends := uploads(), m.resends
+			require.NoError(t, fssync.CopyDir(ctx, incr, localFs, false))
+
+			// Only the changed and new files are uploaded
+			assert.Equal(t, sent+2, uploads())
+			var files []string
+			require.NoError(t, walk.ListR(ctx, incr, "", true, -1, walk.ListObjects, func(entries fs.DirEntries) error {
+				for _, entry := range entries {
+					files = append(files, entry.Remote())
+				}
+				return nil
+			}))
+			assert.ElementsMatch(t, test.wantFiles, files)
+			if test.name == "CopyDest" {
+				// The unchanged files were copied by file_id
+				assert.Equal(t, resends+2, m.resends)
+				for remote, content := range map[string]string{"a.txt": "a", "dir/c.txt": "c", "b.txt": "new b"} {
+					o, err := incr.NewObject(ctx, remote)
+					require.NoError(t, err)
+					assert.Equal(t, content, readObject(ctx, t, o), remote)
+				}
+			}
+			// The comparison directory is left alone
+			o, err := full.NewObject(ctx, "b.txt")
+			require.NoError(t, err)
+			assert.Equal(t, "old b", readObject(ctx, t, o))
+		})
+	}
+}
+
+// TestInterruptedSync cancels syncs part way through and checks the
+// manifest refers to every file which was uploaded completely and
+// nothing else, and that syncing again finishes the job
+func TestInterruptedSync(t *testing.T) {
+	dir := t.TempDir()
+	for i := range 12 {
+		require.NoError(t, os.WriteFile(path.Join(dir, fmt.Sprintf("file%02d.txt", i)), []byte(fmt.Sprintf("content of %d", i)), 0666))
+	}
+	big := make([]byte, 5*4*1024+100)
+	_, err := io.ReadFull(readers.NewPatternReader(int64(len(big))), big)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path.Join(dir, "big.bin"), big, 0666))
+
+	// The sync is cancelled during the nth upload, of a document or
+	// the manifest, or the nth read of the manifest before saving it
+	type cancelPoint struct {
+		upload bool
+		n      int
+	}
+	uploads := []cancelPoint{{true, 1}, {true, 2}, {true, 5}, {true, 8}, {true, 14}, {true, 17}}
+	for _, mode := range []struct {
+		name          string
+		flushInterval fs.Duration
+		finish        func(f *Fs) // what rclone does after the sync stops
+		points        []cancelPoint
+	}{
+		{"Unbatched", 0, func(f *Fs) {}, append(uploads, cancelPoint{false, 2}, cancelPoint{false, 4}, cancelPoint{false, 6}, cancelPoint{false, 8}, cancelPoint{false, 10}, cancelPoint{false, 11})},
+		{"Interrupted", fs.Duration(time.Hour), func(f *Fs) { f.exitFlush() }, uploads},
+		{"MaxDuration", fs.Duration(time.Hour), func(f *Fs) { require.NoError(t, f.Shutdown(context.Background())) }, uploads},
+	} {
+		for _, point := range mode.points {
+			name := fmt.Sprintf("%s/Upload%d", mode.name, point.n)
+			if !point.upload {
+				name = fmt.Sprintf("%s/Read%d", mode.name, point.n)
+			}
+			t.Run(name, func(t *testing.T) {
+				ctx := accounting.WithStatsGroup(context.Background(), t.Name())
+				// Only one document is sent at a time
+				ctx, ci := fs.AddConfig(ctx)
+				ci.Transfers = 1
+				m := newMockServer(t)
+				f := m.newFs()
+				f.opt.ChunkSize = 4 * fs.Kibi
+				f.opt.UploadConcurrency = 1
+				f.opt.ManifestFlushInterval = mode.flushInterval
+				localFs, err := local.NewFs(ctx, "local", dir, configmap.Simple{})
+				require.NoError(t, err)
+
+				// Telegram goes on to carry out the call which is
+				// cancelled
+				syncCtx, cancel := context.WithCancel(ctx)
+				defer cancel()
+				var calls atomic.Int64
+				var cancelledDocument atomic.Bool
+				if point.upload {
+					m.uploadDelay = func(fileName string) time.Duration {
+						if calls.Add(1) == int64(point.n) {
+							cancelledDocument.Store(fileName != fileListName)
+							cancel()
+						}
+						return 0
+					}
+				} else {
+					m.onCall = func(method string) {
+						if method == "getChat" && calls.Add(1) == int64(point.n) {
+							cancel()
+						}
+					}
+				}
+				require.Error(t, fssync.Sync(syncCtx, f, localFs, false))
+				require.Equal(t, context.Canceled, syncCtx.Err(), "sync wasn't cancelled")
+				m.uploadDelay, m.onCall = nil, nil
+				mode.finish(f)
+
+				// Everything in the manifest was uploaded completely
+				out, err := f.Command(ctx, "check-index", nil, nil)
+				require.NoError(t, err)
+				assert.Empty(t, out.(*checkResult).Broken)
+				// and the only document it doesn't refer to is the one
+				// which rclone gave up sending
+				if cancelledDocument.Load() {
+					assert.LessOrEqual(t, len(m.strandedDocuments()), 1)
+				} else {
+					assert.Empty(t, m.strandedDocuments())
+				}
+				require.NoError(t, operations.Check(ctx, &operations.CheckOpt{Fdst: localFs, Fsrc: f, OneWay: true}))
+
+				// and syncing again, without the errors from the first
+				// sync in its stats, uploads the rest
+				ctx = accounting.WithStatsGroup(ctx, t.Name()+"/again")
+				f.DirCacheFlush()
+				require.NoError(t, fssync.Sync(ctx, f, localFs, false))
+				require.NoError(t, f.Shutdown(ctx))
+				require.NoError(t, operations.Check(ctx, &operations.CheckOpt{Fdst: f, Fsrc: localFs}))
+				out, err = f.Command(ctx, "check-index", nil, nil)
+				require.NoError(t, err)
+				assert.Empty(t, out.(*checkResult).Broken)
+				assert.Empty(t, m.manifest().Pending)
+				assert.Len(t, m.manifestPaths(), 13)
+			})
+		}
+	}
+}
+
+func BenchmarkChunkedUpload(b *testing.B) {
+	ctx := context.Background()
+	for _, concurrency := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("Concurrency%d", concurrency), func(b *testing.B) {
+			f, m := newTestFs(b)
+			f.opt.ChunkSize = 64 * fs.Kibi
+			f.opt.UploadConcurrency = concurrency
+			m.discard = true
+			m.uploadDelay = func(fileName string) time.Duration {
+				return 10 * time.Millisecond
+			}
+			const size = 16 * 64 * 1024
+			b.SetBytes(size)
+			for range b.N {
+				src := object.NewStaticObjectInfo("bench.bin", time.Now(), size, true, nil, nil)
+				_, err := f.upload(ctx, readers.NewPatternReader(size), src, nil)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// SetUploadChunkSize sets the chunk_size for the chunked upload tests
+// in fstests
+func (f *Fs) SetUploadChunkSize(cs fs.SizeSuffix) (fs.SizeSuffix, error) {
+	return f.setUploadChunkSize(cs)
+}
+
+var _ fstests.SetUploadChunkSizer = (*Fs)(nil)
+
+// TestIntegrationMock runs the integration tests against the mock Bot
+// API so they run without a bot and a chat to test with
+//
+// Changes are saved straight away as the tests make separate Fs for
+// the same chat which have to see each other's changes.
+func TestIntegrationMock(t *testing.T) {
+	if *fstest.RemoteName != "" {
+		t.Skip("Skipping as -remote set")
+	}
+	m := newMockServer(t)
+	t.Setenv("RCLONE_CONFIG_TESTTELEGRAMMOCK_TYPE", "telegram")
+	t.Setenv("RCLONE_CONFIG_TESTTELEGRAMMOCK_BOT_TOKEN", obscure.MustObscure(testToken))
+	t.Setenv("RCLONE_CONFIG_TESTTELEGRAMMOCK_CHAT_ID", strconv.Itoa(testChatID))
+	t.Setenv("RCLONE_CONFIG_TESTTELEGRAMMOCK_BASE_URL", m.srv.URL)
+	t.Setenv("RCLONE_CONFIG_TESTTELEGRAMMOCK_MANIFEST_FLUSH_INTERVAL", "0")
+	t.Setenv("RCLONE_CONFIG_TESTTELEGRAMMOCK_PACER_MIN_SLEEP", "0")
+	fstests.Run(t, &fstests.Opt{
+		RemoteName: "TestTelegramMock:",
+		NilObject:  (*Object)(nil),
+	})
+}
+
+// TestIntegrationMockDeepRoot runs the integration tests again with a
+// root a few directories down which doesn't exist until the tests
+// make it
+func TestIntegrationMockDeepRoot(t *testing.T) {
+	if *fstest.RemoteName != "" {
+		t.Skip("Skipping as -remote set")
+	}
+	m := newMockServer(t)
+	name := m.setenvRemote(t, nil)
+	fstests.Run(t, &fstests.Opt{
+		RemoteName: name + ":clients/acme/reports/2024",
+		NilObject:  (*Object)(nil),
+	})
+}
@@ -0,0 +1,141 @@
+// Test Telegram filesystem interface
+package telegram_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/rclone/rclone/backend/telegram"
+	"github.com/rclone/rclone/backend/telegram/api"
+	"github.com/rclone/rclone/fs/config/obscure"
+	"github.com/rclone/rclone/fstest/fstests"
+	"github.com/stretchr/testify/require"
+)
+
+// testChatMarker must be in the description of the chat given by
+// TELEGRAM_TEST_CHAT_ID so the tests can't wipe a chat by mistake
+const testChatMarker = "rclone-integration-test"
+
+// TestIntegration runs integration tests against the remote
+//
+// Setting TELEGRAM_TEST_BOT_TOKEN and TELEGRAM_TEST_CHAT_ID runs them
+// against a chat kept for testing instead of a configured remote, and
+// deletes every message posted to it during the tests afterwards.
+func TestIntegration(t *testing.T) {
+	token, chatID := os.Getenv("TELEGRAM_TEST_BOT_TOKEN"), os.Getenv("TELEGRAM_TEST_CHAT_ID")
+	if token != "" && chatID != "" {
+		newTestChat(t, token, chatID)
+		t.Setenv("RCLONE_CONFIG_TESTTELEGRAM_TYPE", "telegram")
+		t.Setenv("RCLONE_CONFIG_TESTTELEGRAM_BOT_TOKEN", obscure.MustObscure(token))
+		t.Setenv("RCLONE_CONFIG_TESTTELEGRAM_CHAT_ID", chatID)
+	}
+	fstests.Run(t, &fstests.Opt{
+		RemoteName: "TestTelegram:",
+		NilObject:  (*telegram.Object)(nil),
+	})
+}
+
+// testChat is a chat kept for the integration tests
+type testChat struct {
+	t      *testing.T
+	token  string
+	chatID string
+	start  int64 // id of the message posted before the tests
+}
+
+// newTestChat checks the chat is kept for testing and arranges for
+// everything posted to it from now on to be deleted when the test ends
+//
+// The bot can't read the chat so the messages to delete are found from
+// the ids of messages it posts before and after the tests. The tests
+// each use a randomly named root so runs sharing the chat keep their
+// files apart, but a run deletes the documents of any run overlapping
+// it, so don't run them at the same time.
+func newTestChat(t *testing.T, token, chatID string) *testChat {
+	c := &testChat{t: t, token: token, chatID: chatID}
+	var chat api.ChatFullInfo
+	require.NoError(t, c.call("getChat", url.Values{"chat_id": {chatID}}, &chat))
+	if !strings.Contains(chat.Description, testChatMarker) {
+		t.Fatalf("Not testing in chat %q as its description doesn't contain %q - only test in a chat kept for it", chat.Title, testChatMarker)
+	}
+	c.start = c.post("rclone integration tests starting")
+	t.Cleanup(c.clean)
+	return c
+}
+
+// call calls the Bot API method with params, decoding the result into
+// result if not nil
+func (c *testChat) call(method string, params url.Values, result any) error {
+	resp, err := http.PostForm("https://api.telegram.org/bot"+c.token+"/"+method, params)
+	if err != nil {
+		// The error holds the URL with the token in
+		return fmt.Errorf("telegram %s failed", method)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	var response api.Response
+	err = json.NewDecoder(resp.Body).Decode(&response)
+	if err != nil {
+		return fmt.Errorf("telegram %s: failed to decode response: %w", method, err)
+	}
+	if !response.OK {
+		return fmt.Errorf("telegram %s failed: %d %s", method, response.ErrorCode, response.Description)
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(response.Result, result)
+}
+
+// post posts text to the chat returning the id of its message
+func (c *testChat) post(text string) int64 {
+	var message api.Message
+	require.NoError(c.t, c.call("sendMessage", url.Values{
+		"chat_id":              {c.chatID},
+		"text":                 {text},
+		"disable_notification": {"true"},
+	}, &message))
+	return message.MessageID
+}
+
+// clean deletes every message posted to the chat since the tests
+// started and the manifest, so the next run starts afresh
+func (c *testChat) clean() {
+	end := c.post("rclone integration tests finished")
+	// deleteMessages takes up to 100 ids and skips those not found
+	for from := c.start; from <= end; from += 100 {
+		var ids []string
+		for id := from; id <= min(from+99, end); id++ {
+			ids = append(ids, strconv.FormatInt(id, 10))
+		}
+		err := c.call("deleteMessages", url.Values{
+			"chat_id":     {c.chatID},
+			"message_ids": {"[" + strings.Join(ids, ",") + "]"},
+		}, nil)
+		if err != nil {
+			c.t.Logf("Failed to delete messages %d to %d: %v", from, from+int64(len(ids))-1, err)
+		}
+	}
+	var chat api.ChatFullInfo
+	err := c.call("getChat", url.Values{"chat_id": {c.chatID}}, &chat)
+	if err != nil {
+		c.t.Logf("Failed to read the chat: %v", err)
+		return
+	}
+	if pinned := chat.PinnedMessage; pinned != nil && pinned.Document != nil && pinned.Document.FileName == "filelist.json" {
+		err = c.call("deleteMessage", url.Values{
+			"chat_id":    {c.chatID},
+			"message_id": {strconv.FormatInt(pinned.MessageID, 10)},
+		}, nil)
+		if err != nil {
+			c.t.Logf("Failed to delete the manifest: %v", err)
+		}
+	}
+}
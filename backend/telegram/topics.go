@@ -0,0 +1,145 @@
+package telegram
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/rclone/rclone/backend/telegram/api"
+	"github.com/rclone/rclone/fs"
+)
+
+// maxTopicNameLength is the most characters Telegram allows in the
+// name of a forum topic
+const maxTopicNameLength = 128
+
+// checkForum checks the chat has topics enabled, as use_topics needs
+func (f *Fs) checkForum(ctx context.Context) error {
+	chat, err := f.getChat(ctx)
+	if err != nil {
+		return err
+	}
+	if !chat.IsForum {
+		return fmt.Errorf("use_topics is set but chat %s doesn't have topics enabled - enable them in the group settings or unset use_topics", f.opt.ChatID)
+	}
+	return nil
+}
+
+// topicDir returns the top level directory holding absPath, which
+// has a forum topic when use_topics is set, or "" if there isn't one
+func (f *Fs) topicDir(absPath string) string {
+	if !f.opt.UseTopics {
+		return ""
+	}
+	dir, _, found := strings.Cut(absPath, "/")
+	if !found {
+		return ""
+	}
+	return dir
+}
+
+// topicFor returns the message_thread_id of the forum topic the
+// documents for absPath are posted in, making the topic if needed
+//
+// It returns 0 for the General topic, which is used for files in the
+// root and when use_topics isn't set.
+func (f *Fs) topicFor(ctx context.Context, absPath string) (int64, error) {
+	dir := f.topicDir(absPath)
+	if dir == "" {
+		return 0, nil
+	}
+	t, err := f.ensureTopic(ctx, dir)
+	if err != nil {
+		return 0, err
+	}
+	return t.ThreadID, nil
+}
+
+// ensureTopic returns the forum topic for the top level directory
+// name, making it and the directory if they don't exist
+func (f *Fs) ensureTopic(ctx context.Context, name string) (topic *forumTopic, err error) {
+	err = f.readFileList(ctx, func(m *manifest) error {
+		topic = m.findTopic(name)
+		return nil
+	})
+	if err != nil || topic != nil {
+		return topic, err
+	}
+	var result api.ForumTopic
+	err = f.call(ctx, "createForumTopic", url.Values{
+		"chat_id": {f.opt.ChatID},
+		"name":    {topicName(name)},
+	}, &result)
+	if err != nil {
+		return nil, fmt.Errorf("failed to make topic for %q: %w", name, err)
+	}
+	fs.Debugf(f, "Made topic %d for %q", result.MessageThreadID, name)
+	made := &forumTopic{Name: name, ThreadID: result.MessageThreadID}
+	err = f.changeFileList(ctx, func(m *manifest) ([]*manifestEntry, error) {
+		// Someone else may have made one at the same time
+		if topic = m.findTopic(name); topic != nil {
+			return nil, nil
+		}
+		topic = made
+		m.addTopic(topic)
+		if !m.isDir(name) {
+			m.addDir(name)
+		}
+		return nil, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if topic != made {
+		f.deleteTopic(ctx, made)
+	}
+	return topic, nil
+}
+
+// deleteTopic deletes the forum topic t along with any messages in it
+//
+// Failures are logged and ignored as the topic is no longer used.
+func (f *Fs) deleteTopic(ctx context.Context, t *forumTopic) {
+	err := f.call(ctx, "deleteForumTopic", url.Values{
+		"chat_id":           {f.opt.ChatID},
+		"message_thread_id": {strconv.FormatInt(t.ThreadID, 10)},
+	}, nil)
+	if err != nil {
+		fs.Logf(f, "Failed to delete topic for %q, leaving it in the chat: %v", t.Name, err)
+	}
+}
+
+// renameTopic renames the forum topic t to name
+func (f *Fs) renameTopic(ctx context.Context, t *forumTopic, name string) error {
+	err := f.call(ctx, "editForumTopic", url.Values{
+		"chat_id":           {f.opt.ChatID},
+		"message_thread_id": {strconv.FormatInt(t.ThreadID, 10)},
+		"name":              {topicName(name)},
+	}, nil)
+	if err != nil {
+		return fmt.Errorf("failed to rename topic for %q: %w", t.Name, err)
+	}
+	return nil
+}
+
+// messageTopic returns the forum topic message is in if use_topics is
+// set, or 0
+func (f *Fs) messageTopic(message *api.Message) int64 {
+	if !f.opt.UseTopics {
+		return 0
+	}
+	return message.MessageThreadID
+}
+
+// topicName returns the name of the forum topic for the top level
+// directory name, shortened to fit if necessary
+func topicName(name string) string {
+	for utf8.RuneCountInString(name) > maxTopicNameLength {
+		_, size := utf8.DecodeLastRuneInString(name)
+		name = name[:len(name)-size]
+	}
+	return name
+}
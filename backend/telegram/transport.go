@@ -0,0 +1,149 @@
+package telegram
+
+import (
+	"context"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/fshttp"
+)
+
+// dumpFlags are the --dump flags which show HTTP traffic
+const dumpFlags = fs.DumpHeaders | fs.DumpBodies | fs.DumpAuth | fs.DumpRequests | fs.DumpResponses
+
+// redacted replaces the bot token wherever it would be shown
+const redacted = "<redacted>"
+
+// dumpMu stops the dumps of concurrent transactions interleaving
+var dumpMu sync.Mutex
+
+// dumpTransport dumps the HTTP traffic as asked for by --dump with the
+// bot token removed
+//
+// The Bot API takes the token as part of the URL so the dumps made by
+// fshttp, which only clean auth headers, would show it.
+type dumpTransport struct {
+	http.RoundTripper
+	dump  fs.DumpFlags
+	token string
+}
+
+// newClient returns an http.Client set up from the global config
+// which never shows token in dumps
+func newClient(ctx context.Context, token string) *http.Client {
+	ci := fs.GetConfig(ctx)
+	if ci.Dump&dumpFlags == 0 {
+		return fshttp.NewClient(ctx)
+	}
+	// Stop fshttp dumping and do it here instead
+	newCtx, newCi := fs.AddConfig(ctx)
+	newCi.Dump &^= dumpFlags
+	client := fshttp.NewClient(newCtx)
+	client.Transport = &dumpTransport{
+		RoundTripper: client.Transport,
+		dump:         ci.Dump,
+		token:        token,
+	}
+	return client
+}
+
+// redact removes the token from s
+func (t *dumpTransport) redact(s string) string {
+	return strings.ReplaceAll(s, t.token, redacted)
+}
+
+// RoundTrip dumps req and the response to it
+//
+// The dumps are made before fshttp adds the User-Agent and any
+// --header flags so these aren't shown.
+func (t *dumpTransport) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+	buf, _ := httputil.DumpRequestOut(req, t.dump&(fs.DumpBodies|fs.DumpRequests) != 0)
+	dumpMu.Lock()
+	fs.Debugf(nil, "%s", strings.Repeat(">", 60))
+	fs.Debugf(nil, "HTTP REQUEST (req %p)", req)
+	fs.Debugf(nil, "%s", t.redact(string(buf)))
+	fs.Debugf(nil, "%s", strings.Repeat(">", 60))
+	dumpMu.Unlock()
+	resp, err = t.RoundTripper.RoundTrip(req)
+	dumpMu.Lock()
+	defer dumpMu.Unlock()
+	fs.Debugf(nil, "%s", strings.Repeat("<", 60))
+	fs.Debugf(nil, "HTTP RESPONSE (req %p)", req)
+	if err != nil {
+		fs.Debugf(nil, "Error: %v", t.redact(err.Error()))
+	} else {
+		buf, _ := httputil.DumpResponse(resp, t.dump&(fs.DumpBodies|fs.DumpResponses) != 0)
+		fs.Debugf(nil, "%s", t.redact(string(buf)))
+	}
+	fs.Debugf(nil, "%s", strings.Repeat("<", 60))
+	return resp, err
+}
+
+// redactError removes the bot token from the URL quoted in err if it
+// is a *url.Error as returned by http.Client, or from the path quoted
+// in err if it is a *os.PathError from reading a file stored by a
+// self-hosted server, which keeps them in a directory named after it
+func (f *Fs) redactError(err error) error {
+	switch err := err.(type) {
+	case *url.Error:
+		redactedErr := *err
+		redactedErr.URL = strings.ReplaceAll(err.URL, f.opt.BotToken, redacted)
+		return &redactedErr
+	case *os.PathError:
+		redactedErr := *err
+		redactedErr.Path = strings.ReplaceAll(err.Path, f.opt.BotToken, redacted)
+		return &redactedErr
+	}
+	return err
+}
+
+// callStats counts the Bot API calls retried while transferring an
+// object
+type callStats struct {
+	retries atomic.Int64
+}
+
+// callStatsKey is the context key for the callStats
+type callStatsKey struct{}
+
+// withCallStats returns a context which counts the calls retried with
+// it in the callStats returned
+func withCallStats(ctx context.Context) (context.Context, *callStats) {
+	stats := &callStats{}
+	return context.WithValue(ctx, callStatsKey{}, stats), stats
+}
+
+// countTry counts the try of a call made with ctx, counting it as a
+// retry if it isn't the first
+func countTry(ctx context.Context, tries *int) {
+	*tries++
+	if stats, ok := ctx.Value(callStatsKey{}).(*callStats); ok && *tries > 1 {
+		stats.retries.Add(1)
+	}
+}
+
+// logCall logs a try of the Bot API call method to chat, which may be
+// empty, sending size bytes which took since start, at debug level
+//
+// err must already have the bot token removed.
+func (f *Fs) logCall(method, chat string, size int64, start time.Time, resp *http.Response, err error) {
+	status := "no response"
+	if resp != nil {
+		status = resp.Status
+	}
+	if chat == "" {
+		chat = "-"
+	}
+	if err != nil {
+		fs.Debugf(f, "API %s chat=%s size=%d status=%q took %v: %v", method, chat, size, status, time.Since(start).Round(time.Millisecond), err)
+		return
+	}
+	fs.Debugf(f, "API %s chat=%s size=%d status=%q took %v", method, chat, size, status, time.Since(start).Round(time.Millisecond))
+}
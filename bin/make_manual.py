@@ -84,6 +84,7 @@ docs = [
     "smb.md",
     "storj.md",
     "sugarsync.md",
+    "telegram.md",
     "ulozto.md",
     "uptobox.md",
     "union.md",
@@ -14,7 +14,9 @@ import (
 	"maps"
 	"mime/multipart"
 	"net/http"
+	"net/textproto"
 	"net/url"
+	"strings"
 	"sync"
 
 	"github.com/rclone/rclone/fs"
@@ -145,6 +147,7 @@ type Opts struct {
 	MultipartMetadataName string       // ..this is used for the name of the metadata form part if set
 	MultipartContentName  string       // ..name of the parameter which is the attached file
 	MultipartFileName     string       // ..name of the file for the attached file
+	MultipartContentType  string       // ..content type of the attached file, application/octet-stream if not set
 	Parameters            url.Values   // any parameters for the final URL
 	TransferEncoding      []string     // transfer encoding, set to "identity" to disable chunked encoding
 	Trailer               *http.Header // set the request trailer
@@ -381,8 +384,30 @@ func (api *Client) Call(ctx context.Context, opts *Opts) (resp *http.Response, e
 //
 // the int64 returned is the overhead in addition to the file contents, in case Content-Length is required
 //
-// NB This doesn't allow setting the content type of the attachment
+// NB This doesn't allow setting the content type of the attachment -
+// use Opts.MultipartContentType with CallJSON for that
 func MultipartUpload(ctx context.Context, in io.Reader, params url.Values, contentName, fileName string) (io.ReadCloser, string, int64, error) {
+	return multipartUpload(ctx, in, params, contentName, fileName, "")
+}
+
+// quoteEscaper escapes the names in the Content-Disposition header
+var quoteEscaper = strings.NewReplacer("\\", "\\\\", `"`, "\\\"")
+
+// createFormFile creates the part for the attached file, with the
+// content type given or application/octet-stream if it is empty
+func createFormFile(writer *multipart.Writer, contentName, fileName, fileContentType string) (io.Writer, error) {
+	if fileContentType == "" {
+		return writer.CreateFormFile(contentName, fileName)
+	}
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Disposition", fmt.Sprintf(`form-data; name="%s"; filename="%s"`, quoteEscaper.Replace(contentName), quoteEscaper.Replace(fileName)))
+	h.Set("Content-Type", fileContentType)
+	return writer.CreatePart(h)
+}
+
+// multipartUpload is MultipartUpload with the content type of the
+// attached file
+func multipartUpload(ctx context.Context, in io.Reader, params url.Values, contentName, fileName, fileContentType string) (io.ReadCloser, string, int64, error) {
 	bodyReader, bodyWriter := io.Pipe()
 	writer := multipart.NewWriter(bodyWriter)
 	contentType := writer.FormDataContentType()
@@ -404,7 +429,7 @@ func MultipartUpload(ctx context.Context, in io.Reader, params url.Values, conte
 		}
 	}
 	if in != nil {
-		_, err = dummyMultipartWriter.CreateFormFile(contentName, fileName)
+		_, err = createFormFile(dummyMultipartWriter, contentName, fileName, fileContentType)
 		if err != nil {
 			return nil, "", 0, err
 		}
@@ -445,7 +470,7 @@ func MultipartUpload(ctx context.Context, in io.Reader, params url.Values, conte
 		}
 
 		if in != nil {
-			part, err := writer.CreateFormFile(contentName, fileName)
+			part, err := createFormFile(writer, contentName, fileName, fileContentType)
 			if err != nil {
 				_ = bodyWriter.CloseWithError(fmt.Errorf("failed to create form file: %w", err))
 				return
@@ -539,7 +564,7 @@ func (api *Client) callCodec(ctx context.Context, opts *Opts, request any, respo
 		opts = opts.Copy()
 
 		var overhead int64
-		opts.Body, opts.ContentType, overhead, err = MultipartUpload(ctx, opts.Body, params, opts.MultipartContentName, opts.MultipartFileName)
+		opts.Body, opts.ContentType, overhead, err = multipartUpload(ctx, opts.Body, params, opts.MultipartContentName, opts.MultipartFileName, opts.MultipartContentType)
 		if err != nil {
 			return nil, err
 		}
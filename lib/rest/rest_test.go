@@ -0,0 +1,79 @@
+package rest
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCallJSONMultipartContentType(t *testing.T) {
+	for _, test := range []struct {
+		contentType string
+		want        string
+	}{
+		{"", "application/octet-stream"},
+		{"text/plain; charset=utf-8", "text/plain; charset=utf-8"},
+		{"image/jpeg", "image/jpeg"},
+	} {
+		t.Run(test.want, func(t *testing.T) {
+			var (
+				gotParam       string
+				gotFileName    string
+				gotContentType string
+				gotContents    string
+			)
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				reader, err := r.MultipartReader()
+				require.NoError(t, err)
+				for {
+					part, err := reader.NextPart()
+					if err == io.EOF {
+						break
+					}
+					require.NoError(t, err)
+					data, err := io.ReadAll(part)
+					require.NoError(t, err)
+					switch part.FormName() {
+					case "param":
+						gotParam = string(data)
+					case "file":
+						gotFileName = part.FileName()
+						gotContentType = part.Header.Get("Content-Type")
+						gotContents = string(data)
+					}
+				}
+				w.Header().Set("Content-Type", "application/json")
+				_, _ = w.Write([]byte(`{"ok":true}`))
+			}))
+			defer ts.Close()
+
+			api := NewClient(ts.Client()).SetRoot(ts.URL)
+			opts := Opts{
+				Method:               "POST",
+				Body:                 strings.NewReader("potato"),
+				MultipartParams:      url.Values{"param": {"value"}},
+				MultipartContentName: "file",
+				MultipartFileName:    `file "name".txt`,
+				MultipartContentType: test.contentType,
+			}
+			var result struct {
+				OK bool `json:"ok"`
+			}
+			_, err := api.CallJSON(context.Background(), &opts, nil, &result)
+			require.NoError(t, err)
+			assert.True(t, result.OK)
+
+			assert.Equal(t, "value", gotParam)
+			assert.Equal(t, `file "name".txt`, gotFileName)
+			assert.Equal(t, test.want, gotContentType)
+			assert.Equal(t, "potato", gotContents)
+		})
+	}
+}